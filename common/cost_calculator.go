@@ -243,13 +243,22 @@ func (c *CostCalculator) FormatCost(cost float64) string {
 }
 
 // CalculateCacheSavings 计算费用节省（使用缓存的节省）
+// 将缓存读取和缓存创建的tokens与按正常input价格计费进行对比，
+// 缓存频繁失效（大量cache_creation、少量cache_read）时节省可能为负数
 func (c *CostCalculator) CalculateCacheSavings(usage *TokenUsage) *SavingsResult {
 	pricing := c.GetModelPricing(usage.Model)
 	cacheReadTokens := usage.CacheReadInputTokens
+	cacheCreateTokens := usage.CacheCreationInputTokens
 
 	// 如果这些token不使用缓存，需要按正常input价格计费
-	normalCost := (float64(cacheReadTokens) / 1000000) * pricing.Input
-	cacheCost := (float64(cacheReadTokens) / 1000000) * pricing.CacheRead
+	normalCost := (float64(cacheReadTokens+cacheCreateTokens) / 1000000) * pricing.Input
+	cacheCost := (float64(cacheReadTokens)/1000000)*pricing.CacheRead + (float64(cacheCreateTokens)/1000000)*pricing.CacheWrite
+
+	return c.BuildSavingsResult(normalCost, cacheCost)
+}
+
+// BuildSavingsResult 根据正常费用和缓存费用构建节省信息（用于多模型汇总）
+func (c *CostCalculator) BuildSavingsResult(normalCost, cacheCost float64) *SavingsResult {
 	savings := normalCost - cacheCost
 	savingsPercentage := 0.0
 	if normalCost > 0 {
@@ -265,7 +274,11 @@ func (c *CostCalculator) CalculateCacheSavings(usage *TokenUsage) *SavingsResult
 
 	result.Formatted.NormalCost = c.FormatCost(normalCost)
 	result.Formatted.CacheCost = c.FormatCost(cacheCost)
-	result.Formatted.Savings = c.FormatCost(savings)
+	if savings < 0 {
+		result.Formatted.Savings = "-" + c.FormatCost(-savings)
+	} else {
+		result.Formatted.Savings = c.FormatCost(savings)
+	}
 	result.Formatted.SavingsPercentage = fmt.Sprintf("%.1f%%", savingsPercentage)
 
 	return result
@@ -302,3 +315,7 @@ func FormatCost(cost float64) string {
 func CalculateCacheSavings(usage *TokenUsage) *SavingsResult {
 	return GlobalCostCalculator.CalculateCacheSavings(usage)
 }
+
+func BuildSavingsResult(normalCost, cacheCost float64) *SavingsResult {
+	return GlobalCostCalculator.BuildSavingsResult(normalCost, cacheCost)
+}
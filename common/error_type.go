@@ -0,0 +1,152 @@
+package common
+
+import (
+	"bytes"
+	"net/http"
+	"unicode/utf8"
+
+	"github.com/tidwall/gjson"
+)
+
+// 日志中记录的错误消息最大字节数
+const maxErrorMessageLength = 2000
+
+// 归一化的错误类型，与Anthropic的错误类型保持一致，另外增加中转服务自身拒绝请求的原因
+const (
+	ErrorTypeInvalidRequest     = "invalid_request_error"
+	ErrorTypeAuthentication     = "authentication_error"
+	ErrorTypePermission         = "permission_error"
+	ErrorTypeNotFound           = "not_found_error"
+	ErrorTypeRequestTooLarge    = "request_too_large"
+	ErrorTypeRateLimit          = "rate_limit_error"
+	ErrorTypeAPI                = "api_error"
+	ErrorTypeOverloaded         = "overloaded_error"
+	ErrorTypeTimeout            = "timeout_error"
+	ErrorTypeQuotaExceeded      = "quota_exceeded"       // API Key达到使用限额
+	ErrorTypeNoAvailableAccount = "no_available_account" // 分组内没有可用账号
+	ErrorTypeModelNotAllowed    = "model_not_allowed"    // 没有权限访问请求的模型
+)
+
+// 上游错误类型到归一化错误类型的映射，包括Anthropic、OpenAI和Gemini的错误类型
+var errorTypeAliases = map[string]string{
+	ErrorTypeInvalidRequest:  ErrorTypeInvalidRequest,
+	ErrorTypeAuthentication:  ErrorTypeAuthentication,
+	ErrorTypePermission:      ErrorTypePermission,
+	ErrorTypeNotFound:        ErrorTypeNotFound,
+	ErrorTypeRequestTooLarge: ErrorTypeRequestTooLarge,
+	ErrorTypeRateLimit:       ErrorTypeRateLimit,
+	ErrorTypeAPI:             ErrorTypeAPI,
+	ErrorTypeOverloaded:      ErrorTypeOverloaded,
+	ErrorTypeTimeout:         ErrorTypeTimeout,
+
+	"invalid_api_key":     ErrorTypeAuthentication,
+	"insufficient_quota":  ErrorTypeRateLimit,
+	"rate_limit_exceeded": ErrorTypeRateLimit,
+	"server_error":        ErrorTypeAPI,
+	"INVALID_ARGUMENT":    ErrorTypeInvalidRequest,
+	"FAILED_PRECONDITION": ErrorTypeInvalidRequest,
+	"UNAUTHENTICATED":     ErrorTypeAuthentication,
+	"PERMISSION_DENIED":   ErrorTypePermission,
+	"NOT_FOUND":           ErrorTypeNotFound,
+	"RESOURCE_EXHAUSTED":  ErrorTypeRateLimit,
+	"INTERNAL":            ErrorTypeAPI,
+	"UNAVAILABLE":         ErrorTypeOverloaded,
+	"DEADLINE_EXCEEDED":   ErrorTypeTimeout,
+}
+
+// NormalizeErrorType 归一化错误类型，无法识别上游的错误类型时按状态码归类
+func NormalizeErrorType(statusCode int, errorType string) string {
+	if normalized, ok := errorTypeAliases[errorType]; ok {
+		return normalized
+	}
+
+	switch {
+	case statusCode == http.StatusUnauthorized:
+		return ErrorTypeAuthentication
+	case statusCode == http.StatusForbidden:
+		return ErrorTypePermission
+	case statusCode == http.StatusNotFound:
+		return ErrorTypeNotFound
+	case statusCode == http.StatusRequestEntityTooLarge:
+		return ErrorTypeRequestTooLarge
+	case statusCode == http.StatusTooManyRequests:
+		return ErrorTypeRateLimit
+	case statusCode == http.StatusRequestTimeout || statusCode == http.StatusGatewayTimeout:
+		return ErrorTypeTimeout
+	case statusCode == http.StatusServiceUnavailable || statusCode == 529:
+		return ErrorTypeOverloaded
+	case statusCode >= http.StatusInternalServerError:
+		return ErrorTypeAPI
+	default:
+		return ErrorTypeInvalidRequest
+	}
+}
+
+// ErrorTypeStatusCode 获取错误类型对应的HTTP状态码，用于没有状态码的流中错误事件
+func ErrorTypeStatusCode(errorType string) int {
+	switch NormalizeErrorType(http.StatusInternalServerError, errorType) {
+	case ErrorTypeInvalidRequest:
+		return http.StatusBadRequest
+	case ErrorTypeAuthentication:
+		return http.StatusUnauthorized
+	case ErrorTypePermission:
+		return http.StatusForbidden
+	case ErrorTypeNotFound:
+		return http.StatusNotFound
+	case ErrorTypeRequestTooLarge:
+		return http.StatusRequestEntityTooLarge
+	case ErrorTypeRateLimit:
+		return http.StatusTooManyRequests
+	case ErrorTypeOverloaded:
+		return 529
+	case ErrorTypeTimeout:
+		return http.StatusGatewayTimeout
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// ParseErrorResponse 从错误响应体中提取错误类型和错误消息
+// 兼容Anthropic、OpenAI、Gemini格式以及中转服务自身的错误响应，非JSON响应体整体作为错误消息
+func ParseErrorResponse(body []byte) (string, string) {
+	body = bytes.TrimSpace(body)
+	if len(body) == 0 {
+		return "", ""
+	}
+	if !gjson.ValidBytes(body) {
+		return "", truncateErrorMessage(string(body))
+	}
+
+	errorValue := gjson.GetBytes(body, "error")
+	var errorType, message string
+	switch {
+	case errorValue.IsObject():
+		errorType = errorValue.Get("type").String()
+		if errorType == "" {
+			errorType = errorValue.Get("status").String()
+		}
+		message = errorValue.Get("message").String()
+	case errorValue.Type == gjson.String:
+		message = errorValue.String()
+	default:
+		message = gjson.GetBytes(body, "message").String()
+	}
+
+	if message == "" {
+		message = string(body)
+	}
+	return errorType, truncateErrorMessage(message)
+}
+
+// truncateErrorMessage 截断过长的错误消息，截断位置不拆分UTF-8字符
+func truncateErrorMessage(message string) string {
+	if len(message) <= maxErrorMessageLength {
+		return message
+	}
+
+	cut := maxErrorMessageLength
+	for cut > 0 && !utf8.RuneStart(message[cut]) {
+		cut--
+	}
+	return message[:cut]
+}
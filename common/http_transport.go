@@ -0,0 +1,195 @@
+package common
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 连接池默认配置
+const (
+	defaultMaxIdleConns        = 100
+	defaultMaxIdleConnsPerHost = 20
+	defaultIdleConnTimeout     = 90 * time.Second
+)
+
+const (
+	// Transport超过该时长未被使用时从注册表移除（如代理分组切换代理后旧的账号和代理组合）
+	transportEvictAfter = 30 * time.Minute
+	// 清理未使用Transport的最小间隔
+	transportSweepInterval = time.Minute
+)
+
+// transportRegistry 按账号和代理复用的Transport注册表
+type transportRegistry struct {
+	mu         sync.Mutex
+	transports map[string]*transportEntry
+	lastSweep  time.Time
+}
+
+type transportEntry struct {
+	transport *http.Transport
+	lastUsed  time.Time
+}
+
+var httpTransports = &transportRegistry{
+	transports: make(map[string]*transportEntry),
+}
+
+// GetHTTPClient 获取复用连接池的HTTP客户端
+// 同一账号、同一代理和TLS配置共享一个Transport，保持长连接和HTTP/2复用，避免每次请求重新握手
+func GetHTTPClient(accountID uint, proxyURI string, tlsOptions *TLSOptions, timeout time.Duration) (*http.Client, error) {
+	transport, err := GetTransport(accountID, proxyURI, tlsOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: transport,
+	}, nil
+}
+
+// NewHTTPClient 创建不复用连接的一次性HTTP客户端
+// 用于OAuth授权等低频请求，避免为临时的代理地址在注册表中保留Transport
+func NewHTTPClient(proxyURI string, tlsOptions *TLSOptions, timeout time.Duration) (*http.Client, error) {
+	transport, err := newPooledTransport(proxyURI, tlsOptions)
+	if err != nil {
+		return nil, err
+	}
+	transport.DisableKeepAlives = true
+
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: transport,
+	}, nil
+}
+
+// GetTransport 获取账号、代理和TLS配置对应的Transport，不存在时创建
+// 同时清理长时间未使用的Transport
+func GetTransport(accountID uint, proxyURI string, tlsOptions *TLSOptions) (*http.Transport, error) {
+	key := transportKey(accountID, proxyURI, tlsOptions)
+	now := time.Now()
+
+	httpTransports.mu.Lock()
+	defer httpTransports.mu.Unlock()
+
+	httpTransports.evictUnused(now)
+
+	if entry, exists := httpTransports.transports[key]; exists {
+		entry.lastUsed = now
+		return entry.transport, nil
+	}
+
+	transport, err := newPooledTransport(proxyURI, tlsOptions)
+	if err != nil {
+		return nil, err
+	}
+	httpTransports.transports[key] = &transportEntry{transport: transport, lastUsed: now}
+	return transport, nil
+}
+
+// evictUnused 移除超过transportEvictAfter未使用的Transport并关闭空闲连接，调用方需持有锁
+// 正在进行的请求不受影响，只关闭空闲连接
+func (r *transportRegistry) evictUnused(now time.Time) {
+	if now.Sub(r.lastSweep) < transportSweepInterval {
+		return
+	}
+	r.lastSweep = now
+
+	for key, entry := range r.transports {
+		if now.Sub(entry.lastUsed) >= transportEvictAfter {
+			entry.transport.CloseIdleConnections()
+			delete(r.transports, key)
+		}
+	}
+}
+
+// InvalidateTransports 移除账号的所有Transport并关闭空闲连接
+// 账号的代理或TLS配置变更、账号被删除时调用
+func InvalidateTransports(accountID uint) {
+	prefix := fmt.Sprintf("%d|", accountID)
+
+	httpTransports.mu.Lock()
+	defer httpTransports.mu.Unlock()
+
+	for key, entry := range httpTransports.transports {
+		if strings.HasPrefix(key, prefix) {
+			entry.transport.CloseIdleConnections()
+			delete(httpTransports.transports, key)
+		}
+	}
+}
+
+// InvalidateTransportsByProxy 移除使用指定代理的所有Transport并关闭空闲连接
+// 代理池中的代理地址变更或被删除时调用
+func InvalidateTransportsByProxy(proxyURI string) {
+	if proxyURI == "" {
+		return
+	}
+
+	httpTransports.mu.Lock()
+	defer httpTransports.mu.Unlock()
+
+	for key, entry := range httpTransports.transports {
+		parts := strings.SplitN(key, "|", 3)
+		if len(parts) == 3 && parts[1] == proxyURI {
+			entry.transport.CloseIdleConnections()
+			delete(httpTransports.transports, key)
+		}
+	}
+}
+
+// transportKey Transport注册表键
+func transportKey(accountID uint, proxyURI string, tlsOptions *TLSOptions) string {
+	return fmt.Sprintf("%d|%s|%s", accountID, proxyURI, tlsOptions.fingerprint())
+}
+
+// newPooledTransport 创建支持连接复用和HTTP/2的Transport
+func newPooledTransport(proxyURI string, tlsOptions *TLSOptions) (*http.Transport, error) {
+	tlsConfig, err := tlsOptions.BuildTLSConfig()
+	if err != nil {
+		return nil, fmt.Errorf("invalid TLS options: %w", err)
+	}
+
+	transport := &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSClientConfig:       tlsConfig,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          getEnvInt("HTTP_MAX_IDLE_CONNS", defaultMaxIdleConns),
+		MaxIdleConnsPerHost:   getEnvInt("HTTP_MAX_IDLE_CONNS_PER_HOST", defaultMaxIdleConnsPerHost),
+		MaxConnsPerHost:       getEnvInt("HTTP_MAX_CONNS_PER_HOST", 0),
+		IdleConnTimeout:       time.Duration(getEnvInt("HTTP_IDLE_CONN_TIMEOUT", int(defaultIdleConnTimeout/time.Second))) * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+
+	if proxyURI != "" {
+		proxyURL, err := url.Parse(proxyURI)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy URI: %w", err)
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	return transport, nil
+}
+
+// getEnvInt 读取整型环境变量，未设置或无效时返回默认值
+func getEnvInt(name string, defaultValue int) int {
+	if value := os.Getenv(name); value != "" {
+		if parsed, err := strconv.Atoi(value); err == nil && parsed >= 0 {
+			return parsed
+		}
+	}
+	return defaultValue
+}
@@ -0,0 +1,216 @@
+package common
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/tidwall/gjson"
+)
+
+// AggregatedMessage 由流式事件合并得到的完整Anthropic消息
+type AggregatedMessage struct {
+	ID           string                   `json:"id"`
+	Type         string                   `json:"type"`
+	Role         string                   `json:"role"`
+	Model        string                   `json:"model"`
+	Content      []map[string]interface{} `json:"content"`
+	StopReason   *string                  `json:"stop_reason"`
+	StopSequence *string                  `json:"stop_sequence"`
+	Usage        map[string]interface{}   `json:"usage"`
+}
+
+// StreamError 流式响应中的error事件
+type StreamError struct {
+	StatusCode int
+	Body       []byte
+}
+
+// MessageAggregator 将Claude SSE事件合并为一个完整的消息对象
+// 用于客户端请求stream=false而上游被强制为流式的场景
+type MessageAggregator struct {
+	message      AggregatedMessage
+	blocks       map[int]map[string]interface{}
+	partialJSON  map[int]*strings.Builder
+	streamError  *StreamError
+	messageStart bool
+}
+
+// NewMessageAggregator 创建消息聚合器
+func NewMessageAggregator() *MessageAggregator {
+	return &MessageAggregator{
+		message: AggregatedMessage{
+			Type:  "message",
+			Role:  "assistant",
+			Usage: map[string]interface{}{},
+		},
+		blocks:      make(map[int]map[string]interface{}),
+		partialJSON: make(map[int]*strings.Builder),
+	}
+}
+
+// AggregateStreamResponse 将完整的SSE响应体合并为消息JSON
+// 如果流中包含error事件，返回StreamError（包含对应的HTTP状态码和错误响应体）
+func AggregateStreamResponse(streamBody []byte) ([]byte, *StreamError, error) {
+	aggregator := NewMessageAggregator()
+	for _, line := range strings.Split(string(streamBody), "\n") {
+		aggregator.ProcessLine(line)
+	}
+
+	if aggregator.streamError != nil {
+		return nil, aggregator.streamError, nil
+	}
+	if !aggregator.messageStart {
+		return nil, nil, errors.New("stream response contains no message_start event")
+	}
+
+	messageJSON, err := json.Marshal(aggregator.Message())
+	return messageJSON, nil, err
+}
+
+// ProcessLine 处理单行SSE数据
+func (a *MessageAggregator) ProcessLine(line string) {
+	line = strings.TrimSpace(line)
+	if !strings.HasPrefix(line, "data:") {
+		return
+	}
+
+	data := strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+	if data == "" || data == "[DONE]" || !gjson.Valid(data) {
+		return
+	}
+
+	event := gjson.Parse(data)
+	index := int(event.Get("index").Int())
+
+	switch event.Get("type").String() {
+	case "message_start":
+		a.messageStart = true
+		message := event.Get("message")
+		a.message.ID = message.Get("id").String()
+		a.message.Model = message.Get("model").String()
+		if usage, ok := message.Get("usage").Value().(map[string]interface{}); ok {
+			a.message.Usage = usage
+		}
+
+	case "content_block_start":
+		block, ok := event.Get("content_block").Value().(map[string]interface{})
+		if !ok {
+			return
+		}
+		a.blocks[index] = block
+		if block["type"] == "tool_use" || block["type"] == "server_tool_use" {
+			a.partialJSON[index] = &strings.Builder{}
+		}
+
+	case "content_block_delta":
+		block, exists := a.blocks[index]
+		if !exists {
+			return
+		}
+		delta := event.Get("delta")
+		switch delta.Get("type").String() {
+		case "text_delta":
+			text, _ := block["text"].(string)
+			block["text"] = text + delta.Get("text").String()
+		case "thinking_delta":
+			thinking, _ := block["thinking"].(string)
+			block["thinking"] = thinking + delta.Get("thinking").String()
+		case "signature_delta":
+			block["signature"] = delta.Get("signature").String()
+		case "input_json_delta":
+			if builder, ok := a.partialJSON[index]; ok {
+				builder.WriteString(delta.Get("partial_json").String())
+			}
+		case "citations_delta":
+			citations, _ := block["citations"].([]interface{})
+			block["citations"] = append(citations, delta.Get("citation").Value())
+		}
+
+	case "content_block_stop":
+		a.finalizeToolInput(index)
+
+	case "message_delta":
+		if stopReason := event.Get("delta.stop_reason"); stopReason.Exists() && stopReason.Type != gjson.Null {
+			value := stopReason.String()
+			a.message.StopReason = &value
+		}
+		if stopSequence := event.Get("delta.stop_sequence"); stopSequence.Exists() && stopSequence.Type != gjson.Null {
+			value := stopSequence.String()
+			a.message.StopSequence = &value
+		}
+		// message_delta中的usage为累计值，覆盖message_start中的值
+		if usage, ok := event.Get("usage").Value().(map[string]interface{}); ok {
+			for key, value := range usage {
+				if value != nil {
+					a.message.Usage[key] = value
+				}
+			}
+		}
+
+	case "error":
+		a.streamError = &StreamError{
+			StatusCode: streamErrorStatusCode(event.Get("error.type").String()),
+			Body:       []byte(data),
+		}
+	}
+}
+
+// Message 返回合并后的消息，内容块按index排序
+func (a *MessageAggregator) Message() AggregatedMessage {
+	indexes := make([]int, 0, len(a.blocks))
+	for index := range a.blocks {
+		a.finalizeToolInput(index)
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+
+	message := a.message
+	message.Content = make([]map[string]interface{}, 0, len(indexes))
+	for _, index := range indexes {
+		message.Content = append(message.Content, a.blocks[index])
+	}
+	return message
+}
+
+// finalizeToolInput 将累积的工具参数JSON解析为input字段
+func (a *MessageAggregator) finalizeToolInput(index int) {
+	builder, exists := a.partialJSON[index]
+	if !exists {
+		return
+	}
+	delete(a.partialJSON, index)
+
+	input := map[string]interface{}{}
+	if partial := builder.String(); partial != "" {
+		if err := json.Unmarshal([]byte(partial), &input); err != nil {
+			SysError("failed to parse tool input json: " + err.Error())
+			input = map[string]interface{}{}
+		}
+	}
+	a.blocks[index]["input"] = input
+}
+
+// streamErrorStatusCode 根据流式error事件的类型推断HTTP状态码
+func streamErrorStatusCode(errorType string) int {
+	switch errorType {
+	case "overloaded_error":
+		return 529
+	case "rate_limit_error":
+		return http.StatusTooManyRequests
+	case "invalid_request_error":
+		return http.StatusBadRequest
+	case "authentication_error":
+		return http.StatusUnauthorized
+	case "permission_error":
+		return http.StatusForbidden
+	case "not_found_error":
+		return http.StatusNotFound
+	case "request_too_large":
+		return http.StatusRequestEntityTooLarge
+	default:
+		return http.StatusInternalServerError
+	}
+}
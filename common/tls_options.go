@@ -0,0 +1,114 @@
+package common
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"strings"
+)
+
+// ErrInvalidTLSConfig TLS配置校验失败，具体原因包装在错误信息中
+var ErrInvalidTLSConfig = errors.New("TLS配置无效")
+
+// TLSOptions 上游连接的TLS配置
+type TLSOptions struct {
+	CACert             string // 自定义CA证书(PEM)，为空时使用系统根证书
+	ClientCert         string // mTLS客户端证书(PEM)
+	ClientKey          string // mTLS客户端私钥(PEM)
+	ServerName         string // SNI覆盖，同时用于证书主机名校验
+	InsecureSkipVerify bool   // 是否跳过证书校验（需显式开启）
+}
+
+// TLSSummary TLS配置摘要，用于账号测试结果展示（不包含证书内容）
+type TLSSummary struct {
+	VerifyCertificate bool   `json:"verify_certificate"`
+	CustomCA          bool   `json:"custom_ca"`
+	ClientCertificate bool   `json:"client_certificate"`
+	ServerName        string `json:"server_name,omitempty"`
+}
+
+// Validate 校验TLS配置是否有效
+func (o *TLSOptions) Validate() error {
+	if o == nil {
+		return nil
+	}
+	_, err := o.BuildTLSConfig()
+	return err
+}
+
+// BuildTLSConfig 根据配置构建tls.Config，默认开启证书校验
+func (o *TLSOptions) BuildTLSConfig() (*tls.Config, error) {
+	config := &tls.Config{}
+	if o == nil {
+		return config, nil
+	}
+
+	if strings.TrimSpace(o.CACert) != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM([]byte(o.CACert)) {
+			return nil, errors.New("CA证书格式无效，需为PEM格式")
+		}
+		config.RootCAs = pool
+	}
+
+	hasCert := strings.TrimSpace(o.ClientCert) != ""
+	hasKey := strings.TrimSpace(o.ClientKey) != ""
+	if hasCert != hasKey {
+		return nil, errors.New("客户端证书和私钥必须同时配置")
+	}
+	if hasCert {
+		certificate, err := tls.X509KeyPair([]byte(o.ClientCert), []byte(o.ClientKey))
+		if err != nil {
+			return nil, errors.New("客户端证书或私钥无效: " + err.Error())
+		}
+		config.Certificates = []tls.Certificate{certificate}
+	}
+
+	if serverName := strings.TrimSpace(o.ServerName); serverName != "" {
+		if strings.ContainsAny(serverName, " /:") {
+			return nil, errors.New("SNI主机名无效: " + serverName)
+		}
+		config.ServerName = serverName
+	}
+
+	config.InsecureSkipVerify = o.InsecureSkipVerify
+	return config, nil
+}
+
+// Summary 返回TLS配置摘要
+func (o *TLSOptions) Summary() TLSSummary {
+	if o == nil {
+		return TLSSummary{VerifyCertificate: true}
+	}
+	return TLSSummary{
+		VerifyCertificate: !o.InsecureSkipVerify,
+		CustomCA:          strings.TrimSpace(o.CACert) != "",
+		ClientCertificate: strings.TrimSpace(o.ClientCert) != "",
+		ServerName:        strings.TrimSpace(o.ServerName),
+	}
+}
+
+// fingerprint TLS配置指纹，用于区分连接池
+func (o *TLSOptions) fingerprint() string {
+	if o == nil {
+		return ""
+	}
+	var builder strings.Builder
+	builder.WriteString(o.CACert)
+	builder.WriteString("\x00")
+	builder.WriteString(o.ClientCert)
+	builder.WriteString("\x00")
+	builder.WriteString(o.ClientKey)
+	builder.WriteString("\x00")
+	builder.WriteString(o.ServerName)
+	if o.InsecureSkipVerify {
+		builder.WriteString("\x00insecure")
+	}
+	hash := sha256.Sum256([]byte(builder.String()))
+	return hex.EncodeToString(hash[:8])
+}
@@ -0,0 +1,207 @@
+package common
+
+import (
+	"bytes"
+	"encoding/base64"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"math"
+	"strings"
+	"unicode"
+
+	"github.com/tidwall/gjson"
+)
+
+// 本地token估算参数（近似Claude分词器，用于上游不支持count_tokens时的兜底）
+const (
+	// 每条消息的结构开销（角色标记等）
+	estimateMessageOverhead = 4
+	// 请求的固定开销
+	estimateRequestOverhead = 3
+	// 携带工具定义时上游注入的工具调用系统提示
+	estimateToolSystemPrompt = 346
+	// 每个工具定义的结构开销
+	estimateToolOverhead = 8
+	// 图片长边超过该像素时会被上游等比缩小
+	estimateImageMaxEdge = 1568
+	// 无法获取图片尺寸时使用的默认值（约为最大尺寸图片的token数）
+	estimateImageDefaultTokens = 1600
+	// 每个PDF页面的估算token数
+	estimateDocumentPageTokens = 1500
+)
+
+// EstimateInputTokens 在本地估算Claude Messages请求的输入token数
+// 覆盖system、messages（文本、工具调用与结果、图片、文档）和tools，结果为近似值
+func EstimateInputTokens(requestBody []byte) int {
+	request := gjson.ParseBytes(requestBody)
+	tokens := estimateRequestOverhead
+
+	system := request.Get("system")
+	if system.Type == gjson.String {
+		tokens += EstimateTextTokens(system.String())
+	} else if system.IsArray() {
+		for _, block := range system.Array() {
+			tokens += estimateContentBlockTokens(block)
+		}
+	}
+
+	for _, message := range request.Get("messages").Array() {
+		tokens += estimateMessageOverhead
+		content := message.Get("content")
+		if content.Type == gjson.String {
+			tokens += EstimateTextTokens(content.String())
+			continue
+		}
+		for _, block := range content.Array() {
+			tokens += estimateContentBlockTokens(block)
+		}
+	}
+
+	tools := request.Get("tools").Array()
+	if len(tools) > 0 {
+		tokens += estimateToolSystemPrompt
+	}
+	for _, tool := range tools {
+		tokens += estimateToolOverhead
+		tokens += EstimateTextTokens(tool.Get("name").String())
+		tokens += EstimateTextTokens(tool.Get("description").String())
+		if schema := tool.Get("input_schema"); schema.Exists() {
+			tokens += EstimateTextTokens(schema.Raw)
+		}
+	}
+
+	return tokens
+}
+
+// estimateContentBlockTokens 估算单个内容块的token数
+func estimateContentBlockTokens(block gjson.Result) int {
+	switch block.Get("type").String() {
+	case "text":
+		return EstimateTextTokens(block.Get("text").String())
+	case "thinking":
+		return EstimateTextTokens(block.Get("thinking").String())
+	case "redacted_thinking":
+		return EstimateTextTokens(block.Get("data").String()) / 4
+	case "tool_use", "server_tool_use":
+		return EstimateTextTokens(block.Get("name").String()) + EstimateTextTokens(block.Get("input").Raw)
+	case "tool_result":
+		content := block.Get("content")
+		if content.Type == gjson.String {
+			return EstimateTextTokens(content.String())
+		}
+		tokens := 0
+		for _, item := range content.Array() {
+			tokens += estimateContentBlockTokens(item)
+		}
+		return tokens
+	case "image":
+		return estimateImageTokens(block.Get("source"))
+	case "document":
+		return estimateDocumentTokens(block.Get("source"))
+	default:
+		if block.Type == gjson.String {
+			return EstimateTextTokens(block.String())
+		}
+		return EstimateTextTokens(block.Raw)
+	}
+}
+
+// estimateImageTokens 按上游规则估算图片token数：缩放后像素数/750
+func estimateImageTokens(source gjson.Result) int {
+	if source.Get("type").String() != "base64" {
+		return estimateImageDefaultTokens
+	}
+
+	data, err := base64.StdEncoding.DecodeString(source.Get("data").String())
+	if err != nil {
+		return estimateImageDefaultTokens
+	}
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || config.Width <= 0 || config.Height <= 0 {
+		return estimateImageDefaultTokens
+	}
+
+	width, height := float64(config.Width), float64(config.Height)
+	if longEdge := math.Max(width, height); longEdge > estimateImageMaxEdge {
+		scale := estimateImageMaxEdge / longEdge
+		width *= scale
+		height *= scale
+	}
+
+	return int(math.Ceil(width * height / 750))
+}
+
+// estimateDocumentTokens 估算文档token数：文本文档按内容估算，PDF按页数估算
+func estimateDocumentTokens(source gjson.Result) int {
+	switch source.Get("type").String() {
+	case "text":
+		return EstimateTextTokens(source.Get("data").String())
+	case "content":
+		tokens := 0
+		for _, item := range source.Get("content").Array() {
+			tokens += estimateContentBlockTokens(item)
+		}
+		return tokens
+	case "base64":
+		data, err := base64.StdEncoding.DecodeString(source.Get("data").String())
+		if err != nil {
+			return estimateDocumentPageTokens
+		}
+		pages := bytes.Count(data, []byte("/Type /Page")) - bytes.Count(data, []byte("/Type /Pages"))
+		pages += bytes.Count(data, []byte("/Type/Page")) - bytes.Count(data, []byte("/Type/Pages"))
+		if pages <= 0 {
+			pages = 1
+		}
+		return pages * estimateDocumentPageTokens
+	default:
+		return estimateDocumentPageTokens
+	}
+}
+
+// EstimateTextTokens 估算文本的token数
+// 中日韩字符约每字1个token；连续的字母数字按约6个字符1个token计算；标点符号各计1个token；空白不单独计数
+func EstimateTextTokens(text string) int {
+	if text == "" {
+		return 0
+	}
+
+	tokens := 0
+	wordLength := 0
+	flushWord := func() {
+		if wordLength > 0 {
+			tokens += (wordLength + 5) / 6
+			wordLength = 0
+		}
+	}
+
+	for _, r := range text {
+		switch {
+		case isCJKRune(r):
+			flushWord()
+			tokens++
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			wordLength++
+		case unicode.IsSpace(r):
+			flushWord()
+		default:
+			flushWord()
+			tokens++
+		}
+	}
+	flushWord()
+
+	// 代码等包含大量缩进的文本中，连续空白也会占用token
+	tokens += strings.Count(text, "    ") / 2
+
+	return tokens
+}
+
+// isCJKRune 判断是否为中日韩字符
+func isCJKRune(r rune) bool {
+	return unicode.Is(unicode.Han, r) ||
+		unicode.Is(unicode.Hiragana, r) ||
+		unicode.Is(unicode.Katakana, r) ||
+		unicode.Is(unicode.Hangul, r)
+}
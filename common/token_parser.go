@@ -14,6 +14,33 @@ type TokenUsage struct {
 	CacheReadInputTokens     int    `json:"cache_read_input_tokens"`
 	CacheCreationInputTokens int    `json:"cache_creation_input_tokens"`
 	Model                    string `json:"model"`
+	Interrupted              bool   `json:"interrupted"`        // 响应在完成前中断（客户端断开或上游连接中断），用量为中断前已产生的部分
+	Estimated                bool   `json:"estimated"`          // 上游未返回用量，部分或全部用量为本地估算值
+	AutoCacheControl         bool   `json:"auto_cache_control"` // 请求中的缓存断点由中转自动添加
+
+	estimatedOutputTokens int // 根据已输出内容累计的估算输出token数
+}
+
+// AddOutputEstimate 累计已输出内容的估算token数，上游未返回输出用量时使用
+func (u *TokenUsage) AddOutputEstimate(text string) {
+	u.estimatedOutputTokens += EstimateTextTokens(text)
+}
+
+// ApplyEstimate 上游未返回用量时使用本地估算值补全，并标记为估算
+// 没有任何输出的请求（通常是上游报错）不做估算，避免对失败请求计费
+func (u *TokenUsage) ApplyEstimate(requestBody []byte) {
+	if u.OutputTokens == 0 && u.estimatedOutputTokens == 0 {
+		return
+	}
+
+	if u.OutputTokens == 0 {
+		u.OutputTokens = u.estimatedOutputTokens
+		u.Estimated = true
+	}
+	if u.InputTokens == 0 && u.CacheReadInputTokens == 0 && u.CacheCreationInputTokens == 0 {
+		u.InputTokens = EstimateInputTokens(requestBody)
+		u.Estimated = true
+	}
 }
 
 // StreamCopyWriter 实现真正的流式转发，边转发边解析
@@ -143,6 +170,19 @@ func (w *StreamCopyWriter) parseLine(line string) {
 		}
 	}
 
+	// 累计输出内容的估算token数，供上游未返回用量时使用
+	if eventType == "content_block_delta" {
+		delta := gjson.Get(dataJSON, "delta")
+		switch delta.Get("type").String() {
+		case "text_delta":
+			w.usage.AddOutputEstimate(delta.Get("text").String())
+		case "thinking_delta":
+			w.usage.AddOutputEstimate(delta.Get("thinking").String())
+		case "input_json_delta":
+			w.usage.AddOutputEstimate(delta.Get("partial_json").String())
+		}
+	}
+
 	// 检查是否是message_delta事件
 	if eventType == "message_delta" {
 		usageJSON := gjson.Get(dataJSON, "usage")
@@ -193,6 +233,8 @@ func ParseStreamResponse(dst io.Writer, src io.Reader) (*TokenUsage, error) {
 		if n > 0 {
 			_, writeErr := streamWriter.Write(buffer[:n])
 			if writeErr != nil {
+				streamWriter.flushRemainder()
+				usage.Interrupted = true
 				return usage, writeErr
 			}
 		}
@@ -200,18 +242,26 @@ func ParseStreamResponse(dst io.Writer, src io.Reader) (*TokenUsage, error) {
 			break
 		}
 		if err != nil {
+			streamWriter.flushRemainder()
+			usage.Interrupted = true
 			return usage, err
 		}
 	}
 
 	// 处理最后一行（如果有的话）
-	if streamWriter != nil && streamWriter.remainder != "" {
-		streamWriter.parseLine(streamWriter.remainder)
-	}
+	streamWriter.flushRemainder()
 
 	return usage, nil
 }
 
+// flushRemainder 解析缓冲中剩余的最后一行
+func (w *StreamCopyWriter) flushRemainder() {
+	if w.remainder != "" {
+		w.parseLine(w.remainder)
+		w.remainder = ""
+	}
+}
+
 // ParseJSONResponse 解析非流式JSON响应中的token使用量
 func ParseJSONResponse(responseBody []byte) (*TokenUsage, error) {
 	usage := &TokenUsage{}
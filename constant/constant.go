@@ -41,5 +41,9 @@ const (
 	PlatformOpenAI        = "openai"
 	PlatformGemini        = "gemini"
 
+	// OpenAI账号的上游接口格式
+	UpstreamFormatChatCompletions = "chat_completions"
+	UpstreamFormatResponses       = "responses"
+
 	ClaudeCodeSystemPrompt = "You are Claude Code, Anthropic's official CLI for Claude."
 )
@@ -1,9 +1,11 @@
 package controller
 
 import (
+	"claude-code-relay/common"
 	"claude-code-relay/constant"
 	"claude-code-relay/model"
 	"claude-code-relay/service"
+	"errors"
 	"net/http"
 	"strconv"
 
@@ -89,6 +91,13 @@ func CreateAccount(c *gin.Context) {
 
 	account, err := accountService.CreateAccount(&req, user.ID)
 	if err != nil {
+		if errors.Is(err, common.ErrInvalidTLSConfig) || isAccountProxyError(err) {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": err.Error(),
+				"code":  constant.InvalidParams,
+			})
+			return
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"error": err.Error(),
 			"code":  constant.InternalServerError,
@@ -192,6 +201,9 @@ func UpdateAccount(c *gin.Context) {
 		} else if err.Error() == "无权访问此账号" {
 			statusCode = http.StatusForbidden
 			code = constant.Unauthorized
+		} else if errors.Is(err, common.ErrInvalidTLSConfig) || isAccountProxyError(err) {
+			statusCode = http.StatusBadRequest
+			code = constant.InvalidParams
 		} else {
 			statusCode = http.StatusInternalServerError
 			code = constant.InternalServerError
@@ -392,3 +404,12 @@ func UpdateAccountCurrentStatus(c *gin.Context) {
 		"code":    constant.Success,
 	})
 }
+
+// isAccountProxyError 判断是否为账号代理配置校验错误
+func isAccountProxyError(err error) bool {
+	switch err.Error() {
+	case "代理和代理分组只能选择一个", "代理不存在", "代理分组不存在":
+		return true
+	}
+	return false
+}
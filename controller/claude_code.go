@@ -1,17 +1,28 @@
 package controller
 
 import (
+	"bytes"
 	"claude-code-relay/common"
 	"claude-code-relay/constant"
 	"claude-code-relay/model"
 	"claude-code-relay/relay"
+	"claude-code-relay/service"
 	"fmt"
 	"github.com/gin-gonic/gin"
 	"github.com/tidwall/gjson"
 	"io"
+	"log"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
+)
+
+const (
+	// statusOverloaded Anthropic过载错误状态码
+	statusOverloaded = 529
+	// queueRetryAfterSeconds 排队失败时建议客户端重试的等待秒数
+	queueRetryAfterSeconds = 10
 )
 
 type ExchangeRequest struct {
@@ -29,10 +40,11 @@ type TestAccountRequest struct {
 
 // TestAccountResponse 测试账号响应结构
 type TestAccountResponse struct {
-	Success      bool   `json:"success"`
-	Message      string `json:"message"`
-	StatusCode   int    `json:"status_code,omitempty"`
-	PlatformType string `json:"platform_type"`
+	Success      bool              `json:"success"`
+	Message      string            `json:"message"`
+	StatusCode   int               `json:"status_code,omitempty"`
+	PlatformType string            `json:"platform_type"`
+	TLS          common.TLSSummary `json:"tls"`
 }
 
 // RequestContext 请求上下文信息
@@ -98,6 +110,16 @@ func ExchangeCode(c *gin.Context) {
 
 // prepareRequestContext 预处理请求上下文
 func prepareRequestContext(c *gin.Context) (*RequestContext, bool) {
+	body, ok := readRequestBody(c)
+	if !ok {
+		return nil, false
+	}
+
+	return selectRequestAccounts(c, body)
+}
+
+// readRequestBody 读取请求体并应用分组的请求改写规则
+func readRequestBody(c *gin.Context) ([]byte, bool) {
 	// 从上下文中获取API Key的详细信息
 	apiKey, _ := c.Get("api_key")
 	keyInfo := apiKey.(*model.ApiKey)
@@ -111,8 +133,21 @@ func prepareRequestContext(c *gin.Context) (*RequestContext, bool) {
 		return nil, false
 	}
 
+	// 请求失败时日志记录请求的模型
+	c.Set("model_name", gjson.GetBytes(body, "model").String())
+
+	// 应用分组的请求改写规则，所有平台的账号都使用改写后的请求体
+	return service.ApplyGroupRewriteRules(keyInfo.GroupID, body), true
+}
+
+// selectRequestAccounts 根据请求的模型查询、过滤并排序可用账号
+func selectRequestAccounts(c *gin.Context, body []byte) (*RequestContext, bool) {
+	apiKey, _ := c.Get("api_key")
+	keyInfo := apiKey.(*model.ApiKey)
+
 	modelName := gjson.GetBytes(body, "model").String()
 	if modelName == "" {
+		c.Set("error_type", common.ErrorTypeInvalidRequest)
 		c.JSON(http.StatusServiceUnavailable, gin.H{
 			"message": "missing model",
 			"code":    constant.InternalServerError,
@@ -130,19 +165,35 @@ func prepareRequestContext(c *gin.Context) (*RequestContext, bool) {
 		return nil, false
 	}
 
+	// 账号均处于限流中时进入分组队列等待限流结束
+	if len(accounts) == 0 && model.HasRateLimitedAccounts(keyInfo.GroupID) {
+		queryAccounts := func() bool {
+			accounts, err = model.GetAvailableAccountsByGroupID(keyInfo.GroupID)
+			return err == nil && len(accounts) > 0
+		}
+		if !waitInRequestQueue(c, keyInfo, queryAccounts) {
+			return nil, false
+		}
+	}
+
 	// 根据模型权限过滤账号
 	filteredAccounts := filterAccountsByModelPermission(accounts, keyInfo, modelName)
 
 	// 根据限额过滤账号
 	filteredAccounts = filterAccountsByLimit(filteredAccounts)
 
+	// 按优先级分层、层内按权重随机排序
+	filteredAccounts = service.NewAccountScheduler().OrderAccounts(filteredAccounts)
+
 	if len(filteredAccounts) == 0 {
 		if len(accounts) == 0 {
+			c.Set("error_type", common.ErrorTypeNoAvailableAccount)
 			c.JSON(http.StatusForbidden, gin.H{
 				"message": "没有可用的账号",
 				"code":    constant.NotFound,
 			})
 		} else {
+			c.Set("error_type", common.ErrorTypeModelNotAllowed)
 			c.JSON(http.StatusForbidden, gin.H{
 				"message": "没有权限访问模型: " + modelName,
 				"code":    constant.Forbidden,
@@ -161,25 +212,250 @@ func prepareRequestContext(c *gin.Context) (*RequestContext, bool) {
 
 // GetMessages 获取对话消息
 func GetMessages(c *gin.Context) {
-	ctx, ok := prepareRequestContext(c)
+	body, ok := readRequestBody(c)
+	if !ok {
+		return
+	}
+
+	cacheKey, hit := serveCachedResponse(c, body)
+	if hit {
+		return
+	}
+
+	ctx, ok := selectRequestAccounts(c, body)
+	if !ok {
+		return
+	}
+
+	relayWithResponseCache(c, ctx, cacheKey)
+}
+
+// GetChatCompletions OpenAI兼容的对话接口
+// 将OpenAI Chat Completions请求转换为Claude Messages请求，经账号池转发后再将响应转换回OpenAI格式
+func GetChatCompletions(c *gin.Context) {
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": gin.H{"message": "请求参数异常", "type": "invalid_request_error"},
+		})
+		return
+	}
+
+	claudeBody, err := relay.ConvertOpenAIToClaudeRequest(body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": gin.H{"message": "请求参数异常: " + err.Error(), "type": "invalid_request_error"},
+		})
+		return
+	}
+	c.Request.Body = io.NopCloser(bytes.NewReader(claudeBody))
+
+	claudeBody, ok := readRequestBody(c)
+	if !ok {
+		return
+	}
+
+	// 缓存回放和转发都输出Claude格式的响应，由chatWriter统一转换为OpenAI格式
+	originalWriter := c.Writer
+	chatWriter := relay.NewOpenAIChatWriter(
+		originalWriter,
+		gjson.GetBytes(body, "stream").Bool(),
+		gjson.GetBytes(body, "stream_options.include_usage").Bool(),
+		gjson.GetBytes(claudeBody, "model").String(),
+	)
+	// 没有可用账号等提前返回的错误同样需要转换为OpenAI格式
+	c.Writer = chatWriter
+	defer func() {
+		chatWriter.Finish()
+		c.Writer = originalWriter
+	}()
+
+	cacheKey, hit := serveCachedResponse(c, claudeBody)
+	if hit {
+		return
+	}
+	ctx, ok := selectRequestAccounts(c, claudeBody)
 	if !ok {
 		return
 	}
+	relayWithResponseCache(c, ctx, cacheKey)
+}
+
+// relayWithFailover 按调度顺序依次尝试账号，可重试错误时切换到下一个账号
+func relayWithFailover(c *gin.Context, ctx *RequestContext) {
+	defer relay.StartBodyCapture(c, ctx.APIKey, ctx.Body)()
+
+	// 分组是否自动添加缓存断点在请求开始时确定一次，各账号的转发处理从上下文读取
+	c.Set("auto_cache_control", model.GetGroupAutoCacheControl(ctx.APIKey.GroupID))
+
+	// 会话粘性：同一会话优先使用上次成功的账号，保证Prompt Cache命中
+	stickySession := service.NewStickySessionService()
+	sessionKey := service.ExtractSessionKey(ctx.Body)
+	accounts := stickySession.ApplyAffinity(ctx.FilteredAccounts, ctx.APIKey.GroupID, sessionKey)
+
+	// 按分组配置确定最多尝试的账号数（账号已由调度器按优先级和权重排序）
+	// 熔断中的账号直接跳过，熔断到期的账号在实际尝试时才获取探测权，获取失败时跳过
+	// 并发已满的账号同样跳过，避免继续堆积请求
+	circuitBreaker := service.NewCircuitBreakerService()
+	concurrencyService := service.NewConcurrencyService()
+	groupMaxAttempts := model.GetGroupMaxAttempts(ctx.APIKey.GroupID)
+	var candidates []model.Account
+	selectCandidates := func() bool {
+		for _, account := range accounts {
+			if len(candidates) >= groupMaxAttempts {
+				break
+			}
+			if concurrencyService.IsSaturated(&account) {
+				continue
+			}
+			if circuitBreaker.GetState(account.ID) == service.CircuitStateOpen {
+				continue
+			}
+			candidates = append(candidates, account)
+		}
+		return len(candidates) > 0
+	}
+
+	// 探测请求成功时恢复熔断器，否则释放探测权（上游失败已在更新账号状态时计入熔断器）
+	finishProbe := func(accountID uint, statusCode int) {
+		if statusCode < http.StatusBadRequest {
+			circuitBreaker.RecordSuccess(accountID)
+			return
+		}
+		circuitBreaker.ReleaseProbe(accountID)
+	}
+
+	// 账号均在熔断或并发已满时进入分组队列等待
+	if !selectCandidates() && !waitInRequestQueue(c, ctx.APIKey, selectCandidates) {
+		return
+	}
+
+	requestID := c.GetString("request_id")
+	originalWriter := c.Writer
+
+	// 可重试的失败尝试，确认有下一个账号可用后才记录日志；没有可用账号时返回给客户端
+	var failed *failedAttempt
+	attempt := 0
+
+	for i, selectedAccount := range candidates {
+		allowed, probing := circuitBreaker.Allow(selectedAccount.ID)
+		if !allowed {
+			continue
+		}
+		attempt++
+
+		// 失败的尝试不会返回给客户端，切换账号前单独记录
+		if failed != nil {
+			relay.SaveErrorLog(c, failed.account.ID, failed.writer.Status(), failed.body, failed.duration, nil)
+			log.Printf("[%s] 账号 %s 请求失败，切换到下一个账号重试", requestID, failed.account.Name)
+			failed = nil
+		}
+
+		// 请求最终失败时由中间件记录日志并关联该账号
+		c.Set("relay_account_id", selectedAccount.ID)
+
+		// 最后一个候选账号直接写入客户端，不再拦截错误响应
+		if i == len(candidates)-1 {
+			relayToAccount(c, &selectedAccount, ctx.Body)
+			log.Printf("[%s] 第%d次尝试 账号 %s (ID: %d) 状态码: %d", requestID, attempt, selectedAccount.Name, selectedAccount.ID, c.Writer.Status())
+			if probing {
+				finishProbe(selectedAccount.ID, c.Writer.Status())
+			}
+			if c.Writer.Status() < http.StatusBadRequest {
+				stickySession.Bind(ctx.APIKey.GroupID, sessionKey, selectedAccount.ID)
+			}
+			return
+		}
+
+		failoverWriter := relay.NewFailoverWriter(originalWriter)
+		errorRecorder := relay.NewErrorRecorder(failoverWriter)
+		c.Writer = errorRecorder
+		attemptStart := time.Now()
+		relayToAccount(c, &selectedAccount, ctx.Body)
+		c.Writer = originalWriter
+
+		log.Printf("[%s] 第%d次尝试 账号 %s (ID: %d) 状态码: %d", requestID, attempt, selectedAccount.Name, selectedAccount.ID, failoverWriter.Status())
+		if probing {
+			finishProbe(selectedAccount.ID, failoverWriter.Status())
+		}
+
+		// 已向客户端发送数据、非可重试错误或客户端已断开时停止重试
+		if !failoverWriter.Retryable() || c.Request.Context().Err() != nil {
+			if failoverWriter.Status() < http.StatusBadRequest {
+				stickySession.Bind(ctx.APIKey.GroupID, sessionKey, selectedAccount.ID)
+			}
+			return
+		}
+
+		failed = &failedAttempt{
+			account:  selectedAccount,
+			writer:   failoverWriter,
+			body:     errorRecorder.Body(),
+			duration: time.Since(attemptStart).Milliseconds(),
+		}
+	}
+
+	// 剩余账号的探测权均被其他请求占用
+	if failed != nil {
+		failed.writer.Replay(failed.body)
+		return
+	}
+	abortNoAvailableAccount(c)
+}
+
+// failedAttempt 故障转移过程中以可重试错误结束的尝试
+type failedAttempt struct {
+	account  model.Account
+	writer   *relay.FailoverWriter
+	body     []byte
+	duration int64
+}
+
+// waitInRequestQueue 在API Key所属分组的队列中等待账号可用
+// 等待超时或队列已满时返回overloaded_error并设置retry-after，客户端断开时直接返回
+func waitInRequestQueue(c *gin.Context, apiKey *model.ApiKey, available func() bool) bool {
+	config := model.GetGroupQueueConfig(apiKey.GroupID)
+	err := service.NewRequestQueueService().Wait(c.Request.Context(), apiKey.GroupID, apiKey.QueuePriority, config, available)
+	if err == nil {
+		return true
+	}
+	if c.Request.Context().Err() != nil {
+		c.Abort()
+		return false
+	}
 
-	// 选择第一个账号（已按优先级和使用次数排序）
-	selectedAccount := ctx.FilteredAccounts[0]
+	log.Printf("[%s] 分组 %d 没有可用账号: %v", c.GetString("request_id"), apiKey.GroupID, err)
+	abortNoAvailableAccount(c)
+	return false
+}
 
-	// 根据平台类型路由到不同的处理器
-	switch selectedAccount.PlatformType {
+// abortNoAvailableAccount 没有可用账号时返回overloaded_error并设置retry-after
+func abortNoAvailableAccount(c *gin.Context) {
+	c.Set("error_type", common.ErrorTypeNoAvailableAccount)
+	c.Header("retry-after", strconv.Itoa(queueRetryAfterSeconds))
+	c.JSON(statusOverloaded, gin.H{
+		"type": "error",
+		"error": gin.H{
+			"type":    "overloaded_error",
+			"message": "All accounts are busy or rate limited, please retry later",
+		},
+	})
+}
+
+// relayToAccount 根据平台类型将请求路由到不同的处理器
+func relayToAccount(c *gin.Context, account *model.Account, body []byte) {
+	switch account.PlatformType {
 	case constant.PlatformClaude:
-		relay.HandleClaudeRequest(c, &selectedAccount, ctx.Body)
+		relay.HandleClaudeRequest(c, account, body)
 	case constant.PlatformClaudeConsole:
-		relay.HandleClaudeConsoleRequest(c, &selectedAccount, ctx.Body)
+		relay.HandleClaudeConsoleRequest(c, account, body)
 	case constant.PlatformOpenAI:
-		relay.HandleOpenAIRequest(c, &selectedAccount, ctx.Body)
+		relay.HandleOpenAIRequest(c, account, body)
+	case constant.PlatformGemini:
+		relay.HandleGeminiRequest(c, account, body)
 	default:
 		c.JSON(http.StatusBadRequest, gin.H{
-			"message": "不支持的平台类型: " + selectedAccount.PlatformType,
+			"message": "不支持的平台类型: " + account.PlatformType,
 			"code":    constant.InvalidParams,
 		})
 	}
@@ -250,6 +526,7 @@ func parseAccountID(c *gin.Context) (uint, error) {
 func executeAccountTest(account *model.Account) TestAccountResponse {
 	testResult := TestAccountResponse{
 		PlatformType: account.PlatformType,
+		TLS:          account.TLSOptions().Summary(),
 	}
 
 	var statusCode int
@@ -263,6 +540,8 @@ func executeAccountTest(account *model.Account) TestAccountResponse {
 		statusCode, errorMsg = relay.TestHandleClaudeConsoleRequest(account)
 	case constant.PlatformOpenAI:
 		statusCode, errorMsg = relay.TestHandleOpenAIRequest(account)
+	case constant.PlatformGemini:
+		statusCode, errorMsg = relay.TestHandleGeminiRequest(account)
 	default:
 		return TestAccountResponse{
 			Success:      false,
@@ -287,27 +566,27 @@ func executeAccountTest(account *model.Account) TestAccountResponse {
 	return testResult
 }
 
-// filterAccountsByModelPermission 根据模型权限过滤账号列表
-func filterAccountsByModelPermission(accounts []model.Account, apiKey *model.ApiKey, modelName string) []model.Account {
-	// 首先检查API Key的模型限制（优先级最高）
-	if apiKey.ModelRestriction != "" {
-		// 解析API Key允许的模型列表
-		allowedModels := strings.Split(apiKey.ModelRestriction, ",")
-
-		// 检查当前模型是否在API Key允许列表中
-		isModelAllowed := false
-		for _, allowedModel := range allowedModels {
-			if strings.EqualFold(strings.TrimSpace(allowedModel), modelName) {
-				isModelAllowed = true
-				break
-			}
-		}
+// apiKeyAllowsModel 检查API Key的模型限制是否允许访问该模型
+func apiKeyAllowsModel(apiKey *model.ApiKey, modelName string) bool {
+	if apiKey.ModelRestriction == "" {
+		return true
+	}
 
-		// 如果API Key不允许此模型，直接返回空列表
-		if !isModelAllowed {
-			return []model.Account{}
+	// 检查当前模型是否在API Key允许列表中
+	for _, allowedModel := range strings.Split(apiKey.ModelRestriction, ",") {
+		if strings.EqualFold(strings.TrimSpace(allowedModel), modelName) {
+			return true
 		}
 	}
+	return false
+}
+
+// filterAccountsByModelPermission 根据模型权限过滤账号列表
+func filterAccountsByModelPermission(accounts []model.Account, apiKey *model.ApiKey, modelName string) []model.Account {
+	// 首先检查API Key的模型限制（优先级最高），不允许此模型时直接返回空列表
+	if !apiKeyAllowsModel(apiKey, modelName) {
+		return []model.Account{}
+	}
 
 	// API Key允许此模型或没有限制，继续检查账号级别的模型限制
 	var filteredAccounts []model.Account
@@ -357,30 +636,32 @@ func filterAccountsByLimit(accounts []model.Account) []model.Account {
 }
 
 // GetCountTokens 获取token计数数据
+// 优先使用Claude官方账号，其次转发到Console账号，分组内都没有时使用本地估算
 func GetCountTokens(c *gin.Context) {
 	ctx, ok := prepareRequestContext(c)
 	if !ok {
 		return
 	}
 
-	// 查找 PlatformType 为 constant.PlatformClaude 的账号
-	var selectedAccount *model.Account
-	for _, account := range ctx.FilteredAccounts {
-		if account.PlatformType == constant.PlatformClaude {
-			selectedAccount = &account
-			break
+	var claudeAccount, consoleAccount *model.Account
+	for i := range ctx.FilteredAccounts {
+		account := &ctx.FilteredAccounts[i]
+		if account.PlatformType == constant.PlatformClaude && claudeAccount == nil {
+			claudeAccount = account
+		}
+		if account.PlatformType == constant.PlatformClaudeConsole && consoleAccount == nil {
+			consoleAccount = account
 		}
 	}
 
-	// 检查是否找到符合条件的账号
-	if selectedAccount == nil {
-		c.JSON(http.StatusBadRequest, gin.H{
-			"message": "没有可用的Claude平台账号",
-			"code":    constant.NotFound,
-		})
-		return
+	switch {
+	case claudeAccount != nil:
+		c.Set("relay_account_id", claudeAccount.ID)
+		relay.GetCountTokens(c, claudeAccount, ctx.Body)
+	case consoleAccount != nil:
+		c.Set("relay_account_id", consoleAccount.ID)
+		relay.GetConsoleCountTokens(c, consoleAccount, ctx.Body)
+	default:
+		relay.RespondEstimatedCountTokens(c, ctx.Body)
 	}
-
-	// 调用Claude平台的GetCountTokens处理器
-	relay.GetCountTokens(c, selectedAccount, ctx.Body)
 }
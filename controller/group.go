@@ -4,6 +4,7 @@ import (
 	"claude-code-relay/constant"
 	"claude-code-relay/model"
 	"claude-code-relay/service"
+	"errors"
 	"net/http"
 	"strconv"
 
@@ -29,7 +30,7 @@ func CreateGroup(c *gin.Context) {
 	if err != nil {
 		var statusCode int
 		var code int
-		if err.Error() == "组名已存在" || err.Error() == "组名不能为空" {
+		if err.Error() == "组名已存在" || err.Error() == "组名不能为空" || errors.Is(err, service.ErrInvalidRewriteRule) {
 			statusCode = http.StatusBadRequest
 			code = constant.InvalidParams
 		} else {
@@ -103,8 +104,8 @@ func UpdateGroup(c *gin.Context) {
 	if err != nil {
 		var statusCode int
 		var code int
-		switch err.Error() {
-		case "组名已存在", "组不存在", "无效的组ID":
+		switch {
+		case err.Error() == "组名已存在" || err.Error() == "组不存在" || err.Error() == "无效的组ID" || errors.Is(err, service.ErrInvalidRewriteRule):
 			statusCode = http.StatusBadRequest
 			code = constant.InvalidParams
 		default:
@@ -204,3 +205,49 @@ func GetGroups(c *gin.Context) {
 		"data":    result,
 	})
 }
+
+// PreviewGroupRewrite 预览请求改写规则的效果
+func PreviewGroupRewrite(c *gin.Context) {
+	var req model.RewritePreviewRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "请求参数错误",
+			"code":  constant.InvalidParams,
+		})
+		return
+	}
+
+	// 从认证中获取用户ID
+	user := c.MustGet("user").(*model.User)
+	userID := user.ID
+
+	body, err := service.PreviewRewriteRules(&req, userID)
+	if err != nil {
+		var statusCode int
+		var code int
+		switch {
+		case err.Error() == "组不存在" || err.Error() == "无效的组ID":
+			statusCode = http.StatusNotFound
+			code = constant.NotFound
+		case err.Error() == "请求体不是有效的JSON" || errors.Is(err, service.ErrInvalidRewriteRule):
+			statusCode = http.StatusBadRequest
+			code = constant.InvalidParams
+		default:
+			statusCode = http.StatusInternalServerError
+			code = constant.InternalServerError
+		}
+		c.JSON(statusCode, gin.H{
+			"error": err.Error(),
+			"code":  code,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "预览成功",
+		"code":    constant.Success,
+		"data": gin.H{
+			"body": body,
+		},
+	})
+}
@@ -0,0 +1,161 @@
+package controller
+
+import (
+	"claude-code-relay/constant"
+	"claude-code-relay/model"
+	"claude-code-relay/service"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GetHeaderRuleList 获取请求头规则列表
+func GetHeaderRuleList(c *gin.Context) {
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "10"))
+	direction := c.Query("direction")
+
+	headerRuleService := service.NewHeaderRuleService()
+	result, err := headerRuleService.GetHeaderRuleList(page, limit, direction)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+			"code":  constant.InternalServerError,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "获取成功",
+		"code":    constant.Success,
+		"data":    result,
+	})
+}
+
+// CreateHeaderRule 创建请求头规则
+func CreateHeaderRule(c *gin.Context) {
+	var req model.HeaderRuleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "请求参数错误",
+			"code":  constant.InvalidParams,
+		})
+		return
+	}
+
+	headerRuleService := service.NewHeaderRuleService()
+	rule, err := headerRuleService.CreateHeaderRule(&req)
+	if err != nil {
+		respondHeaderRuleError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "创建成功",
+		"code":    constant.Success,
+		"data":    rule,
+	})
+}
+
+// GetHeaderRule 获取请求头规则详情
+func GetHeaderRule(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "无效的规则ID",
+			"code":  constant.InvalidParams,
+		})
+		return
+	}
+
+	headerRuleService := service.NewHeaderRuleService()
+	rule, err := headerRuleService.GetHeaderRuleByID(uint(id))
+	if err != nil {
+		respondHeaderRuleError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "获取成功",
+		"code":    constant.Success,
+		"data":    rule,
+	})
+}
+
+// UpdateHeaderRule 更新请求头规则
+func UpdateHeaderRule(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "无效的规则ID",
+			"code":  constant.InvalidParams,
+		})
+		return
+	}
+
+	var req model.HeaderRuleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "请求参数错误",
+			"code":  constant.InvalidParams,
+		})
+		return
+	}
+
+	headerRuleService := service.NewHeaderRuleService()
+	rule, err := headerRuleService.UpdateHeaderRule(uint(id), &req)
+	if err != nil {
+		respondHeaderRuleError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "更新成功",
+		"code":    constant.Success,
+		"data":    rule,
+	})
+}
+
+// DeleteHeaderRule 删除请求头规则
+func DeleteHeaderRule(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "无效的规则ID",
+			"code":  constant.InvalidParams,
+		})
+		return
+	}
+
+	headerRuleService := service.NewHeaderRuleService()
+	if err := headerRuleService.DeleteHeaderRule(uint(id)); err != nil {
+		respondHeaderRuleError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "删除成功",
+		"code":    constant.Success,
+	})
+}
+
+func respondHeaderRuleError(c *gin.Context, err error) {
+	var statusCode int
+	var code int
+	switch err.Error() {
+	case "请求头规则不存在":
+		statusCode = http.StatusNotFound
+		code = constant.NotFound
+	case "无效的请求头名称", "注入请求头不支持通配符", "无效的请求头值", "不允许注入该请求头":
+		statusCode = http.StatusBadRequest
+		code = constant.InvalidParams
+	default:
+		statusCode = http.StatusInternalServerError
+		code = constant.InternalServerError
+	}
+	c.JSON(statusCode, gin.H{
+		"error": err.Error(),
+		"code":  code,
+	})
+}
@@ -14,17 +14,24 @@ import (
 
 // LogQueryRequest 日志查询请求参数
 type LogQueryRequest struct {
-	Page      int      `form:"page"`       // 页码，默认为1
-	Limit     int      `form:"limit"`      // 每页数量，默认为10，最大100
-	UserID    uint     `form:"user_id"`    // 用户ID筛选
-	AccountID uint     `form:"account_id"` // 账号ID筛选
-	ApiKeyID  uint     `form:"api_key_id"` // API Key ID筛选
-	ModelName string   `form:"model_name"` // 模型名称筛选
-	IsStream  *bool    `form:"is_stream"`  // 是否流式请求筛选
-	StartTime string   `form:"start_time"` // 开始时间 格式: 2024-01-01 15:04:05
-	EndTime   string   `form:"end_time"`   // 结束时间 格式: 2024-01-01 15:04:05
-	MinCost   *float64 `form:"min_cost"`   // 最小费用筛选
-	MaxCost   *float64 `form:"max_cost"`   // 最大费用筛选
+	Page        int      `form:"page"`        // 页码，默认为1
+	Limit       int      `form:"limit"`       // 每页数量，默认为10，最大100
+	UserID      uint     `form:"user_id"`     // 用户ID筛选
+	AccountID   uint     `form:"account_id"`  // 账号ID筛选
+	ApiKeyID    uint     `form:"api_key_id"`  // API Key ID筛选
+	ModelName   string   `form:"model_name"`  // 模型名称筛选
+	IsStream    *bool    `form:"is_stream"`   // 是否流式请求筛选
+	Interrupted *bool    `form:"interrupted"` // 是否中断请求筛选
+	Estimated   *bool    `form:"estimated"`   // 是否估算用量筛选
+	CacheHit    *bool    `form:"cache_hit"`   // 是否命中响应缓存筛选
+	Outcome     string   `form:"outcome"`     // 请求结果筛选(success/failed/rejected)
+	ErrorType   string   `form:"error_type"`  // 错误类型筛选
+	StatusCode  int      `form:"status_code"` // 状态码筛选
+	RequestID   string   `form:"request_id"`  // 请求ID筛选
+	StartTime   string   `form:"start_time"`  // 开始时间 格式: 2024-01-01 15:04:05
+	EndTime     string   `form:"end_time"`    // 结束时间 格式: 2024-01-01 15:04:05
+	MinCost     *float64 `form:"min_cost"`    // 最小费用筛选
+	MaxCost     *float64 `form:"max_cost"`    // 最大费用筛选
 }
 
 // GetLogs 获取日志列表（支持多种筛选条件）
@@ -79,8 +86,16 @@ func GetLogById(c *gin.Context) {
 		return
 	}
 
+	user := c.MustGet("user").(*model.User)
+	var userID *uint
+
+	// 如果是普通用户，只能查看自己的日志
+	if user.Role != "admin" {
+		userID = &user.ID
+	}
+
 	logService := service.NewLogService()
-	log, err := logService.GetLogById(id)
+	log, err := logService.GetLogById(id, userID)
 	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{
 			"error": "日志不存在",
@@ -414,6 +429,28 @@ func buildLogFilters(req *LogQueryRequest) *model.LogFilters {
 		filters.IsStream = req.IsStream
 	}
 
+	if req.Interrupted != nil {
+		filters.Interrupted = req.Interrupted
+	}
+	if req.Estimated != nil {
+		filters.Estimated = req.Estimated
+	}
+	if req.CacheHit != nil {
+		filters.CacheHit = req.CacheHit
+	}
+	if req.Outcome != "" {
+		filters.Outcome = &req.Outcome
+	}
+	if req.ErrorType != "" {
+		filters.ErrorType = &req.ErrorType
+	}
+	if req.StatusCode > 0 {
+		filters.StatusCode = &req.StatusCode
+	}
+	if req.RequestID != "" {
+		filters.RequestID = &req.RequestID
+	}
+
 	// 解析时间范围
 	if req.StartTime != "" {
 		if startTime, err := time.Parse("2006-01-02 15:04:05", req.StartTime); err == nil {
@@ -0,0 +1,376 @@
+package controller
+
+import (
+	"claude-code-relay/constant"
+	"claude-code-relay/model"
+	"claude-code-relay/service"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GetProxyList 获取代理列表
+func GetProxyList(c *gin.Context) {
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "10"))
+	proxyGroupID, _ := strconv.ParseUint(c.DefaultQuery("proxy_group_id", "0"), 10, 32)
+
+	user := c.MustGet("user").(*model.User)
+	var userID *uint
+
+	// 如果是普通用户，只能查看自己的代理
+	if user.Role != "admin" {
+		userID = &user.ID
+	}
+
+	proxyService := service.NewProxyService()
+	result, err := proxyService.GetProxyList(page, limit, userID, uint(proxyGroupID))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+			"code":  constant.InternalServerError,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "获取成功",
+		"code":    constant.Success,
+		"data":    result,
+	})
+}
+
+// CreateProxy 创建代理
+func CreateProxy(c *gin.Context) {
+	var req model.CreateProxyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "请求参数错误",
+			"code":  constant.InvalidParams,
+		})
+		return
+	}
+
+	user := c.MustGet("user").(*model.User)
+
+	proxyService := service.NewProxyService()
+	proxy, err := proxyService.CreateProxy(&req, user.ID)
+	if err != nil {
+		var statusCode int
+		var code int
+		if err.Error() == "代理分组不存在" {
+			statusCode = http.StatusBadRequest
+			code = constant.InvalidParams
+		} else {
+			statusCode = http.StatusInternalServerError
+			code = constant.InternalServerError
+		}
+		c.JSON(statusCode, gin.H{
+			"error": err.Error(),
+			"code":  code,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "创建成功",
+		"code":    constant.Success,
+		"data":    proxy,
+	})
+}
+
+// GetProxy 获取代理详情
+func GetProxy(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "无效的代理ID",
+			"code":  constant.InvalidParams,
+		})
+		return
+	}
+
+	user := c.MustGet("user").(*model.User)
+	var userID *uint
+
+	// 如果是普通用户，只能查看自己的代理
+	if user.Role != "admin" {
+		userID = &user.ID
+	}
+
+	proxyService := service.NewProxyService()
+	proxy, err := proxyService.GetProxyByID(uint(id), userID)
+	if err != nil {
+		respondProxyError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "获取成功",
+		"code":    constant.Success,
+		"data":    proxy,
+	})
+}
+
+// UpdateProxy 更新代理
+func UpdateProxy(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "无效的代理ID",
+			"code":  constant.InvalidParams,
+		})
+		return
+	}
+
+	var req model.UpdateProxyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "请求参数错误",
+			"code":  constant.InvalidParams,
+		})
+		return
+	}
+
+	user := c.MustGet("user").(*model.User)
+	var userID *uint
+
+	// 如果是普通用户，只能更新自己的代理
+	if user.Role != "admin" {
+		userID = &user.ID
+	}
+
+	proxyService := service.NewProxyService()
+	proxy, err := proxyService.UpdateProxy(uint(id), &req, userID)
+	if err != nil {
+		respondProxyError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "更新成功",
+		"code":    constant.Success,
+		"data":    proxy,
+	})
+}
+
+// DeleteProxy 删除代理
+func DeleteProxy(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "无效的代理ID",
+			"code":  constant.InvalidParams,
+		})
+		return
+	}
+
+	user := c.MustGet("user").(*model.User)
+	var userID *uint
+
+	// 如果是普通用户，只能删除自己的代理
+	if user.Role != "admin" {
+		userID = &user.ID
+	}
+
+	proxyService := service.NewProxyService()
+	if err := proxyService.DeleteProxy(uint(id), userID); err != nil {
+		respondProxyError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "删除成功",
+		"code":    constant.Success,
+	})
+}
+
+// CheckProxy 手动检测代理连通性
+func CheckProxy(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "无效的代理ID",
+			"code":  constant.InvalidParams,
+		})
+		return
+	}
+
+	user := c.MustGet("user").(*model.User)
+	var userID *uint
+
+	// 如果是普通用户，只能检测自己的代理
+	if user.Role != "admin" {
+		userID = &user.ID
+	}
+
+	proxyService := service.NewProxyService()
+	proxy, err := proxyService.GetProxyByID(uint(id), userID)
+	if err != nil {
+		respondProxyError(c, err)
+		return
+	}
+
+	proxyService.CheckProxy(proxy)
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "检测完成",
+		"code":    constant.Success,
+		"data":    proxy,
+	})
+}
+
+// GetProxyGroups 获取代理分组列表
+func GetProxyGroups(c *gin.Context) {
+	user := c.MustGet("user").(*model.User)
+	var userID *uint
+
+	// 如果是普通用户，只能查看自己的代理分组
+	if user.Role != "admin" {
+		userID = &user.ID
+	}
+
+	proxyService := service.NewProxyService()
+	groups, err := proxyService.GetProxyGroups(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+			"code":  constant.InternalServerError,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "获取成功",
+		"code":    constant.Success,
+		"data":    groups,
+	})
+}
+
+// CreateProxyGroup 创建代理分组
+func CreateProxyGroup(c *gin.Context) {
+	var req model.ProxyGroupRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "请求参数错误",
+			"code":  constant.InvalidParams,
+		})
+		return
+	}
+
+	user := c.MustGet("user").(*model.User)
+
+	proxyService := service.NewProxyService()
+	group, err := proxyService.CreateProxyGroup(&req, user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+			"code":  constant.InternalServerError,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "创建成功",
+		"code":    constant.Success,
+		"data":    group,
+	})
+}
+
+// UpdateProxyGroup 更新代理分组
+func UpdateProxyGroup(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "无效的代理分组ID",
+			"code":  constant.InvalidParams,
+		})
+		return
+	}
+
+	var req model.ProxyGroupRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "请求参数错误",
+			"code":  constant.InvalidParams,
+		})
+		return
+	}
+
+	user := c.MustGet("user").(*model.User)
+	var userID *uint
+
+	// 如果是普通用户，只能更新自己的代理分组
+	if user.Role != "admin" {
+		userID = &user.ID
+	}
+
+	proxyService := service.NewProxyService()
+	group, err := proxyService.UpdateProxyGroup(uint(id), &req, userID)
+	if err != nil {
+		respondProxyError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "更新成功",
+		"code":    constant.Success,
+		"data":    group,
+	})
+}
+
+// DeleteProxyGroup 删除代理分组
+func DeleteProxyGroup(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "无效的代理分组ID",
+			"code":  constant.InvalidParams,
+		})
+		return
+	}
+
+	user := c.MustGet("user").(*model.User)
+	var userID *uint
+
+	// 如果是普通用户，只能删除自己的代理分组
+	if user.Role != "admin" {
+		userID = &user.ID
+	}
+
+	proxyService := service.NewProxyService()
+	if err := proxyService.DeleteProxyGroup(uint(id), userID); err != nil {
+		respondProxyError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "删除成功",
+		"code":    constant.Success,
+	})
+}
+
+// respondProxyError 根据代理服务返回的错误输出对应的状态码
+func respondProxyError(c *gin.Context, err error) {
+	var statusCode int
+	var code int
+	switch err.Error() {
+	case "代理不存在":
+		statusCode = http.StatusNotFound
+		code = constant.NotFound
+	case "代理分组不存在":
+		statusCode = http.StatusNotFound
+		code = constant.NotFound
+	case "代理正在被账号使用，无法删除", "代理分组正在被账号使用，无法删除", "代理分组中还有代理，无法删除":
+		statusCode = http.StatusBadRequest
+		code = constant.InvalidParams
+	default:
+		statusCode = http.StatusInternalServerError
+		code = constant.InternalServerError
+	}
+	c.JSON(statusCode, gin.H{
+		"error": err.Error(),
+		"code":  code,
+	})
+}
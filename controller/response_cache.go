@@ -0,0 +1,64 @@
+package controller
+
+import (
+	"claude-code-relay/model"
+	"claude-code-relay/relay"
+	"claude-code-relay/service"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tidwall/gjson"
+)
+
+// serveCachedResponse API Key开启响应缓存且命中时直接回放缓存的响应，不请求上游
+// 返回请求的缓存键（未开启响应缓存时为空）和是否已命中
+func serveCachedResponse(c *gin.Context, body []byte) (string, bool) {
+	apiKey, _ := c.Get("api_key")
+	keyInfo := apiKey.(*model.ApiKey)
+
+	// 模型限制可能在缓存写入后被修改，不允许的模型交由后续流程返回错误
+	modelName := gjson.GetBytes(body, "model").String()
+	if modelName == "" || !apiKeyAllowsModel(keyInfo, modelName) {
+		return "", false
+	}
+
+	cacheService := service.NewResponseCacheService()
+	cacheKey := cacheService.CacheKey(keyInfo, body)
+	cached := cacheService.Get(cacheKey)
+	if cached == nil {
+		return cacheKey, false
+	}
+
+	startTime := time.Now()
+	relay.ReplayCachedResponse(c, cached)
+	duration := time.Since(startTime).Milliseconds()
+	log.Printf("[%s] API Key %d 命中响应缓存", c.GetString("request_id"), keyInfo.ID)
+
+	go service.UpdateApiKeyStatus(keyInfo, http.StatusOK, nil)
+	go cacheService.LogCacheHit(keyInfo, cached, duration, service.NewRequestLogInfo(c))
+	return cacheKey, true
+}
+
+// relayWithResponseCache 转发请求，缓存键不为空时将完整的成功响应写入缓存
+func relayWithResponseCache(c *gin.Context, ctx *RequestContext, cacheKey string) {
+	if cacheKey == "" {
+		relayWithFailover(c, ctx)
+		return
+	}
+
+	originalWriter := c.Writer
+	recorder := relay.NewResponseRecorder(originalWriter, service.GetResponseCacheMaxEntrySize())
+	c.Writer = recorder
+	relayWithFailover(c, ctx)
+	c.Writer = originalWriter
+
+	// 客户端中途断开时响应可能不完整，不缓存
+	if recorder.Status() != http.StatusOK || c.Request.Context().Err() != nil {
+		return
+	}
+	if body := recorder.Body(); body != nil {
+		go service.NewResponseCacheService().Store(cacheKey, ctx.APIKey.ResponseCacheTTL, ctx.ModelName, body)
+	}
+}
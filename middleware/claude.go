@@ -1,6 +1,7 @@
 package middleware
 
 import (
+	"claude-code-relay/common"
 	"claude-code-relay/model"
 	"net/http"
 	"strings"
@@ -44,8 +45,16 @@ func ClaudeCodeAuth() gin.HandlerFunc {
 			return
 		}
 
+		// API Key已经在model层验证了状态和过期时间
+		// 将API Key信息存储到上下文中供后续使用，被拒绝的请求日志也需要关联API Key
+		c.Set("api_key_id", keyInfo.ID)
+		c.Set("api_key", keyInfo)
+		c.Set("user_id", keyInfo.UserID)
+		c.Set("group_id", keyInfo.GroupID)
+
 		// 判断是否达到每日限额
 		if keyInfo.DailyLimit > 0 && keyInfo.TodayTotalCost >= keyInfo.DailyLimit {
+			c.Set("error_type", common.ErrorTypeQuotaExceeded)
 			c.JSON(http.StatusTooManyRequests, gin.H{
 				"error": "API Key已达到每日使用限额",
 				"code":  40004,
@@ -56,6 +65,7 @@ func ClaudeCodeAuth() gin.HandlerFunc {
 
 		// 判断是否达到总限额
 		if keyInfo.TotalLimit > 0 && keyInfo.TotalCost >= keyInfo.TotalLimit {
+			c.Set("error_type", common.ErrorTypeQuotaExceeded)
 			c.JSON(http.StatusTooManyRequests, gin.H{
 				"error": "API Key已达到总使用限额",
 				"code":  40006,
@@ -77,13 +87,6 @@ func ClaudeCodeAuth() gin.HandlerFunc {
 			}
 		}
 
-		// API Key已经在model层验证了状态和过期时间
-		// 将API Key信息存储到上下文中供后续使用
-		c.Set("api_key_id", keyInfo.ID)
-		c.Set("api_key", keyInfo)
-		c.Set("user_id", keyInfo.UserID)
-		c.Set("group_id", keyInfo.GroupID)
-
 		c.Next()
 	}
 }
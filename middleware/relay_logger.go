@@ -0,0 +1,81 @@
+package middleware
+
+import (
+	"claude-code-relay/common"
+	"claude-code-relay/relay"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	authFailureReportInterval = time.Minute // 未识别API Key的鉴权失败汇总输出的间隔
+	maxAuthFailureClients     = 1000        // 每个汇总周期最多单独统计的客户端IP数，超出部分合并统计
+)
+
+var (
+	authFailureMutex    sync.Mutex
+	authFailureCounts   = make(map[string]int64) // 按客户端IP统计的鉴权失败次数
+	authFailureReporter sync.Once
+)
+
+// RelayErrorLogger 记录中转接口最终失败或被拒绝的请求
+// 需要在鉴权中间件之前注册，以便记录超出限额等已识别API Key的被拒绝请求
+// 缺少或无效API Key的请求不写入日志表，避免匿名请求无限增长日志，只按客户端IP汇总输出到系统日志
+// 故障转移过程中切换账号前的失败尝试由转发流程单独记录
+func RelayErrorLogger() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		recorder := relay.NewErrorRecorder(c.Writer)
+		c.Writer = recorder
+
+		c.Next()
+
+		c.Writer = recorder.ResponseWriter
+		if recorder.Status() < http.StatusBadRequest {
+			return
+		}
+
+		if _, exists := c.Get("api_key"); !exists {
+			recordAuthFailure(c.ClientIP())
+			return
+		}
+
+		// 请求转发到上游账号后失败时记录该账号，未转发时记录为被拒绝
+		relay.SaveErrorLog(c, c.GetUint("relay_account_id"), recorder.Status(), recorder.Body(), time.Since(start).Milliseconds(), relay.SnapshotBodyCapture(c))
+	}
+}
+
+// recordAuthFailure 累计未识别API Key的鉴权失败次数，首次调用时启动定时汇总输出
+func recordAuthFailure(clientIP string) {
+	authFailureReporter.Do(func() {
+		go reportAuthFailures()
+	})
+
+	authFailureMutex.Lock()
+	if _, exists := authFailureCounts[clientIP]; !exists && len(authFailureCounts) >= maxAuthFailureClients {
+		clientIP = "其他"
+	}
+	authFailureCounts[clientIP]++
+	authFailureMutex.Unlock()
+}
+
+// reportAuthFailures 定时输出并清空鉴权失败统计
+func reportAuthFailures() {
+	ticker := time.NewTicker(authFailureReportInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		authFailureMutex.Lock()
+		counts := authFailureCounts
+		authFailureCounts = make(map[string]int64)
+		authFailureMutex.Unlock()
+
+		for clientIP, count := range counts {
+			common.SysLog(fmt.Sprintf("最近%s内客户端 %s 鉴权失败 %d 次", authFailureReportInterval, clientIP, count))
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package model
 
 import (
+	"claude-code-relay/common"
 	"time"
 
 	"gorm.io/gorm"
@@ -11,10 +12,14 @@ type Account struct {
 	Name                          string         `json:"name" gorm:"type:varchar(100);not null;comment:账号名称"`
 	PlatformType                  string         `json:"platform_type" gorm:"type:varchar(50);not null;comment:平台类型(claude/claude_console)"`
 	RequestURL                    string         `json:"request_url" gorm:"type:varchar(500);comment:请求地址"`
+	UpstreamFormat                string         `json:"upstream_format" gorm:"type:varchar(30);default:'';comment:上游接口格式(chat_completions/responses),仅OpenAI账号使用,空值为chat_completions"`
 	SecretKey                     string         `json:"secret_key" gorm:"type:text;comment:请求秘钥"`
 	AccessToken                   string         `json:"access_token" gorm:"type:text;comment:claude的官方token"`
 	RefreshToken                  string         `json:"refresh_token" gorm:"type:text;comment:claude的官方刷新token"`
 	ExpiresAt                     int            `json:"expires_at" gorm:"default:0;comment:token过期时间戳"`
+	TokenRefreshedAt              *Time          `json:"token_refreshed_at" gorm:"comment:最近一次刷新token时间;type:datetime"`
+	TokenRefreshError             string         `json:"token_refresh_error" gorm:"type:text;comment:最近一次刷新token失败原因,成功时清空"`
+	TokenRefreshFailures          int            `json:"token_refresh_failures" gorm:"default:0;comment:连续刷新token失败次数"`
 	IsMax                         bool           `json:"is_max" gorm:"default:false;comment:是否是max账号"`
 	GroupID                       int            `json:"group_id" gorm:"default:0;comment:分组ID"`
 	Priority                      int            `json:"priority" gorm:"default:100;comment:优先级(数字越小越高)"`
@@ -30,6 +35,18 @@ type Account struct {
 	TotalCost                     float64        `json:"total_cost" gorm:"default:0;comment:累计总费用(USD)"`
 	EnableProxy                   bool           `json:"enable_proxy" gorm:"default:false;comment:是否启用代理"`
 	ProxyURI                      string         `json:"proxy_uri" gorm:"type:varchar(500);comment:代理URI字符串"`
+	ProxyID                       uint           `json:"proxy_id" gorm:"default:0;index;comment:关联代理ID(优先于代理URI)"`
+	ProxyGroupID                  uint           `json:"proxy_group_id" gorm:"default:0;index;comment:关联代理分组ID(优先于代理URI)"`
+	MaxConcurrency                int            `json:"max_concurrency" gorm:"default:0;comment:最大并发请求数,0表示不限制"`
+	ConnectTimeout                int            `json:"connect_timeout" gorm:"default:0;comment:连接超时(秒),0表示使用全局配置"`
+	FirstByteTimeout              int            `json:"first_byte_timeout" gorm:"default:0;comment:首字节超时(秒),0表示使用全局配置"`
+	StreamIdleTimeout             int            `json:"stream_idle_timeout" gorm:"default:0;comment:流式响应空闲超时(秒),0表示使用全局配置"`
+	MaxDuration                   int            `json:"max_duration" gorm:"default:0;comment:请求最长持续时间(秒),0表示使用全局配置"`
+	TLSCACert                     string         `json:"tls_ca_cert" gorm:"type:text;comment:自定义CA证书(PEM)"`
+	TLSClientCert                 string         `json:"tls_client_cert" gorm:"type:text;comment:mTLS客户端证书(PEM)"`
+	TLSClientKey                  string         `json:"-" gorm:"type:text;comment:mTLS客户端私钥(PEM)"`
+	TLSServerName                 string         `json:"tls_server_name" gorm:"type:varchar(255);comment:SNI主机名覆盖"`
+	TLSInsecureSkipVerify         bool           `json:"tls_insecure_skip_verify" gorm:"default:false;comment:是否跳过TLS证书校验"`
 	ModelMapping                  string         `json:"model_mapping" gorm:"type:text;comment:模型映射配置(格式:claude-model:openai-model,多个用逗号分隔)"`
 	ModelRestriction              string         `json:"model_restriction" gorm:"type:text;comment:模型限制(允许使用的模型列表,逗号分隔,空值表示无限制)"`
 	LastUsedTime                  *Time          `json:"last_used_time" gorm:"comment:最后使用时间;type:datetime"`
@@ -48,6 +65,11 @@ type Account struct {
 	// 最近一周统计数据（不存储到数据库，运行时计算）
 	WeeklyCost  float64 `json:"weekly_cost" gorm:"-"`  // 最近一周使用费用
 	WeeklyCount int64   `json:"weekly_count" gorm:"-"` // 最近一周使用次数
+
+	// 熔断器状态（closed/open/half_open），不存储在数据库中
+	CircuitState string `json:"circuit_state" gorm:"-"`
+	// 当前并发请求数，不存储在数据库中
+	CurrentConcurrency int64 `json:"current_concurrency" gorm:"-"`
 }
 
 // 账号列表请求参数
@@ -67,47 +89,73 @@ type AccountListResponse struct {
 
 // 账号创建请求参数
 type CreateAccountRequest struct {
-	Name             string  `json:"name" binding:"required,min=1,max=100"`
-	PlatformType     string  `json:"platform_type" binding:"required,oneof=claude claude_console gemini openai"`
-	RequestURL       string  `json:"request_url"`
-	SecretKey        string  `json:"secret_key"`
-	GroupID          int     `json:"group_id"`
-	Priority         int     `json:"priority"`
-	Weight           int     `json:"weight" binding:"min=1"`
-	DailyLimit       float64 `json:"daily_limit" binding:"min=0"`
-	TotalLimit       float64 `json:"total_limit" binding:"min=0"`
-	EnableProxy      bool    `json:"enable_proxy"`
-	ProxyURI         string  `json:"proxy_uri"`
-	ModelMapping     string  `json:"model_mapping"`
-	ModelRestriction string  `json:"model_restriction"`
-	ActiveStatus     int     `json:"active_status" binding:"oneof=1 2"`
-	IsMax            bool    `json:"is_max"` // 是否是max账号
-	AccessToken      string  `json:"access_token"`
-	RefreshToken     string  `json:"refresh_token"`
-	ExpiresAt        int     `json:"expires_at" binding:"min=0"`
-	TodayUsageCount  int     `json:"today_usage_count"` // 今日使用次数
+	Name                  string  `json:"name" binding:"required,min=1,max=100"`
+	PlatformType          string  `json:"platform_type" binding:"required,oneof=claude claude_console gemini openai"`
+	RequestURL            string  `json:"request_url"`
+	UpstreamFormat        string  `json:"upstream_format" binding:"omitempty,oneof=chat_completions responses"` // OpenAI账号的上游接口格式
+	SecretKey             string  `json:"secret_key"`
+	GroupID               int     `json:"group_id"`
+	Priority              int     `json:"priority"`
+	Weight                int     `json:"weight" binding:"min=1"`
+	DailyLimit            float64 `json:"daily_limit" binding:"min=0"`
+	TotalLimit            float64 `json:"total_limit" binding:"min=0"`
+	EnableProxy           bool    `json:"enable_proxy"`
+	ProxyURI              string  `json:"proxy_uri"`
+	ProxyID               uint    `json:"proxy_id"`                            // 关联代理ID
+	ProxyGroupID          uint    `json:"proxy_group_id"`                      // 关联代理分组ID
+	MaxConcurrency        int     `json:"max_concurrency" binding:"min=0"`     // 最大并发请求数，0表示不限制
+	ConnectTimeout        int     `json:"connect_timeout" binding:"min=0"`     // 连接超时(秒)，0表示使用全局配置
+	FirstByteTimeout      int     `json:"first_byte_timeout" binding:"min=0"`  // 首字节超时(秒)，0表示使用全局配置
+	StreamIdleTimeout     int     `json:"stream_idle_timeout" binding:"min=0"` // 流式响应空闲超时(秒)，0表示使用全局配置
+	MaxDuration           int     `json:"max_duration" binding:"min=0"`        // 请求最长持续时间(秒)，0表示使用全局配置
+	ModelMapping          string  `json:"model_mapping"`
+	ModelRestriction      string  `json:"model_restriction"`
+	ActiveStatus          int     `json:"active_status" binding:"oneof=1 2"`
+	IsMax                 bool    `json:"is_max"` // 是否是max账号
+	AccessToken           string  `json:"access_token"`
+	RefreshToken          string  `json:"refresh_token"`
+	ExpiresAt             int     `json:"expires_at" binding:"min=0"`
+	TLSCACert             string  `json:"tls_ca_cert"`              // 自定义CA证书(PEM)
+	TLSClientCert         string  `json:"tls_client_cert"`          // mTLS客户端证书(PEM)
+	TLSClientKey          string  `json:"tls_client_key"`           // mTLS客户端私钥(PEM)
+	TLSServerName         string  `json:"tls_server_name"`          // SNI主机名覆盖
+	TLSInsecureSkipVerify bool    `json:"tls_insecure_skip_verify"` // 显式跳过证书校验
+	TodayUsageCount       int     `json:"today_usage_count"`        // 今日使用次数
 }
 
 // 账号更新请求参数
 type UpdateAccountRequest struct {
-	Name             string  `json:"name" binding:"required,min=1,max=100"`
-	PlatformType     string  `json:"platform_type" binding:"required,oneof=claude claude_console openai gemini"`
-	RequestURL       string  `json:"request_url"`
-	SecretKey        string  `json:"secret_key"`
-	GroupID          *int    `json:"group_id" binding:"omitempty,min=0"`
-	Priority         int     `json:"priority" binding:"min=1"`
-	Weight           int     `json:"weight" binding:"min=1"`
-	DailyLimit       float64 `json:"daily_limit" binding:"min=0"`
-	TotalLimit       float64 `json:"total_limit" binding:"min=0"`
-	EnableProxy      bool    `json:"enable_proxy"`
-	ProxyURI         string  `json:"proxy_uri"`
-	ModelMapping     string  `json:"model_mapping"`
-	ModelRestriction string  `json:"model_restriction"`
-	ActiveStatus     int     `json:"active_status" binding:"oneof=1 2"`
-	IsMax            bool    `json:"is_max"` // 是否是max账号
-	AccessToken      string  `json:"access_token"`
-	RefreshToken     string  `json:"refresh_token"`
-	TodayUsageCount  int     `json:"today_usage_count"` // 今日使用次数
+	Name                  string  `json:"name" binding:"required,min=1,max=100"`
+	PlatformType          string  `json:"platform_type" binding:"required,oneof=claude claude_console openai gemini"`
+	RequestURL            string  `json:"request_url"`
+	UpstreamFormat        string  `json:"upstream_format" binding:"omitempty,oneof=chat_completions responses"` // OpenAI账号的上游接口格式
+	SecretKey             string  `json:"secret_key"`
+	GroupID               *int    `json:"group_id" binding:"omitempty,min=0"`
+	Priority              int     `json:"priority" binding:"min=1"`
+	Weight                int     `json:"weight" binding:"min=1"`
+	DailyLimit            float64 `json:"daily_limit" binding:"min=0"`
+	TotalLimit            float64 `json:"total_limit" binding:"min=0"`
+	EnableProxy           bool    `json:"enable_proxy"`
+	ProxyURI              string  `json:"proxy_uri"`
+	ProxyID               uint    `json:"proxy_id"`                            // 关联代理ID
+	ProxyGroupID          uint    `json:"proxy_group_id"`                      // 关联代理分组ID
+	MaxConcurrency        int     `json:"max_concurrency" binding:"min=0"`     // 最大并发请求数，0表示不限制
+	ConnectTimeout        int     `json:"connect_timeout" binding:"min=0"`     // 连接超时(秒)，0表示使用全局配置
+	FirstByteTimeout      int     `json:"first_byte_timeout" binding:"min=0"`  // 首字节超时(秒)，0表示使用全局配置
+	StreamIdleTimeout     int     `json:"stream_idle_timeout" binding:"min=0"` // 流式响应空闲超时(秒)，0表示使用全局配置
+	MaxDuration           int     `json:"max_duration" binding:"min=0"`        // 请求最长持续时间(秒)，0表示使用全局配置
+	ModelMapping          string  `json:"model_mapping"`
+	ModelRestriction      string  `json:"model_restriction"`
+	ActiveStatus          int     `json:"active_status" binding:"oneof=1 2"`
+	IsMax                 bool    `json:"is_max"` // 是否是max账号
+	AccessToken           string  `json:"access_token"`
+	RefreshToken          string  `json:"refresh_token"`
+	TodayUsageCount       int     `json:"today_usage_count"`        // 今日使用次数
+	TLSCACert             string  `json:"tls_ca_cert"`              // 自定义CA证书(PEM)
+	TLSClientCert         string  `json:"tls_client_cert"`          // mTLS客户端证书(PEM)，为空表示不使用客户端证书
+	TLSClientKey          string  `json:"tls_client_key"`           // mTLS客户端私钥(PEM)，为空表示保持原私钥
+	TLSServerName         string  `json:"tls_server_name"`          // SNI主机名覆盖
+	TLSInsecureSkipVerify bool    `json:"tls_insecure_skip_verify"` // 显式跳过证书校验
 }
 
 // 账号激活状态更新请求参数
@@ -124,6 +172,17 @@ func (a *Account) TableName() string {
 	return "accounts"
 }
 
+// TLSOptions 获取账号的上游TLS配置
+func (a *Account) TLSOptions() *common.TLSOptions {
+	return &common.TLSOptions{
+		CACert:             a.TLSCACert,
+		ClientCert:         a.TLSClientCert,
+		ClientKey:          a.TLSClientKey,
+		ServerName:         a.TLSServerName,
+		InsecureSkipVerify: a.TLSInsecureSkipVerify,
+	}
+}
+
 // 创建账号
 func CreateAccount(account *Account) error {
 	account.ID = 0
@@ -149,9 +208,46 @@ func GetAccountByID(id uint) (*Account, error) {
 	return &account, nil
 }
 
-// 更新账号
+// accountTokenColumns OAuth token相关字段
+// 请求处理过程中持有的账号可能是刷新前读取的旧数据，整体保存时跳过这些字段，避免覆盖其他请求或实例刚刷新的token
+var accountTokenColumns = []string{"access_token", "refresh_token", "expires_at", "token_refreshed_at", "token_refresh_error", "token_refresh_failures"}
+
+// 更新账号（不包含OAuth token相关字段，token通过UpdateAccountToken更新）
 func UpdateAccount(account *Account) error {
-	return DB.Save(account).Error
+	return DB.Omit(accountTokenColumns...).Save(account).Error
+}
+
+// UpdateAccountToken 更新账号的OAuth token，并清除刷新失败记录
+func UpdateAccountToken(id uint, accessToken, refreshToken string, expiresAt int) error {
+	now := Time(time.Now())
+	return DB.Model(&Account{}).Where("id = ?", id).Updates(map[string]interface{}{
+		"access_token":           accessToken,
+		"refresh_token":          refreshToken,
+		"expires_at":             expiresAt,
+		"token_refreshed_at":     &now,
+		"token_refresh_error":    "",
+		"token_refresh_failures": 0,
+	}).Error
+}
+
+// RecordAccountTokenRefreshFailure 记录账号刷新token失败
+func RecordAccountTokenRefreshFailure(id uint, reason string) error {
+	return DB.Model(&Account{}).Where("id = ?", id).Updates(map[string]interface{}{
+		"token_refresh_error":    reason,
+		"token_refresh_failures": gorm.Expr("token_refresh_failures + 1"),
+	}).Error
+}
+
+// GetAccountsNeedingTokenRefresh 获取token将在指定时间前过期、需要提前刷新的Claude OAuth账号
+func GetAccountsNeedingTokenRefresh(before time.Time) ([]Account, error) {
+	var accounts []Account
+	err := DB.Where("platform_type = ? AND active_status = 1 AND refresh_token <> '' AND expires_at > 0 AND expires_at < ?",
+		"claude", before.Unix()).
+		Find(&accounts).Error
+	if err != nil {
+		return nil, err
+	}
+	return accounts, nil
 }
 
 // 删除账号（软删除）
@@ -241,7 +337,7 @@ func GetAccountsByUserID(userID uint) ([]Account, error) {
 	return accounts, nil
 }
 
-// 根据分组ID获取可用账号列表（按优先级和使用次数排序）
+// 根据分组ID获取可用账号列表（按优先级排序，层内选择由调度器按权重完成）
 func GetAvailableAccountsByGroupID(groupID int) ([]Account, error) {
 	var accounts []Account
 	err := DB.Where(`group_id = ? AND active_status = 1
@@ -249,7 +345,7 @@ func GetAvailableAccountsByGroupID(groupID int) ([]Account, error) {
 		AND (daily_limit = 0 OR today_total_cost < daily_limit)
 		AND (total_limit = 0 OR total_cost < total_limit)`,
 		groupID, time.Now()).
-		Order("priority ASC, today_usage_count ASC").
+		Order("priority ASC").
 		Find(&accounts).Error
 	if err != nil {
 		return nil, err
@@ -257,14 +353,11 @@ func GetAvailableAccountsByGroupID(groupID int) ([]Account, error) {
 	return accounts, nil
 }
 
-// 获取指定用户、分组和优先级下可用账号的最大今日请求次数
-func GetMaxTodayUsageCountFromAvailableAccounts(userID uint, groupID int, priority int) (int, error) {
-	var maxUsageCount int
-	err := DB.Model(&Account{}).
-		Where("user_id = ? AND group_id = ? AND priority = ? AND active_status = 1 AND current_status IN (1, 2)", userID, groupID, priority).
-		Select("COALESCE(MAX(today_usage_count), 0)").
-		Scan(&maxUsageCount).Error
-	return maxUsageCount, err
+// HasRateLimitedAccounts 分组内是否存在限流中的启用账号
+func HasRateLimitedAccounts(groupID int) bool {
+	var count int64
+	DB.Model(&Account{}).Where("group_id = ? AND active_status = 1 AND current_status = 3", groupID).Count(&count)
+	return count > 0
 }
 
 // setWeeklyStatsForAccounts 为账号列表设置最近一周的统计数据
@@ -300,7 +393,7 @@ func setWeeklyStatsForAccounts(accounts []Account) error {
 	var weeklyStats []WeeklyStats
 	err := DB.Table("logs").
 		Select("account_id, SUM(total_cost) as total_cost, COUNT(*) as total_count").
-		Where("account_id IN ? AND created_at >= ? AND created_at <= ?", accountIDs, weekStart, now).
+		Where("account_id IN ? AND created_at >= ? AND created_at <= ? AND outcome = ?", accountIDs, weekStart, now, LogOutcomeSuccess).
 		Group("account_id").
 		Scan(&weeklyStats).Error
 
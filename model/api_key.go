@@ -29,6 +29,9 @@ type ApiKey struct {
 	DailyLimit                    float64        `json:"daily_limit" gorm:"default:0;comment:日限额(美元),0表示不限制"`
 	TotalLimit                    float64        `json:"total_limit" gorm:"default:0;comment:总限额(美元),0表示不限制"`
 	TotalCost                     float64        `json:"total_cost" gorm:"default:0;comment:累计总费用(USD)"`
+	QueuePriority                 int            `json:"queue_priority" gorm:"default:0;comment:排队优先级(数字越大越优先,仅分组为优先级排队时生效)"`
+	ResponseCacheTTL              int            `json:"response_cache_ttl" gorm:"default:0;comment:响应缓存有效期(秒),0表示不缓存"`
+	BodyCaptureKB                 int            `json:"body_capture_kb" gorm:"default:0;comment:请求/响应体捕获大小(KB),0表示沿用分组配置,-1表示完整捕获"`
 	LastUsedTime                  *Time          `json:"last_used_time" gorm:"comment:最后使用时间;type:datetime"`
 	CreatedAt                     Time           `json:"created_at" gorm:"type:datetime;default:CURRENT_TIMESTAMP"`
 	UpdatedAt                     Time           `json:"updated_at" gorm:"type:datetime;default:CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP"`
@@ -50,6 +53,9 @@ type CreateApiKeyRequest struct {
 	ModelRestriction string  `json:"model_restriction"`
 	DailyLimit       float64 `json:"daily_limit"`
 	TotalLimit       float64 `json:"total_limit"`
+	QueuePriority    int     `json:"queue_priority"`
+	ResponseCacheTTL int     `json:"response_cache_ttl" binding:"omitempty,min=0,max=604800"`
+	BodyCaptureKB    int     `json:"body_capture_kb" binding:"omitempty,min=-1,max=10240"`
 }
 
 type AutoCreateApiKeyRequest struct {
@@ -62,6 +68,9 @@ type AutoCreateApiKeyRequest struct {
 	ModelRestriction string  `json:"model_restriction"`
 	DailyLimit       float64 `json:"daily_limit"`
 	TotalLimit       float64 `json:"total_limit"`
+	QueuePriority    int     `json:"queue_priority"`
+	ResponseCacheTTL int     `json:"response_cache_ttl" binding:"omitempty,min=0,max=604800"`
+	BodyCaptureKB    int     `json:"body_capture_kb" binding:"omitempty,min=-1,max=10240"`
 }
 
 type UpdateApiKeyRequest struct {
@@ -72,6 +81,9 @@ type UpdateApiKeyRequest struct {
 	ModelRestriction *string  `json:"model_restriction"`
 	DailyLimit       *float64 `json:"daily_limit"`
 	TotalLimit       *float64 `json:"total_limit"`
+	QueuePriority    *int     `json:"queue_priority"`
+	ResponseCacheTTL *int     `json:"response_cache_ttl" binding:"omitempty,min=0,max=604800"`
+	BodyCaptureKB    *int     `json:"body_capture_kb" binding:"omitempty,min=-1,max=10240"`
 }
 
 type ApiKeyListResult struct {
@@ -311,7 +323,7 @@ func setWeeklyStatsForApiKeys(apiKeys []ApiKey) error {
 	var weeklyStats []WeeklyStats
 	err := DB.Table("logs").
 		Select("api_key_id, SUM(total_cost) as total_cost, COUNT(*) as total_count").
-		Where("api_key_id IN ? AND created_at >= ? AND created_at <= ?", apiKeyIDs, weekStart, now).
+		Where("api_key_id IN ? AND created_at >= ? AND created_at <= ? AND outcome = ?", apiKeyIDs, weekStart, now, LogOutcomeSuccess).
 		Group("api_key_id").
 		Scan(&weeklyStats).Error
 
@@ -105,6 +105,10 @@ func InitDB() error {
 		&Group{},
 		&ApiKey{},
 		&Log{},
+		&Proxy{},
+		&ProxyGroup{},
+		&HeaderRule{},
+		&LogCapture{},
 	)
 	if err != nil {
 		return err
@@ -3,6 +3,7 @@ package model
 import (
 	"claude-code-relay/common"
 	"context"
+	"encoding/json"
 	"fmt"
 	"strconv"
 	"time"
@@ -10,16 +11,38 @@ import (
 	"gorm.io/gorm"
 )
 
+// DefaultGroupMaxAttempts 分组默认的单次请求最多尝试账号数
+const DefaultGroupMaxAttempts = 3
+
+// 分组默认的排队配置
+const (
+	DefaultGroupQueueMaxWait  = 30  // 无可用账号时最长排队等待秒数
+	DefaultGroupQueueMaxDepth = 100 // 排队最大请求数
+)
+
+// 分组排队顺序
+const (
+	GroupQueueModeFIFO     = "fifo"     // 先到先得
+	GroupQueueModePriority = "priority" // 按API Key排队优先级，同优先级先到先得
+)
+
 type Group struct {
-	ID         uint           `json:"id" gorm:"primaryKey"`
-	Name       string         `json:"name" gorm:"type:varchar(100);not null;uniqueIndex:idx_groups_user_name"`
-	Remark     string         `json:"remark" gorm:"type:text"`
-	Status     int            `json:"status" gorm:"default:1"` // 1:启用 0:禁用
-	UserID     uint           `json:"user_id" gorm:"not null;uniqueIndex:idx_groups_user_name"`
-	InstanceID string         `json:"instance_id" gorm:"type:varchar(61)"`
-	CreatedAt  Time           `json:"created_at" gorm:"type:datetime;default:CURRENT_TIMESTAMP"`
-	UpdatedAt  Time           `json:"updated_at" gorm:"type:datetime;default:CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP"`
-	DeletedAt  gorm.DeletedAt `json:"-" gorm:"uniqueIndex:idx_groups_user_name"`
+	ID               uint           `json:"id" gorm:"primaryKey"`
+	Name             string         `json:"name" gorm:"type:varchar(100);not null;uniqueIndex:idx_groups_user_name"`
+	Remark           string         `json:"remark" gorm:"type:text"`
+	Status           int            `json:"status" gorm:"default:1"` // 1:启用 0:禁用
+	UserID           uint           `json:"user_id" gorm:"not null;uniqueIndex:idx_groups_user_name"`
+	InstanceID       string         `json:"instance_id" gorm:"type:varchar(61)"`
+	MaxAttempts      int            `json:"max_attempts" gorm:"default:3;comment:单次请求最多尝试的账号数(含首次,1表示不重试)"`
+	QueueMaxWait     int            `json:"queue_max_wait" gorm:"comment:无可用账号时最长排队等待秒数(0表示不排队)"`
+	QueueMaxDepth    int            `json:"queue_max_depth" gorm:"default:100;comment:排队最大请求数"`
+	QueueMode        string         `json:"queue_mode" gorm:"type:varchar(20);default:'fifo';comment:排队顺序(fifo/priority)"`
+	RewriteRules     string         `json:"rewrite_rules" gorm:"type:text;comment:请求改写规则(JSON数组)"`
+	AutoCacheControl bool           `json:"auto_cache_control" gorm:"default:false;comment:是否为未设置cache_control的请求自动添加缓存断点"`
+	BodyCaptureKB    int            `json:"body_capture_kb" gorm:"default:0;comment:请求/响应体捕获大小(KB),0表示不捕获,-1表示完整捕获"`
+	CreatedAt        Time           `json:"created_at" gorm:"type:datetime;default:CURRENT_TIMESTAMP"`
+	UpdatedAt        Time           `json:"updated_at" gorm:"type:datetime;default:CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP"`
+	DeletedAt        gorm.DeletedAt `json:"-" gorm:"uniqueIndex:idx_groups_user_name"`
 
 	// 统计字段，不存储在数据库中
 	ApiKeyCount  int `json:"api_key_count" gorm:"-"`
@@ -27,15 +50,36 @@ type Group struct {
 }
 
 type CreateGroupRequest struct {
-	Name   string `json:"name" binding:"required"`
-	Remark string `json:"remark"`
-	Status int    `json:"status"`
+	Name             string `json:"name" binding:"required"`
+	Remark           string `json:"remark"`
+	Status           int    `json:"status"`
+	MaxAttempts      int    `json:"max_attempts" binding:"omitempty,min=1,max=10"`
+	QueueMaxWait     *int   `json:"queue_max_wait" binding:"omitempty,min=0,max=600"`
+	QueueMaxDepth    int    `json:"queue_max_depth" binding:"omitempty,min=1,max=10000"`
+	QueueMode        string `json:"queue_mode" binding:"omitempty,oneof=fifo priority"`
+	RewriteRules     string `json:"rewrite_rules"`
+	AutoCacheControl bool   `json:"auto_cache_control"`
+	BodyCaptureKB    int    `json:"body_capture_kb" binding:"omitempty,min=-1,max=10240"`
 }
 
 type UpdateGroupRequest struct {
-	Name   string `json:"name"`
-	Remark string `json:"remark"`
-	Status *int   `json:"status"`
+	Name             string  `json:"name"`
+	Remark           string  `json:"remark"`
+	Status           *int    `json:"status"`
+	MaxAttempts      *int    `json:"max_attempts" binding:"omitempty,min=1,max=10"`
+	QueueMaxWait     *int    `json:"queue_max_wait" binding:"omitempty,min=0,max=600"`
+	QueueMaxDepth    *int    `json:"queue_max_depth" binding:"omitempty,min=1,max=10000"`
+	QueueMode        string  `json:"queue_mode" binding:"omitempty,oneof=fifo priority"`
+	RewriteRules     *string `json:"rewrite_rules"`
+	AutoCacheControl *bool   `json:"auto_cache_control"`
+	BodyCaptureKB    *int    `json:"body_capture_kb" binding:"omitempty,min=-1,max=10240"`
+}
+
+// 请求改写规则预览参数，未传rewrite_rules时使用group_id对应分组已保存的规则
+type RewritePreviewRequest struct {
+	GroupID      int             `json:"group_id"`
+	RewriteRules *string         `json:"rewrite_rules"`
+	Body         json.RawMessage `json:"body" binding:"required"`
 }
 
 type GroupListResult struct {
@@ -97,11 +141,107 @@ func GetGroupStatus(id int) int {
 	return group.Status
 }
 
-// clearGroupStatusCache 清理分组状态缓存
+// GroupSettings 转发请求时使用的分组配置
+type GroupSettings struct {
+	MaxAttempts      int    `json:"max_attempts"`
+	QueueMaxWait     int    `json:"queue_max_wait"`
+	QueueMaxDepth    int    `json:"queue_max_depth"`
+	QueueMode        string `json:"queue_mode"`
+	RewriteRules     string `json:"rewrite_rules"`
+	AutoCacheControl bool   `json:"auto_cache_control"`
+	BodyCaptureKB    int    `json:"body_capture_kb"`
+}
+
+// GetGroupSettings 获取分组的转发配置（带缓存），分组不存在时返回nil
+func GetGroupSettings(id int) *GroupSettings {
+	if id <= 0 {
+		return nil
+	}
+
+	// 先尝试从缓存获取
+	cacheKey := fmt.Sprintf("group_settings:%d", id)
+	if common.RDB != nil {
+		cachedSettings, err := common.RDB.Get(context.Background(), cacheKey).Bytes()
+		if err == nil {
+			var settings GroupSettings
+			if json.Unmarshal(cachedSettings, &settings) == nil {
+				return &settings
+			}
+		}
+	}
+
+	// 缓存未命中，从数据库查询
+	var group Group
+	err := DB.Select("id,max_attempts,queue_max_wait,queue_max_depth,queue_mode,rewrite_rules,auto_cache_control,body_capture_kb").
+		Where("id = ?", id).First(&group).Error
+	if err != nil {
+		return nil
+	}
+
+	settings := &GroupSettings{
+		MaxAttempts:      group.MaxAttempts,
+		QueueMaxWait:     group.QueueMaxWait,
+		QueueMaxDepth:    group.QueueMaxDepth,
+		QueueMode:        group.QueueMode,
+		RewriteRules:     group.RewriteRules,
+		AutoCacheControl: group.AutoCacheControl,
+		BodyCaptureKB:    group.BodyCaptureKB,
+	}
+
+	// 存储到缓存（5分钟）
+	if common.RDB != nil {
+		if data, err := json.Marshal(settings); err == nil {
+			common.RDB.Set(context.Background(), cacheKey, data, 5*time.Minute)
+		}
+	}
+
+	return settings
+}
+
+// GetGroupMaxAttempts 获取分组单次请求最多尝试的账号数，分组不存在时返回默认值
+func GetGroupMaxAttempts(id int) int {
+	settings := GetGroupSettings(id)
+	if settings == nil || settings.MaxAttempts < 1 {
+		return DefaultGroupMaxAttempts
+	}
+
+	return settings.MaxAttempts
+}
+
+// GetGroupRewriteRules 获取分组的请求改写规则，分组不存在或未配置时返回空字符串
+func GetGroupRewriteRules(id int) string {
+	settings := GetGroupSettings(id)
+	if settings == nil {
+		return ""
+	}
+
+	return settings.RewriteRules
+}
+
+// GetGroupAutoCacheControl 获取分组是否开启自动缓存断点
+func GetGroupAutoCacheControl(id int) bool {
+	settings := GetGroupSettings(id)
+	if settings == nil {
+		return false
+	}
+
+	return settings.AutoCacheControl
+}
+
+// GetGroupBodyCaptureKB 获取分组的请求/响应体捕获大小(KB)，分组不存在时返回0（不捕获）
+func GetGroupBodyCaptureKB(id int) int {
+	settings := GetGroupSettings(id)
+	if settings == nil {
+		return 0
+	}
+
+	return settings.BodyCaptureKB
+}
+
+// clearGroupStatusCache 清理分组状态和转发配置缓存
 func clearGroupStatusCache(groupID int) {
 	if common.RDB != nil {
-		cacheKey := fmt.Sprintf("group_status:%d", groupID)
-		common.RDB.Del(context.Background(), cacheKey)
+		common.RDB.Del(context.Background(), fmt.Sprintf("group_status:%d", groupID), fmt.Sprintf("group_settings:%d", groupID))
 	}
 }
 
@@ -201,3 +341,32 @@ func GetInstanceID(groupID uint) string {
 	}
 	return group.InstanceID
 }
+
+// GroupQueueConfig 分组排队配置
+type GroupQueueConfig struct {
+	MaxWait  int    // 最长排队等待秒数，0表示不排队
+	MaxDepth int    // 排队最大请求数
+	Mode     string // 排队顺序
+}
+
+// GetGroupQueueConfig 获取分组排队配置，分组不存在时返回默认值
+func GetGroupQueueConfig(id int) GroupQueueConfig {
+	config := GroupQueueConfig{
+		MaxWait:  DefaultGroupQueueMaxWait,
+		MaxDepth: DefaultGroupQueueMaxDepth,
+		Mode:     GroupQueueModeFIFO,
+	}
+	settings := GetGroupSettings(id)
+	if settings == nil {
+		return config
+	}
+
+	config.MaxWait = settings.QueueMaxWait
+	if settings.QueueMaxDepth > 0 {
+		config.MaxDepth = settings.QueueMaxDepth
+	}
+	if settings.QueueMode == GroupQueueModePriority {
+		config.Mode = GroupQueueModePriority
+	}
+	return config
+}
@@ -0,0 +1,109 @@
+package model
+
+import (
+	"gorm.io/gorm"
+)
+
+// 请求头规则作用方向
+const (
+	HeaderRuleDirectionRequest  = "request"  // 转发到上游的请求头
+	HeaderRuleDirectionResponse = "response" // 返回给客户端的响应头
+)
+
+// 请求头规则动作
+const (
+	HeaderRuleActionAllow = "allow" // 白名单，存在白名单规则时只转发匹配的请求头
+	HeaderRuleActionDeny  = "deny"  // 黑名单，匹配的请求头不转发
+	HeaderRuleActionSet   = "set"   // 注入固定值的请求头
+)
+
+type HeaderRule struct {
+	ID           uint           `json:"id" gorm:"primaryKey"`
+	Name         string         `json:"name" gorm:"type:varchar(100);not null;comment:规则名称"`
+	PlatformType string         `json:"platform_type" gorm:"type:varchar(50);default:'';comment:适用平台类型,空值表示所有平台"`
+	GroupID      int            `json:"group_id" gorm:"default:0;index;comment:适用分组ID,0表示所有分组"`
+	Direction    string         `json:"direction" gorm:"type:varchar(20);not null;comment:作用方向(request/response)"`
+	Action       string         `json:"action" gorm:"type:varchar(20);not null;comment:动作(allow/deny/set)"`
+	HeaderName   string         `json:"header_name" gorm:"type:varchar(255);not null;comment:请求头名称,不区分大小写,支持末尾*通配"`
+	HeaderValue  string         `json:"header_value" gorm:"type:text;comment:注入的请求头值(仅set动作)"`
+	Remark       string         `json:"remark" gorm:"type:text;comment:备注"`
+	Status       int            `json:"status" gorm:"default:1;comment:状态(1:启用,2:禁用)"`
+	CreatedAt    Time           `json:"created_at" gorm:"type:datetime;default:CURRENT_TIMESTAMP"`
+	UpdatedAt    Time           `json:"updated_at" gorm:"type:datetime;default:CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP"`
+	DeletedAt    gorm.DeletedAt `json:"-" gorm:"index"`
+}
+
+// 请求头规则创建/更新请求参数
+type HeaderRuleRequest struct {
+	Name         string `json:"name" binding:"required,min=1,max=100"`
+	PlatformType string `json:"platform_type" binding:"omitempty,oneof=claude claude_console openai gemini"`
+	GroupID      int    `json:"group_id" binding:"min=0"`
+	Direction    string `json:"direction" binding:"required,oneof=request response"`
+	Action       string `json:"action" binding:"required,oneof=allow deny set"`
+	HeaderName   string `json:"header_name" binding:"required,max=255"`
+	HeaderValue  string `json:"header_value"`
+	Remark       string `json:"remark"`
+	Status       int    `json:"status" binding:"omitempty,oneof=1 2"`
+}
+
+// 请求头规则列表响应结构
+type HeaderRuleListResult struct {
+	Rules []HeaderRule `json:"rules"`
+	Total int64        `json:"total"`
+	Page  int          `json:"page"`
+	Limit int          `json:"limit"`
+}
+
+func (r *HeaderRule) TableName() string {
+	return "header_rules"
+}
+
+func CreateHeaderRule(rule *HeaderRule) error {
+	rule.ID = 0
+	return DB.Create(rule).Error
+}
+
+func GetHeaderRuleByID(id uint) (*HeaderRule, error) {
+	var rule HeaderRule
+	if err := DB.Where("id = ?", id).First(&rule).Error; err != nil {
+		return nil, err
+	}
+	return &rule, nil
+}
+
+func UpdateHeaderRule(rule *HeaderRule) error {
+	return DB.Save(rule).Error
+}
+
+func DeleteHeaderRule(id uint) error {
+	return DB.Delete(&HeaderRule{}, id).Error
+}
+
+// GetHeaderRuleList 分页获取请求头规则列表，direction为空时返回所有方向
+func GetHeaderRuleList(page, limit int, direction string) ([]HeaderRule, int64, error) {
+	var rules []HeaderRule
+	var total int64
+
+	query := DB.Model(&HeaderRule{})
+	if direction != "" {
+		query = query.Where("direction = ?", direction)
+	}
+
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	offset := (page - 1) * limit
+	if err := query.Offset(offset).Limit(limit).Order("id DESC").Find(&rules).Error; err != nil {
+		return nil, 0, err
+	}
+
+	return rules, total, nil
+}
+
+// GetEnabledHeaderRules 获取所有启用的请求头规则
+func GetEnabledHeaderRules() ([]HeaderRule, error) {
+	var rules []HeaderRule
+	err := DB.Where("status = ?", 1).Order("id ASC").Find(&rules).Error
+	return rules, err
+}
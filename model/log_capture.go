@@ -0,0 +1,49 @@
+package model
+
+import (
+	"time"
+)
+
+// LogCapture 与请求日志关联的请求体和响应体捕获（gzip压缩，已脱敏）
+type LogCapture struct {
+	LogID        string `json:"log_id" gorm:"primaryKey;type:varchar(19);comment:关联的日志ID"`
+	RequestBody  []byte `json:"-" gorm:"type:mediumblob;comment:gzip压缩的请求体"`
+	ResponseBody []byte `json:"-" gorm:"type:mediumblob;comment:gzip压缩的响应体"`
+	RequestSize  int    `json:"request_size" gorm:"default:0;comment:脱敏后截断前的请求体大小(字节)"`
+	ResponseSize int    `json:"response_size" gorm:"default:0;comment:脱敏后截断前的响应体大小(字节)"`
+	Truncated    bool   `json:"truncated" gorm:"default:false;comment:是否只保存了部分内容"`
+	CreatedAt    Time   `json:"created_at" gorm:"type:datetime;default:CURRENT_TIMESTAMP;index"`
+}
+
+// LogCaptureDetail 解压后的捕获内容，用于日志详情展示
+type LogCaptureDetail struct {
+	RequestBody  string `json:"request_body"`
+	ResponseBody string `json:"response_body"`
+	RequestSize  int    `json:"request_size"`
+	ResponseSize int    `json:"response_size"`
+	Truncated    bool   `json:"truncated"`
+	CreatedAt    Time   `json:"created_at"`
+}
+
+func (l *LogCapture) TableName() string {
+	return "log_captures"
+}
+
+func CreateLogCapture(capture *LogCapture) error {
+	return DB.Create(capture).Error
+}
+
+func GetLogCaptureByLogID(logID string) (*LogCapture, error) {
+	var capture LogCapture
+	if err := DB.Where("log_id = ?", logID).First(&capture).Error; err != nil {
+		return nil, err
+	}
+	return &capture, nil
+}
+
+// DeleteExpiredLogCaptures 删除超过保留天数的捕获内容
+func DeleteExpiredLogCaptures(days int) (int64, error) {
+	cutoffTime := time.Now().AddDate(0, 0, -days)
+	result := DB.Where("created_at < ?", cutoffTime).Delete(&LogCapture{})
+	return result.RowsAffected, result.Error
+}
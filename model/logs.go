@@ -26,12 +26,48 @@ type Log struct {
 	CacheReadCost            float64 `json:"cache_read_cost" gorm:"default:0"`                          // 缓存读取费用(USD)
 	TotalCost                float64 `json:"total_cost" gorm:"default:0"`                               // 总费用(USD)
 	IsStream                 bool    `json:"is_stream" gorm:"default:false"`                            // 是否为流式输出
+	Interrupted              bool    `json:"interrupted" gorm:"default:false;index"`                    // 是否在响应完成前中断（按已产生的用量计费）
+	Estimated                bool    `json:"estimated" gorm:"default:false"`                            // 用量是否为本地估算（上游未返回用量）
+	AutoCacheControl         bool    `json:"auto_cache_control" gorm:"default:false;index"`             // 是否自动添加了缓存断点
+	CacheHit                 bool    `json:"cache_hit" gorm:"default:false;index"`                      // 是否命中响应缓存（未请求上游，不计费）
 	Duration                 int64   `json:"duration"`                                                  // 请求总耗时(毫秒)
+	StatusCode               int     `json:"status_code" gorm:"default:200;index"`                      // 返回的状态码
+	Outcome                  string  `json:"outcome" gorm:"type:varchar(20);default:'success';index"`   // 请求结果: success/failed/rejected
+	ErrorType                string  `json:"error_type" gorm:"type:varchar(50);index"`                  // 归一化的错误类型
+	ErrorMessage             string  `json:"error_message" gorm:"type:text"`                            // 上游或中转服务返回的错误消息
+	RequestID                string  `json:"request_id" gorm:"type:varchar(50);index"`                  // 请求ID
+	ClientIP                 string  `json:"client_ip" gorm:"type:varchar(45)"`                         // 客户端IP
+	UserAgent                string  `json:"user_agent" gorm:"type:varchar(500)"`                       // 客户端User-Agent
 	CreatedAt                Time    `json:"created_at" gorm:"type:datetime;default:CURRENT_TIMESTAMP"` // 创建时间
 
 	// 关联关系
 	User   User   `json:"user,omitempty" gorm:"foreignKey:UserID"`
 	ApiKey ApiKey `json:"api_key,omitempty" gorm:"foreignKey:ApiKeyID"`
+
+	// 请求体和响应体捕获（仅日志详情返回）
+	Capture *LogCaptureDetail `json:"capture,omitempty" gorm:"-"`
+}
+
+// 日志的请求结果
+const (
+	LogOutcomeSuccess  = "success"  // 请求成功
+	LogOutcomeFailed   = "failed"   // 已转发到上游账号，但上游返回错误或请求失败
+	LogOutcomeRejected = "rejected" // 未转发到上游即被拒绝（鉴权失败、超出限额、没有可用账号等）
+)
+
+// 请求数和平均耗时只统计成功请求，失败和被拒绝的请求单独统计为错误数
+const (
+	successRequestsSQL    = "SUM(CASE WHEN outcome = 'success' THEN 1 ELSE 0 END)"
+	successStreamsSQL     = "SUM(CASE WHEN outcome = 'success' AND is_stream = true THEN 1 ELSE 0 END)"
+	successAvgDurationSQL = "COALESCE(AVG(CASE WHEN outcome = 'success' THEN duration END), 0)"
+	errorRequestsSQL      = "SUM(CASE WHEN outcome <> 'success' THEN 1 ELSE 0 END)"
+)
+
+// RequestLogInfo 日志记录的请求来源信息
+type RequestLogInfo struct {
+	RequestID string
+	ClientIP  string
+	UserAgent string
 }
 
 // LogCreateRequest 创建日志请求结构
@@ -50,7 +86,18 @@ type LogCreateRequest struct {
 	CacheReadCost            float64 `json:"cache_read_cost"`
 	TotalCost                float64 `json:"total_cost"`
 	IsStream                 bool    `json:"is_stream"`
+	Interrupted              bool    `json:"interrupted"`
+	Estimated                bool    `json:"estimated"`
+	AutoCacheControl         bool    `json:"auto_cache_control"`
+	CacheHit                 bool    `json:"cache_hit"`
 	Duration                 int64   `json:"duration"`
+	StatusCode               int     `json:"status_code"`
+	Outcome                  string  `json:"outcome"`
+	ErrorType                string  `json:"error_type"`
+	ErrorMessage             string  `json:"error_message"`
+	RequestID                string  `json:"request_id"`
+	ClientIP                 string  `json:"client_ip"`
+	UserAgent                string  `json:"user_agent"`
 }
 
 // LogListResult 日志列表响应结构
@@ -69,6 +116,7 @@ type LogStatsResult struct {
 	AvgDuration    float64 `json:"avg_duration"`
 	StreamRequests int64   `json:"stream_requests"`
 	StreamPercent  float64 `json:"stream_percent"`
+	ErrorRequests  int64   `json:"error_requests"`
 }
 
 // DetailedStatsResult 详细统计结果
@@ -87,6 +135,13 @@ type DetailedStatsResult struct {
 	AvgDuration              float64 `json:"avg_duration"`                // 平均响应时间
 	StreamRequests           int64   `json:"stream_requests"`             // 流式请求数
 	StreamPercent            float64 `json:"stream_percent"`              // 流式请求比例
+	SuccessRequests          int64   `json:"success_requests"`            // 成功请求数
+	FailedRequests           int64   `json:"failed_requests"`             // 上游失败请求数
+	RejectedRequests         int64   `json:"rejected_requests"`           // 被拒绝请求数
+	ErrorRate                float64 `json:"error_rate"`                  // 错误率(失败和被拒绝请求占比)
+
+	CacheSavings     *common.SavingsResult `json:"cache_savings"`      // Prompt Cache节省费用
+	AutoCacheSavings *common.SavingsResult `json:"auto_cache_savings"` // 自动缓存断点请求的节省费用
 }
 
 // StatsQueryRequest 统计查询请求
@@ -97,6 +152,7 @@ type StatsQueryRequest struct {
 	AccountFilter string     `form:"account_filter"` // 账号筛选（ID或邮箱/名称）
 	ApiKeyFilter  string     `form:"api_key_filter"` // API Key筛选（ID或秘钥值）
 	ModelName     string     `form:"model_name"`     // 模型名称筛选
+	Outcome       string     `form:"outcome"`        // 请求结果筛选(success/failed/rejected)
 	StartTime     *time.Time `form:"-"`              // 开始时间(不从form绑定)
 	EndTime       *time.Time `form:"-"`              // 结束时间(不从form绑定)
 }
@@ -111,6 +167,7 @@ type TrendDataItem struct {
 	CacheTokens  int64   `json:"cache_tokens"`  // 缓存tokens
 	InputTokens  int64   `json:"input_tokens"`  // 输入tokens
 	OutputTokens int64   `json:"output_tokens"` // 输出tokens
+	Errors       int64   `json:"errors"`        // 失败和被拒绝的请求数
 }
 
 // StatsResponse 统计响应结果
@@ -121,15 +178,22 @@ type StatsResponse struct {
 
 // LogFilters 日志查询过滤条件
 type LogFilters struct {
-	UserID    *uint      `json:"user_id"`    // 用户ID筛选
-	AccountID *uint      `json:"account_id"` // 账号ID筛选
-	ApiKeyID  *uint      `json:"api_key_id"` // API Key ID筛选
-	ModelName *string    `json:"model_name"` // 模型名称筛选
-	IsStream  *bool      `json:"is_stream"`  // 是否流式请求筛选
-	StartTime *time.Time `json:"start_time"` // 开始时间
-	EndTime   *time.Time `json:"end_time"`   // 结束时间
-	MinCost   *float64   `json:"min_cost"`   // 最小费用
-	MaxCost   *float64   `json:"max_cost"`   // 最大费用
+	UserID      *uint      `json:"user_id"`     // 用户ID筛选
+	AccountID   *uint      `json:"account_id"`  // 账号ID筛选
+	ApiKeyID    *uint      `json:"api_key_id"`  // API Key ID筛选
+	ModelName   *string    `json:"model_name"`  // 模型名称筛选
+	IsStream    *bool      `json:"is_stream"`   // 是否流式请求筛选
+	Interrupted *bool      `json:"interrupted"` // 是否中断请求筛选
+	Estimated   *bool      `json:"estimated"`   // 是否估算用量筛选
+	CacheHit    *bool      `json:"cache_hit"`   // 是否命中响应缓存筛选
+	Outcome     *string    `json:"outcome"`     // 请求结果筛选
+	ErrorType   *string    `json:"error_type"`  // 错误类型筛选
+	StatusCode  *int       `json:"status_code"` // 状态码筛选
+	RequestID   *string    `json:"request_id"`  // 请求ID筛选
+	StartTime   *time.Time `json:"start_time"`  // 开始时间
+	EndTime     *time.Time `json:"end_time"`    // 结束时间
+	MinCost     *float64   `json:"min_cost"`    // 最小费用
+	MaxCost     *float64   `json:"max_cost"`    // 最大费用
 }
 
 func (l *Log) TableName() string {
@@ -172,7 +236,18 @@ func CreateLog(logReq *LogCreateRequest) (*Log, error) {
 		CacheReadCost:            logReq.CacheReadCost,
 		TotalCost:                logReq.TotalCost,
 		IsStream:                 logReq.IsStream,
+		Interrupted:              logReq.Interrupted,
+		Estimated:                logReq.Estimated,
+		AutoCacheControl:         logReq.AutoCacheControl,
+		CacheHit:                 logReq.CacheHit,
 		Duration:                 logReq.Duration,
+		StatusCode:               logReq.StatusCode,
+		Outcome:                  logReq.Outcome,
+		ErrorType:                logReq.ErrorType,
+		ErrorMessage:             logReq.ErrorMessage,
+		RequestID:                logReq.RequestID,
+		ClientIP:                 logReq.ClientIP,
+		UserAgent:                logReq.UserAgent,
 	}
 
 	err := DB.Create(log).Error
@@ -185,7 +260,7 @@ func CreateLog(logReq *LogCreateRequest) (*Log, error) {
 }
 
 // CreateLogFromTokenUsage 根据TokenUsage创建日志记录
-func CreateLogFromTokenUsage(usage *common.TokenUsage, userID, apiKeyID, accountID uint, duration int64, isStream bool) (*Log, error) {
+func CreateLogFromTokenUsage(usage *common.TokenUsage, userID, apiKeyID, accountID uint, duration int64, isStream bool, info *RequestLogInfo) (*Log, error) {
 	// 使用费用计算器计算详细费用
 	costResult := common.CalculateCost(usage)
 
@@ -204,12 +279,26 @@ func CreateLogFromTokenUsage(usage *common.TokenUsage, userID, apiKeyID, account
 		CacheReadCost:            costResult.Costs.CacheRead,
 		TotalCost:                costResult.Costs.Total,
 		IsStream:                 isStream,
+		Interrupted:              usage.Interrupted,
+		Estimated:                usage.Estimated,
+		AutoCacheControl:         usage.AutoCacheControl,
 		Duration:                 duration,
 	}
+	logReq.SetRequestInfo(info)
 
 	return CreateLog(logReq)
 }
 
+// SetRequestInfo 设置请求来源信息
+func (r *LogCreateRequest) SetRequestInfo(info *RequestLogInfo) {
+	if info == nil {
+		return
+	}
+	r.RequestID = info.RequestID
+	r.ClientIP = info.ClientIP
+	r.UserAgent = info.UserAgent
+}
+
 // GetLogById 根据ID获取日志
 func GetLogById(id string) (*Log, error) {
 	var log Log
@@ -299,34 +388,34 @@ func GetLogStats(userID *uint) (*LogStatsResult, error) {
 		query = query.Where("user_id = ?", *userID)
 	}
 
-	// 统计总请求数
-	err := query.Count(&stats.TotalRequests).Error
-	if err != nil {
-		return nil, err
-	}
-
-	// 统计其他数据
+	// 统计数据
 	var result struct {
+		TotalRequests  int64
 		TotalTokens    int64
 		TotalCost      float64
 		AvgDuration    float64
 		StreamRequests int64
+		ErrorRequests  int64
 	}
 
-	err = query.Select(
+	err := query.Select(
+		successRequestsSQL+" as total_requests",
 		"SUM(input_tokens + output_tokens + cache_read_input_tokens + cache_creation_input_tokens) as total_tokens",
 		"SUM(total_cost) as total_cost",
-		"AVG(duration) as avg_duration",
-		"SUM(CASE WHEN is_stream = true THEN 1 ELSE 0 END) as stream_requests",
+		successAvgDurationSQL+" as avg_duration",
+		successStreamsSQL+" as stream_requests",
+		errorRequestsSQL+" as error_requests",
 	).Scan(&result).Error
 	if err != nil {
 		return nil, err
 	}
 
+	stats.TotalRequests = result.TotalRequests
 	stats.TotalTokens = result.TotalTokens
 	stats.TotalCost = result.TotalCost
 	stats.AvgDuration = result.AvgDuration
 	stats.StreamRequests = result.StreamRequests
+	stats.ErrorRequests = result.ErrorRequests
 
 	// 计算流式请求百分比
 	if stats.TotalRequests > 0 {
@@ -338,11 +427,18 @@ func GetLogStats(userID *uint) (*LogStatsResult, error) {
 
 // DeleteLogById 删除指定ID的日志记录
 func DeleteLogById(id string) error {
-	return DB.Delete(&Log{}, "id = ?", id).Error
+	if err := DB.Delete(&Log{}, "id = ?", id).Error; err != nil {
+		return err
+	}
+	return DB.Delete(&LogCapture{}, "log_id = ?", id).Error
 }
 
 // DeleteLogsByUser 删除指定用户的所有日志记录
 func DeleteLogsByUser(userID uint) error {
+	err := DB.Where("log_id IN (?)", DB.Model(&Log{}).Select("id").Where("user_id = ?", userID)).Delete(&LogCapture{}).Error
+	if err != nil {
+		return err
+	}
 	return DB.Where("user_id = ?", userID).Delete(&Log{}).Error
 }
 
@@ -387,6 +483,38 @@ func GetLogsWithFilters(filters *LogFilters, page, limit int) ([]Log, int64, err
 			countQuery = countQuery.Where("is_stream = ?", *filters.IsStream)
 		}
 
+		// 是否中断请求筛选
+		if filters.Interrupted != nil {
+			query = query.Where("interrupted = ?", *filters.Interrupted)
+			countQuery = countQuery.Where("interrupted = ?", *filters.Interrupted)
+		}
+		if filters.Estimated != nil {
+			query = query.Where("estimated = ?", *filters.Estimated)
+			countQuery = countQuery.Where("estimated = ?", *filters.Estimated)
+		}
+		if filters.CacheHit != nil {
+			query = query.Where("cache_hit = ?", *filters.CacheHit)
+			countQuery = countQuery.Where("cache_hit = ?", *filters.CacheHit)
+		}
+
+		// 请求结果和错误筛选
+		if filters.Outcome != nil {
+			query = query.Where("outcome = ?", *filters.Outcome)
+			countQuery = countQuery.Where("outcome = ?", *filters.Outcome)
+		}
+		if filters.ErrorType != nil {
+			query = query.Where("error_type = ?", *filters.ErrorType)
+			countQuery = countQuery.Where("error_type = ?", *filters.ErrorType)
+		}
+		if filters.StatusCode != nil {
+			query = query.Where("status_code = ?", *filters.StatusCode)
+			countQuery = countQuery.Where("status_code = ?", *filters.StatusCode)
+		}
+		if filters.RequestID != nil {
+			query = query.Where("request_id = ?", *filters.RequestID)
+			countQuery = countQuery.Where("request_id = ?", *filters.RequestID)
+		}
+
 		// 时间范围筛选
 		if filters.StartTime != nil {
 			query = query.Where("created_at >= ?", *filters.StartTime)
@@ -475,10 +603,13 @@ func GetDetailedStats(req *StatsQueryRequest) (*DetailedStatsResult, error) {
 		CacheReadCost            float64
 		AvgDuration              float64
 		StreamRequests           int64
+		SuccessRequests          int64
+		FailedRequests           int64
+		RejectedRequests         int64
 	}
 
 	err := query.Select(
-		"COUNT(*) as total_requests",
+		successRequestsSQL+" as total_requests",
 		"SUM(input_tokens) as total_input_tokens",
 		"SUM(output_tokens) as total_output_tokens",
 		"SUM(cache_read_input_tokens) as total_cache_read_tokens",
@@ -488,8 +619,11 @@ func GetDetailedStats(req *StatsQueryRequest) (*DetailedStatsResult, error) {
 		"SUM(output_cost) as output_cost",
 		"SUM(cache_write_cost) as cache_write_cost",
 		"SUM(cache_read_cost) as cache_read_cost",
-		"AVG(duration) as avg_duration",
-		"SUM(CASE WHEN is_stream = true THEN 1 ELSE 0 END) as stream_requests",
+		successAvgDurationSQL+" as avg_duration",
+		successStreamsSQL+" as stream_requests",
+		successRequestsSQL+" as success_requests",
+		"SUM(CASE WHEN outcome = 'failed' THEN 1 ELSE 0 END) as failed_requests",
+		"SUM(CASE WHEN outcome = 'rejected' THEN 1 ELSE 0 END) as rejected_requests",
 	).Scan(&result).Error
 
 	if err != nil {
@@ -510,15 +644,68 @@ func GetDetailedStats(req *StatsQueryRequest) (*DetailedStatsResult, error) {
 	stats.CacheReadCost = result.CacheReadCost
 	stats.AvgDuration = result.AvgDuration
 	stats.StreamRequests = result.StreamRequests
+	stats.SuccessRequests = result.SuccessRequests
+	stats.FailedRequests = result.FailedRequests
+	stats.RejectedRequests = result.RejectedRequests
 
-	// 计算流式请求比例
+	// 计算流式请求比例和错误率
 	if stats.TotalRequests > 0 {
 		stats.StreamPercent = float64(stats.StreamRequests) / float64(stats.TotalRequests) * 100
 	}
+	if allRequests := stats.SuccessRequests + stats.FailedRequests + stats.RejectedRequests; allRequests > 0 {
+		stats.ErrorRate = float64(stats.FailedRequests+stats.RejectedRequests) / float64(allRequests) * 100
+	}
+
+	// 计算缓存节省费用
+	savingsQuery := applyStatsFilters(DB.Model(&Log{}), req).Where("created_at >= ? AND created_at <= ?", startTime, endTime)
+	cacheSavings, err := calculateCacheSavings(savingsQuery)
+	if err != nil {
+		return nil, err
+	}
+	stats.CacheSavings = cacheSavings
+
+	// 计算自动添加缓存断点的请求的节省费用
+	autoSavingsQuery := applyStatsFilters(DB.Model(&Log{}), req).Where("created_at >= ? AND created_at <= ?", startTime, endTime)
+	autoCacheSavings, err := calculateCacheSavings(autoSavingsQuery.Where("auto_cache_control = ?", true))
+	if err != nil {
+		return nil, err
+	}
+	stats.AutoCacheSavings = autoCacheSavings
 
 	return &stats, nil
 }
 
+// calculateCacheSavings 按模型汇总缓存tokens并计算缓存节省费用
+func calculateCacheSavings(query *gorm.DB) (*common.SavingsResult, error) {
+	var rows []struct {
+		ModelName                string
+		CacheReadInputTokens     int
+		CacheCreationInputTokens int
+	}
+
+	err := query.Select(
+		"model_name",
+		"SUM(cache_read_input_tokens) as cache_read_input_tokens",
+		"SUM(cache_creation_input_tokens) as cache_creation_input_tokens",
+	).Group("model_name").Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+
+	var normalCost, cacheCost float64
+	for _, row := range rows {
+		savings := common.CalculateCacheSavings(&common.TokenUsage{
+			Model:                    row.ModelName,
+			CacheReadInputTokens:     row.CacheReadInputTokens,
+			CacheCreationInputTokens: row.CacheCreationInputTokens,
+		})
+		normalCost += savings.NormalCost
+		cacheCost += savings.CacheCost
+	}
+
+	return common.BuildSavingsResult(normalCost, cacheCost), nil
+}
+
 // GetTrendData 获取趋势数据
 func GetTrendData(req *StatsQueryRequest) ([]TrendDataItem, error) {
 	// 构建基础查询
@@ -552,13 +739,14 @@ func GetTrendData(req *StatsQueryRequest) ([]TrendDataItem, error) {
 
 	rows, err := query.Select(
 		groupBy+" as date_group",
-		"COUNT(*) as requests",
+		successRequestsSQL+" as requests",
 		"SUM(input_tokens + output_tokens + cache_read_input_tokens + cache_creation_input_tokens) as tokens",
 		"SUM(total_cost) as cost",
-		"AVG(duration) as avg_duration",
+		successAvgDurationSQL+" as avg_duration",
 		"SUM(cache_read_input_tokens + cache_creation_input_tokens) as cache_tokens",
 		"SUM(input_tokens) as input_tokens",
 		"SUM(output_tokens) as output_tokens",
+		errorRequestsSQL+" as errors",
 	).Group(groupBy).Order(groupBy).Rows()
 
 	if err != nil {
@@ -578,6 +766,7 @@ func GetTrendData(req *StatsQueryRequest) ([]TrendDataItem, error) {
 			&item.CacheTokens,
 			&item.InputTokens,
 			&item.OutputTokens,
+			&item.Errors,
 		)
 		if err != nil {
 			return nil, err
@@ -606,6 +795,9 @@ func applyStatsFilters(query *gorm.DB, req *StatsQueryRequest) *gorm.DB {
 	if req.ModelName != "" {
 		query = query.Where("model_name = ?", req.ModelName)
 	}
+	if req.Outcome != "" {
+		query = query.Where("outcome = ?", req.Outcome)
+	}
 	return query
 }
 
@@ -708,6 +900,10 @@ type DashboardStats struct {
 	// API Key排名
 	ApiKeyRanking []ApiKeyRankItem `json:"api_key_ranking"` // API Key排名
 
+	// Prompt Cache节省费用
+	CacheSavings     *common.SavingsResult `json:"cache_savings"`      // 最近30天的缓存节省费用
+	AutoCacheSavings *common.SavingsResult `json:"auto_cache_savings"` // 最近30天自动缓存断点的节省费用
+
 	// 今日vs昨日数据对比
 	TodayStats     *DayStatsItem `json:"today_stats"`     // 今日统计
 	YesterdayStats *DayStatsItem `json:"yesterday_stats"` // 昨日统计
@@ -748,8 +944,12 @@ type DayStatsItem struct {
 	Requests int64   `json:"requests"` // 请求数
 	Tokens   int64   `json:"tokens"`   // tokens数
 	Cost     float64 `json:"cost"`     // 费用
+	Errors   int64   `json:"errors"`   // 失败和被拒绝的请求数
 }
 
+// 仪表盘趋势和缓存节省费用统计的天数
+const dashboardRecentDays = 30
+
 // GetDashboardStats 获取仪表盘统计数据
 func GetDashboardStats() (*DashboardStats, error) {
 	stats := &DashboardStats{}
@@ -766,7 +966,7 @@ func GetDashboardStats() (*DashboardStats, error) {
 	stats.ApiKeyCount = baseStats.ApiKeyCount
 
 	// 获取趋势数据(最近30天)
-	trendData, err := getRecentTrendData(30)
+	trendData, err := getRecentTrendData(dashboardRecentDays)
 	if err != nil {
 		return nil, err
 	}
@@ -801,6 +1001,22 @@ func GetDashboardStats() (*DashboardStats, error) {
 	stats.TodayStats = todayStats
 	stats.YesterdayStats = yesterdayStats
 
+	// 获取缓存节省费用(最近30天，与趋势数据的时间范围一致)
+	now := time.Now()
+	recentStart := time.Date(now.Year(), now.Month(), now.Day()-dashboardRecentDays, 0, 0, 0, 0, now.Location())
+	cacheSavings, err := calculateCacheSavings(DB.Model(&Log{}).Where("created_at >= ?", recentStart))
+	if err != nil {
+		return nil, err
+	}
+	stats.CacheSavings = cacheSavings
+
+	// 获取自动缓存断点节省费用(最近30天)
+	autoCacheSavings, err := calculateCacheSavings(DB.Model(&Log{}).Where("auto_cache_control = ? AND created_at >= ?", true, recentStart))
+	if err != nil {
+		return nil, err
+	}
+	stats.AutoCacheSavings = autoCacheSavings
+
 	return stats, nil
 }
 
@@ -820,7 +1036,7 @@ func getBaseStats() (*struct {
 	err := DB.Model(&Log{}).Select(
 		"SUM(total_cost) as total_cost",
 		"SUM(input_tokens + output_tokens + cache_read_input_tokens + cache_creation_input_tokens) as total_tokens",
-	).Scan(&result).Error
+	).Where("outcome = ?", LogOutcomeSuccess).Scan(&result).Error
 	if err != nil {
 		return nil, err
 	}
@@ -860,13 +1076,14 @@ func getRecentTrendData(days int) ([]TrendDataItem, error) {
 
 	rows, err := DB.Model(&Log{}).Select(
 		"DATE(created_at) as date_group",
-		"COUNT(*) as requests",
+		successRequestsSQL+" as requests",
 		"SUM(input_tokens + output_tokens + cache_read_input_tokens + cache_creation_input_tokens) as tokens",
 		"SUM(total_cost) as cost",
-		"AVG(duration) as avg_duration",
+		successAvgDurationSQL+" as avg_duration",
 		"SUM(cache_read_input_tokens + cache_creation_input_tokens) as cache_tokens",
 		"SUM(input_tokens) as input_tokens",
 		"SUM(output_tokens) as output_tokens",
+		errorRequestsSQL+" as errors",
 	).Where("created_at >= ? AND created_at <= ?", startTime, endTime).
 		Group("DATE(created_at)").Order("DATE(created_at)").Rows()
 
@@ -888,6 +1105,7 @@ func getRecentTrendData(days int) ([]TrendDataItem, error) {
 			&item.CacheTokens,
 			&item.InputTokens,
 			&item.OutputTokens,
+			&item.Errors,
 		)
 		if err != nil {
 			return nil, err
@@ -909,7 +1127,7 @@ func getModelUsageStats() ([]ModelUsageItem, error) {
 		"COUNT(*) as requests",
 		"SUM(input_tokens + output_tokens + cache_read_input_tokens + cache_creation_input_tokens) as tokens",
 		"SUM(total_cost) as cost",
-	).Group("model_name").Order("cost DESC").Rows()
+	).Where("outcome = ?", LogOutcomeSuccess).Group("model_name").Order("cost DESC").Rows()
 
 	if err != nil {
 		return nil, err
@@ -957,7 +1175,7 @@ func getAccountRanking(limit int) ([]AccountRankItem, error) {
 			SUM(l.total_cost) as cost
 		`).
 		Joins("LEFT JOIN accounts a ON l.account_id = a.id").
-		Where("l.created_at >= ? AND l.created_at <= ?", currentStart, currentEnd).
+		Where("l.outcome = ? AND l.created_at >= ? AND l.created_at <= ?", LogOutcomeSuccess, currentStart, currentEnd).
 		Group("l.account_id, a.name, a.platform_type").
 		Order("cost DESC").
 		Limit(limit).Rows()
@@ -1013,7 +1231,7 @@ func getApiKeyRanking(limit int) ([]ApiKeyRankItem, error) {
 			SUM(l.total_cost) as cost
 		`).
 		Joins("LEFT JOIN api_keys ak ON l.api_key_id = ak.id").
-		Where("l.created_at >= ? AND l.created_at <= ?", currentStart, currentEnd).
+		Where("l.outcome = ? AND l.created_at >= ? AND l.created_at <= ?", LogOutcomeSuccess, currentStart, currentEnd).
 		Group("l.api_key_id, ak.name").
 		Order("requests DESC").
 		Limit(limit).Rows()
@@ -1080,12 +1298,14 @@ func getDayStats(startTime, endTime time.Time, label string) (*DayStatsItem, err
 		Requests int64
 		Tokens   int64
 		Cost     float64
+		Errors   int64
 	}
 
 	err := DB.Model(&Log{}).Select(
-		"COUNT(*) as requests",
+		successRequestsSQL+" as requests",
 		"SUM(input_tokens + output_tokens + cache_read_input_tokens + cache_creation_input_tokens) as tokens",
 		"SUM(total_cost) as cost",
+		errorRequestsSQL+" as errors",
 	).Where("created_at >= ? AND created_at <= ?", startTime, endTime).Scan(&result).Error
 
 	if err != nil {
@@ -1097,6 +1317,7 @@ func getDayStats(startTime, endTime time.Time, label string) (*DayStatsItem, err
 		Requests: result.Requests,
 		Tokens:   result.Tokens,
 		Cost:     result.Cost,
+		Errors:   result.Errors,
 	}, nil
 }
 
@@ -1106,7 +1327,7 @@ func calculateAccountGrowthRate(accountID uint, prevStart, prevEnd, currentStart
 
 	// 上期费用
 	err := DB.Model(&Log{}).Select("SUM(total_cost)").
-		Where("account_id = ? AND created_at >= ? AND created_at <= ?", accountID, prevStart, prevEnd).
+		Where("account_id = ? AND outcome = ? AND created_at >= ? AND created_at <= ?", accountID, LogOutcomeSuccess, prevStart, prevEnd).
 		Scan(&prevCost).Error
 	if err != nil {
 		return 0, err
@@ -1114,7 +1335,7 @@ func calculateAccountGrowthRate(accountID uint, prevStart, prevEnd, currentStart
 
 	// 本期费用
 	err = DB.Model(&Log{}).Select("SUM(total_cost)").
-		Where("account_id = ? AND created_at >= ? AND created_at <= ?", accountID, currentStart, currentEnd).
+		Where("account_id = ? AND outcome = ? AND created_at >= ? AND created_at <= ?", accountID, LogOutcomeSuccess, currentStart, currentEnd).
 		Scan(&currentCost).Error
 	if err != nil {
 		return 0, err
@@ -1137,7 +1358,7 @@ func calculateApiKeyGrowthRate(apiKeyID uint, prevStart, prevEnd, currentStart,
 
 	// 上期请求数
 	err := DB.Model(&Log{}).Select("COUNT(*)").
-		Where("api_key_id = ? AND created_at >= ? AND created_at <= ?", apiKeyID, prevStart, prevEnd).
+		Where("api_key_id = ? AND outcome = ? AND created_at >= ? AND created_at <= ?", apiKeyID, LogOutcomeSuccess, prevStart, prevEnd).
 		Scan(&prevRequests).Error
 	if err != nil {
 		return 0, err
@@ -1145,7 +1366,7 @@ func calculateApiKeyGrowthRate(apiKeyID uint, prevStart, prevEnd, currentStart,
 
 	// 本期请求数
 	err = DB.Model(&Log{}).Select("COUNT(*)").
-		Where("api_key_id = ? AND created_at >= ? AND created_at <= ?", apiKeyID, currentStart, currentEnd).
+		Where("api_key_id = ? AND outcome = ? AND created_at >= ? AND created_at <= ?", apiKeyID, LogOutcomeSuccess, currentStart, currentEnd).
 		Scan(&currentRequests).Error
 	if err != nil {
 		return 0, err
@@ -0,0 +1,279 @@
+package model
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+
+	"gorm.io/gorm"
+)
+
+// 代理类型
+const (
+	ProxyTypeHTTP   = "http"
+	ProxyTypeHTTPS  = "https"
+	ProxyTypeSocks5 = "socks5"
+)
+
+// 代理健康状态
+const (
+	ProxyHealthUnknown   = 0
+	ProxyHealthHealthy   = 1
+	ProxyHealthUnhealthy = 2
+)
+
+type Proxy struct {
+	ID            uint           `json:"id" gorm:"primaryKey"`
+	Name          string         `json:"name" gorm:"type:varchar(100);not null;comment:代理名称"`
+	Type          string         `json:"type" gorm:"type:varchar(20);not null;comment:代理类型(http/https/socks5)"`
+	Host          string         `json:"host" gorm:"type:varchar(255);not null;comment:代理主机"`
+	Port          int            `json:"port" gorm:"not null;comment:代理端口"`
+	Username      string         `json:"username" gorm:"type:varchar(255);comment:认证用户名"`
+	Password      string         `json:"-" gorm:"type:varchar(255);comment:认证密码"`
+	ProxyGroupID  uint           `json:"proxy_group_id" gorm:"default:0;index;comment:所属代理分组ID"`
+	Remark        string         `json:"remark" gorm:"type:text;comment:备注"`
+	Status        int            `json:"status" gorm:"default:1;comment:状态(1:启用,2:禁用)"`
+	HealthStatus  int            `json:"health_status" gorm:"default:0;comment:健康状态(0:未检测,1:正常,2:异常)"`
+	LastLatency   int            `json:"last_latency" gorm:"default:0;comment:最近一次检测延迟(毫秒)"`
+	LastError     string         `json:"last_error" gorm:"type:text;comment:最近一次检测错误"`
+	LastCheckTime *Time          `json:"last_check_time" gorm:"comment:最近检测时间;type:datetime"`
+	UserID        uint           `json:"user_id" gorm:"not null;comment:所属用户ID"`
+	CreatedAt     Time           `json:"created_at" gorm:"type:datetime;default:CURRENT_TIMESTAMP"`
+	UpdatedAt     Time           `json:"updated_at" gorm:"type:datetime;default:CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP"`
+	DeletedAt     gorm.DeletedAt `json:"-" gorm:"index"`
+
+	// 统计字段，不存储在数据库中
+	HasPassword  bool `json:"has_password" gorm:"-"`
+	AccountCount int  `json:"account_count" gorm:"-"`
+}
+
+type ProxyGroup struct {
+	ID        uint           `json:"id" gorm:"primaryKey"`
+	Name      string         `json:"name" gorm:"type:varchar(100);not null;comment:代理分组名称"`
+	Remark    string         `json:"remark" gorm:"type:text;comment:备注"`
+	UserID    uint           `json:"user_id" gorm:"not null;comment:所属用户ID"`
+	CreatedAt Time           `json:"created_at" gorm:"type:datetime;default:CURRENT_TIMESTAMP"`
+	UpdatedAt Time           `json:"updated_at" gorm:"type:datetime;default:CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP"`
+	DeletedAt gorm.DeletedAt `json:"-" gorm:"index"`
+
+	// 统计字段，不存储在数据库中
+	ProxyCount   int `json:"proxy_count" gorm:"-"`
+	AccountCount int `json:"account_count" gorm:"-"`
+}
+
+// 代理创建请求参数
+type CreateProxyRequest struct {
+	Name         string `json:"name" binding:"required,min=1,max=100"`
+	Type         string `json:"type" binding:"required,oneof=http https socks5"`
+	Host         string `json:"host" binding:"required,max=255"`
+	Port         int    `json:"port" binding:"required,min=1,max=65535"`
+	Username     string `json:"username" binding:"max=255"`
+	Password     string `json:"password" binding:"max=255"`
+	ProxyGroupID uint   `json:"proxy_group_id"`
+	Remark       string `json:"remark"`
+	Status       int    `json:"status" binding:"omitempty,oneof=1 2"`
+}
+
+// 代理更新请求参数
+type UpdateProxyRequest struct {
+	Name         string `json:"name" binding:"required,min=1,max=100"`
+	Type         string `json:"type" binding:"required,oneof=http https socks5"`
+	Host         string `json:"host" binding:"required,max=255"`
+	Port         int    `json:"port" binding:"required,min=1,max=65535"`
+	Username     string `json:"username" binding:"max=255"`
+	Password     string `json:"password" binding:"max=255"` // 为空表示保持原密码
+	ProxyGroupID uint   `json:"proxy_group_id"`
+	Remark       string `json:"remark"`
+	Status       int    `json:"status" binding:"oneof=1 2"`
+}
+
+// 代理列表响应结构
+type ProxyListResult struct {
+	Proxies []Proxy `json:"proxies"`
+	Total   int64   `json:"total"`
+	Page    int     `json:"page"`
+	Limit   int     `json:"limit"`
+}
+
+// 代理分组创建/更新请求参数
+type ProxyGroupRequest struct {
+	Name   string `json:"name" binding:"required,min=1,max=100"`
+	Remark string `json:"remark"`
+}
+
+func (p *Proxy) TableName() string {
+	return "proxies"
+}
+
+func (g *ProxyGroup) TableName() string {
+	return "proxy_groups"
+}
+
+// URI 生成代理连接地址，包含认证信息
+func (p *Proxy) URI() string {
+	proxyURL := &url.URL{
+		Scheme: p.Type,
+		Host:   net.JoinHostPort(p.Host, strconv.Itoa(p.Port)),
+	}
+	if p.Username != "" {
+		proxyURL.User = url.UserPassword(p.Username, p.Password)
+	}
+	return proxyURL.String()
+}
+
+// DisplayAddress 不含认证信息的代理地址，用于日志输出
+func (p *Proxy) DisplayAddress() string {
+	return fmt.Sprintf("%s://%s", p.Type, net.JoinHostPort(p.Host, strconv.Itoa(p.Port)))
+}
+
+func CreateProxy(proxy *Proxy) error {
+	proxy.ID = 0
+	return DB.Create(proxy).Error
+}
+
+// GetProxyByID 根据ID获取代理，userID不为空时只查询该用户的代理
+func GetProxyByID(id uint, userID *uint) (*Proxy, error) {
+	var proxy Proxy
+	query := DB.Where("id = ?", id)
+	if userID != nil {
+		query = query.Where("user_id = ?", *userID)
+	}
+	if err := query.First(&proxy).Error; err != nil {
+		return nil, err
+	}
+	proxy.HasPassword = proxy.Password != ""
+	return &proxy, nil
+}
+
+func UpdateProxy(proxy *Proxy) error {
+	return DB.Save(proxy).Error
+}
+
+func DeleteProxy(id uint) error {
+	return DB.Delete(&Proxy{}, id).Error
+}
+
+// GetProxyList 分页获取代理列表
+func GetProxyList(page, limit int, userID *uint, proxyGroupID uint) ([]Proxy, int64, error) {
+	var proxies []Proxy
+	var total int64
+
+	query := DB.Model(&Proxy{})
+	if userID != nil {
+		query = query.Where("user_id = ?", *userID)
+	}
+	if proxyGroupID > 0 {
+		query = query.Where("proxy_group_id = ?", proxyGroupID)
+	}
+
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	offset := (page - 1) * limit
+	if err := query.Offset(offset).Limit(limit).Order("id DESC").Find(&proxies).Error; err != nil {
+		return nil, 0, err
+	}
+
+	for i := range proxies {
+		proxies[i].HasPassword = proxies[i].Password != ""
+		var accountCount int64
+		DB.Model(&Account{}).Where("proxy_id = ?", proxies[i].ID).Count(&accountCount)
+		proxies[i].AccountCount = int(accountCount)
+	}
+
+	return proxies, total, nil
+}
+
+// GetEnabledProxies 获取所有启用的代理（用于健康检查）
+func GetEnabledProxies() ([]Proxy, error) {
+	var proxies []Proxy
+	err := DB.Where("status = ?", 1).Find(&proxies).Error
+	return proxies, err
+}
+
+// GetAllProxies 获取所有代理（用于解析账号代理的进程内缓存）
+func GetAllProxies() ([]Proxy, error) {
+	var proxies []Proxy
+	err := DB.Order("id ASC").Find(&proxies).Error
+	return proxies, err
+}
+
+// UpdateProxyHealth 更新代理健康检查结果
+func UpdateProxyHealth(id uint, healthStatus int, latency int, lastError string, checkTime Time) error {
+	return DB.Model(&Proxy{}).Where("id = ?", id).Updates(map[string]interface{}{
+		"health_status":   healthStatus,
+		"last_latency":    latency,
+		"last_error":      lastError,
+		"last_check_time": checkTime,
+	}).Error
+}
+
+// CountAccountsByProxy 统计引用代理或代理分组的账号数量
+func CountAccountsByProxy(proxyID, proxyGroupID uint) int64 {
+	var count int64
+	query := DB.Model(&Account{})
+	if proxyID > 0 {
+		query = query.Where("proxy_id = ?", proxyID)
+	} else {
+		query = query.Where("proxy_group_id = ?", proxyGroupID)
+	}
+	query.Count(&count)
+	return count
+}
+
+// CountProxiesByGroupID 统计代理分组中的代理数量
+func CountProxiesByGroupID(proxyGroupID uint) int64 {
+	var count int64
+	DB.Model(&Proxy{}).Where("proxy_group_id = ?", proxyGroupID).Count(&count)
+	return count
+}
+
+func CreateProxyGroup(group *ProxyGroup) error {
+	group.ID = 0
+	return DB.Create(group).Error
+}
+
+// GetProxyGroupByID 根据ID获取代理分组，userID不为空时只查询该用户的分组
+func GetProxyGroupByID(id uint, userID *uint) (*ProxyGroup, error) {
+	var group ProxyGroup
+	query := DB.Where("id = ?", id)
+	if userID != nil {
+		query = query.Where("user_id = ?", *userID)
+	}
+	if err := query.First(&group).Error; err != nil {
+		return nil, err
+	}
+	return &group, nil
+}
+
+func UpdateProxyGroup(group *ProxyGroup) error {
+	return DB.Save(group).Error
+}
+
+func DeleteProxyGroup(id uint) error {
+	return DB.Delete(&ProxyGroup{}, id).Error
+}
+
+// GetProxyGroups 获取代理分组列表（不分页）
+func GetProxyGroups(userID *uint) ([]ProxyGroup, error) {
+	var groups []ProxyGroup
+	query := DB.Model(&ProxyGroup{})
+	if userID != nil {
+		query = query.Where("user_id = ?", *userID)
+	}
+	if err := query.Order("id ASC").Find(&groups).Error; err != nil {
+		return nil, err
+	}
+
+	for i := range groups {
+		var proxyCount, accountCount int64
+		DB.Model(&Proxy{}).Where("proxy_group_id = ?", groups[i].ID).Count(&proxyCount)
+		DB.Model(&Account{}).Where("proxy_group_id = ?", groups[i].ID).Count(&accountCount)
+		groups[i].ProxyCount = int(proxyCount)
+		groups[i].AccountCount = int(accountCount)
+	}
+
+	return groups, nil
+}
@@ -0,0 +1,77 @@
+package relay
+
+import (
+	"claude-code-relay/model"
+	"claude-code-relay/service"
+	"log"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tidwall/gjson"
+)
+
+const bodyCaptureContextKey = "body_capture"
+
+type bodyCapture struct {
+	recorder    *ResponseRecorder
+	requestBody []byte
+	limit       int
+}
+
+// BodyCaptureSnapshot 保存日志时的捕获内容快照
+// gin.Context会被复用，异步保存日志前需要先复制已记录的内容
+type BodyCaptureSnapshot struct {
+	requestBody  []byte
+	responseBody []byte
+	limit        int
+	incomplete   bool
+}
+
+// StartBodyCapture API Key或分组开启请求体捕获时，记录请求体和返回给客户端的响应
+// 返回恢复原响应写入器的函数
+func StartBodyCapture(c *gin.Context, apiKey *model.ApiKey, requestBody []byte) func() {
+	limit := service.GetBodyCaptureLimit(apiKey)
+	if limit == 0 {
+		return func() {}
+	}
+
+	originalWriter := c.Writer
+	recordSize := service.BodyCaptureRecordSize(limit, gjson.GetBytes(requestBody, "stream").Bool())
+	recorder := NewResponseRecorder(originalWriter, recordSize)
+	c.Writer = recorder
+	c.Set(bodyCaptureContextKey, &bodyCapture{
+		recorder:    recorder,
+		requestBody: requestBody,
+		limit:       limit,
+	})
+
+	return func() {
+		c.Writer = originalWriter
+	}
+}
+
+// SnapshotBodyCapture 复制当前已记录的请求体和响应，未开启捕获时返回nil
+func SnapshotBodyCapture(c *gin.Context) *BodyCaptureSnapshot {
+	value, exists := c.Get(bodyCaptureContextKey)
+	if !exists {
+		return nil
+	}
+
+	capture := value.(*bodyCapture)
+	return &BodyCaptureSnapshot{
+		requestBody:  append([]byte(nil), capture.requestBody...),
+		responseBody: append([]byte(nil), capture.recorder.Recorded()...),
+		limit:        capture.limit,
+		incomplete:   capture.recorder.Overflowed(),
+	}
+}
+
+// Save 保存与日志关联的捕获内容，快照为nil时不做任何操作
+func (s *BodyCaptureSnapshot) Save(logID string) {
+	if s == nil {
+		return
+	}
+
+	if err := service.NewLogCaptureService().SaveLogCapture(logID, s.requestBody, s.responseBody, s.limit, s.incomplete); err != nil {
+		log.Printf("保存日志 %s 的请求体捕获失败: %v", logID, err)
+	}
+}
@@ -0,0 +1,177 @@
+package relay
+
+import (
+	"encoding/json"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// Claude单个请求最多允许的缓存断点数
+const maxCacheBreakpoints = 4
+
+var ephemeralCacheControl = []byte(`{"type":"ephemeral"}`)
+
+// applyGroupCacheControl 分组开启自动缓存断点时为请求添加cache_control，返回是否添加了断点
+// 分组是否开启由转发流程在请求开始时确定并写入上下文auto_cache_control，故障转移的每次尝试不再重复查询
+func applyGroupCacheControl(c *gin.Context, body []byte) ([]byte, bool) {
+	if !c.GetBool("auto_cache_control") {
+		return body, false
+	}
+
+	body, injected := injectCacheControl(body)
+	return body, injected > 0
+}
+
+// injectCacheControl 按工具列表、系统提示词、最后一条稳定的用户消息的顺序添加缓存断点
+// 已设置断点的位置保持不变，总断点数不超过上限；返回新增的断点数
+func injectCacheControl(body []byte) ([]byte, int) {
+	remaining := maxCacheBreakpoints - countCacheBreakpoints(body)
+	injected := 0
+
+	for _, inject := range []func([]byte) ([]byte, bool){
+		injectToolsCacheControl,
+		injectSystemCacheControl,
+		injectMessagesCacheControl,
+	} {
+		if remaining <= 0 {
+			break
+		}
+		if updated, ok := inject(body); ok {
+			body = updated
+			remaining--
+			injected++
+		}
+	}
+
+	return body, injected
+}
+
+// countCacheBreakpoints 统计请求中已有的缓存断点数
+func countCacheBreakpoints(body []byte) int {
+	count := 0
+	for _, path := range []string{"tools", "system", "messages"} {
+		count += countCacheControl(gjson.GetBytes(body, path))
+	}
+	return count
+}
+
+// countCacheControl 递归统计内容中的cache_control数量（包括tool_result中嵌套的内容块）
+func countCacheControl(value gjson.Result) int {
+	count := 0
+	switch {
+	case value.IsArray():
+		for _, item := range value.Array() {
+			count += countCacheControl(item)
+		}
+	case value.IsObject():
+		value.ForEach(func(key, item gjson.Result) bool {
+			if key.String() == "cache_control" {
+				count++
+			} else {
+				count += countCacheControl(item)
+			}
+			return true
+		})
+	}
+	return count
+}
+
+func hasCacheControl(value gjson.Result) bool {
+	return countCacheControl(value) > 0
+}
+
+// injectToolsCacheControl 在最后一个工具定义上添加断点，缓存整个工具列表
+func injectToolsCacheControl(body []byte) ([]byte, bool) {
+	tools := gjson.GetBytes(body, "tools")
+	if !tools.IsArray() || len(tools.Array()) == 0 || hasCacheControl(tools) {
+		return body, false
+	}
+
+	path := "tools." + strconv.Itoa(len(tools.Array())-1) + ".cache_control"
+	updated, err := sjson.SetRawBytes(body, path, ephemeralCacheControl)
+	if err != nil {
+		return body, false
+	}
+	return updated, true
+}
+
+// injectSystemCacheControl 在系统提示词的最后一个文本块上添加断点，字符串形式的系统提示词转换为文本块
+func injectSystemCacheControl(body []byte) ([]byte, bool) {
+	system := gjson.GetBytes(body, "system")
+	path, ok := lastCacheableBlockPath("system", system)
+	if !ok {
+		return body, false
+	}
+	return setCacheControl(body, path, system)
+}
+
+// injectMessagesCacheControl 在最后一条稳定的用户消息上添加断点
+// 最后一条用户消息通常每次请求都不同，因此选择它之前的用户消息，缓存此前的对话历史
+func injectMessagesCacheControl(body []byte) ([]byte, bool) {
+	messages := gjson.GetBytes(body, "messages")
+	if !messages.IsArray() || hasCacheControl(messages) {
+		return body, false
+	}
+
+	items := messages.Array()
+	for i := len(items) - 2; i >= 0; i-- {
+		if items[i].Get("role").String() != "user" {
+			continue
+		}
+		content := items[i].Get("content")
+		path, ok := lastCacheableBlockPath("messages."+strconv.Itoa(i)+".content", content)
+		if !ok {
+			return body, false
+		}
+		return setCacheControl(body, path, content)
+	}
+	return body, false
+}
+
+// lastCacheableBlockPath 获取内容中最后一个可添加断点的块路径
+// 内容为字符串时返回内容本身的路径，空内容和思考块不能添加断点
+func lastCacheableBlockPath(contentPath string, content gjson.Result) (string, bool) {
+	if content.Type == gjson.String {
+		return contentPath, content.Str != ""
+	}
+	if !content.IsArray() || hasCacheControl(content) {
+		return "", false
+	}
+
+	blocks := content.Array()
+	for i := len(blocks) - 1; i >= 0; i-- {
+		switch blocks[i].Get("type").String() {
+		case "thinking", "redacted_thinking":
+			continue
+		case "text":
+			if blocks[i].Get("text").String() == "" {
+				continue
+			}
+		}
+		return contentPath + "." + strconv.Itoa(i), true
+	}
+	return "", false
+}
+
+// setCacheControl 为块添加断点，字符串内容先转换为带断点的文本块数组
+func setCacheControl(body []byte, path string, content gjson.Result) ([]byte, bool) {
+	var updated []byte
+	var err error
+	if content.Type == gjson.String {
+		block, _ := json.Marshal([]map[string]interface{}{{
+			"type":          "text",
+			"text":          content.Str,
+			"cache_control": json.RawMessage(ephemeralCacheControl),
+		}})
+		updated, err = sjson.SetRawBytes(body, path, block)
+	} else {
+		updated, err = sjson.SetRawBytes(body, path+".cache_control", ephemeralCacheControl)
+	}
+	if err != nil {
+		return body, false
+	}
+	return updated, true
+}
@@ -3,12 +3,12 @@ package relay
 import (
 	"bytes"
 	"claude-code-relay/common"
+	"claude-code-relay/constant"
 	"claude-code-relay/model"
 	"claude-code-relay/service"
 	"compress/flate"
 	"compress/gzip"
 	"context"
-	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -16,8 +16,6 @@ import (
 	"io"
 	"log"
 	"net/http"
-	"net/url"
-	"os"
 	"strconv"
 	"strings"
 	"time"
@@ -32,15 +30,22 @@ const (
 	ClaudeOAuthTokenURL  = "https://console.anthropic.com/v1/oauth/token"
 	ClaudeOAuthClientID  = "9d1c250a-e61b-44d9-88ed-5944d1962f5e"
 
-	// 默认超时配置
-	defaultHTTPTimeout = 120 * time.Second
 	tokenRefreshBuffer = 300 // 5分钟
 	rateLimitDuration  = 5 * time.Hour
 
+	// 后台续期token的重试次数和首次重试间隔（之后每次翻倍）
+	tokenRenewMaxAttempts  = 3
+	tokenRenewRetryBackoff = 2 * time.Second
+
 	// 状态码
 	statusRateLimit  = 429
 	statusOK         = 200
 	statusBadRequest = 400
+	// 客户端在响应完成前断开连接（沿用nginx的499约定，仅用于日志和中间件）
+	statusClientClosedRequest = 499
+
+	// 本地估算count_tokens时添加的响应头
+	countTokensEstimatedHeader = "X-Token-Count-Estimated"
 
 	// 账号状态
 	accountStatusActive    = 1
@@ -52,11 +57,12 @@ const (
 var (
 	errAuthFailed    = gin.H{"error": map[string]interface{}{"type": "authentication_error", "message": "Failed to get valid access token"}}
 	errCreateRequest = gin.H{"error": map[string]interface{}{"type": "internal_server_error", "message": "Failed to create request"}}
-	errProxyConfig   = gin.H{"error": map[string]interface{}{"type": "proxy_configuration_error", "message": "Invalid proxy URI"}}
-	errTimeout       = gin.H{"error": map[string]interface{}{"type": "timeout_error", "message": "Request was canceled or timed out"}}
+	errProxyConfig   = gin.H{"error": map[string]interface{}{"type": "proxy_configuration_error", "message": "Invalid proxy or TLS configuration"}}
+	errTimeout       = gin.H{"error": map[string]interface{}{"type": "timeout_error", "message": "Upstream request timed out"}}
 	errNetworkError  = gin.H{"error": map[string]interface{}{"type": "network_error", "message": "Failed to execute request"}}
 	errDecompression = gin.H{"error": map[string]interface{}{"type": "decompression_error", "message": "Failed to create decompressor"}}
 	errResponseRead  = gin.H{"error": map[string]interface{}{"type": "response_read_error", "message": "Failed to read error response"}}
+	errConcurrency   = gin.H{"error": map[string]interface{}{"type": "concurrency_limit_error", "message": "Account concurrency limit reached"}}
 )
 
 // OAuthTokenResponse 表示OAuth token刷新响应
@@ -93,12 +99,24 @@ func HandleClaudeRequest(c *gin.Context, account *model.Account, requestBody []b
 		return
 	}
 
+	slot, ok := acquireAccountSlot(c, account)
+	if !ok {
+		return
+	}
+	defer slot.Release()
+
+	req, guard := resolveUpstreamTimeouts(account).guard(req)
+	defer guard.stop()
+
 	resp, err := client.Do(req)
 	if err != nil {
+		err = guard.wrapError(err)
+		recordNetworkFailure(account, err)
 		handleRequestError(c, err)
 		return
 	}
 	defer common.CloseIO(resp.Body)
+	resp.Body = guard.wrapBody(resp.Body)
 
 	responseReader, err := createResponseReader(resp)
 	if err != nil {
@@ -108,7 +126,12 @@ func HandleClaudeRequest(c *gin.Context, account *model.Account, requestBody []b
 
 	var usageTokens *common.TokenUsage
 	if resp.StatusCode < statusBadRequest {
-		usageTokens = handleSuccessResponse(c, resp, responseReader)
+		usageTokens = handleSuccessResponse(c, resp, responseReader, requestData.ClientStream)
+		if usageTokens != nil {
+			usageTokens.ApplyEstimate(requestData.Body)
+			usageTokens.AutoCacheControl = requestData.AutoCacheControl
+		}
+		markInterruptedUsage(c, account, usageTokens)
 	} else {
 		handleErrorResponse(c, resp, responseReader, account)
 	}
@@ -119,12 +142,14 @@ func HandleClaudeRequest(c *gin.Context, account *model.Account, requestBody []b
 		go service.UpdateApiKeyStatus(apiKey, resp.StatusCode, usageTokens)
 	}
 
-	saveRequestLog(startTime, apiKey, account, resp.StatusCode, usageTokens, true)
+	saveRequestLog(c, startTime, apiKey, account, resp.StatusCode, usageTokens, requestData.ClientStream)
 }
 
 // requestData 封装请求数据
 type requestData struct {
-	Body []byte
+	Body             []byte
+	ClientStream     bool // 客户端原始请求是否为流式
+	AutoCacheControl bool // 是否自动添加了缓存断点
 }
 
 // extractAPIKey 从上下文中提取API Key
@@ -146,40 +171,42 @@ func prepareRequestBody(c *gin.Context, requestBody []byte) *requestData {
 		body, _ = sjson.SetBytes(body, "metadata.user_id", common.GetInstanceID()) // 设置固定的用户ID
 	}
 
-	return &requestData{Body: body}
+	body, autoCacheControl := applyGroupCacheControl(c, body)
+
+	return &requestData{
+		Body:             body,
+		ClientStream:     gjson.GetBytes(requestBody, "stream").Bool(),
+		AutoCacheControl: autoCacheControl,
+	}
 }
 
 // createHTTPClient 创建HTTP客户端
+// 不设置整体超时，由timeoutGuard按阶段控制，避免长时间的流式响应被截断
 func createHTTPClient(account *model.Account) *http.Client {
-	timeout := parseHTTPTimeout()
-
-	transport := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-	}
-
-	if account.EnableProxy && account.ProxyURI != "" {
-		proxyURL, err := url.Parse(account.ProxyURI)
-		if err != nil {
-			log.Printf("invalid proxy URI: %s", err.Error())
-			return nil
-		}
-		transport.Proxy = http.ProxyURL(proxyURL)
+	client, err := newAccountHTTPClient(account, accountProxyURI(account), 0)
+	if err != nil {
+		log.Printf("invalid proxy or TLS configuration: %s", err.Error())
+		return nil
 	}
+	return client
+}
 
-	return &http.Client{
-		Timeout:   timeout,
-		Transport: transport,
+// accountProxyURI 获取账号实际使用的代理地址（未启用代理时为空）
+func accountProxyURI(account *model.Account) string {
+	if account.EnableProxy {
+		return account.ProxyURI
 	}
+	return ""
 }
 
-// parseHTTPTimeout 解析HTTP超时时间
-func parseHTTPTimeout() time.Duration {
-	if timeoutStr := os.Getenv("HTTP_CLIENT_TIMEOUT"); timeoutStr != "" {
-		if timeout, err := time.ParseDuration(timeoutStr + "s"); err == nil {
-			return timeout
-		}
+// newAccountHTTPClient 获取账号的上游HTTP客户端
+// 账号关联了代理池中的代理或代理分组时优先使用，否则使用账号上配置的代理URI
+func newAccountHTTPClient(account *model.Account, legacyProxyURI string, timeout time.Duration) (*http.Client, error) {
+	proxyURI, err := service.NewProxyService().ResolveAccountProxyURI(account, legacyProxyURI)
+	if err != nil {
+		return nil, err
 	}
-	return defaultHTTPTimeout
+	return common.GetHTTPClient(account.ID, proxyURI, account.TLSOptions(), timeout)
 }
 
 // createClaudeRequest 创建Claude请求
@@ -194,20 +221,17 @@ func createClaudeRequest(c *gin.Context, body []byte, accessToken string) (*http
 		return nil, err
 	}
 
-	copyRequestHeaders(c, req)
+	copyRequestHeaders(c, req, constant.PlatformClaude)
 	setClaudeAPIHeaders(req, accessToken)
 	setStreamHeaders(c, req)
 
 	return req, nil
 }
 
-// copyRequestHeaders 复制原始请求头
-func copyRequestHeaders(c *gin.Context, req *http.Request) {
-	for name, values := range c.Request.Header {
-		for _, value := range values {
-			req.Header.Add(name, value)
-		}
-	}
+// copyRequestHeaders 按请求头转发规则复制原始请求头，并注入规则配置的固定请求头
+func copyRequestHeaders(c *gin.Context, req *http.Request, platformType string) {
+	policy := service.NewHeaderRuleService().GetHeaderPolicy(model.HeaderRuleDirectionRequest, platformType, c.GetInt("group_id"))
+	policy.Apply(c.Request.Header, req.Header)
 }
 
 // setClaudeAPIHeaders 设置Claude API请求头
@@ -232,10 +256,37 @@ func setStreamHeaders(c *gin.Context, req *http.Request) {
 	}
 }
 
+// acquireAccountSlot 获取账号并发槽位，达到并发上限时返回429以便切换到其他账号
+// 槽位覆盖上游请求和流式响应的整个生命周期，调用方需在请求结束后释放
+func acquireAccountSlot(c *gin.Context, account *model.Account) (*service.ConcurrencySlot, bool) {
+	slot, ok := service.NewConcurrencyService().Acquire(account)
+	if !ok {
+		log.Printf("账号 %s (ID: %d) 并发已达上限 %d", account.Name, account.ID, account.MaxConcurrency)
+		c.JSON(http.StatusTooManyRequests, errConcurrency)
+		return nil, false
+	}
+	return slot, true
+}
+
+// recordNetworkFailure 将网络错误计入账号熔断器（客户端主动取消的请求除外）
+func recordNetworkFailure(account *model.Account, err error) {
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+	service.NewCircuitBreakerService().RecordFailure(account.ID)
+}
+
 // handleRequestError 处理请求错误
 func handleRequestError(c *gin.Context, err error) {
+	if timeoutErr := asUpstreamTimeout(err); timeoutErr != nil {
+		log.Printf("❌ 上游请求超时: %v", timeoutErr)
+		c.JSON(http.StatusGatewayTimeout, appendErrorMessage(errTimeout, timeoutErr.Error()))
+		return
+	}
 	if errors.Is(err, context.Canceled) {
-		c.JSON(http.StatusRequestTimeout, errTimeout)
+		// 客户端已断开，无需再返回响应体
+		log.Printf("客户端在上游响应前断开连接: %v", err)
+		c.AbortWithStatus(statusClientClosedRequest)
 		return
 	}
 
@@ -263,9 +314,13 @@ func createResponseReader(resp *http.Response) (io.Reader, error) {
 }
 
 // handleSuccessResponse 处理成功响应
-func handleSuccessResponse(c *gin.Context, resp *http.Response, responseReader io.Reader) *common.TokenUsage {
+func handleSuccessResponse(c *gin.Context, resp *http.Response, responseReader io.Reader, clientStream bool) *common.TokenUsage {
+	if !clientStream {
+		return handleAggregatedResponse(c, resp, responseReader, constant.PlatformClaude)
+	}
+
 	c.Status(resp.StatusCode)
-	copyResponseHeaders(c, resp)
+	copyResponseHeaders(c, resp, constant.PlatformClaude)
 	setStreamResponseHeaders(c)
 
 	c.Writer.Flush()
@@ -273,11 +328,64 @@ func handleSuccessResponse(c *gin.Context, resp *http.Response, responseReader i
 	usageTokens, err := common.ParseStreamResponse(c.Writer, responseReader)
 	if err != nil {
 		log.Println("stream copy and parse failed:", err.Error())
+		writeUpstreamTimeoutError(c.Writer, err, true)
+	}
+
+	return usageTokens
+}
+
+// handleAggregatedResponse 客户端请求非流式响应时，将上游SSE合并为完整的消息JSON返回
+func handleAggregatedResponse(c *gin.Context, resp *http.Response, responseReader io.Reader, platformType string) *common.TokenUsage {
+	var streamBody bytes.Buffer
+	usageTokens, err := common.ParseStreamResponse(&streamBody, responseReader)
+	if err != nil {
+		log.Println("stream read and parse failed:", err.Error())
+	}
+
+	if timeoutErr := asUpstreamTimeout(err); timeoutErr != nil {
+		c.JSON(http.StatusGatewayTimeout, appendErrorMessage(errTimeout, timeoutErr.Error()))
+		return usageTokens
+	}
+	if usageTokens != nil && usageTokens.Interrupted {
+		// 上游流在中途断开，无法合并出完整消息，但已产生的用量仍需计费
+		c.JSON(http.StatusBadGateway, appendErrorMessage(errNetworkError, "upstream stream interrupted"))
+		return usageTokens
 	}
 
+	messageJSON, streamErr, err := common.AggregateStreamResponse(streamBody.Bytes())
+	if streamErr != nil {
+		log.Printf("❌ 流式响应中包含错误事件: %s", string(streamErr.Body))
+		c.Data(streamErr.StatusCode, "application/json", streamErr.Body)
+		return nil
+	}
+	if err != nil {
+		log.Printf("❌ 合并流式响应失败: %v", err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": map[string]interface{}{"type": "api_error", "message": "Failed to aggregate stream response: " + err.Error()}})
+		return nil
+	}
+
+	copyResponseHeaders(c, resp, platformType)
+	c.Writer.Header().Del("Content-Encoding")
+	c.Header("Content-Type", "application/json")
+	c.Data(resp.StatusCode, "application/json", messageJSON)
+
 	return usageTokens
 }
 
+// markInterruptedUsage 标记中断的响应
+// 客户端断开时写入可能不会立即报错，这里以请求上下文为准；中断前已产生的用量照常计费并在日志中标记
+func markInterruptedUsage(c *gin.Context, account *model.Account, usageTokens *common.TokenUsage) {
+	if usageTokens == nil {
+		return
+	}
+	if c.Request.Context().Err() != nil {
+		usageTokens.Interrupted = true
+	}
+	if usageTokens.Interrupted {
+		log.Printf("⚠️ 账号 %s (ID: %d) 响应中断，按已产生用量计费: input=%d, output=%d", account.Name, account.ID, usageTokens.InputTokens, usageTokens.OutputTokens)
+	}
+}
+
 // handleErrorResponse 处理错误响应
 func handleErrorResponse(c *gin.Context, resp *http.Response, responseReader io.Reader, account *model.Account) {
 	responseBody, err := io.ReadAll(responseReader)
@@ -290,21 +398,16 @@ func handleErrorResponse(c *gin.Context, resp *http.Response, responseReader io.
 	log.Printf("❌ 状态码: %s, 错误响应内容: %s", strconv.Itoa(resp.StatusCode), string(responseBody))
 
 	c.Status(resp.StatusCode)
-	copyResponseHeaders(c, resp)
+	copyResponseHeaders(c, resp, constant.PlatformClaude)
 
 	handleRateLimit(resp, responseBody, account)
 	c.Data(resp.StatusCode, resp.Header.Get("Content-Type"), responseBody)
 }
 
-// copyResponseHeaders 复制响应头
-func copyResponseHeaders(c *gin.Context, resp *http.Response) {
-	for name, values := range resp.Header {
-		if strings.ToLower(name) != "content-length" {
-			for _, value := range values {
-				c.Header(name, value)
-			}
-		}
-	}
+// copyResponseHeaders 按响应头转发规则复制上游响应头，并注入规则配置的固定响应头
+func copyResponseHeaders(c *gin.Context, resp *http.Response, platformType string) {
+	policy := service.NewHeaderRuleService().GetHeaderPolicy(model.HeaderRuleDirectionResponse, platformType, c.GetInt("group_id"))
+	policy.Apply(resp.Header, c.Writer.Header())
 }
 
 // setStreamResponseHeaders 设置流式响应头
@@ -400,15 +503,19 @@ func clearRateLimitIfExpired(account *model.Account) {
 }
 
 // saveRequestLog 保存请求日志
-func saveRequestLog(startTime time.Time, apiKey *model.ApiKey, account *model.Account, statusCode int, usageTokens *common.TokenUsage, isStream bool) {
+func saveRequestLog(c *gin.Context, startTime time.Time, apiKey *model.ApiKey, account *model.Account, statusCode int, usageTokens *common.TokenUsage, isStream bool) {
 	if statusCode >= statusOK && statusCode < 300 && usageTokens != nil && apiKey != nil {
 		duration := time.Since(startTime).Milliseconds()
 		logService := service.NewLogService()
+		capture := SnapshotBodyCapture(c)
+		info := service.NewRequestLogInfo(c)
 		go func() {
-			_, err := logService.CreateLogFromTokenUsage(usageTokens, apiKey.UserID, apiKey.ID, account.ID, duration, isStream)
+			logEntry, err := logService.CreateLogFromTokenUsage(usageTokens, apiKey.UserID, apiKey.ID, account.ID, duration, isStream, info)
 			if err != nil {
 				log.Printf("保存日志失败: %v", err)
+				return
 			}
+			capture.Save(logEntry.ID)
 		}()
 	}
 }
@@ -443,22 +550,9 @@ func TestsHandleClaudeRequest(account *model.Account) (int, string) {
 		req.Header.Set(name, value)
 	}
 
-	httpClientTimeout := 30 * time.Second
-	transport := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-	}
-
-	if account.EnableProxy && account.ProxyURI != "" {
-		proxyURL, err := url.Parse(account.ProxyURI)
-		if err != nil {
-			return http.StatusInternalServerError, "Invalid proxy URI: " + err.Error()
-		}
-		transport.Proxy = http.ProxyURL(proxyURL)
-	}
-
-	client := &http.Client{
-		Timeout:   httpClientTimeout,
-		Transport: transport,
+	client, err := newAccountHTTPClient(account, accountProxyURI(account), 30*time.Second)
+	if err != nil {
+		return http.StatusInternalServerError, "Invalid proxy or TLS configuration: " + err.Error()
 	}
 
 	resp, err := client.Do(req)
@@ -486,62 +580,122 @@ func buildClaudeAPIHeaders(accessToken string, anthropicBeta string) map[string]
 }
 
 // getValidAccessToken 获取有效的访问token，如果过期则自动刷新
+// 正常情况下token由定时任务提前续期，这里只在续期失败或未及时续期时兜底
 func getValidAccessToken(account *model.Account) (string, error) {
 	// 检查当前token是否存在
 	if account.AccessToken == "" {
 		return "", errors.New("账号缺少访问token")
 	}
 
-	// 检查token是否过期（提前5分钟刷新）
-	now := time.Now().Unix()
+	// 如果过期时间存在且距离过期不到5分钟，或者已经过期，则需要刷新
+	if !tokenNeedsRefresh(account, tokenRefreshBuffer) {
+		return account.AccessToken, nil
+	}
+
+	log.Printf("账号 %s 的token即将过期或已过期，尝试刷新", account.Name)
+
+	if account.RefreshToken == "" {
+		return "", errors.New("账号缺少刷新token，无法自动刷新")
+	}
+
 	expiresAt := int64(account.ExpiresAt)
+	if err := refreshAccountToken(account, tokenRefreshBuffer); err != nil {
+		log.Printf("刷新token失败: %v", err)
+		// 刷新失败时，如果当前token未完全过期，仍尝试使用
+		if time.Now().Unix() < expiresAt {
+			log.Printf("刷新失败但token未完全过期，尝试使用当前token")
+			return account.AccessToken, nil
+		}
 
-	// 如果过期时间存在且距离过期不到5分钟，或者已经过期，则需要刷新
-	if expiresAt > 0 && now >= (expiresAt-tokenRefreshBuffer) {
-		log.Printf("账号 %s 的token即将过期或已过期，尝试刷新", account.Name)
+		// 其他实例仍在刷新，本次请求放弃该账号，不禁用
+		if errors.Is(err, service.ErrTokenRefreshTimeout) {
+			return "", err
+		}
 
-		if account.RefreshToken == "" {
-			return "", errors.New("账号缺少刷新token，无法自动刷新")
+		// token已过期且刷新失败，禁用此账号
+		log.Printf("token已过期且刷新失败，禁用账号: %s", account.Name)
+		account.CurrentStatus = accountStatusDisabled // 设置为禁用状态
+		if updateErr := model.UpdateAccount(account); updateErr != nil {
+			log.Printf("禁用账号失败: %v", updateErr)
+		} else {
+			log.Printf("账号 %s 已被自动禁用", account.Name)
 		}
+		return "", fmt.Errorf("token已过期且刷新失败: %v", err)
+	}
+
+	return account.AccessToken, nil
+}
 
-		// 刷新token
-		newAccessToken, newRefreshToken, newExpiresAt, err := refreshToken(account)
+// tokenNeedsRefresh 判断token是否会在buffer秒内过期
+func tokenNeedsRefresh(account *model.Account, buffer int64) bool {
+	expiresAt := int64(account.ExpiresAt)
+	return expiresAt > 0 && time.Now().Unix() >= expiresAt-buffer
+}
+
+// refreshAccountToken 刷新账号token，并将数据库中的最新token同步到account
+// 同一账号同一时间只有一个请求（跨实例）真正调用刷新接口，其余请求等待后直接使用刷新结果
+func refreshAccountToken(account *model.Account, buffer int64) error {
+	err := service.NewTokenRefreshService().Refresh(account.ID, func() error {
+		// 重新读取token，等待期间可能已被其他请求或实例刷新
+		latest, err := model.GetAccountByID(account.ID)
 		if err != nil {
-			log.Printf("刷新token失败: %v", err)
-			// 刷新失败时，如果当前token未完全过期，仍尝试使用
-			if now < expiresAt {
-				log.Printf("刷新失败但token未完全过期，尝试使用当前token")
-				return account.AccessToken, nil
-			}
+			return fmt.Errorf("读取账号失败: %v", err)
+		}
+		if !tokenNeedsRefresh(latest, buffer) {
+			return nil
+		}
 
-			// token已过期且刷新失败，禁用此账号
-			log.Printf("token已过期且刷新失败，禁用账号: %s", account.Name)
-			account.CurrentStatus = accountStatusDisabled // 设置为禁用状态
-			if updateErr := model.UpdateAccount(account); updateErr != nil {
-				log.Printf("禁用账号失败: %v", updateErr)
-			} else {
-				log.Printf("账号 %s 已被自动禁用", account.Name)
+		newAccessToken, newRefreshToken, newExpiresAt, err := refreshToken(latest)
+		if err != nil {
+			if recordErr := model.RecordAccountTokenRefreshFailure(account.ID, err.Error()); recordErr != nil {
+				log.Printf("记录账号token刷新失败状态失败: %v", recordErr)
 			}
-			return "", fmt.Errorf("token已过期且刷新失败: %v", err)
+			return err
+		}
+		if newRefreshToken == "" {
+			newRefreshToken = latest.RefreshToken
 		}
 
-		// 更新账号信息
-		account.AccessToken = newAccessToken
-		account.RefreshToken = newRefreshToken
-		account.ExpiresAt = int(newExpiresAt)
-
-		// 保存到数据库
-		if err := model.UpdateAccount(account); err != nil {
-			log.Printf("更新账号token信息到数据库失败: %v", err)
-			// 不返回错误，因为内存中的token已经更新
+		if err := model.UpdateAccountToken(account.ID, newAccessToken, newRefreshToken, int(newExpiresAt)); err != nil {
+			return fmt.Errorf("保存刷新后的token失败: %v", err)
 		}
 
 		log.Printf("账号 %s token刷新成功", account.Name)
-		return newAccessToken, nil
+		return nil
+	})
+	if err != nil {
+		return err
 	}
 
-	// token还有效，直接返回
-	return account.AccessToken, nil
+	latest, err := model.GetAccountByID(account.ID)
+	if err != nil {
+		return fmt.Errorf("读取账号失败: %v", err)
+	}
+	account.AccessToken = latest.AccessToken
+	account.RefreshToken = latest.RefreshToken
+	account.ExpiresAt = latest.ExpiresAt
+	account.TokenRefreshedAt = latest.TokenRefreshedAt
+	account.TokenRefreshError = latest.TokenRefreshError
+	account.TokenRefreshFailures = latest.TokenRefreshFailures
+	return nil
+}
+
+// RenewAccountToken 提前续期账号token（供定时任务调用），失败时按指数退避重试
+func RenewAccountToken(account *model.Account, renewBefore time.Duration) error {
+	var err error
+	for attempt := 1; attempt <= tokenRenewMaxAttempts; attempt++ {
+		err = refreshAccountToken(account, int64(renewBefore/time.Second))
+		if err == nil {
+			return nil
+		}
+
+		if attempt < tokenRenewMaxAttempts {
+			backoff := tokenRenewRetryBackoff << (attempt - 1)
+			log.Printf("账号 %s 第%d次续期token失败: %v，%s后重试", account.Name, attempt, err, backoff)
+			time.Sleep(backoff)
+		}
+	}
+	return err
 }
 
 // refreshToken 使用refresh token获取新的access token
@@ -569,21 +723,10 @@ func refreshToken(account *model.Account) (accessToken, refreshToken string, exp
 	req.Header.Set("Referer", "https://claude.ai/")
 	req.Header.Set("Origin", "https://claude.ai")
 
-	// 创建HTTP客户端，配置代理（如果启用）
-	transport := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-	}
-
-	if account.EnableProxy && account.ProxyURI != "" {
-		proxyURL, err := url.Parse(account.ProxyURI)
-		if err == nil {
-			transport.Proxy = http.ProxyURL(proxyURL)
-		}
-	}
-
-	client := &http.Client{
-		Timeout:   30 * time.Second,
-		Transport: transport,
+	// 获取HTTP客户端，配置代理（如果启用）
+	client, err := newAccountHTTPClient(account, accountProxyURI(account), service.TokenRefreshRequestTimeout)
+	if err != nil {
+		return "", "", 0, fmt.Errorf("创建HTTP客户端失败: %v", err)
 	}
 
 	resp, err := client.Do(req)
@@ -653,7 +796,7 @@ func GetCountTokens(c *gin.Context, account *model.Account, requestBody []byte)
 	}
 
 	// 复制原始请求头
-	copyRequestHeaders(c, req)
+	copyRequestHeaders(c, req, constant.PlatformClaude)
 
 	// 设置Claude API请求头，包含Authorization认证
 	anthropicBeta := req.Header.Get("anthropic-beta")
@@ -689,7 +832,7 @@ func GetCountTokens(c *gin.Context, account *model.Account, requestBody []byte)
 
 	// 设置响应状态码和头部
 	c.Status(resp.StatusCode)
-	copyResponseHeaders(c, resp)
+	copyResponseHeaders(c, resp, constant.PlatformClaude)
 
 	// 如果是错误响应，处理错误逻辑
 	if resp.StatusCode >= statusBadRequest {
@@ -700,3 +843,17 @@ func GetCountTokens(c *gin.Context, account *model.Account, requestBody []byte)
 	// 返回原始响应
 	c.Data(resp.StatusCode, resp.Header.Get("Content-Type"), responseBody)
 }
+
+// RespondEstimatedCountTokens 使用本地估算返回count_tokens结果
+// 响应结构与官方接口一致，并通过响应头告知客户端该结果为估算值
+func RespondEstimatedCountTokens(c *gin.Context, requestBody []byte) {
+	if !gjson.ValidBytes(requestBody) {
+		c.JSON(http.StatusBadRequest, gin.H{"type": "error", "error": map[string]interface{}{"type": "invalid_request_error", "message": "Invalid JSON request body"}})
+		return
+	}
+
+	c.Header(countTokensEstimatedHeader, "true")
+	c.JSON(http.StatusOK, gin.H{
+		"input_tokens": common.EstimateInputTokens(requestBody),
+	})
+}
@@ -3,18 +3,16 @@ package relay
 import (
 	"bytes"
 	"claude-code-relay/common"
+	"claude-code-relay/constant"
 	"claude-code-relay/model"
 	"claude-code-relay/service"
 	"compress/flate"
 	"compress/gzip"
 	"context"
-	"crypto/tls"
 	"errors"
 	"io"
 	"log"
 	"net/http"
-	"net/url"
-	"os"
 	"strconv"
 	"strings"
 	"time"
@@ -25,9 +23,6 @@ import (
 )
 
 const (
-	// Console默认超时配置
-	consoleDefaultTimeout = 120 * time.Second
-
 	// 状态码
 	consoleStatusOK         = 200
 	consoleStatusBadRequest = 400
@@ -43,8 +38,8 @@ const (
 var (
 	consoleErrRequestBodyRead = gin.H{"error": map[string]interface{}{"type": "request_body_error", "message": "Failed to read request body"}}
 	consoleErrCreateRequest   = gin.H{"error": map[string]interface{}{"type": "internal_server_error", "message": "Failed to create request"}}
-	consoleErrProxyConfig     = gin.H{"error": map[string]interface{}{"type": "proxy_configuration_error", "message": "Invalid proxy URI"}}
-	consoleErrTimeout         = gin.H{"error": map[string]interface{}{"type": "timeout_error", "message": "Request was canceled or timed out"}}
+	consoleErrProxyConfig     = gin.H{"error": map[string]interface{}{"type": "proxy_configuration_error", "message": "Invalid proxy or TLS configuration"}}
+	consoleErrTimeout         = gin.H{"error": map[string]interface{}{"type": "timeout_error", "message": "Upstream request timed out"}}
 	consoleErrNetworkError    = gin.H{"error": map[string]interface{}{"type": "network_error", "message": "Failed to execute request"}}
 	consoleErrDecompression   = gin.H{"error": map[string]interface{}{"type": "decompression_error", "message": "Failed to create decompressor"}}
 )
@@ -55,12 +50,18 @@ func HandleClaudeConsoleRequest(c *gin.Context, account *model.Account, requestB
 
 	apiKey := extractConsoleAPIKey(c)
 
+	// 记录客户端原始的stream参数，上游请求会被强制为流式
+	clientStream := gjson.GetBytes(requestBody, "stream").Bool()
+
 	body, err := parseConsoleRequest(c, requestBody)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, appendConsoleErrorMessage(consoleErrRequestBodyRead, err.Error()))
 		return
 	}
 
+	// 分组开启自动缓存断点时添加cache_control
+	body, autoCacheControl := applyGroupCacheControl(c, body)
+
 	client := createConsoleHTTPClient(account)
 	if client == nil {
 		c.JSON(http.StatusInternalServerError, consoleErrProxyConfig)
@@ -73,12 +74,24 @@ func HandleClaudeConsoleRequest(c *gin.Context, account *model.Account, requestB
 		return
 	}
 
+	slot, ok := acquireAccountSlot(c, account)
+	if !ok {
+		return
+	}
+	defer slot.Release()
+
+	req, guard := resolveUpstreamTimeouts(account).guard(req)
+	defer guard.stop()
+
 	resp, err := client.Do(req)
 	if err != nil {
+		err = guard.wrapError(err)
+		recordNetworkFailure(account, err)
 		handleConsoleRequestError(c, err)
 		return
 	}
 	defer common.CloseIO(resp.Body)
+	resp.Body = guard.wrapBody(resp.Body)
 
 	responseReader, err := createConsoleResponseReader(resp)
 	if err != nil {
@@ -88,7 +101,12 @@ func HandleClaudeConsoleRequest(c *gin.Context, account *model.Account, requestB
 
 	var usageTokens *common.TokenUsage
 	if resp.StatusCode < consoleStatusBadRequest {
-		usageTokens = handleConsoleSuccessResponse(c, resp, responseReader)
+		usageTokens = handleConsoleSuccessResponse(c, resp, responseReader, clientStream)
+		if usageTokens != nil {
+			usageTokens.ApplyEstimate(body)
+			usageTokens.AutoCacheControl = autoCacheControl
+		}
+		markInterruptedUsage(c, account, usageTokens)
 	} else {
 		handleConsoleErrorResponse(c, resp, responseReader, account)
 	}
@@ -101,7 +119,7 @@ func HandleClaudeConsoleRequest(c *gin.Context, account *model.Account, requestB
 	}
 
 	// 保存请求日志
-	saveConsoleRequestLog(startTime, apiKey, account, resp.StatusCode, usageTokens)
+	saveConsoleRequestLog(c, startTime, apiKey, account, resp.StatusCode, usageTokens, clientStream)
 }
 
 // extractConsoleAPIKey 从上下文中提取API Key
@@ -132,36 +150,14 @@ func parseConsoleRequest(c *gin.Context, requestBody []byte) ([]byte, error) {
 }
 
 // createConsoleHTTPClient 创建Console HTTP客户端
+// 不设置整体超时，由timeoutGuard按阶段控制
 func createConsoleHTTPClient(account *model.Account) *http.Client {
-	timeout := parseConsoleHTTPTimeout()
-
-	transport := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-	}
-
-	if account.ProxyURI != "" {
-		proxyURL, err := url.Parse(account.ProxyURI)
-		if err != nil {
-			log.Printf("invalid proxy URI: %s", err.Error())
-			return nil
-		}
-		transport.Proxy = http.ProxyURL(proxyURL)
-	}
-
-	return &http.Client{
-		Timeout:   timeout,
-		Transport: transport,
-	}
-}
-
-// parseConsoleHTTPTimeout 解析Console HTTP超时时间
-func parseConsoleHTTPTimeout() time.Duration {
-	if timeoutStr := os.Getenv("HTTP_CLIENT_TIMEOUT"); timeoutStr != "" {
-		if timeout, err := time.ParseDuration(timeoutStr + "s"); err == nil {
-			return timeout
-		}
+	client, err := newAccountHTTPClient(account, account.ProxyURI, 0)
+	if err != nil {
+		log.Printf("invalid proxy or TLS configuration: %s", err.Error())
+		return nil
 	}
-	return consoleDefaultTimeout
+	return client
 }
 
 // createConsoleRequest 创建Console请求
@@ -178,22 +174,13 @@ func createConsoleRequest(c *gin.Context, body []byte, account *model.Account) (
 		return nil, err
 	}
 
-	copyConsoleRequestHeaders(c, req)
+	copyRequestHeaders(c, req, constant.PlatformClaudeConsole)
 	setConsoleAPIHeaders(req, account.SecretKey)
 	setConsoleStreamHeaders(c, req)
 
 	return req, nil
 }
 
-// copyConsoleRequestHeaders 复制Console原始请求头
-func copyConsoleRequestHeaders(c *gin.Context, req *http.Request) {
-	for name, values := range c.Request.Header {
-		for _, value := range values {
-			req.Header.Add(name, value)
-		}
-	}
-}
-
 // setConsoleAPIHeaders 设置Console API请求头
 func setConsoleAPIHeaders(req *http.Request, secretKey string) {
 	// 获取 anthropic-beta 的请求头参数
@@ -225,8 +212,15 @@ func setConsoleStreamHeaders(c *gin.Context, req *http.Request) {
 
 // handleConsoleRequestError 处理Console请求错误
 func handleConsoleRequestError(c *gin.Context, err error) {
+	if timeoutErr := asUpstreamTimeout(err); timeoutErr != nil {
+		log.Println("upstream request timed out:", timeoutErr.Error())
+		c.JSON(http.StatusGatewayTimeout, appendConsoleErrorMessage(consoleErrTimeout, timeoutErr.Error()))
+		return
+	}
 	if errors.Is(err, context.Canceled) {
-		c.JSON(http.StatusRequestTimeout, consoleErrTimeout)
+		// 客户端已断开，无需再返回响应体
+		log.Println("client disconnected before upstream response:", err.Error())
+		c.AbortWithStatus(statusClientClosedRequest)
 		return
 	}
 
@@ -254,13 +248,17 @@ func createConsoleResponseReader(resp *http.Response) (io.Reader, error) {
 }
 
 // handleConsoleSuccessResponse 处理Console成功响应
-func handleConsoleSuccessResponse(c *gin.Context, resp *http.Response, responseReader io.Reader) *common.TokenUsage {
+func handleConsoleSuccessResponse(c *gin.Context, resp *http.Response, responseReader io.Reader, clientStream bool) *common.TokenUsage {
 	if (resp.StatusCode < consoleStatusOK || resp.StatusCode >= consoleStatusBadRequest) || responseReader == nil {
 		return nil
 	}
 
+	if !clientStream {
+		return handleAggregatedResponse(c, resp, responseReader, constant.PlatformClaudeConsole)
+	}
+
 	c.Status(resp.StatusCode)
-	copyConsoleResponseHeaders(c, resp)
+	copyResponseHeaders(c, resp, constant.PlatformClaudeConsole)
 	setConsoleStreamResponseHeaders(c)
 
 	c.Writer.Flush()
@@ -268,22 +266,12 @@ func handleConsoleSuccessResponse(c *gin.Context, resp *http.Response, responseR
 	usageTokens, err := common.ParseStreamResponse(c.Writer, responseReader)
 	if err != nil {
 		log.Println("stream copy and parse failed:", err.Error())
+		writeUpstreamTimeoutError(c.Writer, err, true)
 	}
 
 	return usageTokens
 }
 
-// copyConsoleResponseHeaders 复制Console响应头
-func copyConsoleResponseHeaders(c *gin.Context, resp *http.Response) {
-	for name, values := range resp.Header {
-		if strings.ToLower(name) != "content-length" {
-			for _, value := range values {
-				c.Header(name, value)
-			}
-		}
-	}
-}
-
 // setConsoleStreamResponseHeaders 设置Console流式响应头
 func setConsoleStreamResponseHeaders(c *gin.Context) {
 	c.Header("Cache-Control", "no-cache")
@@ -294,15 +282,19 @@ func setConsoleStreamResponseHeaders(c *gin.Context) {
 }
 
 // saveConsoleRequestLog 保存Console请求日志
-func saveConsoleRequestLog(startTime time.Time, apiKey *model.ApiKey, account *model.Account, statusCode int, usageTokens *common.TokenUsage) {
+func saveConsoleRequestLog(c *gin.Context, startTime time.Time, apiKey *model.ApiKey, account *model.Account, statusCode int, usageTokens *common.TokenUsage, isStream bool) {
 	if statusCode >= consoleStatusOK && statusCode < 300 && usageTokens != nil && apiKey != nil {
 		duration := time.Since(startTime).Milliseconds()
 		logService := service.NewLogService()
+		capture := SnapshotBodyCapture(c)
+		info := service.NewRequestLogInfo(c)
 		go func() {
-			_, err := logService.CreateLogFromTokenUsage(usageTokens, apiKey.UserID, apiKey.ID, account.ID, duration, true)
+			logEntry, err := logService.CreateLogFromTokenUsage(usageTokens, apiKey.UserID, apiKey.ID, account.ID, duration, isStream, info)
 			if err != nil {
 				log.Printf("保存日志失败: %v", err)
+				return
 			}
+			capture.Save(logEntry.ID)
 		}()
 	}
 }
@@ -326,7 +318,7 @@ func handleConsoleErrorResponse(c *gin.Context, resp *http.Response, responseRea
 	log.Printf("❌ 状态码: %s, 错误响应内容: %s", strconv.Itoa(resp.StatusCode), string(responseBody))
 
 	c.Status(resp.StatusCode)
-	copyConsoleResponseHeaders(c, resp)
+	copyResponseHeaders(c, resp, constant.PlatformClaudeConsole)
 
 	handleConsoleRateLimit(resp, responseBody, account)
 	c.Data(resp.StatusCode, resp.Header.Get("Content-Type"), responseBody)
@@ -434,9 +426,9 @@ func TestHandleClaudeConsoleRequest(account *model.Account) (int, string) {
 		req.Header.Set(name, value)
 	}
 
-	client := createConsoleHTTPClient(account)
-	if client == nil {
-		return http.StatusInternalServerError, "Failed to create HTTP client"
+	client, err := newAccountHTTPClient(account, account.ProxyURI, 30*time.Second)
+	if err != nil {
+		return http.StatusInternalServerError, "Failed to create HTTP client: " + err.Error()
 	}
 
 	resp, err := client.Do(req)
@@ -447,3 +439,67 @@ func TestHandleClaudeConsoleRequest(account *model.Account) (int, string) {
 
 	return resp.StatusCode, ""
 }
+
+// GetConsoleCountTokens 将count_tokens请求转发到Console账号
+// 上游不支持该接口（404/405）、上游异常或请求失败时，改为本地估算
+func GetConsoleCountTokens(c *gin.Context, account *model.Account, requestBody []byte) {
+	client, err := newAccountHTTPClient(account, account.ProxyURI, 30*time.Second)
+	if err != nil {
+		log.Printf("invalid proxy or TLS configuration: %s", err.Error())
+		RespondEstimatedCountTokens(c, requestBody)
+		return
+	}
+
+	req, err := http.NewRequestWithContext(
+		c.Request.Context(),
+		"POST",
+		account.RequestURL+"/v1/messages/count_tokens?beta=true",
+		bytes.NewBuffer(requestBody),
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, appendConsoleErrorMessage(consoleErrCreateRequest, err.Error()))
+		return
+	}
+
+	copyRequestHeaders(c, req, constant.PlatformClaudeConsole)
+	setConsoleAPIHeaders(req, account.SecretKey)
+	req.Header.Set("Accept", "application/json")
+	req.Header.Del("Cookie")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		if errors.Is(err, context.Canceled) {
+			c.AbortWithStatus(statusClientClosedRequest)
+			return
+		}
+		log.Printf("Console账号 %s count_tokens请求失败，使用本地估算: %v", account.Name, err)
+		RespondEstimatedCountTokens(c, requestBody)
+		return
+	}
+	defer common.CloseIO(resp.Body)
+
+	if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusMethodNotAllowed || resp.StatusCode >= 500 {
+		log.Printf("Console账号 %s count_tokens不可用(状态码: %d)，使用本地估算", account.Name, resp.StatusCode)
+		RespondEstimatedCountTokens(c, requestBody)
+		return
+	}
+
+	responseReader, err := createConsoleResponseReader(resp)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, appendConsoleErrorMessage(consoleErrDecompression, err.Error()))
+		return
+	}
+
+	responseBody, err := io.ReadAll(responseReader)
+	if err != nil {
+		log.Printf("读取count_tokens响应失败: %v", err)
+		RespondEstimatedCountTokens(c, requestBody)
+		return
+	}
+
+	if resp.StatusCode >= consoleStatusBadRequest {
+		log.Printf("❌ Console count_tokens状态码: %d, 响应内容: %s", resp.StatusCode, string(responseBody))
+	}
+
+	c.Data(resp.StatusCode, "application/json", responseBody)
+}
@@ -0,0 +1,90 @@
+package relay
+
+import (
+	"bytes"
+	"claude-code-relay/model"
+	"claude-code-relay/service"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 失败请求日志最多记录的错误响应字节数
+const maxErrorResponseRecordSize = 64 << 10
+
+// ErrorRecorder 包装gin.ResponseWriter，记录错误响应（状态码>=400）的响应体用于失败请求日志
+// 成功响应不记录
+type ErrorRecorder struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+// NewErrorRecorder 创建错误响应记录器
+func NewErrorRecorder(w gin.ResponseWriter) *ErrorRecorder {
+	return &ErrorRecorder{ResponseWriter: w}
+}
+
+// Write 透传响应体，错误响应同时记录
+func (w *ErrorRecorder) Write(data []byte) (int, error) {
+	w.record(data)
+	return w.ResponseWriter.Write(data)
+}
+
+// WriteString 透传字符串响应体，错误响应同时记录
+func (w *ErrorRecorder) WriteString(s string) (int, error) {
+	w.record([]byte(s))
+	return w.ResponseWriter.WriteString(s)
+}
+
+// Body 返回记录的错误响应体
+func (w *ErrorRecorder) Body() []byte {
+	return w.body.Bytes()
+}
+
+func (w *ErrorRecorder) record(data []byte) {
+	if w.Status() < http.StatusBadRequest {
+		return
+	}
+	remaining := maxErrorResponseRecordSize - w.body.Len()
+	if remaining <= 0 {
+		return
+	}
+	if len(data) > remaining {
+		data = data[:remaining]
+	}
+	w.body.Write(data)
+}
+
+// SaveErrorLog 异步保存失败或被拒绝请求的日志
+// accountID为0表示请求未转发到上游账号，记录为被拒绝，此时可以通过上下文的error_type指定错误类型
+// capture为请求体捕获快照，可以为nil
+func SaveErrorLog(c *gin.Context, accountID uint, statusCode int, responseBody []byte, duration int64, capture *BodyCaptureSnapshot) {
+	logReq := &model.LogCreateRequest{
+		ModelName:  c.GetString("model_name"),
+		AccountID:  accountID,
+		Duration:   duration,
+		StatusCode: statusCode,
+		Outcome:    model.LogOutcomeFailed,
+	}
+	if accountID == 0 {
+		logReq.Outcome = model.LogOutcomeRejected
+		logReq.ErrorType = c.GetString("error_type")
+	}
+	if apiKey, exists := c.Get("api_key"); exists {
+		keyInfo := apiKey.(*model.ApiKey)
+		logReq.UserID = keyInfo.UserID
+		logReq.ApiKeyID = keyInfo.ID
+	}
+	logReq.SetRequestInfo(service.NewRequestLogInfo(c))
+
+	body := append([]byte(nil), responseBody...)
+	go func() {
+		logEntry, err := service.NewLogService().CreateErrorLog(logReq, body)
+		if err != nil {
+			log.Printf("保存失败请求日志失败: %v", err)
+			return
+		}
+		capture.Save(logEntry.ID)
+	}()
+}
@@ -0,0 +1,149 @@
+package relay
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// FailoverWriter 包装gin.ResponseWriter，用于账号故障转移
+// 在任何字节发送到客户端之前，先缓存状态码和响应头：
+// 如果状态码可重试（429/5xx），则丢弃本次响应，由调用方换下一个账号重试；
+// 否则提交响应头并透传后续写入，此后不再允许重试
+type FailoverWriter struct {
+	gin.ResponseWriter
+	header    http.Header
+	status    int
+	committed bool
+	discarded bool
+}
+
+// NewFailoverWriter 创建故障转移写入器
+func NewFailoverWriter(w gin.ResponseWriter) *FailoverWriter {
+	return &FailoverWriter{
+		ResponseWriter: w,
+		header:         make(http.Header),
+		status:         http.StatusOK,
+	}
+}
+
+// IsRetryableStatus 判断状态码是否允许切换账号重试
+func IsRetryableStatus(statusCode int) bool {
+	return statusCode == http.StatusTooManyRequests || statusCode >= http.StatusInternalServerError
+}
+
+// Retryable 本次尝试是否以可重试的错误结束且未向客户端发送任何数据
+func (w *FailoverWriter) Retryable() bool {
+	if w.committed {
+		return false
+	}
+	return w.discarded || IsRetryableStatus(w.status)
+}
+
+// Header 提交前返回独立的响应头，避免失败尝试的上游响应头泄露给客户端
+func (w *FailoverWriter) Header() http.Header {
+	if w.committed {
+		return w.ResponseWriter.Header()
+	}
+	return w.header
+}
+
+// WriteHeader 提交前仅记录状态码
+func (w *FailoverWriter) WriteHeader(code int) {
+	if w.committed || w.discarded || code <= 0 {
+		return
+	}
+	w.status = code
+}
+
+// WriteHeaderNow 立即写出响应头（可重试状态码时丢弃）
+func (w *FailoverWriter) WriteHeaderNow() {
+	if w.commit() {
+		w.ResponseWriter.WriteHeaderNow()
+	}
+}
+
+// Write 写入响应体（可重试状态码时丢弃）
+func (w *FailoverWriter) Write(data []byte) (int, error) {
+	if !w.commit() {
+		return len(data), nil
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+// WriteString 写入字符串响应体（可重试状态码时丢弃）
+func (w *FailoverWriter) WriteString(s string) (int, error) {
+	if !w.commit() {
+		return len(s), nil
+	}
+	return w.ResponseWriter.WriteString(s)
+}
+
+// Flush 刷新响应（可重试状态码时丢弃）
+func (w *FailoverWriter) Flush() {
+	if w.commit() {
+		w.ResponseWriter.Flush()
+	}
+}
+
+// Status 返回当前状态码
+func (w *FailoverWriter) Status() int {
+	if w.committed {
+		return w.ResponseWriter.Status()
+	}
+	return w.status
+}
+
+// Size 返回已写入的响应体大小
+func (w *FailoverWriter) Size() int {
+	if w.committed {
+		return w.ResponseWriter.Size()
+	}
+	return -1
+}
+
+// Replay 将丢弃的错误响应写出到客户端，没有其他账号可以重试时调用
+// body为记录的错误响应体，可能被截断，因此不保留原响应的Content-Length
+func (w *FailoverWriter) Replay(body []byte) {
+	if w.committed {
+		return
+	}
+
+	target := w.ResponseWriter.Header()
+	for name, values := range w.header {
+		target[name] = values
+	}
+	target.Del("Content-Length")
+	w.ResponseWriter.WriteHeader(w.status)
+	w.ResponseWriter.Write(body)
+	w.committed = true
+	w.discarded = false
+}
+
+// Written 是否已经写出（或丢弃）响应
+func (w *FailoverWriter) Written() bool {
+	return w.committed || w.discarded
+}
+
+// commit 根据状态码决定提交还是丢弃响应，返回是否需要透传写入
+func (w *FailoverWriter) commit() bool {
+	if w.committed {
+		return true
+	}
+	if w.discarded {
+		return false
+	}
+
+	if IsRetryableStatus(w.status) {
+		w.discarded = true
+		return false
+	}
+
+	target := w.ResponseWriter.Header()
+	for name, values := range w.header {
+		target[name] = values
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+	w.committed = true
+	return true
+}
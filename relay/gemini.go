@@ -0,0 +1,795 @@
+package relay
+
+import (
+	"bufio"
+	"bytes"
+	"claude-code-relay/common"
+	"claude-code-relay/constant"
+	"claude-code-relay/model"
+	"claude-code-relay/service"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tidwall/gjson"
+)
+
+const (
+	// Gemini API默认请求地址
+	defaultGeminiBaseURL = "https://generativelanguage.googleapis.com/v1beta"
+	// 未配置模型映射时使用的默认Gemini模型
+	defaultGeminiModel = "gemini-2.5-pro"
+	// Gemini限流响应中没有retryDelay时的默认限流时长（Gemini配额按分钟计算）
+	defaultGeminiRateLimitDuration = time.Minute
+)
+
+// Gemini API 类型定义
+type GeminiRequest struct {
+	Contents          []GeminiContent         `json:"contents"`
+	SystemInstruction *GeminiContent          `json:"systemInstruction,omitempty"`
+	Tools             []GeminiTool            `json:"tools,omitempty"`
+	ToolConfig        *GeminiToolConfig       `json:"toolConfig,omitempty"`
+	GenerationConfig  *GeminiGenerationConfig `json:"generationConfig,omitempty"`
+}
+
+type GeminiContent struct {
+	Role  string       `json:"role,omitempty"`
+	Parts []GeminiPart `json:"parts"`
+}
+
+type GeminiPart struct {
+	Text             string                  `json:"text,omitempty"`
+	InlineData       *GeminiInlineData       `json:"inlineData,omitempty"`
+	FileData         *GeminiFileData         `json:"fileData,omitempty"`
+	FunctionCall     *GeminiFunctionCall     `json:"functionCall,omitempty"`
+	FunctionResponse *GeminiFunctionResponse `json:"functionResponse,omitempty"`
+}
+
+type GeminiInlineData struct {
+	MimeType string `json:"mimeType"`
+	Data     string `json:"data"`
+}
+
+type GeminiFileData struct {
+	MimeType string `json:"mimeType,omitempty"`
+	FileURI  string `json:"fileUri"`
+}
+
+type GeminiFunctionCall struct {
+	Name string                 `json:"name"`
+	Args map[string]interface{} `json:"args"`
+}
+
+type GeminiFunctionResponse struct {
+	Name     string                 `json:"name"`
+	Response map[string]interface{} `json:"response"`
+}
+
+type GeminiTool struct {
+	FunctionDeclarations []GeminiFunctionDeclaration `json:"functionDeclarations"`
+}
+
+type GeminiFunctionDeclaration struct {
+	Name        string      `json:"name"`
+	Description string      `json:"description,omitempty"`
+	Parameters  interface{} `json:"parameters,omitempty"`
+}
+
+type GeminiToolConfig struct {
+	FunctionCallingConfig GeminiFunctionCallingConfig `json:"functionCallingConfig"`
+}
+
+type GeminiFunctionCallingConfig struct {
+	Mode                 string   `json:"mode"`
+	AllowedFunctionNames []string `json:"allowedFunctionNames,omitempty"`
+}
+
+type GeminiGenerationConfig struct {
+	MaxOutputTokens int      `json:"maxOutputTokens,omitempty"`
+	Temperature     *float64 `json:"temperature,omitempty"`
+	TopP            *float64 `json:"topP,omitempty"`
+	TopK            *int     `json:"topK,omitempty"`
+	StopSequences   []string `json:"stopSequences,omitempty"`
+}
+
+// HandleGeminiRequest 处理 Gemini 请求的中转
+func HandleGeminiRequest(c *gin.Context, account *model.Account, requestBody []byte) {
+	// 记录请求开始时间用于计算耗时
+	startTime := time.Now()
+
+	// 从上下文中获取API Key信息
+	var apiKey *model.ApiKey
+	if keyInfo, exists := c.Get("api_key"); exists {
+		apiKey = keyInfo.(*model.ApiKey)
+	}
+
+	// 解析Claude请求
+	var claudeReq ClaudeRequest
+	if err := json.Unmarshal(requestBody, &claudeReq); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": map[string]interface{}{
+				"type":    "json_parse_error",
+				"message": "Failed to parse request JSON: " + err.Error(),
+			},
+		})
+		return
+	}
+
+	// 应用模型映射并转换为Gemini格式
+	mappedModelName := applyModelMapping(claudeReq.Model, account.ModelMapping, defaultGeminiModel)
+	geminiBody, err := json.Marshal(convertClaudeToGemini(claudeReq))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": map[string]interface{}{
+				"type":    "json_marshal_error",
+				"message": "Failed to marshal Gemini request: " + err.Error(),
+			},
+		})
+		return
+	}
+
+	// 统一使用流式接口请求上游
+	req, err := http.NewRequestWithContext(c.Request.Context(), "POST", buildGeminiURL(account, mappedModelName, true), bytes.NewBuffer(geminiBody))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": map[string]interface{}{
+				"type":    "internal_server_error",
+				"message": "Failed to create request: " + err.Error(),
+			},
+		})
+		return
+	}
+	copyRequestHeaders(c, req, constant.PlatformGemini)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("x-goog-api-key", account.SecretKey)
+
+	// 创建HTTP客户端（超时由timeoutGuard按阶段控制）
+	client, err := newAccountHTTPClient(account, account.ProxyURI, 0)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": map[string]interface{}{
+				"type":    "proxy_configuration_error",
+				"message": "Invalid proxy or TLS configuration: " + err.Error(),
+			},
+		})
+		return
+	}
+
+	slot, ok := acquireAccountSlot(c, account)
+	if !ok {
+		return
+	}
+	defer slot.Release()
+
+	req, guard := resolveUpstreamTimeouts(account).guard(req)
+	defer guard.stop()
+
+	// 发送请求
+	resp, err := client.Do(req)
+	if err != nil {
+		err = guard.wrapError(err)
+		log.Printf("Gemini API request failed: %v", err)
+		recordNetworkFailure(account, err)
+		if errors.Is(err, context.Canceled) {
+			c.AbortWithStatus(statusClientClosedRequest)
+			return
+		}
+		if timeoutErr := asUpstreamTimeout(err); timeoutErr != nil {
+			c.Data(http.StatusGatewayTimeout, "application/json", upstreamTimeoutBody(timeoutErr))
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": map[string]interface{}{
+				"type":    "network_error",
+				"message": "Failed to execute request: " + err.Error(),
+			},
+		})
+		return
+	}
+	defer common.CloseIO(resp.Body)
+	resp.Body = guard.wrapBody(resp.Body)
+
+	// 检查响应状态
+	accountService := service.NewAccountService()
+	if resp.StatusCode >= 400 {
+		bodyBytes, _ := io.ReadAll(resp.Body)
+		errorBody := geminiErrorBody(bodyBytes)
+		if resp.StatusCode == statusRateLimit {
+			setGeminiRateLimitEndTime(account, errorBody)
+		}
+		accountService.UpdateAccountStatus(account, resp.StatusCode, nil)
+		c.JSON(resp.StatusCode, convertGeminiError(resp.StatusCode, errorBody))
+		return
+	}
+
+	if claudeReq.Stream {
+		c.Header("Content-Type", "text/event-stream")
+		c.Header("Cache-Control", "no-cache")
+		c.Header("Connection", "keep-alive")
+		c.Writer.Flush()
+	}
+
+	// 处理Gemini流式响应（使用原始Claude模型名称，用于日志记录）
+	transformer := newGeminiStreamTransformer(claudeReq.Model)
+	usageTokens := processGeminiStreamResponse(c.Writer, resp.Body, transformer, claudeReq.Stream)
+	usageTokens.ApplyEstimate(requestBody)
+	markInterruptedUsage(c, account, usageTokens)
+
+	// 更新账号状态和统计信息
+	accountService.UpdateAccountStatus(account, resp.StatusCode, usageTokens)
+
+	// 更新API Key统计信息
+	if apiKey != nil {
+		go service.UpdateApiKeyStatus(apiKey, resp.StatusCode, usageTokens)
+
+		// 保存日志记录
+		duration := time.Since(startTime).Milliseconds()
+		logService := service.NewLogService()
+		capture := SnapshotBodyCapture(c)
+		info := service.NewRequestLogInfo(c)
+		go func() {
+			logEntry, err := logService.CreateLogFromTokenUsage(usageTokens, apiKey.UserID, apiKey.ID, account.ID, duration, claudeReq.Stream, info)
+			if err != nil {
+				log.Printf("保存日志失败: %v", err)
+				return
+			}
+			capture.Save(logEntry.ID)
+		}()
+	}
+}
+
+// geminiErrorBody 获取Gemini错误响应中的错误对象，流式接口的错误响应为数组格式
+func geminiErrorBody(body []byte) []byte {
+	if first := gjson.GetBytes(body, "0"); gjson.GetBytes(body, "@this").IsArray() && first.IsObject() {
+		return []byte(first.Raw)
+	}
+	return body
+}
+
+// convertGeminiError 将Gemini错误响应转换为Claude格式的错误
+func convertGeminiError(statusCode int, body []byte) gin.H {
+	errorType, message := common.ParseErrorResponse(body)
+	if message == "" {
+		message = http.StatusText(statusCode)
+	}
+	return gin.H{
+		"type": "error",
+		"error": gin.H{
+			"type":    common.NormalizeErrorType(statusCode, errorType),
+			"message": message,
+		},
+	}
+}
+
+// setGeminiRateLimitEndTime 根据RESOURCE_EXHAUSTED响应中RetryInfo的retryDelay设置限流结束时间
+// 未返回retryDelay时使用默认限流时长，账号状态由UpdateAccountStatus一并保存
+func setGeminiRateLimitEndTime(account *model.Account, body []byte) {
+	retryDelay := defaultGeminiRateLimitDuration
+	gjson.GetBytes(body, "error.details").ForEach(func(_, detail gjson.Result) bool {
+		delay, err := time.ParseDuration(detail.Get("retryDelay").String())
+		if err != nil || delay <= 0 {
+			return true
+		}
+		retryDelay = delay
+		return false
+	})
+
+	resetTime := time.Now().Add(retryDelay)
+	rateLimitEndTime := model.Time(resetTime)
+	account.RateLimitEndTime = &rateLimitEndTime
+	log.Printf("🚫 Gemini账号 %s 被限流，限流至 %s", account.Name, resetTime.Format(time.RFC3339))
+}
+
+// buildGeminiURL 构建Gemini生成接口地址
+func buildGeminiURL(account *model.Account, modelName string, stream bool) string {
+	baseURL := strings.TrimSuffix(account.RequestURL, "/")
+	if baseURL == "" {
+		baseURL = defaultGeminiBaseURL
+	}
+
+	if stream {
+		return fmt.Sprintf("%s/models/%s:streamGenerateContent?alt=sse", baseURL, modelName)
+	}
+	return fmt.Sprintf("%s/models/%s:generateContent", baseURL, modelName)
+}
+
+// convertClaudeToGemini 将Claude请求转换为Gemini格式
+func convertClaudeToGemini(claudeReq ClaudeRequest) GeminiRequest {
+	geminiReq := GeminiRequest{}
+
+	// system消息转换为systemInstruction
+	if systemMessage := extractSystemMessage(claudeReq.System); systemMessage != "" {
+		geminiReq.SystemInstruction = &GeminiContent{
+			Parts: []GeminiPart{{Text: systemMessage}},
+		}
+	}
+
+	// Gemini的functionResponse需要函数名，记录tool_use id与函数名的对应关系
+	toolNames := make(map[string]string)
+
+	for _, message := range claudeReq.Messages {
+		role := "user"
+		if message.Role == "assistant" {
+			role = "model"
+		}
+
+		var parts []GeminiPart
+		switch content := message.Content.(type) {
+		case string:
+			if content != "" {
+				parts = append(parts, GeminiPart{Text: content})
+			}
+		case []interface{}:
+			for _, block := range content {
+				blockMap, ok := block.(map[string]interface{})
+				if !ok {
+					continue
+				}
+				parts = append(parts, convertClaudeBlockToGeminiParts(blockMap, toolNames)...)
+			}
+		}
+
+		if len(parts) == 0 {
+			continue
+		}
+
+		// Gemini要求角色交替，相同角色的连续消息合并
+		if last := len(geminiReq.Contents) - 1; last >= 0 && geminiReq.Contents[last].Role == role {
+			geminiReq.Contents[last].Parts = append(geminiReq.Contents[last].Parts, parts...)
+			continue
+		}
+		geminiReq.Contents = append(geminiReq.Contents, GeminiContent{Role: role, Parts: parts})
+	}
+
+	// 转换工具
+	if len(claudeReq.Tools) > 0 {
+		var declarations []GeminiFunctionDeclaration
+		for _, tool := range claudeReq.Tools {
+			declarations = append(declarations, GeminiFunctionDeclaration{
+				Name:        tool.Name,
+				Description: tool.Description,
+				Parameters:  recursivelyCleanSchema(tool.InputSchema),
+			})
+		}
+		geminiReq.Tools = []GeminiTool{{FunctionDeclarations: declarations}}
+	}
+
+	// 转换工具选择
+	if claudeReq.ToolChoice != nil && len(claudeReq.Tools) > 0 {
+		config := GeminiFunctionCallingConfig{Mode: "AUTO"}
+		switch claudeReq.ToolChoice.Type {
+		case "any":
+			config.Mode = "ANY"
+		case "tool":
+			config.Mode = "ANY"
+			config.AllowedFunctionNames = []string{claudeReq.ToolChoice.Name}
+		case "none":
+			config.Mode = "NONE"
+		}
+		geminiReq.ToolConfig = &GeminiToolConfig{FunctionCallingConfig: config}
+	}
+
+	geminiReq.GenerationConfig = &GeminiGenerationConfig{
+		MaxOutputTokens: claudeReq.MaxTokens,
+		Temperature:     claudeReq.Temperature,
+		TopP:            claudeReq.TopP,
+		TopK:            claudeReq.TopK,
+		StopSequences:   claudeReq.StopSequences,
+	}
+
+	return geminiReq
+}
+
+// convertClaudeBlockToGeminiParts 将Claude内容块转换为Gemini part，不支持的类型（如thinking）返回nil
+func convertClaudeBlockToGeminiParts(block map[string]interface{}, toolNames map[string]string) []GeminiPart {
+	switch block["type"] {
+	case "text":
+		text, _ := block["text"].(string)
+		if text == "" {
+			return nil
+		}
+		return []GeminiPart{{Text: text}}
+
+	case "image":
+		source, ok := block["source"].(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		mediaType, _ := source["media_type"].(string)
+		if source["type"] == "url" {
+			fileURI, _ := source["url"].(string)
+			return []GeminiPart{{FileData: &GeminiFileData{MimeType: mediaType, FileURI: fileURI}}}
+		}
+		data, _ := source["data"].(string)
+		return []GeminiPart{{InlineData: &GeminiInlineData{MimeType: mediaType, Data: data}}}
+
+	case "tool_use":
+		id, _ := block["id"].(string)
+		name, _ := block["name"].(string)
+		toolNames[id] = name
+		args, _ := block["input"].(map[string]interface{})
+		if args == nil {
+			args = map[string]interface{}{}
+		}
+		return []GeminiPart{{FunctionCall: &GeminiFunctionCall{Name: name, Args: args}}}
+
+	case "tool_result":
+		toolUseID, _ := block["tool_use_id"].(string)
+		name := toolNames[toolUseID]
+		if name == "" {
+			name = toolUseID
+		}
+		parts := []GeminiPart{{FunctionResponse: &GeminiFunctionResponse{
+			Name:     name,
+			Response: map[string]interface{}{"content": extractToolResultText(block["content"])},
+		}}}
+
+		// functionResponse只支持JSON，工具返回的图片（如截图）作为随后的part发送
+		if content, ok := block["content"].([]interface{}); ok {
+			for _, item := range content {
+				if itemMap, ok := item.(map[string]interface{}); ok && itemMap["type"] == "image" {
+					parts = append(parts, convertClaudeBlockToGeminiParts(itemMap, toolNames)...)
+				}
+			}
+		}
+		return parts
+	}
+
+	return nil
+}
+
+// extractToolResultText 提取tool_result内容中的文本（支持字符串和内容块数组），图片由调用方单独转换
+func extractToolResultText(content interface{}) string {
+	switch c := content.(type) {
+	case nil:
+		return ""
+	case string:
+		return c
+	case []interface{}:
+		var textParts []string
+		for _, item := range c {
+			if itemMap, ok := item.(map[string]interface{}); ok && itemMap["type"] == "text" {
+				if text, ok := itemMap["text"].(string); ok {
+					textParts = append(textParts, text)
+				}
+			}
+		}
+		return strings.Join(textParts, "\n")
+	default:
+		jsonBytes, _ := json.Marshal(c)
+		return string(jsonBytes)
+	}
+}
+
+// GeminiStreamTransformer 将Gemini流式响应转换为Claude SSE事件
+type GeminiStreamTransformer struct {
+	started       bool
+	messageID     string
+	model         string
+	blockIndex    int
+	textBlockOpen bool
+	hasToolUse    bool
+	finishReason  string
+	contentBlocks []ClaudeContentBlock
+}
+
+// newGeminiStreamTransformer 创建Gemini流式转换器
+func newGeminiStreamTransformer(model string) *GeminiStreamTransformer {
+	return &GeminiStreamTransformer{
+		messageID: fmt.Sprintf("msg_%s", generateRandomID()),
+		model:     model,
+	}
+}
+
+// processGeminiStreamResponse 处理Gemini流式响应并转换为Claude格式
+func processGeminiStreamResponse(writer gin.ResponseWriter, reader io.Reader, transformer *GeminiStreamTransformer, isClientStream bool) *common.TokenUsage {
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 0, 64*1024), 10*1024*1024)
+
+	usageTokens := &common.TokenUsage{Model: transformer.model}
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if !strings.HasPrefix(line, "data:") {
+			continue
+		}
+
+		data := strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+		if !gjson.Valid(data) {
+			continue
+		}
+		chunk := gjson.Parse(data)
+
+		// 提取usage信息（每个chunk都携带累计值，以最后一个为准）
+		if usageMetadata := chunk.Get("usageMetadata"); usageMetadata.Exists() {
+			cachedTokens := int(usageMetadata.Get("cachedContentTokenCount").Int())
+			usageTokens.InputTokens = int(usageMetadata.Get("promptTokenCount").Int()) - cachedTokens
+			usageTokens.CacheReadInputTokens = cachedTokens
+			usageTokens.OutputTokens = int(usageMetadata.Get("candidatesTokenCount").Int() + usageMetadata.Get("thoughtsTokenCount").Int())
+		}
+
+		candidate := chunk.Get("candidates.0")
+		if !candidate.Exists() {
+			continue
+		}
+
+		for _, part := range candidate.Get("content.parts").Array() {
+			// 累计输出内容的估算token数（包括思考过程），供上游未返回用量时使用
+			usageTokens.AddOutputEstimate(part.Get("text").String())
+			usageTokens.AddOutputEstimate(part.Get("functionCall").Raw)
+
+			// 跳过思考过程
+			if part.Get("thought").Bool() {
+				continue
+			}
+
+			if text := part.Get("text"); text.Exists() && text.String() != "" {
+				transformer.handleText(writer, text.String(), isClientStream)
+			}
+			if functionCall := part.Get("functionCall"); functionCall.Exists() {
+				transformer.handleFunctionCall(writer, functionCall, isClientStream)
+			}
+		}
+
+		if finishReason := candidate.Get("finishReason").String(); finishReason != "" {
+			transformer.finishReason = finishReason
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		log.Printf("读取Gemini流式响应失败: %v", err)
+		usageTokens.Interrupted = true
+
+		// 上游超时时返回明确的超时错误，不再输出不完整的消息
+		if writeUpstreamTimeoutError(writer, err, isClientStream) {
+			return usageTokens
+		}
+	}
+
+	if isClientStream {
+		transformer.sendFinalEvents(writer, usageTokens)
+	} else {
+		claudeResponse := ClaudeResponse{
+			ID:         transformer.messageID,
+			Type:       "message",
+			Role:       "assistant",
+			Model:      transformer.model,
+			Content:    transformer.contentBlocks,
+			StopReason: transformer.stopReason(),
+			Usage: ClaudeUsage{
+				InputTokens:  usageTokens.InputTokens,
+				OutputTokens: usageTokens.OutputTokens,
+			},
+		}
+		if claudeResponse.Content == nil {
+			claudeResponse.Content = []ClaudeContentBlock{}
+		}
+
+		writer.Header().Set("Content-Type", "application/json")
+		jsonBytes, _ := json.Marshal(claudeResponse)
+		writer.Write(jsonBytes)
+	}
+
+	return usageTokens
+}
+
+// sendEvent 发送SSE事件
+func (gt *GeminiStreamTransformer) sendEvent(writer gin.ResponseWriter, eventType string, data interface{}) {
+	jsonData, _ := json.Marshal(data)
+	fmt.Fprintf(writer, "event: %s\ndata: %s\n\n", eventType, jsonData)
+	writer.Flush()
+}
+
+// ensureStarted 发送消息开始事件
+func (gt *GeminiStreamTransformer) ensureStarted(writer gin.ResponseWriter) {
+	if gt.started {
+		return
+	}
+	gt.started = true
+
+	gt.sendEvent(writer, "message_start", map[string]interface{}{
+		"type": "message_start",
+		"message": map[string]interface{}{
+			"id":          gt.messageID,
+			"type":        "message",
+			"role":        "assistant",
+			"model":       gt.model,
+			"content":     []interface{}{},
+			"stop_reason": nil,
+			"usage": map[string]int{
+				"input_tokens":  0,
+				"output_tokens": 0,
+			},
+		},
+	})
+}
+
+// handleText 处理文本片段
+func (gt *GeminiStreamTransformer) handleText(writer gin.ResponseWriter, text string, isClientStream bool) {
+	if !isClientStream {
+		if count := len(gt.contentBlocks); count > 0 && gt.contentBlocks[count-1].Type == "text" {
+			gt.contentBlocks[count-1].Text += text
+		} else {
+			gt.contentBlocks = append(gt.contentBlocks, ClaudeContentBlock{Type: "text", Text: text})
+		}
+		return
+	}
+
+	gt.ensureStarted(writer)
+	if !gt.textBlockOpen {
+		gt.sendEvent(writer, "content_block_start", map[string]interface{}{
+			"type":  "content_block_start",
+			"index": gt.blockIndex,
+			"content_block": map[string]interface{}{
+				"type": "text",
+				"text": "",
+			},
+		})
+		gt.textBlockOpen = true
+	}
+
+	gt.sendEvent(writer, "content_block_delta", map[string]interface{}{
+		"type":  "content_block_delta",
+		"index": gt.blockIndex,
+		"delta": map[string]interface{}{
+			"type": "text_delta",
+			"text": text,
+		},
+	})
+}
+
+// handleFunctionCall 处理函数调用（Gemini一次性返回完整参数）
+func (gt *GeminiStreamTransformer) handleFunctionCall(writer gin.ResponseWriter, functionCall gjson.Result, isClientStream bool) {
+	gt.hasToolUse = true
+	toolID := fmt.Sprintf("toolu_%s", generateRandomID())
+	name := functionCall.Get("name").String()
+	args := functionCall.Get("args").Raw
+	if args == "" {
+		args = "{}"
+	}
+
+	if !isClientStream {
+		var input map[string]interface{}
+		if err := json.Unmarshal([]byte(args), &input); err != nil || input == nil {
+			input = make(map[string]interface{})
+		}
+		gt.contentBlocks = append(gt.contentBlocks, ClaudeContentBlock{
+			Type:  "tool_use",
+			ID:    toolID,
+			Name:  name,
+			Input: input,
+		})
+		return
+	}
+
+	gt.ensureStarted(writer)
+	gt.closeTextBlock(writer)
+
+	gt.sendEvent(writer, "content_block_start", map[string]interface{}{
+		"type":  "content_block_start",
+		"index": gt.blockIndex,
+		"content_block": map[string]interface{}{
+			"type":  "tool_use",
+			"id":    toolID,
+			"name":  name,
+			"input": map[string]interface{}{},
+		},
+	})
+	gt.sendEvent(writer, "content_block_delta", map[string]interface{}{
+		"type":  "content_block_delta",
+		"index": gt.blockIndex,
+		"delta": map[string]interface{}{
+			"type":         "input_json_delta",
+			"partial_json": args,
+		},
+	})
+	gt.sendEvent(writer, "content_block_stop", map[string]interface{}{
+		"type":  "content_block_stop",
+		"index": gt.blockIndex,
+	})
+	gt.blockIndex++
+}
+
+// closeTextBlock 结束当前文本块
+func (gt *GeminiStreamTransformer) closeTextBlock(writer gin.ResponseWriter) {
+	if !gt.textBlockOpen {
+		return
+	}
+	gt.sendEvent(writer, "content_block_stop", map[string]interface{}{
+		"type":  "content_block_stop",
+		"index": gt.blockIndex,
+	})
+	gt.textBlockOpen = false
+	gt.blockIndex++
+}
+
+// stopReason 将Gemini的finishReason映射为Claude的stop_reason
+// 因安全策略、引用检测等被拦截的回答映射为refusal，便于客户端与正常结束区分
+func (gt *GeminiStreamTransformer) stopReason() string {
+	if gt.hasToolUse {
+		return "tool_use"
+	}
+	switch gt.finishReason {
+	case "MAX_TOKENS":
+		return "max_tokens"
+	case "SAFETY", "RECITATION", "BLOCKLIST", "PROHIBITED_CONTENT", "SPII", "IMAGE_SAFETY":
+		return "refusal"
+	default:
+		return "end_turn"
+	}
+}
+
+// sendFinalEvents 发送最终事件
+func (gt *GeminiStreamTransformer) sendFinalEvents(writer gin.ResponseWriter, usageTokens *common.TokenUsage) {
+	gt.ensureStarted(writer)
+	gt.closeTextBlock(writer)
+
+	gt.sendEvent(writer, "message_delta", map[string]interface{}{
+		"type": "message_delta",
+		"delta": map[string]interface{}{
+			"stop_reason":   gt.stopReason(),
+			"stop_sequence": nil,
+		},
+		"usage": map[string]int{
+			"input_tokens":            usageTokens.InputTokens,
+			"output_tokens":           usageTokens.OutputTokens,
+			"cache_read_input_tokens": usageTokens.CacheReadInputTokens,
+		},
+	})
+
+	gt.sendEvent(writer, "message_stop", map[string]interface{}{
+		"type": "message_stop",
+	})
+}
+
+// TestHandleGeminiRequest 测试Gemini账号连通性，返回状态码和响应内容
+func TestHandleGeminiRequest(account *model.Account) (int, string) {
+	requestBody := common.GetTestRequestBody(100)
+
+	// 解析Claude请求
+	var claudeReq ClaudeRequest
+	if err := json.Unmarshal([]byte(requestBody), &claudeReq); err != nil {
+		return http.StatusBadRequest, "Failed to parse request JSON: " + err.Error()
+	}
+
+	// 应用模型映射并转换为Gemini格式
+	mappedModelName := applyModelMapping(claudeReq.Model, account.ModelMapping, defaultGeminiModel)
+	geminiBody, err := json.Marshal(convertClaudeToGemini(claudeReq))
+	if err != nil {
+		return http.StatusInternalServerError, "Failed to marshal Gemini request: " + err.Error()
+	}
+
+	req, err := http.NewRequest("POST", buildGeminiURL(account, mappedModelName, false), bytes.NewBuffer(geminiBody))
+	if err != nil {
+		return http.StatusInternalServerError, "Failed to create request: " + err.Error()
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("x-goog-api-key", account.SecretKey)
+
+	client, err := newAccountHTTPClient(account, account.ProxyURI, 30*time.Second)
+	if err != nil {
+		return http.StatusInternalServerError, "Invalid proxy or TLS configuration: " + err.Error()
+	}
+
+	// 发送请求
+	resp, err := client.Do(req)
+	if err != nil {
+		return http.StatusInternalServerError, "Request failed: " + err.Error()
+	}
+	defer common.CloseIO(resp.Body)
+
+	// 读取错误响应内容
+	if resp.StatusCode >= 400 {
+		bodyBytes, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(bodyBytes)
+	}
+
+	return resp.StatusCode, ""
+}
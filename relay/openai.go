@@ -4,19 +4,21 @@ import (
 	"bufio"
 	"bytes"
 	"claude-code-relay/common"
+	"claude-code-relay/constant"
 	"claude-code-relay/model"
 	"claude-code-relay/service"
-	"crypto/tls"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/gin-gonic/gin"
 	"io"
 	"log"
 	"math/rand"
 	"net/http"
-	"net/url"
-	"os"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -30,6 +32,8 @@ type ClaudeTool struct {
 type ClaudeContentBlock struct {
 	Type      string                 `json:"type"`
 	Text      string                 `json:"text,omitempty"`
+	Thinking  string                 `json:"thinking,omitempty"`
+	Signature string                 `json:"signature,omitempty"`
 	Source    *ClaudeContentSource   `json:"source,omitempty"`
 	ID        string                 `json:"id,omitempty"`
 	Name      string                 `json:"name,omitempty"`
@@ -40,8 +44,9 @@ type ClaudeContentBlock struct {
 
 type ClaudeContentSource struct {
 	Type      string `json:"type"`
-	MediaType string `json:"media_type"`
-	Data      string `json:"data"`
+	MediaType string `json:"media_type,omitempty"`
+	Data      string `json:"data,omitempty"`
+	URL       string `json:"url,omitempty"`
 }
 
 type ClaudeMessage struct {
@@ -50,8 +55,9 @@ type ClaudeMessage struct {
 }
 
 type ClaudeToolChoice struct {
-	Type string `json:"type"`
-	Name string `json:"name,omitempty"`
+	Type                   string `json:"type"`
+	Name                   string `json:"name,omitempty"`
+	DisableParallelToolUse bool   `json:"disable_parallel_tool_use,omitempty"`
 }
 
 type ClaudeRequest struct {
@@ -66,15 +72,22 @@ type ClaudeRequest struct {
 	TopK          *int                   `json:"top_k,omitempty"`
 	Tools         []ClaudeTool           `json:"tools,omitempty"`
 	ToolChoice    *ClaudeToolChoice      `json:"tool_choice,omitempty"`
+	Thinking      *ClaudeThinking        `json:"thinking,omitempty"`
 	Metadata      map[string]interface{} `json:"metadata,omitempty"`
 }
 
+type ClaudeThinking struct {
+	Type         string `json:"type"`
+	BudgetTokens int    `json:"budget_tokens,omitempty"`
+}
+
 // OpenAI API 类型定义
 type OpenAIMessage struct {
-	Role       string           `json:"role"`
-	Content    interface{}      `json:"content"`
-	ToolCalls  []OpenAIToolCall `json:"tool_calls,omitempty"`
-	ToolCallID string           `json:"tool_call_id,omitempty"`
+	Role             string           `json:"role"`
+	Content          interface{}      `json:"content"`
+	ReasoningContent string           `json:"reasoning_content,omitempty"`
+	ToolCalls        []OpenAIToolCall `json:"tool_calls,omitempty"`
+	ToolCallID       string           `json:"tool_call_id,omitempty"`
 }
 
 type OpenAIToolCall struct {
@@ -105,17 +118,27 @@ type OpenAIToolChoice struct {
 }
 
 type OpenAIRequest struct {
-	Model       string          `json:"model"`
-	Messages    []OpenAIMessage `json:"messages"`
-	MaxTokens   *int            `json:"max_tokens,omitempty"`
-	Temperature *float64        `json:"temperature,omitempty"`
-	TopP        *float64        `json:"top_p,omitempty"`
-	Stop        []string        `json:"stop,omitempty"`
-	Stream      bool            `json:"stream,omitempty"`
-	Tools       []OpenAITool    `json:"tools,omitempty"`
-	ToolChoice  interface{}     `json:"tool_choice,omitempty"`
+	Model             string               `json:"model"`
+	Messages          []OpenAIMessage      `json:"messages"`
+	MaxTokens         *int                 `json:"max_tokens,omitempty"`
+	Temperature       *float64             `json:"temperature,omitempty"`
+	TopP              *float64             `json:"top_p,omitempty"`
+	Stop              []string             `json:"stop,omitempty"`
+	Stream            bool                 `json:"stream,omitempty"`
+	StreamOptions     *OpenAIStreamOptions `json:"stream_options,omitempty"`
+	Tools             []OpenAITool         `json:"tools,omitempty"`
+	ToolChoice        interface{}          `json:"tool_choice,omitempty"`
+	ParallelToolCalls *bool                `json:"parallel_tool_calls,omitempty"`
 }
 
+// OpenAIStreamOptions 流式请求选项
+type OpenAIStreamOptions struct {
+	IncludeUsage bool `json:"include_usage"` // 在流末尾返回用量
+}
+
+// streamUsageUnsupportedAccounts 不支持stream_options参数的账号（进程内缓存，重启后重新探测）
+var streamUsageUnsupportedAccounts sync.Map
+
 // OpenAI 响应类型定义
 type OpenAIResponse struct {
 	ID      string         `json:"id"`
@@ -150,8 +173,9 @@ type ClaudeResponse struct {
 }
 
 type ClaudeUsage struct {
-	InputTokens  int `json:"input_tokens"`
-	OutputTokens int `json:"output_tokens"`
+	InputTokens          int `json:"input_tokens"`
+	OutputTokens         int `json:"output_tokens"`
+	CacheReadInputTokens int `json:"cache_read_input_tokens,omitempty"`
 }
 
 type OpenAITargetConfig struct {
@@ -205,8 +229,13 @@ func HandleOpenAIRequest(c *gin.Context, account *model.Account, requestBody []b
 	// 转换Claude请求为OpenAI格式
 	openaiReq := convertClaudeToOpenAI(claudeReq, mappedModelName)
 
-	// 序列化OpenAI请求
-	openaiBody, err := json.Marshal(openaiReq)
+	// 要求上游在流末尾返回用量，上游不支持时改为本地估算（Responses API始终返回用量）
+	if _, unsupported := streamUsageUnsupportedAccounts.Load(account.ID); !unsupported && account.UpstreamFormat != constant.UpstreamFormatResponses {
+		openaiReq.StreamOptions = &OpenAIStreamOptions{IncludeUsage: true}
+	}
+
+	// 按账号的上游接口格式序列化请求
+	openaiURL, openaiBody, err := buildOpenAIUpstreamBody(targetConfig.BaseURL, account.UpstreamFormat, claudeReq, openaiReq)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"error": map[string]interface{}{
@@ -218,7 +247,6 @@ func HandleOpenAIRequest(c *gin.Context, account *model.Account, requestBody []b
 	}
 
 	// 创建OpenAI API请求
-	openaiURL := targetConfig.BaseURL + "/chat/completions"
 	req, err := http.NewRequestWithContext(ctx, "POST", openaiURL, bytes.NewBuffer(openaiBody))
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{
@@ -230,44 +258,49 @@ func HandleOpenAIRequest(c *gin.Context, account *model.Account, requestBody []b
 		return
 	}
 
-	// 设置请求头
+	// 设置请求头（客户端请求头只转发白名单规则允许的部分）
+	copyRequestHeaders(c, req, constant.PlatformOpenAI)
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Authorization", "Bearer "+account.SecretKey)
 
-	// 创建HTTP客户端
-	httpClientTimeout, _ := time.ParseDuration(os.Getenv("HTTP_CLIENT_TIMEOUT") + "s")
-	if httpClientTimeout == 0 {
-		httpClientTimeout = 120 * time.Second
-	}
-
-	transport := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	// 获取复用连接池的客户端并配置代理（超时由timeoutGuard按阶段控制）
+	client, err := newAccountHTTPClient(account, account.ProxyURI, 0)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": map[string]interface{}{
+				"type":    "proxy_configuration_error",
+				"message": "Invalid proxy or TLS configuration: " + err.Error(),
+			},
+		})
+		return
 	}
 
-	// 配置代理
-	if account.ProxyURI != "" {
-		proxyURL, err := url.Parse(account.ProxyURI)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{
-				"error": map[string]interface{}{
-					"type":    "proxy_configuration_error",
-					"message": "Invalid proxy URI: " + err.Error(),
-				},
-			})
-			return
-		}
-		transport.Proxy = http.ProxyURL(proxyURL)
+	slot, ok := acquireAccountSlot(c, account)
+	if !ok {
+		return
 	}
+	defer slot.Release()
 
-	client := &http.Client{
-		Timeout:   httpClientTimeout,
-		Transport: transport,
-	}
+	req, guard := resolveUpstreamTimeouts(account).guard(req)
+	defer guard.stop()
 
 	// 发送请求
 	resp, err := client.Do(req)
+	if err == nil && resp.StatusCode == http.StatusBadRequest && openaiReq.StreamOptions != nil {
+		resp, err = retryWithoutStreamOptions(client, req, resp, openaiReq, account)
+	}
 	if err != nil {
+		err = guard.wrapError(err)
 		log.Printf("OpenAI API request failed: %v", err)
+		recordNetworkFailure(account, err)
+		if errors.Is(err, context.Canceled) {
+			c.AbortWithStatus(statusClientClosedRequest)
+			return
+		}
+		if timeoutErr := asUpstreamTimeout(err); timeoutErr != nil {
+			c.Data(http.StatusGatewayTimeout, "application/json", upstreamTimeoutBody(timeoutErr))
+			return
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"error": map[string]interface{}{
 				"type":    "network_error",
@@ -277,6 +310,7 @@ func HandleOpenAIRequest(c *gin.Context, account *model.Account, requestBody []b
 		return
 	}
 	defer common.CloseIO(resp.Body)
+	resp.Body = guard.wrapBody(resp.Body)
 
 	// 检查响应状态
 	accountService := service.NewAccountService()
@@ -288,7 +322,33 @@ func HandleOpenAIRequest(c *gin.Context, account *model.Account, requestBody []b
 	}
 
 	// 统一使用流式响应处理（传递原始Claude模型名称，用于日志记录）
-	handleStreamingResponse(c, resp, claudeReq.Model, claudeReq.Stream, account, apiKey, startTime)
+	handleStreamingResponse(c, resp, requestBody, claudeReq.Model, claudeReq.Stream, account, apiKey, startTime)
+}
+
+// retryWithoutStreamOptions 上游因不支持stream_options返回400时，去掉该参数重试一次，并记住该账号不再发送
+func retryWithoutStreamOptions(client *http.Client, req *http.Request, resp *http.Response, openaiReq OpenAIRequest, account *model.Account) (*http.Response, error) {
+	bodyBytes, _ := io.ReadAll(resp.Body)
+	common.CloseIO(resp.Body)
+	if !strings.Contains(string(bodyBytes), "stream_options") {
+		resp.Body = io.NopCloser(bytes.NewReader(bodyBytes))
+		return resp, nil
+	}
+
+	log.Printf("账号 %s 不支持stream_options参数，改为本地估算用量", account.Name)
+	streamUsageUnsupportedAccounts.Store(account.ID, true)
+
+	openaiReq.StreamOptions = nil
+	openaiBody, err := json.Marshal(openaiReq)
+	if err != nil {
+		return nil, err
+	}
+	retryReq, err := http.NewRequestWithContext(req.Context(), req.Method, req.URL.String(), bytes.NewBuffer(openaiBody))
+	if err != nil {
+		return nil, err
+	}
+	retryReq.Header = req.Header.Clone()
+
+	return client.Do(retryReq)
 }
 
 // extractSystemMessage 从system字段中提取系统消息文本
@@ -416,71 +476,11 @@ func convertClaudeToOpenAI(claudeReq ClaudeRequest, modelName string) OpenAIRequ
 
 	// 转换消息
 	for _, message := range claudeReq.Messages {
+		contentBlocks, ok := message.Content.([]interface{})
 		if message.Role == "user" {
-			// 处理用户消息
-			if contentBlocks, ok := message.Content.([]interface{}); ok {
-				var toolResults []interface{}
-				var otherContent []interface{}
-
-				for _, block := range contentBlocks {
-					if blockMap, ok := block.(map[string]interface{}); ok {
-						if blockMap["type"] == "tool_result" {
-							toolResults = append(toolResults, blockMap)
-						} else {
-							otherContent = append(otherContent, blockMap)
-						}
-					}
-				}
-
-				// 添加工具结果消息
-				for _, result := range toolResults {
-					if resultMap, ok := result.(map[string]interface{}); ok {
-						var content string
-						if resultMap["content"] != nil {
-							if str, ok := resultMap["content"].(string); ok {
-								content = str
-							} else {
-								contentBytes, _ := json.Marshal(resultMap["content"])
-								content = string(contentBytes)
-							}
-						}
-
-						openaiMessages = append(openaiMessages, OpenAIMessage{
-							Role:       "tool",
-							ToolCallID: resultMap["tool_use_id"].(string),
-							Content:    content,
-						})
-					}
-				}
-
-				// 添加其他用户内容
-				if len(otherContent) > 0 {
-					var convertedContent []map[string]interface{}
-					for _, block := range otherContent {
-						if blockMap, ok := block.(map[string]interface{}); ok {
-							if blockMap["type"] == "text" {
-								convertedContent = append(convertedContent, map[string]interface{}{
-									"type": "text",
-									"text": blockMap["text"],
-								})
-							} else if blockMap["type"] == "image" {
-								if source, ok := blockMap["source"].(map[string]interface{}); ok {
-									imageURL := fmt.Sprintf("data:%s;base64,%s", source["media_type"], source["data"])
-									convertedContent = append(convertedContent, map[string]interface{}{
-										"type": "image_url",
-										"image_url": map[string]string{
-											"url": imageURL,
-										},
-									})
-								}
-							}
-						}
-					}
-					openaiMessages = append(openaiMessages, OpenAIMessage{
-						Role:    "user",
-						Content: convertedContent,
-					})
-				}
+			if ok {
+				// 工具结果转换为tool消息，其余内容合并为一条用户消息
+				openaiMessages = append(openaiMessages, convertClaudeUserBlocks(contentBlocks)...)
 			} else {
 				// 简单文本消息
 				openaiMessages = append(openaiMessages, OpenAIMessage{
@@ -489,47 +489,14 @@ func convertClaudeToOpenAI(claudeReq ClaudeRequest, modelName string) OpenAIRequ
 				})
 			}
 		} else if message.Role == "assistant" {
-			// 处理助手消息
-			var textParts []string
-			var toolCalls []OpenAIToolCall
-
-			if contentBlocks, ok := message.Content.([]interface{}); ok {
-				for _, block := range contentBlocks {
-					if blockMap, ok := block.(map[string]interface{}); ok {
-						if blockMap["type"] == "text" {
-							textParts = append(textParts, blockMap["text"].(string))
-						} else if blockMap["type"] == "tool_use" {
-							arguments := "{}"
-							if blockMap["input"] != nil {
-								argBytes, _ := json.Marshal(blockMap["input"])
-								arguments = string(argBytes)
-							}
-
-							toolCalls = append(toolCalls, OpenAIToolCall{
-								ID:   blockMap["id"].(string),
-								Type: "function",
-								Function: OpenAIFunctionCall{
-									Name:      blockMap["name"].(string),
-									Arguments: arguments,
-								},
-							})
-						}
-					}
-				}
-			}
-
-			assistantMessage := OpenAIMessage{
-				Role:    "assistant",
-				Content: strings.Join(textParts, "\n"),
-			}
-			if len(toolCalls) > 0 {
-				assistantMessage.ToolCalls = toolCalls
-			}
-			if assistantMessage.Content == "" {
-				assistantMessage.Content = nil
+			if ok {
+				openaiMessages = append(openaiMessages, convertClaudeAssistantBlocks(contentBlocks))
+			} else {
+				openaiMessages = append(openaiMessages, OpenAIMessage{
+					Role:    "assistant",
+					Content: message.Content,
+				})
 			}
-
-			openaiMessages = append(openaiMessages, assistantMessage)
 		}
 	}
 
@@ -560,9 +527,14 @@ func convertClaudeToOpenAI(claudeReq ClaudeRequest, modelName string) OpenAIRequ
 
 	// 转换工具选择
 	if claudeReq.ToolChoice != nil {
-		if claudeReq.ToolChoice.Type == "auto" || claudeReq.ToolChoice.Type == "any" {
+		switch claudeReq.ToolChoice.Type {
+		case "auto":
 			openaiReq.ToolChoice = "auto"
-		} else if claudeReq.ToolChoice.Type == "tool" {
+		case "any":
+			openaiReq.ToolChoice = "required"
+		case "none":
+			openaiReq.ToolChoice = "none"
+		case "tool":
 			openaiReq.ToolChoice = map[string]interface{}{
 				"type": "function",
 				"function": map[string]string{
@@ -570,11 +542,223 @@ func convertClaudeToOpenAI(claudeReq ClaudeRequest, modelName string) OpenAIRequ
 				},
 			}
 		}
+
+		if claudeReq.ToolChoice.DisableParallelToolUse && len(openaiReq.Tools) > 0 {
+			parallelToolCalls := false
+			openaiReq.ParallelToolCalls = &parallelToolCalls
+		}
 	}
 
 	return openaiReq
 }
 
+// convertClaudeUserBlocks 转换Claude用户消息内容块
+// OpenAI的tool消息只支持文本，工具结果中的图片和文档放到随后的用户消息中
+func convertClaudeUserBlocks(blocks []interface{}) []OpenAIMessage {
+	var messages []OpenAIMessage
+	var parts []map[string]interface{}
+
+	for _, block := range blocks {
+		blockMap, ok := block.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		if blockMap["type"] == "tool_result" {
+			toolMessage, mediaParts := convertClaudeToolResult(blockMap)
+			messages = append(messages, toolMessage)
+			parts = append(parts, mediaParts...)
+			continue
+		}
+		parts = append(parts, convertClaudeContentPart(blockMap)...)
+	}
+
+	// 添加其他用户内容
+	if len(parts) > 0 {
+		messages = append(messages, OpenAIMessage{
+			Role:    "user",
+			Content: parts,
+		})
+	}
+
+	return messages
+}
+
+// convertClaudeToolResult 转换工具结果，返回tool消息和其中无法放入tool消息的图片、文档内容
+func convertClaudeToolResult(block map[string]interface{}) (OpenAIMessage, []map[string]interface{}) {
+	toolUseID, _ := block["tool_use_id"].(string)
+
+	var textParts []string
+	var mediaParts []map[string]interface{}
+	switch content := block["content"].(type) {
+	case string:
+		textParts = append(textParts, content)
+	case []interface{}:
+		for _, item := range content {
+			itemMap, ok := item.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			if itemMap["type"] == "text" {
+				text, _ := itemMap["text"].(string)
+				textParts = append(textParts, text)
+				continue
+			}
+			mediaParts = append(mediaParts, convertClaudeContentPart(itemMap)...)
+		}
+	case nil:
+	default:
+		contentBytes, _ := json.Marshal(content)
+		textParts = append(textParts, string(contentBytes))
+	}
+
+	text := strings.Join(textParts, "\n")
+	if isError, _ := block["is_error"].(bool); isError {
+		text = "Error: " + text
+	}
+
+	// 标明图片来自哪次工具调用，便于模型对应
+	if len(mediaParts) > 0 {
+		mediaParts = append([]map[string]interface{}{{
+			"type": "text",
+			"text": fmt.Sprintf("Content returned by tool call %s:", toolUseID),
+		}}, mediaParts...)
+	}
+
+	return OpenAIMessage{
+		Role:       "tool",
+		ToolCallID: toolUseID,
+		Content:    text,
+	}, mediaParts
+}
+
+// convertClaudeContentPart 将Claude内容块（文本、图片、文档）转换为OpenAI content part
+// 不支持的内容块类型返回nil
+func convertClaudeContentPart(block map[string]interface{}) []map[string]interface{} {
+	source, _ := block["source"].(map[string]interface{})
+	sourceType, _ := source["type"].(string)
+
+	switch block["type"] {
+	case "text":
+		return []map[string]interface{}{{
+			"type": "text",
+			"text": block["text"],
+		}}
+	case "image":
+		imageURL, _ := source["url"].(string)
+		if sourceType == "base64" {
+			imageURL = fmt.Sprintf("data:%s;base64,%s", source["media_type"], source["data"])
+		}
+		if imageURL == "" {
+			return nil
+		}
+		return []map[string]interface{}{{
+			"type": "image_url",
+			"image_url": map[string]string{
+				"url": imageURL,
+			},
+		}}
+	case "document":
+		title, _ := block["title"].(string)
+		switch sourceType {
+		case "base64":
+			// PDF等二进制文档使用file content part
+			filename := title
+			if filename == "" {
+				filename = "document.pdf"
+			}
+			return []map[string]interface{}{{
+				"type": "file",
+				"file": map[string]string{
+					"filename":  filename,
+					"file_data": fmt.Sprintf("data:%s;base64,%s", source["media_type"], source["data"]),
+				},
+			}}
+		case "text":
+			text, _ := source["data"].(string)
+			if title != "" {
+				text = title + "\n\n" + text
+			}
+			return []map[string]interface{}{{
+				"type": "text",
+				"text": text,
+			}}
+		case "content":
+			var parts []map[string]interface{}
+			items, _ := source["content"].([]interface{})
+			for _, item := range items {
+				if itemMap, ok := item.(map[string]interface{}); ok {
+					parts = append(parts, convertClaudeContentPart(itemMap)...)
+				}
+			}
+			return parts
+		case "url":
+			// OpenAI的file content part不支持URL，以文本形式传递文档地址
+			documentURL, _ := source["url"].(string)
+			return []map[string]interface{}{{
+				"type": "text",
+				"text": fmt.Sprintf("Document: %s", documentURL),
+			}}
+		}
+	}
+	return nil
+}
+
+// convertClaudeAssistantBlocks 转换Claude助手消息内容块（文本、思考过程和工具调用）
+func convertClaudeAssistantBlocks(blocks []interface{}) OpenAIMessage {
+	var textParts []string
+	var reasoningParts []string
+	var toolCalls []OpenAIToolCall
+
+	for _, block := range blocks {
+		blockMap, ok := block.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		switch blockMap["type"] {
+		case "text":
+			text, _ := blockMap["text"].(string)
+			textParts = append(textParts, text)
+		case "thinking":
+			// 思考过程通过reasoning_content回传，redacted_thinking为加密内容，其他上游无法使用，直接丢弃
+			thinking, _ := blockMap["thinking"].(string)
+			reasoningParts = append(reasoningParts, thinking)
+		case "tool_use":
+			arguments := "{}"
+			if blockMap["input"] != nil {
+				argBytes, _ := json.Marshal(blockMap["input"])
+				arguments = string(argBytes)
+			}
+
+			id, _ := blockMap["id"].(string)
+			name, _ := blockMap["name"].(string)
+			toolCalls = append(toolCalls, OpenAIToolCall{
+				ID:   id,
+				Type: "function",
+				Function: OpenAIFunctionCall{
+					Name:      name,
+					Arguments: arguments,
+				},
+			})
+		}
+	}
+
+	assistantMessage := OpenAIMessage{
+		Role:             "assistant",
+		Content:          strings.Join(textParts, "\n"),
+		ReasoningContent: strings.Join(reasoningParts, "\n"),
+	}
+	if len(toolCalls) > 0 {
+		assistantMessage.ToolCalls = toolCalls
+	}
+	if assistantMessage.Content == "" {
+		assistantMessage.Content = nil
+	}
+
+	return assistantMessage
+}
+
 // convertOpenAIToClaudeResponse 将OpenAI响应转换为Claude格式
 func convertOpenAIToClaudeResponse(openaiResp OpenAIResponse, model string) ClaudeResponse {
 	var contentBlocks []ClaudeContentBlock
@@ -582,6 +766,14 @@ func convertOpenAIToClaudeResponse(openaiResp OpenAIResponse, model string) Clau
 	if len(openaiResp.Choices) > 0 {
 		choice := openaiResp.Choices[0]
 
+		// 添加思考内容
+		if choice.Message.ReasoningContent != "" {
+			contentBlocks = append(contentBlocks, ClaudeContentBlock{
+				Type:     "thinking",
+				Thinking: choice.Message.ReasoningContent,
+			})
+		}
+
 		// 添加文本内容
 		if choice.Message.Content != nil {
 			if content, ok := choice.Message.Content.(string); ok && content != "" {
@@ -611,18 +803,9 @@ func convertOpenAIToClaudeResponse(openaiResp OpenAIResponse, model string) Clau
 	}
 
 	// 映射停止原因
-	stopReasonMap := map[string]string{
-		"stop":       "end_turn",
-		"length":     "max_tokens",
-		"tool_calls": "tool_use",
-	}
-
-	var stopReason string
+	stopReason := "end_turn"
 	if len(openaiResp.Choices) > 0 {
-		stopReason = stopReasonMap[openaiResp.Choices[0].FinishReason]
-	}
-	if stopReason == "" {
-		stopReason = "end_turn"
+		stopReason = openAIStopReason(openaiResp.Choices[0].FinishReason)
 	}
 
 	return ClaudeResponse{
@@ -640,7 +823,7 @@ func convertOpenAIToClaudeResponse(openaiResp OpenAIResponse, model string) Clau
 }
 
 // handleStreamingResponse 处理流式响应
-func handleStreamingResponse(c *gin.Context, resp *http.Response, model string, isClientStream bool, account *model.Account, apiKey *model.ApiKey, startTime time.Time) {
+func handleStreamingResponse(c *gin.Context, resp *http.Response, requestBody []byte, model string, isClientStream bool, account *model.Account, apiKey *model.ApiKey, startTime time.Time) {
 	// 设置流式响应头
 	c.Header("Content-Type", "text/event-stream")
 	c.Header("Cache-Control", "no-cache")
@@ -649,16 +832,14 @@ func handleStreamingResponse(c *gin.Context, resp *http.Response, model string,
 
 	// 创建流式转换器并处理OpenAI流式响应
 	transformer := createStreamTransformer(model)
+	if account.UpstreamFormat == constant.UpstreamFormatResponses {
+		transformer.responses = newResponsesStreamState()
+	}
 	usageTokens := processOpenAIStreamResponse(c.Writer, resp.Body, transformer, isClientStream)
 
-	// 如果没有usage信息，创建0值的TokenUsage用于日志记录
-	if usageTokens == nil {
-		usageTokens = &common.TokenUsage{
-			InputTokens:  0,
-			OutputTokens: 0,
-			Model:        model,
-		}
-	}
+	// 上游未返回usage信息时，根据请求和已输出内容估算
+	usageTokens.ApplyEstimate(requestBody)
+	markInterruptedUsage(c, account, usageTokens)
 
 	// 更新账号状态和统计信息
 	accountService := service.NewAccountService()
@@ -673,11 +854,15 @@ func handleStreamingResponse(c *gin.Context, resp *http.Response, model string,
 	if resp.StatusCode >= 200 && resp.StatusCode < 300 && apiKey != nil {
 		duration := time.Since(startTime).Milliseconds()
 		logService := service.NewLogService()
+		capture := SnapshotBodyCapture(c)
+		info := service.NewRequestLogInfo(c)
 		go func() {
-			_, err := logService.CreateLogFromTokenUsage(usageTokens, apiKey.UserID, apiKey.ID, account.ID, duration, isClientStream)
+			logEntry, err := logService.CreateLogFromTokenUsage(usageTokens, apiKey.UserID, apiKey.ID, account.ID, duration, isClientStream, info)
 			if err != nil {
 				log.Printf("保存日志失败: %v", err)
+				return
 			}
+			capture.Save(logEntry.ID)
 		}()
 	}
 }
@@ -685,9 +870,13 @@ func handleStreamingResponse(c *gin.Context, resp *http.Response, model string,
 // processOpenAIStreamResponse 处理OpenAI流式响应并转换为Claude格式
 func processOpenAIStreamResponse(writer gin.ResponseWriter, reader io.Reader, transformer *StreamTransformer, isClientStream bool) *common.TokenUsage {
 	scanner := bufio.NewScanner(reader)
+	// Responses API的response.created/completed等事件会回显完整的instructions、tools和output，单行可能远超默认的64KB
+	scanner.Buffer(make([]byte, 0, 64*1024), 10*1024*1024)
 
-	var totalPromptTokens, totalCompletionTokens int
+	var totalPromptTokens, totalCompletionTokens, totalCachedTokens int
+	var upstreamError map[string]interface{}
 	var responseContent strings.Builder
+	var reasoningContent strings.Builder
 	var toolCalls []OpenAIToolCall
 	var finishReason string
 
@@ -715,6 +904,21 @@ func processOpenAIStreamResponse(writer gin.ResponseWriter, reader io.Reader, tr
 			continue // 忽略解析错误的chunk
 		}
 
+		// Responses API事件先转换为Chat Completions格式的chunk
+		responseDone := false
+		if transformer.responses != nil {
+			openaiChunk, responseDone = transformer.responses.toChatChunk(openaiChunk)
+			if openaiChunk == nil {
+				continue
+			}
+		}
+
+		// 上游在流中返回错误
+		if errorInfo, ok := openaiChunk["error"].(map[string]interface{}); ok {
+			upstreamError = errorInfo
+			break
+		}
+
 		// 提取usage信息
 		if usage, ok := openaiChunk["usage"].(map[string]interface{}); ok {
 			if promptTokens, ok := usage["prompt_tokens"].(float64); ok {
@@ -723,6 +927,11 @@ func processOpenAIStreamResponse(writer gin.ResponseWriter, reader io.Reader, tr
 			if completionTokens, ok := usage["completion_tokens"].(float64); ok {
 				totalCompletionTokens = int(completionTokens)
 			}
+			if details, ok := usage["prompt_tokens_details"].(map[string]interface{}); ok {
+				if cachedTokens, ok := details["cached_tokens"].(float64); ok {
+					totalCachedTokens = int(cachedTokens)
+				}
+			}
 		}
 
 		// 处理流式数据
@@ -734,6 +943,9 @@ func processOpenAIStreamResponse(writer gin.ResponseWriter, reader io.Reader, tr
 				}
 
 				if delta, ok := choice["delta"].(map[string]interface{}); ok {
+					// 收集思考内容
+					reasoningContent.WriteString(openAIReasoningDelta(delta))
+
 					// 收集文本内容
 					if content, ok := delta["content"].(string); ok {
 						responseContent.WriteString(content)
@@ -743,7 +955,8 @@ func processOpenAIStreamResponse(writer gin.ResponseWriter, reader io.Reader, tr
 					if toolCallsData, ok := delta["tool_calls"].([]interface{}); ok {
 						for _, tc := range toolCallsData {
 							if tcMap, ok := tc.(map[string]interface{}); ok {
-								index := int(tcMap["index"].(float64))
+								indexValue, _ := tcMap["index"].(float64)
+								index := int(indexValue)
 
 								// 确保toolCalls数组足够长
 								for len(toolCalls) <= index {
@@ -775,6 +988,62 @@ func processOpenAIStreamResponse(writer gin.ResponseWriter, reader io.Reader, tr
 		if isClientStream {
 			transformer.processChunk(writer, openaiChunk)
 		}
+
+		// Responses流以response.completed事件结束，没有[DONE]标记
+		if responseDone {
+			if isClientStream {
+				transformer.sendFinalEvents(writer)
+			}
+			break
+		}
+	}
+
+	// 上游连接中断或客户端断开导致读取失败时，响应不完整
+	scanErr := scanner.Err()
+	if scanErr != nil {
+		log.Printf("读取OpenAI流式响应失败: %v", scanErr)
+	}
+
+	// OpenAI的prompt_tokens包含缓存命中部分，拆分为普通输入和缓存读取
+	usageTokens := &common.TokenUsage{
+		InputTokens:          totalPromptTokens - totalCachedTokens,
+		OutputTokens:         totalCompletionTokens,
+		CacheReadInputTokens: totalCachedTokens,
+		Model:                transformer.model,
+		Interrupted:          scanErr != nil,
+	}
+
+	// 累计输出内容的估算token数，供上游未返回用量时使用
+	usageTokens.AddOutputEstimate(reasoningContent.String())
+	usageTokens.AddOutputEstimate(responseContent.String())
+	for _, toolCall := range toolCalls {
+		usageTokens.AddOutputEstimate(toolCall.Function.Name)
+		usageTokens.AddOutputEstimate(toolCall.Function.Arguments)
+	}
+
+	// 上游超时时返回明确的超时错误，不再输出不完整的消息
+	if writeUpstreamTimeoutError(writer, scanErr, isClientStream) {
+		return usageTokens
+	}
+
+	// 上游在流中返回错误时，转换为Claude格式的错误
+	if upstreamError != nil {
+		log.Printf("OpenAI流式响应返回错误: %v", upstreamError)
+		errorMessage, _ := upstreamError["message"].(string)
+		errorBody := map[string]interface{}{
+			"type": "error",
+			"error": map[string]interface{}{
+				"type":    "api_error",
+				"message": errorMessage,
+			},
+		}
+		if isClientStream {
+			transformer.sendEvent(writer, "error", errorBody)
+		} else {
+			jsonBytes, _ := json.Marshal(errorBody)
+			writer.Write(jsonBytes)
+		}
+		return usageTokens
 	}
 
 	// 如果客户端不需要流式响应，发送完整的非流式响应
@@ -782,6 +1051,14 @@ func processOpenAIStreamResponse(writer gin.ResponseWriter, reader io.Reader, tr
 		// 构建Claude格式的内容块
 		var contentBlocks []ClaudeContentBlock
 
+		// 添加思考内容
+		if reasoningContent.Len() > 0 {
+			contentBlocks = append(contentBlocks, ClaudeContentBlock{
+				Type:     "thinking",
+				Thinking: reasoningContent.String(),
+			})
+		}
+
 		// 添加文本内容
 		if responseContent.Len() > 0 {
 			contentBlocks = append(contentBlocks, ClaudeContentBlock{
@@ -810,27 +1087,17 @@ func processOpenAIStreamResponse(writer gin.ResponseWriter, reader io.Reader, tr
 			}
 		}
 
-		// 映射停止原因
-		stopReasonMap := map[string]string{
-			"stop":       "end_turn",
-			"length":     "max_tokens",
-			"tool_calls": "tool_use",
-		}
-		stopReason := stopReasonMap[finishReason]
-		if stopReason == "" {
-			stopReason = "end_turn"
-		}
-
 		claudeResponse := ClaudeResponse{
 			ID:         fmt.Sprintf("msg_%s", generateRandomID()),
 			Type:       "message",
 			Role:       "assistant",
 			Model:      transformer.model,
 			Content:    contentBlocks,
-			StopReason: stopReason,
+			StopReason: openAIStopReason(finishReason),
 			Usage: ClaudeUsage{
-				InputTokens:  totalPromptTokens,
-				OutputTokens: totalCompletionTokens,
+				InputTokens:          usageTokens.InputTokens,
+				OutputTokens:         totalCompletionTokens,
+				CacheReadInputTokens: totalCachedTokens,
 			},
 		}
 
@@ -841,15 +1108,7 @@ func processOpenAIStreamResponse(writer gin.ResponseWriter, reader io.Reader, tr
 	}
 
 	// 返回token使用统计
-	if totalPromptTokens > 0 || totalCompletionTokens > 0 {
-		return &common.TokenUsage{
-			InputTokens:  totalPromptTokens,
-			OutputTokens: totalCompletionTokens,
-			Model:        transformer.model,
-		}
-	}
-
-	return nil
+	return usageTokens
 }
 
 // StreamTransformer 流式转换器结构
@@ -858,7 +1117,12 @@ type StreamTransformer struct {
 	messageID         string
 	model             string
 	toolCalls         map[int]*ToolCallState
-	contentBlockIndex int
+	contentBlockIndex int    // 下一个内容块的索引
+	currentBlockType  string // 当前打开的文本或思考内容块类型，为空表示没有打开的块
+	currentBlockIndex int
+	finishReason      string
+	outputTokens      int
+	responses         *responsesStreamState // 上游为Responses API时的事件转换状态
 }
 
 // ToolCallState 工具调用状态
@@ -891,6 +1155,29 @@ func generateRandomID() string {
 	return string(result)
 }
 
+// openAIStopReason 将OpenAI的finish_reason映射为Claude停止原因
+func openAIStopReason(finishReason string) string {
+	switch finishReason {
+	case "length":
+		return "max_tokens"
+	case "tool_calls", "function_call":
+		return "tool_use"
+	case "content_filter":
+		return "refusal"
+	default:
+		return "end_turn"
+	}
+}
+
+// openAIReasoningDelta 提取OpenAI兼容上游的思考内容（reasoning_content或reasoning字段）
+func openAIReasoningDelta(delta map[string]interface{}) string {
+	if reasoning, ok := delta["reasoning_content"].(string); ok && reasoning != "" {
+		return reasoning
+	}
+	reasoning, _ := delta["reasoning"].(string)
+	return reasoning
+}
+
 // sendEvent 发送SSE事件
 func (st *StreamTransformer) sendEvent(writer gin.ResponseWriter, eventType string, data interface{}) {
 	jsonData, _ := json.Marshal(data)
@@ -898,47 +1185,66 @@ func (st *StreamTransformer) sendEvent(writer gin.ResponseWriter, eventType stri
 	writer.Flush()
 }
 
+// sendMessageStart 发送消息开始事件
+func (st *StreamTransformer) sendMessageStart(writer gin.ResponseWriter) {
+	st.sendEvent(writer, "message_start", map[string]interface{}{
+		"type": "message_start",
+		"message": map[string]interface{}{
+			"id":          st.messageID,
+			"type":        "message",
+			"role":        "assistant",
+			"model":       st.model,
+			"content":     []interface{}{},
+			"stop_reason": nil,
+			"usage": map[string]int{
+				"input_tokens":  0,
+				"output_tokens": 0,
+			},
+		},
+	})
+	st.initialized = true
+}
+
 // processChunk 处理单个流式chunk
 func (st *StreamTransformer) processChunk(writer gin.ResponseWriter, openaiChunk map[string]interface{}) {
 	// 初始化消息开始事件
 	if !st.initialized {
-		st.sendEvent(writer, "message_start", map[string]interface{}{
-			"type": "message_start",
-			"message": map[string]interface{}{
-				"id":          st.messageID,
-				"type":        "message",
-				"role":        "assistant",
-				"model":       st.model,
-				"content":     []interface{}{},
-				"stop_reason": nil,
-				"usage": map[string]int{
-					"input_tokens":  0,
-					"output_tokens": 0,
-				},
-			},
-		})
-
-		st.sendEvent(writer, "content_block_start", map[string]interface{}{
-			"type":  "content_block_start",
-			"index": 0,
-			"content_block": map[string]interface{}{
-				"type": "text",
-				"text": "",
-			},
-		})
+		st.sendMessageStart(writer)
+	}
 
-		st.initialized = true
+	if usage, ok := openaiChunk["usage"].(map[string]interface{}); ok {
+		if completionTokens, ok := usage["completion_tokens"].(float64); ok {
+			st.outputTokens = int(completionTokens)
+		}
 	}
 
 	// 处理choices数组
 	if choices, ok := openaiChunk["choices"].([]interface{}); ok && len(choices) > 0 {
 		if choice, ok := choices[0].(map[string]interface{}); ok {
+			if reason, ok := choice["finish_reason"].(string); ok && reason != "" {
+				st.finishReason = reason
+			}
+
 			if delta, ok := choice["delta"].(map[string]interface{}); ok {
+				// 处理思考内容
+				if reasoning := openAIReasoningDelta(delta); reasoning != "" {
+					st.startBlock(writer, "thinking")
+					st.sendEvent(writer, "content_block_delta", map[string]interface{}{
+						"type":  "content_block_delta",
+						"index": st.currentBlockIndex,
+						"delta": map[string]interface{}{
+							"type":     "thinking_delta",
+							"thinking": reasoning,
+						},
+					})
+				}
+
 				// 处理文本内容
-				if content, ok := delta["content"].(string); ok {
+				if content, ok := delta["content"].(string); ok && content != "" {
+					st.startBlock(writer, "text")
 					st.sendEvent(writer, "content_block_delta", map[string]interface{}{
 						"type":  "content_block_delta",
-						"index": 0,
+						"index": st.currentBlockIndex,
 						"delta": map[string]interface{}{
 							"type": "text_delta",
 							"text": content,
@@ -959,9 +1265,53 @@ func (st *StreamTransformer) processChunk(writer gin.ResponseWriter, openaiChunk
 	}
 }
 
+// startBlock 开始文本或思考内容块，当前打开的是其他类型的块时先将其结束
+func (st *StreamTransformer) startBlock(writer gin.ResponseWriter, blockType string) {
+	if st.currentBlockType == blockType {
+		return
+	}
+	st.stopCurrentBlock(writer)
+
+	contentBlock := map[string]interface{}{
+		"type": "text",
+		"text": "",
+	}
+	if blockType == "thinking" {
+		contentBlock = map[string]interface{}{
+			"type":      "thinking",
+			"thinking":  "",
+			"signature": "",
+		}
+	}
+
+	st.currentBlockType = blockType
+	st.currentBlockIndex = st.contentBlockIndex
+	st.contentBlockIndex++
+
+	st.sendEvent(writer, "content_block_start", map[string]interface{}{
+		"type":          "content_block_start",
+		"index":         st.currentBlockIndex,
+		"content_block": contentBlock,
+	})
+}
+
+// stopCurrentBlock 结束当前打开的文本或思考内容块
+func (st *StreamTransformer) stopCurrentBlock(writer gin.ResponseWriter) {
+	if st.currentBlockType == "" {
+		return
+	}
+
+	st.sendEvent(writer, "content_block_stop", map[string]interface{}{
+		"type":  "content_block_stop",
+		"index": st.currentBlockIndex,
+	})
+	st.currentBlockType = ""
+}
+
 // processToolCallDelta 处理工具调用增量
 func (st *StreamTransformer) processToolCallDelta(writer gin.ResponseWriter, tcDelta map[string]interface{}) {
-	index := int(tcDelta["index"].(float64))
+	indexValue, _ := tcDelta["index"].(float64)
+	index := int(indexValue)
 
 	// 初始化工具调用状态
 	if _, exists := st.toolCalls[index]; !exists {
@@ -992,9 +1342,10 @@ func (st *StreamTransformer) processToolCallDelta(writer gin.ResponseWriter, tcD
 
 	// 如果工具调用准备就绪且未开始，发送开始事件
 	if toolCall.ID != "" && toolCall.Name != "" && !toolCall.Started {
-		st.contentBlockIndex++
+		st.stopCurrentBlock(writer)
 		toolCall.ClaudeIndex = st.contentBlockIndex
 		toolCall.Started = true
+		st.contentBlockIndex++
 
 		st.sendEvent(writer, "content_block_start", map[string]interface{}{
 			"type":  "content_block_start",
@@ -1006,12 +1357,25 @@ func (st *StreamTransformer) processToolCallDelta(writer gin.ResponseWriter, tcD
 				"input": map[string]interface{}{},
 			},
 		})
+
+		// 开始前已累积的参数一并发送
+		if toolCall.Args != "" {
+			st.sendEvent(writer, "content_block_delta", map[string]interface{}{
+				"type":  "content_block_delta",
+				"index": toolCall.ClaudeIndex,
+				"delta": map[string]interface{}{
+					"type":         "input_json_delta",
+					"partial_json": toolCall.Args,
+				},
+			})
+		}
+		return
 	}
 
 	// 如果有新的参数内容，发送增量事件
 	if toolCall.Started {
 		if function, ok := tcDelta["function"].(map[string]interface{}); ok {
-			if args, ok := function["arguments"].(string); ok {
+			if args, ok := function["arguments"].(string); ok && args != "" {
 				st.sendEvent(writer, "content_block_delta", map[string]interface{}{
 					"type":  "content_block_delta",
 					"index": toolCall.ClaudeIndex,
@@ -1027,31 +1391,37 @@ func (st *StreamTransformer) processToolCallDelta(writer gin.ResponseWriter, tcD
 
 // sendFinalEvents 发送最终事件
 func (st *StreamTransformer) sendFinalEvents(writer gin.ResponseWriter) {
+	if !st.initialized {
+		st.sendMessageStart(writer)
+	}
+
 	// 发送内容块结束事件
-	st.sendEvent(writer, "content_block_stop", map[string]interface{}{
-		"type":  "content_block_stop",
-		"index": 0,
-	})
+	st.stopCurrentBlock(writer)
 
-	// 发送所有工具调用的结束事件
+	// 按索引顺序发送所有工具调用的结束事件
+	var toolIndexes []int
 	for _, toolCall := range st.toolCalls {
 		if toolCall.Started {
-			st.sendEvent(writer, "content_block_stop", map[string]interface{}{
-				"type":  "content_block_stop",
-				"index": toolCall.ClaudeIndex,
-			})
+			toolIndexes = append(toolIndexes, toolCall.ClaudeIndex)
 		}
 	}
+	sort.Ints(toolIndexes)
+	for _, index := range toolIndexes {
+		st.sendEvent(writer, "content_block_stop", map[string]interface{}{
+			"type":  "content_block_stop",
+			"index": index,
+		})
+	}
 
 	// 发送消息增量事件（包含停止原因）
 	st.sendEvent(writer, "message_delta", map[string]interface{}{
 		"type": "message_delta",
 		"delta": map[string]interface{}{
-			"stop_reason":   "end_turn",
+			"stop_reason":   openAIStopReason(st.finishReason),
 			"stop_sequence": nil,
 		},
 		"usage": map[string]int{
-			"output_tokens": 0,
+			"output_tokens": st.outputTokens,
 		},
 	})
 
@@ -1087,14 +1457,13 @@ func TestHandleOpenAIRequest(account *model.Account) (int, string) {
 	// 转换Claude请求为OpenAI格式
 	openaiReq := convertClaudeToOpenAI(claudeReq, mappedModelName)
 
-	// 序列化OpenAI请求
-	openaiBody, err := json.Marshal(openaiReq)
+	// 按账号的上游接口格式序列化请求
+	openaiURL, openaiBody, err := buildOpenAIUpstreamBody(targetConfig.BaseURL, account.UpstreamFormat, claudeReq, openaiReq)
 	if err != nil {
 		return http.StatusInternalServerError, "Failed to marshal OpenAI request: " + err.Error()
 	}
 
 	// 创建OpenAI API请求
-	openaiURL := targetConfig.BaseURL + "/chat/completions"
 	req, err := http.NewRequest("POST", openaiURL, bytes.NewBuffer(openaiBody))
 	if err != nil {
 		return http.StatusInternalServerError, "Failed to create request: " + err.Error()
@@ -1105,23 +1474,9 @@ func TestHandleOpenAIRequest(account *model.Account) (int, string) {
 	req.Header.Set("Authorization", "Bearer "+account.SecretKey)
 
 	// 创建HTTP客户端
-	httpClientTimeout := 30 * time.Second
-	transport := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-	}
-
-	// 配置代理
-	if account.ProxyURI != "" {
-		proxyURL, err := url.Parse(account.ProxyURI)
-		if err != nil {
-			return http.StatusInternalServerError, "Invalid proxy URI: " + err.Error()
-		}
-		transport.Proxy = http.ProxyURL(proxyURL)
-	}
-
-	client := &http.Client{
-		Timeout:   httpClientTimeout,
-		Transport: transport,
+	client, err := newAccountHTTPClient(account, account.ProxyURI, 30*time.Second)
+	if err != nil {
+		return http.StatusInternalServerError, "Invalid proxy or TLS configuration: " + err.Error()
 	}
 
 	// 发送请求
@@ -0,0 +1,661 @@
+package relay
+
+import (
+	"bytes"
+	"claude-code-relay/common"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tidwall/gjson"
+)
+
+// 入站OpenAI请求未指定max_tokens时使用的默认值（Claude要求必须指定）
+const defaultInboundMaxTokens = 8192
+
+// ConvertOpenAIToClaudeRequest 将OpenAI Chat Completions请求转换为Claude Messages请求
+// 转换后的请求始终为流式，由OpenAIChatWriter根据客户端的stream参数决定输出格式
+func ConvertOpenAIToClaudeRequest(body []byte) ([]byte, error) {
+	if !gjson.ValidBytes(body) {
+		return nil, errors.New("invalid JSON body")
+	}
+
+	request := gjson.ParseBytes(body)
+	claudeReq := ClaudeRequest{
+		Model:     request.Get("model").String(),
+		MaxTokens: defaultInboundMaxTokens,
+		Stream:    true,
+	}
+
+	if maxTokens := request.Get("max_completion_tokens"); maxTokens.Exists() {
+		claudeReq.MaxTokens = int(maxTokens.Int())
+	} else if maxTokens := request.Get("max_tokens"); maxTokens.Exists() {
+		claudeReq.MaxTokens = int(maxTokens.Int())
+	}
+
+	if temperature := request.Get("temperature"); temperature.Exists() {
+		value := temperature.Float()
+		claudeReq.Temperature = &value
+	}
+	if topP := request.Get("top_p"); topP.Exists() {
+		value := topP.Float()
+		claudeReq.TopP = &value
+	}
+
+	// stop支持字符串和数组两种格式
+	if stop := request.Get("stop"); stop.Exists() {
+		if stop.IsArray() {
+			for _, item := range stop.Array() {
+				claudeReq.StopSequences = append(claudeReq.StopSequences, item.String())
+			}
+		} else if stop.String() != "" {
+			claudeReq.StopSequences = []string{stop.String()}
+		}
+	}
+
+	// 转换消息，system/developer消息合并为Claude的system字段
+	var systemParts []string
+	for _, message := range request.Get("messages").Array() {
+		role := message.Get("role").String()
+		switch role {
+		case "system", "developer":
+			if text := extractOpenAIText(message.Get("content")); text != "" {
+				systemParts = append(systemParts, text)
+			}
+		case "user":
+			claudeReq.Messages = appendClaudeMessage(claudeReq.Messages, "user", convertOpenAIUserContent(message.Get("content")))
+		case "assistant":
+			claudeReq.Messages = appendClaudeMessage(claudeReq.Messages, "assistant", convertOpenAIAssistantContent(message))
+		case "tool":
+			toolResult := map[string]interface{}{
+				"type":        "tool_result",
+				"tool_use_id": message.Get("tool_call_id").String(),
+				"content":     extractOpenAIText(message.Get("content")),
+			}
+			claudeReq.Messages = appendClaudeMessage(claudeReq.Messages, "user", []interface{}{toolResult})
+		}
+	}
+	if len(systemParts) > 0 {
+		claudeReq.System = strings.Join(systemParts, "\n")
+	}
+
+	if len(claudeReq.Messages) == 0 {
+		return nil, errors.New("messages must contain at least one user or assistant message")
+	}
+
+	// 转换工具定义
+	for _, tool := range request.Get("tools").Array() {
+		if tool.Get("type").String() != "function" {
+			continue
+		}
+		var inputSchema interface{} = map[string]interface{}{"type": "object"}
+		if parameters := tool.Get("function.parameters"); parameters.Exists() {
+			inputSchema = parameters.Value()
+		}
+		claudeReq.Tools = append(claudeReq.Tools, ClaudeTool{
+			Name:        tool.Get("function.name").String(),
+			Description: tool.Get("function.description").String(),
+			InputSchema: inputSchema,
+		})
+	}
+
+	// 转换工具选择
+	if toolChoice := request.Get("tool_choice"); toolChoice.Exists() && len(claudeReq.Tools) > 0 {
+		switch {
+		case toolChoice.IsObject():
+			claudeReq.ToolChoice = &ClaudeToolChoice{Type: "tool", Name: toolChoice.Get("function.name").String()}
+		case toolChoice.String() == "required":
+			claudeReq.ToolChoice = &ClaudeToolChoice{Type: "any"}
+		case toolChoice.String() == "none":
+			claudeReq.ToolChoice = &ClaudeToolChoice{Type: "none"}
+		default:
+			claudeReq.ToolChoice = &ClaudeToolChoice{Type: "auto"}
+		}
+	}
+
+	return json.Marshal(claudeReq)
+}
+
+// appendClaudeMessage 追加Claude消息，相同角色的连续消息合并为一条（Claude要求角色交替）
+func appendClaudeMessage(messages []ClaudeMessage, role string, blocks []interface{}) []ClaudeMessage {
+	if len(blocks) == 0 {
+		return messages
+	}
+
+	if len(messages) > 0 && messages[len(messages)-1].Role == role {
+		if existing, ok := messages[len(messages)-1].Content.([]interface{}); ok {
+			messages[len(messages)-1].Content = append(existing, blocks...)
+			return messages
+		}
+	}
+
+	return append(messages, ClaudeMessage{Role: role, Content: blocks})
+}
+
+// extractOpenAIText 提取OpenAI消息内容中的文本（支持字符串和content part数组）
+func extractOpenAIText(content gjson.Result) string {
+	if !content.IsArray() {
+		return content.String()
+	}
+
+	var textParts []string
+	for _, part := range content.Array() {
+		if part.Get("type").String() == "text" {
+			textParts = append(textParts, part.Get("text").String())
+		}
+	}
+	return strings.Join(textParts, "\n")
+}
+
+// convertOpenAIUserContent 转换OpenAI用户消息内容为Claude内容块
+func convertOpenAIUserContent(content gjson.Result) []interface{} {
+	if !content.IsArray() {
+		if content.String() == "" {
+			return nil
+		}
+		return []interface{}{map[string]interface{}{"type": "text", "text": content.String()}}
+	}
+
+	var blocks []interface{}
+	for _, part := range content.Array() {
+		switch part.Get("type").String() {
+		case "text":
+			blocks = append(blocks, map[string]interface{}{"type": "text", "text": part.Get("text").String()})
+		case "image_url":
+			if imageBlock := convertOpenAIImageURL(part.Get("image_url.url").String()); imageBlock != nil {
+				blocks = append(blocks, imageBlock)
+			}
+		case "file":
+			if documentBlock := convertOpenAIFile(part.Get("file")); documentBlock != nil {
+				blocks = append(blocks, documentBlock)
+			}
+		}
+	}
+	return blocks
+}
+
+// convertOpenAIImageURL 将OpenAI的image_url转换为Claude图片内容块（支持data URL和普通URL）
+func convertOpenAIImageURL(imageURL string) map[string]interface{} {
+	if imageURL == "" {
+		return nil
+	}
+
+	if strings.HasPrefix(imageURL, "data:") {
+		// 格式: data:image/png;base64,xxxx
+		header, data, found := strings.Cut(strings.TrimPrefix(imageURL, "data:"), ",")
+		if !found {
+			return nil
+		}
+		mediaType := strings.TrimSuffix(header, ";base64")
+		return map[string]interface{}{
+			"type": "image",
+			"source": map[string]interface{}{
+				"type":       "base64",
+				"media_type": mediaType,
+				"data":       data,
+			},
+		}
+	}
+
+	return map[string]interface{}{
+		"type": "image",
+		"source": map[string]interface{}{
+			"type": "url",
+			"url":  imageURL,
+		},
+	}
+}
+
+// convertOpenAIFile 将OpenAI的file content part转换为Claude文档内容块（仅支持file_data内联数据，file_id无法转换）
+func convertOpenAIFile(file gjson.Result) map[string]interface{} {
+	header, data, found := strings.Cut(strings.TrimPrefix(file.Get("file_data").String(), "data:"), ",")
+	if !found {
+		return nil
+	}
+
+	document := map[string]interface{}{
+		"type": "document",
+		"source": map[string]interface{}{
+			"type":       "base64",
+			"media_type": strings.TrimSuffix(header, ";base64"),
+			"data":       data,
+		},
+	}
+	if filename := file.Get("filename").String(); filename != "" {
+		document["title"] = filename
+	}
+	return document
+}
+
+// convertOpenAIAssistantContent 转换OpenAI助手消息（文本和工具调用）为Claude内容块
+func convertOpenAIAssistantContent(message gjson.Result) []interface{} {
+	var blocks []interface{}
+
+	if text := extractOpenAIText(message.Get("content")); text != "" {
+		blocks = append(blocks, map[string]interface{}{"type": "text", "text": text})
+	}
+
+	for _, toolCall := range message.Get("tool_calls").Array() {
+		input := map[string]interface{}{}
+		if arguments := toolCall.Get("function.arguments").String(); arguments != "" {
+			if err := json.Unmarshal([]byte(arguments), &input); err != nil {
+				input = map[string]interface{}{}
+			}
+		}
+		blocks = append(blocks, map[string]interface{}{
+			"type":  "tool_use",
+			"id":    toolCall.Get("id").String(),
+			"name":  toolCall.Get("function.name").String(),
+			"input": input,
+		})
+	}
+
+	return blocks
+}
+
+// OpenAIChatWriter 将Claude SSE响应转换为OpenAI Chat Completions格式
+// 流式请求实时输出chat.completion.chunk事件；非流式请求在Finish时输出完整的chat.completion对象
+// 错误响应（状态码>=400）和非流式请求流中的错误事件在Finish时转换为OpenAI格式的错误输出
+type OpenAIChatWriter struct {
+	gin.ResponseWriter
+	clientStream bool
+	includeUsage bool
+	model        string
+	created      int64
+	id           string
+
+	status        int
+	passthrough   bool
+	headerWritten bool
+	finished      bool
+	remainder     string
+	errorBody     bytes.Buffer // 错误响应体
+	streamError   []byte       // 非流式请求时流中的错误事件
+
+	content      strings.Builder
+	reasoning    strings.Builder
+	toolCalls    []OpenAIToolCall
+	blockToTool  map[int]int
+	finishReason string
+	usage        common.TokenUsage
+}
+
+// NewOpenAIChatWriter 创建OpenAI格式响应写入器
+func NewOpenAIChatWriter(w gin.ResponseWriter, clientStream, includeUsage bool, model string) *OpenAIChatWriter {
+	return &OpenAIChatWriter{
+		ResponseWriter: w,
+		clientStream:   clientStream,
+		includeUsage:   includeUsage,
+		model:          model,
+		created:        time.Now().Unix(),
+		id:             "chatcmpl-" + generateRandomID(),
+		status:         http.StatusOK,
+		blockToTool:    make(map[int]int),
+	}
+}
+
+// WriteHeader 记录状态码，错误状态码时记录响应体，在Finish时转换输出
+func (w *OpenAIChatWriter) WriteHeader(code int) {
+	if w.headerWritten || code <= 0 {
+		return
+	}
+	w.status = code
+	if code >= http.StatusBadRequest {
+		w.passthrough = true
+		w.headerWritten = true
+	}
+}
+
+// WriteHeaderNow 立即写出响应头，错误响应在Finish时写出
+func (w *OpenAIChatWriter) WriteHeaderNow() {
+	if w.passthrough {
+		return
+	}
+	if w.clientStream {
+		w.writeStreamHeader()
+	}
+}
+
+// Status 返回状态码
+func (w *OpenAIChatWriter) Status() int {
+	return w.status
+}
+
+// Written 是否已写出响应
+func (w *OpenAIChatWriter) Written() bool {
+	return w.headerWritten
+}
+
+// Write 解析Claude SSE数据并转换输出
+func (w *OpenAIChatWriter) Write(data []byte) (int, error) {
+	if w.passthrough {
+		remaining := maxErrorResponseRecordSize - w.errorBody.Len()
+		if len(data) > remaining {
+			w.errorBody.Write(data[:remaining])
+		} else {
+			w.errorBody.Write(data)
+		}
+		return len(data), nil
+	}
+
+	lines := strings.Split(w.remainder+string(data), "\n")
+	w.remainder = lines[len(lines)-1]
+	for _, line := range lines[:len(lines)-1] {
+		w.processLine(line)
+	}
+
+	return len(data), nil
+}
+
+// WriteString 写入字符串
+func (w *OpenAIChatWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+// Flush 流式模式下刷新输出
+func (w *OpenAIChatWriter) Flush() {
+	if w.passthrough {
+		return
+	}
+	if w.clientStream {
+		w.writeStreamHeader()
+		w.ResponseWriter.Flush()
+	}
+}
+
+// Finish 结束响应：错误响应转换为OpenAI格式输出，流式补发结束事件，非流式输出完整响应
+func (w *OpenAIChatWriter) Finish() {
+	if w.finished {
+		return
+	}
+	if w.passthrough {
+		w.finished = true
+		w.writeError(w.status, w.errorBody.Bytes())
+		return
+	}
+	if w.remainder != "" {
+		w.processLine(w.remainder)
+		w.remainder = ""
+	}
+
+	if w.clientStream {
+		w.finishStream()
+		return
+	}
+
+	w.finished = true
+	if w.streamError != nil {
+		errorType, _ := common.ParseErrorResponse(w.streamError)
+		w.writeError(common.ErrorTypeStatusCode(errorType), w.streamError)
+		return
+	}
+	message := map[string]interface{}{
+		"role":    "assistant",
+		"content": w.content.String(),
+	}
+	if w.reasoning.Len() > 0 {
+		message["reasoning_content"] = w.reasoning.String()
+	}
+	if len(w.toolCalls) > 0 {
+		message["tool_calls"] = w.toolCalls
+	}
+
+	response := map[string]interface{}{
+		"id":      w.id,
+		"object":  "chat.completion",
+		"created": w.created,
+		"model":   w.model,
+		"choices": []interface{}{
+			map[string]interface{}{
+				"index":         0,
+				"message":       message,
+				"finish_reason": w.openAIFinishReason(),
+			},
+		},
+		"usage": w.openAIUsage(),
+	}
+
+	jsonBytes, _ := json.Marshal(response)
+	header := w.ResponseWriter.Header()
+	header.Del("Content-Length")
+	header.Del("Content-Encoding")
+	header.Set("Content-Type", "application/json")
+	w.headerWritten = true
+	w.ResponseWriter.WriteHeader(w.status)
+	w.ResponseWriter.Write(jsonBytes)
+}
+
+// processLine 处理单行Claude SSE数据
+func (w *OpenAIChatWriter) processLine(line string) {
+	line = strings.TrimSpace(line)
+	if !strings.HasPrefix(line, "data:") {
+		return
+	}
+	data := strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+	if data == "" || data == "[DONE]" || !gjson.Valid(data) {
+		return
+	}
+
+	event := gjson.Parse(data)
+	switch event.Get("type").String() {
+	case "message_start":
+		if model := event.Get("message.model").String(); model != "" && w.model == "" {
+			w.model = model
+		}
+		w.usage.InputTokens = int(event.Get("message.usage.input_tokens").Int())
+		w.usage.OutputTokens = int(event.Get("message.usage.output_tokens").Int())
+		w.usage.CacheReadInputTokens = int(event.Get("message.usage.cache_read_input_tokens").Int())
+		w.usage.CacheCreationInputTokens = int(event.Get("message.usage.cache_creation_input_tokens").Int())
+		w.sendChunk(map[string]interface{}{"role": "assistant", "content": ""}, nil)
+
+	case "content_block_start":
+		if event.Get("content_block.type").String() != "tool_use" {
+			return
+		}
+		toolIndex := len(w.toolCalls)
+		w.blockToTool[int(event.Get("index").Int())] = toolIndex
+		toolCall := OpenAIToolCall{
+			ID:   event.Get("content_block.id").String(),
+			Type: "function",
+			Function: OpenAIFunctionCall{
+				Name: event.Get("content_block.name").String(),
+			},
+		}
+		w.toolCalls = append(w.toolCalls, toolCall)
+		w.sendChunk(map[string]interface{}{
+			"tool_calls": []interface{}{
+				map[string]interface{}{
+					"index":    toolIndex,
+					"id":       toolCall.ID,
+					"type":     "function",
+					"function": map[string]interface{}{"name": toolCall.Function.Name, "arguments": ""},
+				},
+			},
+		}, nil)
+
+	case "content_block_delta":
+		switch event.Get("delta.type").String() {
+		case "text_delta":
+			text := event.Get("delta.text").String()
+			w.content.WriteString(text)
+			w.sendChunk(map[string]interface{}{"content": text}, nil)
+		case "thinking_delta":
+			thinking := event.Get("delta.thinking").String()
+			w.reasoning.WriteString(thinking)
+			w.sendChunk(map[string]interface{}{"reasoning_content": thinking}, nil)
+		case "input_json_delta":
+			toolIndex, exists := w.blockToTool[int(event.Get("index").Int())]
+			if !exists {
+				return
+			}
+			partialJSON := event.Get("delta.partial_json").String()
+			w.toolCalls[toolIndex].Function.Arguments += partialJSON
+			w.sendChunk(map[string]interface{}{
+				"tool_calls": []interface{}{
+					map[string]interface{}{
+						"index":    toolIndex,
+						"function": map[string]interface{}{"arguments": partialJSON},
+					},
+				},
+			}, nil)
+		}
+
+	case "message_delta":
+		if stopReason := event.Get("delta.stop_reason").String(); stopReason != "" {
+			w.finishReason = stopReason
+		}
+		if outputTokens := event.Get("usage.output_tokens"); outputTokens.Exists() {
+			w.usage.OutputTokens = int(outputTokens.Int())
+		}
+		if inputTokens := event.Get("usage.input_tokens").Int(); inputTokens > 0 {
+			w.usage.InputTokens = int(inputTokens)
+		}
+
+	case "message_stop":
+		w.finishStream()
+
+	case "error":
+		if w.clientStream {
+			errorType := event.Get("error.type").String()
+			w.writeSSEData(openAIErrorBody(common.ErrorTypeStatusCode(errorType), []byte(data)))
+		} else if w.streamError == nil {
+			w.streamError = []byte(data)
+		}
+	}
+}
+
+// writeError 输出OpenAI格式的错误响应
+func (w *OpenAIChatWriter) writeError(statusCode int, body []byte) {
+	jsonBytes, _ := json.Marshal(openAIErrorBody(statusCode, body))
+	header := w.ResponseWriter.Header()
+	header.Del("Content-Length")
+	header.Del("Content-Encoding")
+	header.Set("Content-Type", "application/json")
+	w.headerWritten = true
+	w.status = statusCode
+	w.ResponseWriter.WriteHeader(statusCode)
+	w.ResponseWriter.Write(jsonBytes)
+}
+
+// openAIErrorBody 将中转服务或上游的错误响应转换为OpenAI格式的错误
+// 兼容Claude格式、OpenAI格式以及中转服务自身的{"message","code"}和{"error","code"}格式
+func openAIErrorBody(statusCode int, body []byte) map[string]interface{} {
+	errorType, message := common.ParseErrorResponse(body)
+	if message == "" {
+		message = http.StatusText(statusCode)
+	}
+
+	var code interface{}
+	if value := gjson.GetBytes(body, "error.code"); value.Exists() {
+		code = value.Value()
+	} else if value := gjson.GetBytes(body, "code"); value.Exists() {
+		code = value.Value()
+	}
+
+	return map[string]interface{}{
+		"error": map[string]interface{}{
+			"message": message,
+			"type":    common.NormalizeErrorType(statusCode, errorType),
+			"code":    code,
+		},
+	}
+}
+
+// sendChunk 流式模式下发送chat.completion.chunk事件
+func (w *OpenAIChatWriter) sendChunk(delta map[string]interface{}, finishReason interface{}) {
+	if !w.clientStream || w.finished {
+		return
+	}
+
+	w.writeSSEData(map[string]interface{}{
+		"id":      w.id,
+		"object":  "chat.completion.chunk",
+		"created": w.created,
+		"model":   w.model,
+		"choices": []interface{}{
+			map[string]interface{}{
+				"index":         0,
+				"delta":         delta,
+				"finish_reason": finishReason,
+			},
+		},
+	})
+}
+
+// finishStream 发送结束chunk、usage chunk和[DONE]标记
+func (w *OpenAIChatWriter) finishStream() {
+	if !w.clientStream || w.finished {
+		return
+	}
+
+	w.sendChunk(map[string]interface{}{}, w.openAIFinishReason())
+
+	if w.includeUsage {
+		w.writeSSEData(map[string]interface{}{
+			"id":      w.id,
+			"object":  "chat.completion.chunk",
+			"created": w.created,
+			"model":   w.model,
+			"choices": []interface{}{},
+			"usage":   w.openAIUsage(),
+		})
+	}
+
+	w.finished = true
+	fmt.Fprint(w.ResponseWriter, "data: [DONE]\n\n")
+	w.ResponseWriter.Flush()
+}
+
+// writeSSEData 写出一条SSE data事件
+func (w *OpenAIChatWriter) writeSSEData(data interface{}) {
+	w.writeStreamHeader()
+	jsonBytes, _ := json.Marshal(data)
+	fmt.Fprintf(w.ResponseWriter, "data: %s\n\n", jsonBytes)
+	w.ResponseWriter.Flush()
+}
+
+// writeStreamHeader 写出流式响应头
+func (w *OpenAIChatWriter) writeStreamHeader() {
+	if w.headerWritten {
+		return
+	}
+	header := w.ResponseWriter.Header()
+	header.Del("Content-Length")
+	header.Del("Content-Encoding")
+	header.Set("Content-Type", "text/event-stream")
+	header.Set("Cache-Control", "no-cache")
+	header.Set("Connection", "keep-alive")
+	w.headerWritten = true
+	w.ResponseWriter.WriteHeader(w.status)
+}
+
+// openAIFinishReason 将Claude停止原因映射为OpenAI的finish_reason
+func (w *OpenAIChatWriter) openAIFinishReason() string {
+	switch w.finishReason {
+	case "max_tokens":
+		return "length"
+	case "tool_use":
+		return "tool_calls"
+	case "refusal":
+		return "content_filter"
+	default:
+		return "stop"
+	}
+}
+
+// openAIUsage 构建OpenAI格式的usage（prompt_tokens包含缓存读取和创建的tokens）
+func (w *OpenAIChatWriter) openAIUsage() map[string]interface{} {
+	promptTokens := w.usage.InputTokens + w.usage.CacheReadInputTokens + w.usage.CacheCreationInputTokens
+	return map[string]interface{}{
+		"prompt_tokens":     promptTokens,
+		"completion_tokens": w.usage.OutputTokens,
+		"total_tokens":      promptTokens + w.usage.OutputTokens,
+		"prompt_tokens_details": map[string]interface{}{
+			"cached_tokens": w.usage.CacheReadInputTokens,
+		},
+	}
+}
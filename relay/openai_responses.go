@@ -0,0 +1,335 @@
+package relay
+
+import (
+	"claude-code-relay/constant"
+	"encoding/json"
+	"strings"
+)
+
+// Responses API 类型定义
+type ResponsesRequest struct {
+	Model             string              `json:"model"`
+	Instructions      string              `json:"instructions,omitempty"`
+	Input             []interface{}       `json:"input"`
+	MaxOutputTokens   int                 `json:"max_output_tokens,omitempty"`
+	Temperature       *float64            `json:"temperature,omitempty"`
+	TopP              *float64            `json:"top_p,omitempty"`
+	Stream            bool                `json:"stream"`
+	Store             bool                `json:"store"`
+	Tools             []ResponsesTool     `json:"tools,omitempty"`
+	ToolChoice        interface{}         `json:"tool_choice,omitempty"`
+	ParallelToolCalls *bool               `json:"parallel_tool_calls,omitempty"`
+	Reasoning         *ResponsesReasoning `json:"reasoning,omitempty"`
+}
+
+type ResponsesTool struct {
+	Type        string      `json:"type"`
+	Name        string      `json:"name"`
+	Description string      `json:"description,omitempty"`
+	Parameters  interface{} `json:"parameters"`
+}
+
+type ResponsesReasoning struct {
+	Effort  string `json:"effort,omitempty"`
+	Summary string `json:"summary,omitempty"`
+}
+
+// buildOpenAIUpstreamBody 根据账号的上游接口格式构建请求地址和请求体
+func buildOpenAIUpstreamBody(baseURL, upstreamFormat string, claudeReq ClaudeRequest, openaiReq OpenAIRequest) (string, []byte, error) {
+	if upstreamFormat == constant.UpstreamFormatResponses {
+		body, err := json.Marshal(convertOpenAIToResponsesRequest(openaiReq, claudeReq))
+		return baseURL + "/responses", body, err
+	}
+
+	body, err := json.Marshal(openaiReq)
+	return baseURL + "/chat/completions", body, err
+}
+
+// convertOpenAIToResponsesRequest 将已转换的Chat Completions请求转换为Responses API请求
+// 复用Claude到Chat Completions的内容转换，再将消息展开为Responses的input item
+func convertOpenAIToResponsesRequest(openaiReq OpenAIRequest, claudeReq ClaudeRequest) ResponsesRequest {
+	responsesReq := ResponsesRequest{
+		Model:             openaiReq.Model,
+		MaxOutputTokens:   claudeReq.MaxTokens,
+		Temperature:       openaiReq.Temperature,
+		TopP:              openaiReq.TopP,
+		Stream:            true, // 强制流式处理
+		Store:             false,
+		ParallelToolCalls: openaiReq.ParallelToolCalls,
+		Input:             []interface{}{},
+	}
+
+	var instructions []string
+	for _, message := range openaiReq.Messages {
+		switch message.Role {
+		case "system":
+			if text, ok := message.Content.(string); ok && text != "" {
+				instructions = append(instructions, text)
+			}
+		case "user":
+			responsesReq.Input = append(responsesReq.Input, map[string]interface{}{
+				"role":    "user",
+				"content": convertChatContentToResponses(message.Content),
+			})
+		case "assistant":
+			// 思考过程无法还原为Responses的reasoning item（需要上游签发的id和加密内容），不回传
+			if text, ok := message.Content.(string); ok && text != "" {
+				responsesReq.Input = append(responsesReq.Input, map[string]interface{}{
+					"role":    "assistant",
+					"content": text,
+				})
+			}
+			for _, toolCall := range message.ToolCalls {
+				responsesReq.Input = append(responsesReq.Input, map[string]interface{}{
+					"type":      "function_call",
+					"call_id":   toolCall.ID,
+					"name":      toolCall.Function.Name,
+					"arguments": toolCall.Function.Arguments,
+				})
+			}
+		case "tool":
+			output, _ := message.Content.(string)
+			responsesReq.Input = append(responsesReq.Input, map[string]interface{}{
+				"type":    "function_call_output",
+				"call_id": message.ToolCallID,
+				"output":  output,
+			})
+		}
+	}
+	responsesReq.Instructions = strings.Join(instructions, "\n")
+
+	// 转换工具（Responses的函数定义不再嵌套在function字段中）
+	for _, tool := range openaiReq.Tools {
+		responsesReq.Tools = append(responsesReq.Tools, ResponsesTool{
+			Type:        "function",
+			Name:        tool.Function.Name,
+			Description: tool.Function.Description,
+			Parameters:  tool.Function.Parameters,
+		})
+	}
+
+	// 转换工具选择
+	switch toolChoice := openaiReq.ToolChoice.(type) {
+	case string:
+		responsesReq.ToolChoice = toolChoice
+	case map[string]interface{}:
+		if function, ok := toolChoice["function"].(map[string]string); ok {
+			responsesReq.ToolChoice = map[string]interface{}{
+				"type": "function",
+				"name": function["name"],
+			}
+		}
+	}
+
+	// 开启extended thinking时要求推理模型返回思考摘要
+	if claudeReq.Thinking != nil && claudeReq.Thinking.Type == "enabled" {
+		responsesReq.Reasoning = &ResponsesReasoning{
+			Effort:  reasoningEffortForBudget(claudeReq.Thinking.BudgetTokens),
+			Summary: "auto",
+		}
+	}
+
+	return responsesReq
+}
+
+// convertChatContentToResponses 将Chat Completions的content part转换为Responses的input content
+func convertChatContentToResponses(content interface{}) interface{} {
+	parts, ok := content.([]map[string]interface{})
+	if !ok {
+		return content
+	}
+
+	var converted []map[string]interface{}
+	for _, part := range parts {
+		switch part["type"] {
+		case "text":
+			converted = append(converted, map[string]interface{}{
+				"type": "input_text",
+				"text": part["text"],
+			})
+		case "image_url":
+			if imageURL, ok := part["image_url"].(map[string]string); ok {
+				converted = append(converted, map[string]interface{}{
+					"type":      "input_image",
+					"image_url": imageURL["url"],
+				})
+			}
+		case "file":
+			if file, ok := part["file"].(map[string]string); ok {
+				converted = append(converted, map[string]interface{}{
+					"type":      "input_file",
+					"filename":  file["filename"],
+					"file_data": file["file_data"],
+				})
+			}
+		}
+	}
+	return converted
+}
+
+// reasoningEffortForBudget 根据Claude的思考预算选择推理强度
+func reasoningEffortForBudget(budgetTokens int) string {
+	switch {
+	case budgetTokens > 0 && budgetTokens < 4096:
+		return "low"
+	case budgetTokens >= 16384:
+		return "high"
+	default:
+		return "medium"
+	}
+}
+
+// responsesStreamState Responses API流式事件转换状态
+// 将Responses事件转换为Chat Completions格式的chunk，复用Chat Completions的流式处理逻辑
+type responsesStreamState struct {
+	toolIndexes  map[int]int  // output_index -> 工具调用序号
+	argsStreamed map[int]bool // 工具调用参数是否已通过增量事件输出
+	hasToolCalls bool
+}
+
+func newResponsesStreamState() *responsesStreamState {
+	return &responsesStreamState{
+		toolIndexes:  make(map[int]int),
+		argsStreamed: make(map[int]bool),
+	}
+}
+
+// toChatChunk 将单个Responses事件转换为Chat Completions chunk
+// 无需转发的事件返回nil；done表示响应已结束（Responses流不以[DONE]结尾）
+func (s *responsesStreamState) toChatChunk(event map[string]interface{}) (chunk map[string]interface{}, done bool) {
+	eventType, _ := event["type"].(string)
+	outputIndexValue, _ := event["output_index"].(float64)
+	outputIndex := int(outputIndexValue)
+
+	switch eventType {
+	case "response.output_text.delta", "response.refusal.delta":
+		delta, _ := event["delta"].(string)
+		return chatDeltaChunk(map[string]interface{}{"content": delta}, ""), false
+
+	case "response.reasoning_summary_text.delta", "response.reasoning_text.delta":
+		delta, _ := event["delta"].(string)
+		return chatDeltaChunk(map[string]interface{}{"reasoning_content": delta}, ""), false
+
+	case "response.reasoning_summary_part.added":
+		// 多段思考摘要之间用空行分隔
+		if summaryIndex, _ := event["summary_index"].(float64); summaryIndex > 0 {
+			return chatDeltaChunk(map[string]interface{}{"reasoning_content": "\n\n"}, ""), false
+		}
+		return nil, false
+
+	case "response.output_item.added":
+		// 只转换函数调用，web_search_call等内置工具由上游执行，结果体现在输出文本中
+		item, _ := event["item"].(map[string]interface{})
+		if item["type"] != "function_call" {
+			return nil, false
+		}
+		toolIndex := len(s.toolIndexes)
+		s.toolIndexes[outputIndex] = toolIndex
+		s.hasToolCalls = true
+		return chatDeltaChunk(map[string]interface{}{
+			"tool_calls": []interface{}{
+				map[string]interface{}{
+					"index": float64(toolIndex),
+					"id":    item["call_id"],
+					"type":  "function",
+					"function": map[string]interface{}{
+						"name":      item["name"],
+						"arguments": "",
+					},
+				},
+			},
+		}, ""), false
+
+	case "response.function_call_arguments.delta":
+		toolIndex, exists := s.toolIndexes[outputIndex]
+		if !exists {
+			return nil, false
+		}
+		s.argsStreamed[outputIndex] = true
+		delta, _ := event["delta"].(string)
+		return chatToolArgumentsChunk(toolIndex, delta), false
+
+	case "response.output_item.done":
+		// 部分上游不发送参数增量，只在item完成时给出完整参数
+		toolIndex, exists := s.toolIndexes[outputIndex]
+		if !exists || s.argsStreamed[outputIndex] {
+			return nil, false
+		}
+		item, _ := event["item"].(map[string]interface{})
+		arguments, _ := item["arguments"].(string)
+		s.argsStreamed[outputIndex] = true
+		return chatToolArgumentsChunk(toolIndex, arguments), false
+
+	case "response.completed", "response.incomplete":
+		response, _ := event["response"].(map[string]interface{})
+		finishReason := "stop"
+		if s.hasToolCalls {
+			finishReason = "tool_calls"
+		}
+		if details, ok := response["incomplete_details"].(map[string]interface{}); ok {
+			switch details["reason"] {
+			case "max_output_tokens":
+				finishReason = "length"
+			case "content_filter":
+				finishReason = "content_filter"
+			}
+		}
+
+		chunk = chatDeltaChunk(map[string]interface{}{}, finishReason)
+		if usage, ok := response["usage"].(map[string]interface{}); ok {
+			chunk["usage"] = map[string]interface{}{
+				"prompt_tokens":         usage["input_tokens"],
+				"completion_tokens":     usage["output_tokens"],
+				"prompt_tokens_details": usage["input_tokens_details"],
+			}
+		}
+		return chunk, true
+
+	case "response.failed", "error":
+		// error事件的错误信息在顶层，response.failed的错误信息在response.error中
+		errorInfo := event
+		if response, ok := event["response"].(map[string]interface{}); ok {
+			errorInfo, _ = response["error"].(map[string]interface{})
+		}
+		message, _ := errorInfo["message"].(string)
+		if message == "" {
+			message = "upstream response failed"
+		}
+		return map[string]interface{}{
+			"error": map[string]interface{}{
+				"type":    "api_error",
+				"message": message,
+			},
+		}, true
+	}
+
+	return nil, false
+}
+
+// chatDeltaChunk 构建Chat Completions格式的增量chunk
+func chatDeltaChunk(delta map[string]interface{}, finishReason string) map[string]interface{} {
+	choice := map[string]interface{}{
+		"index": float64(0),
+		"delta": delta,
+	}
+	if finishReason != "" {
+		choice["finish_reason"] = finishReason
+	}
+	return map[string]interface{}{
+		"choices": []interface{}{choice},
+	}
+}
+
+// chatToolArgumentsChunk 构建工具调用参数增量chunk
+func chatToolArgumentsChunk(toolIndex int, arguments string) map[string]interface{} {
+	return chatDeltaChunk(map[string]interface{}{
+		"tool_calls": []interface{}{
+			map[string]interface{}{
+				"index": float64(toolIndex),
+				"function": map[string]interface{}{
+					"arguments": arguments,
+				},
+			},
+		},
+	}, "")
+}
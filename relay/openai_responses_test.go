@@ -0,0 +1,256 @@
+package relay
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestConvertOpenAIToResponsesRequest(t *testing.T) {
+	tests := []struct {
+		name    string
+		fixture string
+	}{
+		{name: "工具结果包含文本和图片", fixture: "claude_tool_result_media"},
+		{name: "文档来源", fixture: "claude_document_sources"},
+		{name: "思考内容不回传", fixture: "claude_thinking_blocks"},
+		{name: "tool_choice为any", fixture: "claude_tool_choice_any"},
+		{name: "tool_choice为指定工具", fixture: "claude_tool_choice_tool"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var claudeReq ClaudeRequest
+			readFixture(t, tt.fixture, &claudeReq)
+
+			openaiReq := convertClaudeToOpenAI(claudeReq, "gpt-5")
+			assertGolden(t, "responses_"+tt.fixture, convertOpenAIToResponsesRequest(openaiReq, claudeReq))
+		})
+	}
+}
+
+func TestReasoningEffortForBudget(t *testing.T) {
+	tests := []struct {
+		budgetTokens int
+		want         string
+	}{
+		{budgetTokens: 0, want: "medium"},
+		{budgetTokens: 1024, want: "low"},
+		{budgetTokens: 4096, want: "medium"},
+		{budgetTokens: 16384, want: "high"},
+	}
+
+	for _, tt := range tests {
+		if got := reasoningEffortForBudget(tt.budgetTokens); got != tt.want {
+			t.Errorf("reasoningEffortForBudget(%d) = %s, want %s", tt.budgetTokens, got, tt.want)
+		}
+	}
+}
+
+func TestResponsesStreamStateToChatChunk(t *testing.T) {
+	tests := []struct {
+		name     string
+		events   []string
+		want     string // 最后一个事件转换后的chunk
+		wantDone bool
+	}{
+		{
+			name:   "文本增量",
+			events: []string{`{"type":"response.output_text.delta","delta":"hi"}`},
+			want:   `{"choices":[{"delta":{"content":"hi"},"index":0}]}`,
+		},
+		{
+			name:   "拒绝回答增量按文本输出",
+			events: []string{`{"type":"response.refusal.delta","delta":"no"}`},
+			want:   `{"choices":[{"delta":{"content":"no"},"index":0}]}`,
+		},
+		{
+			name:   "思考摘要增量",
+			events: []string{`{"type":"response.reasoning_summary_text.delta","delta":"hmm"}`},
+			want:   `{"choices":[{"delta":{"reasoning_content":"hmm"},"index":0}]}`,
+		},
+		{
+			name:   "第一段思考摘要不输出分隔",
+			events: []string{`{"type":"response.reasoning_summary_part.added","summary_index":0}`},
+			want:   `null`,
+		},
+		{
+			name:   "后续思考摘要以空行分隔",
+			events: []string{`{"type":"response.reasoning_summary_part.added","summary_index":1}`},
+			want:   `{"choices":[{"delta":{"reasoning_content":"\n\n"},"index":0}]}`,
+		},
+		{
+			name:   "内置工具调用不转换",
+			events: []string{`{"type":"response.output_item.added","output_index":0,"item":{"type":"web_search_call"}}`},
+			want:   `null`,
+		},
+		{
+			name: "函数调用按出现顺序编号",
+			events: []string{
+				`{"type":"response.output_item.added","output_index":1,"item":{"type":"function_call","call_id":"call_1","name":"a"}}`,
+				`{"type":"response.output_item.added","output_index":3,"item":{"type":"function_call","call_id":"call_2","name":"b"}}`,
+			},
+			want: `{"choices":[{"delta":{"tool_calls":[{"function":{"arguments":"","name":"b"},"id":"call_2","index":1,"type":"function"}]},"index":0}]}`,
+		},
+		{
+			name: "参数增量",
+			events: []string{
+				`{"type":"response.output_item.added","output_index":2,"item":{"type":"function_call","call_id":"call_1","name":"a"}}`,
+				`{"type":"response.function_call_arguments.delta","output_index":2,"delta":"{}"}`,
+			},
+			want: `{"choices":[{"delta":{"tool_calls":[{"function":{"arguments":"{}"},"index":0}]},"index":0}]}`,
+		},
+		{
+			name:   "未知工具的参数增量忽略",
+			events: []string{`{"type":"response.function_call_arguments.delta","output_index":5,"delta":"{}"}`},
+			want:   `null`,
+		},
+		{
+			name: "已输出参数增量时item完成不重复输出",
+			events: []string{
+				`{"type":"response.output_item.added","output_index":0,"item":{"type":"function_call","call_id":"call_1","name":"a"}}`,
+				`{"type":"response.function_call_arguments.delta","output_index":0,"delta":"{}"}`,
+				`{"type":"response.output_item.done","output_index":0,"item":{"type":"function_call","arguments":"{}"}}`,
+			},
+			want: `null`,
+		},
+		{
+			name: "没有参数增量时item完成输出完整参数",
+			events: []string{
+				`{"type":"response.output_item.added","output_index":0,"item":{"type":"function_call","call_id":"call_1","name":"a"}}`,
+				`{"type":"response.output_item.done","output_index":0,"item":{"type":"function_call","arguments":"{\"x\":1}"}}`,
+			},
+			want: `{"choices":[{"delta":{"tool_calls":[{"function":{"arguments":"{\"x\":1}"},"index":0}]},"index":0}]}`,
+		},
+		{
+			name:     "完成时转换用量",
+			events:   []string{`{"type":"response.completed","response":{"usage":{"input_tokens":10,"input_tokens_details":{"cached_tokens":4},"output_tokens":3}}}`},
+			want:     `{"choices":[{"delta":{},"finish_reason":"stop","index":0}],"usage":{"completion_tokens":3,"prompt_tokens":10,"prompt_tokens_details":{"cached_tokens":4}}}`,
+			wantDone: true,
+		},
+		{
+			name: "有工具调用时完成原因为tool_calls",
+			events: []string{
+				`{"type":"response.output_item.added","output_index":0,"item":{"type":"function_call","call_id":"call_1","name":"a"}}`,
+				`{"type":"response.completed","response":{}}`,
+			},
+			want:     `{"choices":[{"delta":{},"finish_reason":"tool_calls","index":0}]}`,
+			wantDone: true,
+		},
+		{
+			name:     "达到输出上限",
+			events:   []string{`{"type":"response.incomplete","response":{"incomplete_details":{"reason":"max_output_tokens"}}}`},
+			want:     `{"choices":[{"delta":{},"finish_reason":"length","index":0}]}`,
+			wantDone: true,
+		},
+		{
+			name:     "内容过滤",
+			events:   []string{`{"type":"response.incomplete","response":{"incomplete_details":{"reason":"content_filter"}}}`},
+			want:     `{"choices":[{"delta":{},"finish_reason":"content_filter","index":0}]}`,
+			wantDone: true,
+		},
+		{
+			name:     "响应失败",
+			events:   []string{`{"type":"response.failed","response":{"error":{"code":"server_error","message":"boom"}}}`},
+			want:     `{"error":{"message":"boom","type":"api_error"}}`,
+			wantDone: true,
+		},
+		{
+			name:     "错误事件没有消息时使用默认消息",
+			events:   []string{`{"type":"error","code":"rate_limit_exceeded"}`},
+			want:     `{"error":{"message":"upstream response failed","type":"api_error"}}`,
+			wantDone: true,
+		},
+		{
+			name:   "其他事件忽略",
+			events: []string{`{"type":"response.in_progress","response":{}}`},
+			want:   `null`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state := newResponsesStreamState()
+
+			var chunk map[string]interface{}
+			var done bool
+			for _, eventJSON := range tt.events {
+				var event map[string]interface{}
+				if err := json.Unmarshal([]byte(eventJSON), &event); err != nil {
+					t.Fatalf("解析事件失败: %v", err)
+				}
+				chunk, done = state.toChatChunk(event)
+			}
+
+			got, _ := json.Marshal(chunk)
+			if string(got) != tt.want {
+				t.Errorf("toChatChunk() = %s, want %s", got, tt.want)
+			}
+			if done != tt.wantDone {
+				t.Errorf("toChatChunk() done = %v, want %v", done, tt.wantDone)
+			}
+		})
+	}
+}
+
+func TestResponsesStream(t *testing.T) {
+	tests := []struct {
+		name    string
+		fixture string
+	}{
+		{name: "思考摘要、文本和工具调用", fixture: "responses_stream_tool_call"},
+		{name: "达到输出上限", fixture: "responses_stream_incomplete"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			events, usage := runOpenAIStream(t, tt.fixture, newResponsesStreamState())
+
+			assertGolden(t, tt.fixture, events)
+			if usage.Interrupted {
+				t.Errorf("完整的流被标记为中断")
+			}
+		})
+	}
+}
+
+// Responses API的完成事件会回显完整的instructions和output，单行超过bufio.Scanner默认的64KB
+func TestResponsesStreamLargeCompletedEvent(t *testing.T) {
+	instructions := strings.Repeat("You are Claude Code. ", 20000)
+	completed, _ := json.Marshal(map[string]interface{}{
+		"type": "response.completed",
+		"response": map[string]interface{}{
+			"instructions": instructions,
+			"output": []interface{}{
+				map[string]interface{}{
+					"type":    "message",
+					"content": []interface{}{map[string]interface{}{"type": "output_text", "text": "done"}},
+				},
+			},
+			"usage": map[string]interface{}{"input_tokens": 25000, "output_tokens": 7},
+		},
+	})
+	if len(completed) <= 64*1024 {
+		t.Fatalf("完成事件长度 %d 未超过64KB", len(completed))
+	}
+
+	upstream := fmt.Sprintf("data: {\"type\":\"response.output_text.delta\",\"delta\":\"done\"}\n\ndata: %s\n\n", completed)
+	events, usage := processTestStream(t, upstream, newResponsesStreamState())
+
+	if usage.Interrupted {
+		t.Fatalf("超长事件导致流被标记为中断")
+	}
+	if usage.InputTokens != 25000 || usage.OutputTokens != 7 {
+		t.Errorf("usage = %d/%d, want 25000/7", usage.InputTokens, usage.OutputTokens)
+	}
+
+	last := events[len(events)-1]
+	if last.Event != "message_stop" {
+		t.Errorf("最后一个事件 = %s, want message_stop", last.Event)
+	}
+	messageDelta := events[len(events)-2]
+	if messageDelta.Event != "message_delta" || messageDelta.Data["usage"].(map[string]interface{})["output_tokens"] != float64(7) {
+		t.Errorf("message_delta = %v", messageDelta)
+	}
+}
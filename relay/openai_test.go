@@ -0,0 +1,307 @@
+package relay
+
+import (
+	"bytes"
+	"claude-code-relay/common"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 使用 go test ./relay -update 重新生成golden文件
+var updateGolden = flag.Bool("update", false, "update golden files")
+
+// assertGolden 将结果与testdata下的golden文件比较
+func assertGolden(t *testing.T, name string, got interface{}) {
+	t.Helper()
+
+	actual, err := json.MarshalIndent(got, "", "  ")
+	if err != nil {
+		t.Fatalf("序列化结果失败: %v", err)
+	}
+	actual = append(actual, '\n')
+
+	goldenPath := filepath.Join("testdata", name+".golden.json")
+	if *updateGolden {
+		if err := os.WriteFile(goldenPath, actual, 0644); err != nil {
+			t.Fatalf("写入golden文件失败: %v", err)
+		}
+		return
+	}
+
+	expected, err := os.ReadFile(goldenPath)
+	if err != nil {
+		t.Fatalf("读取golden文件失败: %v", err)
+	}
+	if !bytes.Equal(actual, expected) {
+		t.Errorf("%s 与golden文件不一致\n实际:\n%s\n期望:\n%s", name, actual, expected)
+	}
+}
+
+func readFixture(t *testing.T, name string, v interface{}) {
+	t.Helper()
+
+	data, err := os.ReadFile(filepath.Join("testdata", name+".json"))
+	if err != nil {
+		t.Fatalf("读取测试数据失败: %v", err)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		t.Fatalf("解析测试数据失败: %v", err)
+	}
+}
+
+func TestConvertClaudeToOpenAI(t *testing.T) {
+	tests := []struct {
+		name    string
+		fixture string
+	}{
+		{name: "图片base64和URL来源", fixture: "claude_image_sources"},
+		{name: "文档base64、文本、内容和URL来源", fixture: "claude_document_sources"},
+		{name: "工具结果包含文本和图片", fixture: "claude_tool_result_media"},
+		{name: "思考和加密思考内容块", fixture: "claude_thinking_blocks"},
+		{name: "tool_choice为none", fixture: "claude_tool_choice_none"},
+		{name: "tool_choice为any", fixture: "claude_tool_choice_any"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var claudeReq ClaudeRequest
+			readFixture(t, tt.fixture, &claudeReq)
+
+			assertGolden(t, tt.fixture, convertClaudeToOpenAI(claudeReq, "gpt-4o"))
+		})
+	}
+}
+
+func TestConvertClaudeUserBlocks(t *testing.T) {
+	tests := []struct {
+		name   string
+		blocks string
+		want   string
+	}{
+		{
+			name:   "只有文本",
+			blocks: `[{"type":"text","text":"hello"}]`,
+			want:   `[{"role":"user","content":[{"text":"hello","type":"text"}]}]`,
+		},
+		{
+			name:   "只有工具结果时不生成用户消息",
+			blocks: `[{"type":"tool_result","tool_use_id":"toolu_01","content":"42"}]`,
+			want:   `[{"role":"tool","content":"42","tool_call_id":"toolu_01"}]`,
+		},
+		{
+			name:   "工具结果中的图片放到随后的用户消息",
+			blocks: `[{"type":"tool_result","tool_use_id":"toolu_01","content":[{"type":"image","source":{"type":"url","url":"https://example.com/a.png"}}]}]`,
+			want:   `[{"role":"tool","content":"","tool_call_id":"toolu_01"},{"role":"user","content":[{"text":"Content returned by tool call toolu_01:","type":"text"},{"image_url":{"url":"https://example.com/a.png"},"type":"image_url"}]}]`,
+		},
+		{
+			name:   "工具结果为空",
+			blocks: `[{"type":"tool_result","tool_use_id":"toolu_01"}]`,
+			want:   `[{"role":"tool","content":"","tool_call_id":"toolu_01"}]`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var blocks []interface{}
+			if err := json.Unmarshal([]byte(tt.blocks), &blocks); err != nil {
+				t.Fatalf("解析内容块失败: %v", err)
+			}
+
+			got, _ := json.Marshal(convertClaudeUserBlocks(blocks))
+			if string(got) != tt.want {
+				t.Errorf("convertClaudeUserBlocks() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConvertClaudeContentPart(t *testing.T) {
+	tests := []struct {
+		name  string
+		block string
+		want  string
+	}{
+		{
+			name:  "图片base64来源",
+			block: `{"type":"image","source":{"type":"base64","media_type":"image/webp","data":"UklGRg=="}}`,
+			want:  `[{"image_url":{"url":"data:image/webp;base64,UklGRg=="},"type":"image_url"}]`,
+		},
+		{
+			name:  "图片URL来源",
+			block: `{"type":"image","source":{"type":"url","url":"https://example.com/a.png"}}`,
+			want:  `[{"image_url":{"url":"https://example.com/a.png"},"type":"image_url"}]`,
+		},
+		{
+			name:  "图片缺少来源",
+			block: `{"type":"image"}`,
+			want:  `null`,
+		},
+		{
+			name:  "文档base64来源没有标题时使用默认文件名",
+			block: `{"type":"document","source":{"type":"base64","media_type":"application/pdf","data":"JVBERi0="}}`,
+			want:  `[{"file":{"file_data":"data:application/pdf;base64,JVBERi0=","filename":"document.pdf"},"type":"file"}]`,
+		},
+		{
+			name:  "文档文本来源",
+			block: `{"type":"document","title":"a.txt","source":{"type":"text","data":"content"}}`,
+			want:  `[{"text":"a.txt\n\ncontent","type":"text"}]`,
+		},
+		{
+			name:  "文档URL来源",
+			block: `{"type":"document","source":{"type":"url","url":"https://example.com/a.pdf"}}`,
+			want:  `[{"text":"Document: https://example.com/a.pdf","type":"text"}]`,
+		},
+		{
+			name:  "不支持的内容块",
+			block: `{"type":"search_result","content":[]}`,
+			want:  `null`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var block map[string]interface{}
+			if err := json.Unmarshal([]byte(tt.block), &block); err != nil {
+				t.Fatalf("解析内容块失败: %v", err)
+			}
+
+			got, _ := json.Marshal(convertClaudeContentPart(block))
+			if string(got) != tt.want {
+				t.Errorf("convertClaudeContentPart() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// sseEvent 转换后的Claude SSE事件
+type sseEvent struct {
+	Event string                 `json:"event"`
+	Data  map[string]interface{} `json:"data"`
+}
+
+// parseSSEEvents 解析Claude SSE事件
+func parseSSEEvents(t *testing.T, body string) []sseEvent {
+	t.Helper()
+
+	var events []sseEvent
+	for _, chunk := range strings.Split(strings.TrimSpace(body), "\n\n") {
+		var event sseEvent
+		for _, line := range strings.Split(chunk, "\n") {
+			switch {
+			case strings.HasPrefix(line, "event: "):
+				event.Event = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &event.Data); err != nil {
+					t.Fatalf("解析SSE数据失败: %v", err)
+				}
+			}
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+// readSSEFixture 将testdata中的chunk数组转换为上游SSE格式的响应
+func readSSEFixture(t *testing.T, fixture string) string {
+	t.Helper()
+
+	var chunks []json.RawMessage
+	readFixture(t, fixture, &chunks)
+
+	var upstream strings.Builder
+	for _, chunk := range chunks {
+		var compact bytes.Buffer
+		if err := json.Compact(&compact, chunk); err != nil {
+			t.Fatalf("压缩chunk失败: %v", err)
+		}
+		fmt.Fprintf(&upstream, "data: %s\n\n", compact.Bytes())
+	}
+	return upstream.String()
+}
+
+// runOpenAIStream 将testdata中的chunk数组按SSE格式输入流式转换，返回转换后的Claude事件
+// responses不为nil时按Responses API事件处理
+func runOpenAIStream(t *testing.T, fixture string, responses *responsesStreamState) ([]sseEvent, *common.TokenUsage) {
+	t.Helper()
+
+	upstream := readSSEFixture(t, fixture)
+	// Responses流不以[DONE]结尾
+	if responses == nil {
+		upstream += "data: [DONE]\n\n"
+	}
+
+	return processTestStream(t, upstream, responses)
+}
+
+// processTestStream 使用固定消息ID处理上游流式响应
+func processTestStream(t *testing.T, upstream string, responses *responsesStreamState) ([]sseEvent, *common.TokenUsage) {
+	t.Helper()
+
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	transformer := createStreamTransformer("claude-sonnet-4-20250514")
+	transformer.messageID = "msg_test"
+	transformer.responses = responses
+
+	usage := processOpenAIStreamResponse(c.Writer, strings.NewReader(upstream), transformer, true)
+	return parseSSEEvents(t, recorder.Body.String()), usage
+}
+
+func TestStreamTransformer(t *testing.T) {
+	tests := []struct {
+		name    string
+		fixture string
+	}{
+		{name: "reasoning_content转换为thinking_delta", fixture: "openai_stream_reasoning"},
+		{name: "reasoning和工具调用", fixture: "openai_stream_tool_call"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			events, usage := runOpenAIStream(t, tt.fixture, nil)
+
+			assertGolden(t, tt.fixture, events)
+			if usage.OutputTokens == 0 {
+				t.Errorf("未统计输出tokens")
+			}
+		})
+	}
+}
+
+func TestStreamTransformerThinkingDelta(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	transformer := createStreamTransformer("claude-sonnet-4-20250514")
+
+	transformer.processChunk(c.Writer, map[string]interface{}{
+		"choices": []interface{}{
+			map[string]interface{}{
+				"delta": map[string]interface{}{"reasoning_content": "thinking..."},
+			},
+		},
+	})
+
+	events := parseSSEEvents(t, recorder.Body.String())
+	if len(events) != 3 {
+		t.Fatalf("事件数量 = %d, want 3", len(events))
+	}
+
+	wantBlock := map[string]interface{}{"type": "thinking", "thinking": "", "signature": ""}
+	if got := events[1].Data["content_block"]; events[1].Event != "content_block_start" || !reflect.DeepEqual(got, wantBlock) {
+		t.Errorf("content_block_start = %v, want %v", got, wantBlock)
+	}
+
+	wantDelta := map[string]interface{}{"type": "thinking_delta", "thinking": "thinking..."}
+	if got := events[2].Data["delta"]; events[2].Event != "content_block_delta" || !reflect.DeepEqual(got, wantDelta) {
+		t.Errorf("content_block_delta = %v, want %v", got, wantDelta)
+	}
+}
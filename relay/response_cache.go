@@ -0,0 +1,118 @@
+package relay
+
+import (
+	"bytes"
+	"claude-code-relay/service"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// ResponseRecorder 包装gin.ResponseWriter，在透传响应的同时记录响应体，用于响应缓存和请求体捕获
+// 超过大小上限后停止记录，只保留已记录的部分
+type ResponseRecorder struct {
+	gin.ResponseWriter
+	body     bytes.Buffer
+	maxSize  int
+	overflow bool
+}
+
+// NewResponseRecorder 创建响应记录器
+func NewResponseRecorder(w gin.ResponseWriter, maxSize int) *ResponseRecorder {
+	return &ResponseRecorder{
+		ResponseWriter: w,
+		maxSize:        maxSize,
+	}
+}
+
+// Write 透传并记录响应体
+func (w *ResponseRecorder) Write(data []byte) (int, error) {
+	w.record(data)
+	return w.ResponseWriter.Write(data)
+}
+
+// WriteString 透传并记录字符串响应体
+func (w *ResponseRecorder) WriteString(s string) (int, error) {
+	w.record([]byte(s))
+	return w.ResponseWriter.WriteString(s)
+}
+
+// Body 返回记录的完整响应体，超过大小上限时返回nil
+func (w *ResponseRecorder) Body() []byte {
+	if w.overflow {
+		return nil
+	}
+	return w.body.Bytes()
+}
+
+// Recorded 返回已记录的响应体，超过大小上限时为不完整的前缀
+func (w *ResponseRecorder) Recorded() []byte {
+	return w.body.Bytes()
+}
+
+// Overflowed 响应体是否超过大小上限
+func (w *ResponseRecorder) Overflowed() bool {
+	return w.overflow
+}
+
+func (w *ResponseRecorder) record(data []byte) {
+	if w.overflow {
+		return
+	}
+	if w.body.Len()+len(data) > w.maxSize {
+		w.overflow = true
+		w.body.Write(data[:w.maxSize-w.body.Len()])
+		return
+	}
+	w.body.Write(data)
+}
+
+// ReplayCachedResponse 回放缓存的响应
+// 流式响应按原始SSE事件逐个输出并刷新，消息ID重新生成，与上游实时返回的格式一致
+func ReplayCachedResponse(c *gin.Context, cached *service.CachedResponse) {
+	messageID := fmt.Sprintf("msg_%s", generateRandomID())
+	c.Header("X-Response-Cache", "HIT")
+
+	if !cached.Stream {
+		body, err := sjson.Set(cached.Body, "id", messageID)
+		if err != nil {
+			body = cached.Body
+		}
+		c.Header("Content-Type", "application/json")
+		c.Status(http.StatusOK)
+		c.Writer.WriteString(body)
+		return
+	}
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Status(http.StatusOK)
+
+	for _, event := range cached.Events {
+		if c.Request.Context().Err() != nil {
+			return
+		}
+		c.Writer.WriteString(replaceMessageStartID(event, messageID) + "\n\n")
+		c.Writer.Flush()
+	}
+}
+
+// replaceMessageStartID 替换message_start事件中的消息ID
+func replaceMessageStartID(event, messageID string) string {
+	lines := strings.Split(event, "\n")
+	for i, line := range lines {
+		data, ok := strings.CutPrefix(line, "data:")
+		if !ok || gjson.Get(data, "type").String() != "message_start" {
+			continue
+		}
+		if replaced, err := sjson.Set(strings.TrimSpace(data), "message.id", messageID); err == nil {
+			lines[i] = "data: " + replaced
+		}
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,274 @@
+package relay
+
+import (
+	"claude-code-relay/model"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// 上游请求超时阶段
+const (
+	timeoutPhaseConnect    = "connect"
+	timeoutPhaseFirstByte  = "first_byte"
+	timeoutPhaseStreamIdle = "stream_idle"
+	timeoutPhaseTotal      = "total"
+)
+
+// 默认超时配置
+const (
+	defaultConnectTimeout    = 10 * time.Second
+	defaultFirstByteTimeout  = 120 * time.Second
+	defaultStreamIdleTimeout = 120 * time.Second
+	defaultMaxDuration       = 30 * time.Minute
+)
+
+// upstreamTimeouts 上游请求的分阶段超时配置，0表示不限制
+type upstreamTimeouts struct {
+	Connect    time.Duration // 建立连接（含DNS、代理、TLS握手）
+	FirstByte  time.Duration // 连接建立后等待响应首字节
+	StreamIdle time.Duration // 响应体两次读取之间的最大间隔
+	Total      time.Duration // 整个请求的最长持续时间
+}
+
+// upstreamTimeoutError 上游请求超时错误
+type upstreamTimeoutError struct {
+	Phase   string
+	Timeout time.Duration
+}
+
+func (e *upstreamTimeoutError) Error() string {
+	switch e.Phase {
+	case timeoutPhaseConnect:
+		return fmt.Sprintf("upstream connect timeout after %s", e.Timeout)
+	case timeoutPhaseFirstByte:
+		return fmt.Sprintf("upstream did not respond within %s", e.Timeout)
+	case timeoutPhaseStreamIdle:
+		return fmt.Sprintf("upstream stream idle for more than %s", e.Timeout)
+	default:
+		return fmt.Sprintf("upstream request exceeded max duration of %s", e.Timeout)
+	}
+}
+
+// resolveUpstreamTimeouts 获取账号的超时配置，账号未设置的项使用环境变量或默认值
+func resolveUpstreamTimeouts(account *model.Account) upstreamTimeouts {
+	// HTTP_CLIENT_TIMEOUT 为旧配置，仅作为首字节超时的默认值
+	firstByteDefault := getTimeoutEnv("HTTP_CLIENT_TIMEOUT", defaultFirstByteTimeout)
+
+	return upstreamTimeouts{
+		Connect:    accountTimeout(account.ConnectTimeout, getTimeoutEnv("HTTP_CONNECT_TIMEOUT", defaultConnectTimeout)),
+		FirstByte:  accountTimeout(account.FirstByteTimeout, getTimeoutEnv("HTTP_FIRST_BYTE_TIMEOUT", firstByteDefault)),
+		StreamIdle: accountTimeout(account.StreamIdleTimeout, getTimeoutEnv("HTTP_STREAM_IDLE_TIMEOUT", defaultStreamIdleTimeout)),
+		Total:      accountTimeout(account.MaxDuration, getTimeoutEnv("HTTP_MAX_DURATION", defaultMaxDuration)),
+	}
+}
+
+// accountTimeout 账号配置的超时（秒）大于0时优先使用
+func accountTimeout(seconds int, defaultValue time.Duration) time.Duration {
+	if seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	return defaultValue
+}
+
+// getTimeoutEnv 从环境变量读取以秒为单位的超时时间，0表示不限制
+func getTimeoutEnv(name string, defaultValue time.Duration) time.Duration {
+	if valueStr := os.Getenv(name); valueStr != "" {
+		if value, err := strconv.Atoi(valueStr); err == nil && value >= 0 {
+			return time.Duration(value) * time.Second
+		}
+	}
+	return defaultValue
+}
+
+// timeoutGuard 按阶段监控上游请求，超时后取消请求并记录超时原因
+// 阶段依次为：连接 -> 首字节 -> 流式空闲（每次读到数据后重新计时），总时长独立计时
+type timeoutGuard struct {
+	timeouts upstreamTimeouts
+	cancel   context.CancelFunc
+
+	mu         sync.Mutex
+	phaseTimer *time.Timer
+	totalTimer *time.Timer
+	err        *upstreamTimeoutError
+	stopped    bool
+}
+
+// guard 为请求绑定超时监控，返回的请求需替代原请求发送；请求结束后必须调用stop
+func (t upstreamTimeouts) guard(req *http.Request) (*http.Request, *timeoutGuard) {
+	ctx, cancel := context.WithCancel(req.Context())
+	g := &timeoutGuard{timeouts: t, cancel: cancel}
+
+	g.startPhase(timeoutPhaseConnect, t.Connect)
+	if t.Total > 0 {
+		g.totalTimer = time.AfterFunc(t.Total, func() {
+			g.fire(timeoutPhaseTotal, t.Total)
+		})
+	}
+
+	trace := &httptrace.ClientTrace{
+		GotConn: func(httptrace.GotConnInfo) {
+			g.startPhase(timeoutPhaseFirstByte, t.FirstByte)
+		},
+		GotFirstResponseByte: func() {
+			g.startPhase(timeoutPhaseStreamIdle, t.StreamIdle)
+		},
+	}
+
+	return req.WithContext(httptrace.WithClientTrace(ctx, trace)), g
+}
+
+// startPhase 进入新的超时阶段，停止上一阶段的计时
+func (g *timeoutGuard) startPhase(phase string, timeout time.Duration) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.stopped || g.err != nil {
+		return
+	}
+	if g.phaseTimer != nil {
+		g.phaseTimer.Stop()
+		g.phaseTimer = nil
+	}
+	if timeout > 0 {
+		g.phaseTimer = time.AfterFunc(timeout, func() {
+			g.fire(phase, timeout)
+		})
+	}
+}
+
+// touch 读到响应数据后重置空闲计时
+func (g *timeoutGuard) touch() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.phaseTimer != nil && g.err == nil && !g.stopped {
+		g.phaseTimer.Reset(g.timeouts.StreamIdle)
+	}
+}
+
+// fire 记录超时原因并取消上游请求
+func (g *timeoutGuard) fire(phase string, timeout time.Duration) {
+	g.mu.Lock()
+	if g.stopped || g.err != nil {
+		g.mu.Unlock()
+		return
+	}
+	g.err = &upstreamTimeoutError{Phase: phase, Timeout: timeout}
+	g.mu.Unlock()
+
+	g.cancel()
+}
+
+// timeoutErr 获取已触发的超时错误
+func (g *timeoutGuard) timeoutErr() *upstreamTimeoutError {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.err
+}
+
+// wrapError 请求因超时被取消时，将取消错误替换为具体的超时错误
+func (g *timeoutGuard) wrapError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if timeoutErr := g.timeoutErr(); timeoutErr != nil {
+		return timeoutErr
+	}
+	return err
+}
+
+// wrapBody 包装响应体，读取数据时重置空闲计时，超时导致的读取失败返回具体的超时错误
+func (g *timeoutGuard) wrapBody(body io.ReadCloser) io.ReadCloser {
+	return &guardedBody{ReadCloser: body, guard: g}
+}
+
+// stop 停止所有计时并释放请求上下文
+func (g *timeoutGuard) stop() {
+	g.mu.Lock()
+	g.stopped = true
+	if g.phaseTimer != nil {
+		g.phaseTimer.Stop()
+	}
+	if g.totalTimer != nil {
+		g.totalTimer.Stop()
+	}
+	g.mu.Unlock()
+
+	g.cancel()
+}
+
+// guardedBody 受超时监控的响应体
+type guardedBody struct {
+	io.ReadCloser
+	guard *timeoutGuard
+}
+
+func (b *guardedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.guard.touch()
+	}
+	if err != nil && err != io.EOF {
+		err = b.guard.wrapError(err)
+	}
+	return n, err
+}
+
+// asUpstreamTimeout 判断错误是否为上游超时
+func asUpstreamTimeout(err error) *upstreamTimeoutError {
+	var timeoutErr *upstreamTimeoutError
+	if errors.As(err, &timeoutErr) {
+		return timeoutErr
+	}
+	return nil
+}
+
+// upstreamTimeoutBody 构建Claude格式的超时错误
+func upstreamTimeoutBody(timeoutErr *upstreamTimeoutError) []byte {
+	body, _ := json.Marshal(map[string]interface{}{
+		"type": "error",
+		"error": map[string]interface{}{
+			"type":    "timeout_error",
+			"message": timeoutErr.Error(),
+			"phase":   timeoutErr.Phase,
+		},
+	})
+	return body
+}
+
+// writeUpstreamTimeoutError 响应已开始输出后发生超时，向客户端写入明确的错误而不是直接截断
+// 流式响应写入SSE error事件，非流式响应写入错误JSON；err不是超时错误时不写入并返回false
+func writeUpstreamTimeoutError(w io.Writer, err error, stream bool) bool {
+	timeoutErr := asUpstreamTimeout(err)
+	if timeoutErr == nil {
+		return false
+	}
+
+	body := upstreamTimeoutBody(timeoutErr)
+	if stream {
+		fmt.Fprintf(w, "event: error\ndata: %s\n\n", body)
+	} else {
+		// 响应头尚未发送时仍可返回504
+		if rw, ok := w.(interface {
+			http.ResponseWriter
+			Written() bool
+		}); ok && !rw.Written() {
+			rw.Header().Set("Content-Type", "application/json")
+			rw.WriteHeader(http.StatusGatewayTimeout)
+		}
+		w.Write(body)
+	}
+	if flusher, ok := w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return true
+}
@@ -22,12 +22,14 @@ func SetAPIRouter(server *gin.Engine, embeddedFS embed.FS, staticFileSystem http
 
 	// Claude Code 路由
 	claude := server.Group("/claude-code")
-	claude.Use(middleware.ClaudeCodeAuth())
+	claude.Use(middleware.RelayErrorLogger(), middleware.ClaudeCodeAuth())
 	{
 		// 对话接口
 		claude.POST("/v1/messages", controller.GetMessages)
 		// 使用量统计接口
 		claude.POST("/v1/messages/count_tokens", controller.GetCountTokens)
+		// OpenAI兼容对话接口
+		claude.POST("/v1/chat/completions", controller.GetChatCompletions)
 	}
 
 	// API路由组
@@ -66,12 +68,13 @@ func SetAPIRouter(server *gin.Engine, embeddedFS embed.FS, staticFileSystem http
 			// 分组相关
 			group := authenticated.Group("/groups")
 			{
-				group.GET("/list", controller.GetGroups)            // 获取分组列表
-				group.GET("/all", controller.GetAllGroups)          // 获取所有分组（用于下拉选择）
-				group.POST("/create", controller.CreateGroup)       // 创建分组
-				group.GET("/detail/:id", controller.GetGroup)       // 获取分组详情
-				group.PUT("/update/:id", controller.UpdateGroup)    // 更新分组
-				group.DELETE("/delete/:id", controller.DeleteGroup) // 删除分组
+				group.GET("/list", controller.GetGroups)                       // 获取分组列表
+				group.GET("/all", controller.GetAllGroups)                     // 获取所有分组（用于下拉选择）
+				group.POST("/create", controller.CreateGroup)                  // 创建分组
+				group.GET("/detail/:id", controller.GetGroup)                  // 获取分组详情
+				group.PUT("/update/:id", controller.UpdateGroup)               // 更新分组
+				group.DELETE("/delete/:id", controller.DeleteGroup)            // 删除分组
+				group.POST("/rewrite-preview", controller.PreviewGroupRewrite) // 预览请求改写规则
 			}
 
 			// 账号管理相关
@@ -87,6 +90,21 @@ func SetAPIRouter(server *gin.Engine, embeddedFS embed.FS, staticFileSystem http
 				account.POST("/test/:id", controller.TestGetMessages)                            // 测试账号连通性
 			}
 
+			// 代理池相关
+			proxy := authenticated.Group("/proxies")
+			{
+				proxy.GET("/list", controller.GetProxyList)                     // 获取代理列表
+				proxy.POST("/create", controller.CreateProxy)                   // 创建代理
+				proxy.GET("/detail/:id", controller.GetProxy)                   // 获取代理详情
+				proxy.PUT("/update/:id", controller.UpdateProxy)                // 更新代理
+				proxy.DELETE("/delete/:id", controller.DeleteProxy)             // 删除代理
+				proxy.POST("/check/:id", controller.CheckProxy)                 // 检测代理连通性
+				proxy.GET("/groups/list", controller.GetProxyGroups)            // 获取代理分组列表
+				proxy.POST("/groups/create", controller.CreateProxyGroup)       // 创建代理分组
+				proxy.PUT("/groups/update/:id", controller.UpdateProxyGroup)    // 更新代理分组
+				proxy.DELETE("/groups/delete/:id", controller.DeleteProxyGroup) // 删除代理分组
+			}
+
 			// Claude OAuth 相关
 			oauth := authenticated.Group("/oauth")
 			{
@@ -139,6 +157,16 @@ func SetAPIRouter(server *gin.Engine, embeddedFS embed.FS, staticFileSystem http
 					adminLogs.DELETE("/cleanup", controller.DeleteExpiredLogs) // 删除过期日志
 				}
 
+				// 请求头转发规则（管理员专用）
+				headerRules := admin.Group("/header-rules")
+				{
+					headerRules.GET("/list", controller.GetHeaderRuleList)         // 获取请求头规则列表
+					headerRules.POST("/create", controller.CreateHeaderRule)       // 创建请求头规则
+					headerRules.GET("/detail/:id", controller.GetHeaderRule)       // 获取请求头规则详情
+					headerRules.PUT("/update/:id", controller.UpdateHeaderRule)    // 更新请求头规则
+					headerRules.DELETE("/delete/:id", controller.DeleteHeaderRule) // 删除请求头规则
+				}
+
 				// 定时任务测试接口（管理员专用）
 				admin.POST("/test/reset-stats", controller.ManualResetStats) // 手动重置统计数据
 				admin.POST("/test/clean-logs", controller.ManualCleanLogs)   // 手动清理过期日志
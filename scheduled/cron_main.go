@@ -46,6 +46,13 @@ func (s *CronService) Start() {
 		return
 	}
 
+	// 每天凌晨1点30分清理过期的请求体捕获
+	_, err = s.cron.AddFunc("0 30 1 * * *", s.cleanExpiredLogCaptures)
+	if err != nil {
+		log.Printf("Failed to add log capture cleanup cron job: %v", err)
+		return
+	}
+
 	// 每30分钟执行一次账号异常恢复测试
 	_, err = s.cron.AddFunc("0 */30 * * * *", s.recoverAbnormalAccounts)
 	if err != nil {
@@ -60,6 +67,20 @@ func (s *CronService) Start() {
 		return
 	}
 
+	// 每5分钟检测代理池连通性
+	_, err = s.cron.AddFunc("0 */5 * * * *", s.checkProxyHealth)
+	if err != nil {
+		log.Printf("Failed to add proxy health check cron job: %v", err)
+		return
+	}
+
+	// 每5分钟提前续期即将过期的OAuth token
+	_, err = s.cron.AddFunc("0 */5 * * * *", s.renewExpiringTokens)
+	if err != nil {
+		log.Printf("Failed to add token renewal cron job: %v", err)
+		return
+	}
+
 	// 启动定时任务
 	s.cron.Start()
 	common.SysLog("Cron service started successfully")
@@ -188,6 +209,23 @@ func (s *CronService) cleanExpiredLogs() {
 	common.SysLog("Expired logs cleanup task completed in " + duration.String())
 }
 
+// cleanExpiredLogCaptures 清理过期的请求体捕获，保留天数独立于日志保留月数
+func (s *CronService) cleanExpiredLogCaptures() {
+	startTime := time.Now()
+	common.SysLog("Starting expired log captures cleanup task")
+
+	retentionDays := service.GetLogCaptureRetentionDays()
+	deletedCount, err := service.NewLogCaptureService().DeleteExpiredLogCaptures(retentionDays)
+	if err != nil {
+		common.SysError("Failed to clean expired log captures: " + err.Error())
+	} else {
+		common.SysLog("Cleaned expired log captures successfully, deleted " + strconv.FormatInt(deletedCount, 10) + " records (older than " + strconv.Itoa(retentionDays) + " days)")
+	}
+
+	duration := time.Since(startTime)
+	common.SysLog("Expired log captures cleanup task completed in " + duration.String())
+}
+
 // getLogRetentionMonths 从环境变量获取日志保留月数
 func getLogRetentionMonths() int {
 	monthsStr := os.Getenv("LOG_RETENTION_MONTHS")
@@ -253,6 +291,8 @@ func (s *CronService) testAndRecoverAccount(account *model.Account) bool {
 		statusCode, err = relay.TestHandleClaudeConsoleRequest(account)
 	case constant.PlatformOpenAI:
 		statusCode, err = relay.TestHandleOpenAIRequest(account)
+	case constant.PlatformGemini:
+		statusCode, err = relay.TestHandleGeminiRequest(account)
 	default:
 		common.SysError(fmt.Sprintf("Unsupported platform type for account %s (ID: %d): %s", account.Name, account.ID, account.PlatformType))
 		return false
@@ -334,3 +374,69 @@ func (s *CronService) checkRateLimitExpiredAccounts() {
 	duration := time.Since(startTime)
 	common.SysLog(fmt.Sprintf("Rate limit expired accounts check task completed in %s. Recovered: %d", duration.String(), recoveredCount))
 }
+
+// checkProxyHealth 检测代理池中所有启用代理的连通性
+func (s *CronService) checkProxyHealth() {
+	startTime := time.Now()
+
+	healthy, unhealthy, err := service.NewProxyService().CheckAllProxies()
+	if err != nil {
+		common.SysError("Failed to check proxy health: " + err.Error())
+		return
+	}
+	if healthy+unhealthy == 0 {
+		return
+	}
+
+	duration := time.Since(startTime)
+	common.SysLog(fmt.Sprintf("Proxy health check completed in %s, healthy: %d, unhealthy: %d", duration.String(), healthy, unhealthy))
+}
+
+// renewExpiringTokens 提前续期即将过期的Claude OAuth token，避免用户请求承担刷新耗时
+func (s *CronService) renewExpiringTokens() {
+	startTime := time.Now()
+	renewBefore := getTokenRenewBefore()
+
+	accounts, err := model.GetAccountsNeedingTokenRefresh(startTime.Add(renewBefore))
+	if err != nil {
+		common.SysError("Failed to query accounts needing token renewal: " + err.Error())
+		return
+	}
+
+	if len(accounts) == 0 {
+		return
+	}
+
+	common.SysLog(fmt.Sprintf("Found %d accounts with tokens expiring within %s", len(accounts), renewBefore.String()))
+
+	renewedCount := 0
+	failedCount := 0
+
+	for _, account := range accounts {
+		if err := relay.RenewAccountToken(&account, renewBefore); err != nil {
+			failedCount++
+			common.SysError(fmt.Sprintf("Failed to renew token for account %s (ID: %d): %v", account.Name, account.ID, err))
+			continue
+		}
+		renewedCount++
+	}
+
+	duration := time.Since(startTime)
+	common.SysLog(fmt.Sprintf("Token renewal task completed in %s. Renewed: %d, Failed: %d", duration.String(), renewedCount, failedCount))
+}
+
+// getTokenRenewBefore 从环境变量获取token提前续期时间（秒），默认为30分钟
+func getTokenRenewBefore() time.Duration {
+	secondsStr := os.Getenv("TOKEN_RENEW_BEFORE")
+	if secondsStr == "" {
+		return 30 * time.Minute
+	}
+
+	seconds, err := strconv.Atoi(secondsStr)
+	if err != nil || seconds <= 0 {
+		log.Printf("Invalid TOKEN_RENEW_BEFORE value: %s, using default value 1800", secondsStr)
+		return 30 * time.Minute
+	}
+
+	return time.Duration(seconds) * time.Second
+}
@@ -4,6 +4,7 @@ import (
 	"claude-code-relay/common"
 	"claude-code-relay/model"
 	"errors"
+	"fmt"
 	"log"
 	"time"
 )
@@ -28,6 +29,13 @@ func (s *AccountService) GetAccountList(page, limit int, userID *uint) (*model.A
 		return nil, errors.New("获取账号列表失败")
 	}
 
+	circuitBreaker := NewCircuitBreakerService()
+	concurrencyService := NewConcurrencyService()
+	for i := range accounts {
+		accounts[i].CircuitState = circuitBreaker.GetState(accounts[i].ID)
+		accounts[i].CurrentConcurrency = concurrencyService.CurrentConcurrency(accounts[i].ID)
+	}
+
 	result := &model.AccountListResponse{
 		Accounts: accounts,
 		Total:    total,
@@ -40,40 +48,49 @@ func (s *AccountService) GetAccountList(page, limit int, userID *uint) (*model.A
 
 // CreateAccount 创建账号
 func (s *AccountService) CreateAccount(req *model.CreateAccountRequest, userID uint) (*model.Account, error) {
-	// 设置今日请求次数：获取同用户、同分组、同优先级可用账号的最大今日请求次数，然后减1
-	todayUsageCount := req.TodayUsageCount
-	if todayUsageCount == 0 && req.Priority > 0 {
-		maxUsageCount, err := model.GetMaxTodayUsageCountFromAvailableAccounts(userID, req.GroupID, req.Priority)
-		if err != nil {
-			return nil, errors.New("获取最大今日请求次数失败")
-		}
-		todayUsageCount = maxUsageCount - 1
-		if todayUsageCount < 0 {
-			todayUsageCount = 0
-		}
+	account := &model.Account{
+		Name:              req.Name,
+		PlatformType:      req.PlatformType,
+		RequestURL:        req.RequestURL,
+		UpstreamFormat:    req.UpstreamFormat,
+		SecretKey:         req.SecretKey,
+		GroupID:           req.GroupID,
+		Priority:          req.Priority,
+		Weight:            req.Weight,
+		DailyLimit:        req.DailyLimit,
+		TotalLimit:        req.TotalLimit,
+		EnableProxy:       req.EnableProxy,
+		ProxyURI:          req.ProxyURI,
+		ProxyID:           req.ProxyID,
+		ProxyGroupID:      req.ProxyGroupID,
+		MaxConcurrency:    req.MaxConcurrency,
+		ConnectTimeout:    req.ConnectTimeout,
+		FirstByteTimeout:  req.FirstByteTimeout,
+		StreamIdleTimeout: req.StreamIdleTimeout,
+		MaxDuration:       req.MaxDuration,
+		ModelMapping:      req.ModelMapping,
+		ModelRestriction:  req.ModelRestriction,
+		ActiveStatus:      req.ActiveStatus,
+		IsMax:             req.IsMax,
+		AccessToken:       req.AccessToken,
+		RefreshToken:      req.RefreshToken,
+		ExpiresAt:         req.ExpiresAt,
+		TodayUsageCount:   req.TodayUsageCount,
+		UserID:            userID,
+
+		TLSCACert:             req.TLSCACert,
+		TLSClientCert:         req.TLSClientCert,
+		TLSClientKey:          req.TLSClientKey,
+		TLSServerName:         req.TLSServerName,
+		TLSInsecureSkipVerify: req.TLSInsecureSkipVerify,
 	}
 
-	account := &model.Account{
-		Name:             req.Name,
-		PlatformType:     req.PlatformType,
-		RequestURL:       req.RequestURL,
-		SecretKey:        req.SecretKey,
-		GroupID:          req.GroupID,
-		Priority:         req.Priority,
-		Weight:           req.Weight,
-		DailyLimit:       req.DailyLimit,
-		TotalLimit:       req.TotalLimit,
-		EnableProxy:      req.EnableProxy,
-		ProxyURI:         req.ProxyURI,
-		ModelMapping:     req.ModelMapping,
-		ModelRestriction: req.ModelRestriction,
-		ActiveStatus:     req.ActiveStatus,
-		IsMax:            req.IsMax,
-		AccessToken:      req.AccessToken,
-		RefreshToken:     req.RefreshToken,
-		ExpiresAt:        req.ExpiresAt,
-		TodayUsageCount:  todayUsageCount,
-		UserID:           userID,
+	if err := account.TLSOptions().Validate(); err != nil {
+		return nil, fmt.Errorf("%w: %v", common.ErrInvalidTLSConfig, err)
+	}
+
+	if err := NewProxyService().ValidateAccountProxy(account.ProxyID, account.ProxyGroupID, userID); err != nil {
+		return nil, err
 	}
 
 	if err := model.CreateAccount(account); err != nil {
@@ -105,10 +122,16 @@ func (s *AccountService) UpdateAccount(id uint, req *model.UpdateAccountRequest,
 		return nil, err
 	}
 
+	// 代理或TLS配置变更时需要重建连接池
+	previousTLS := *account.TLSOptions()
+	proxyChanged := account.EnableProxy != req.EnableProxy || account.ProxyURI != req.ProxyURI ||
+		account.ProxyID != req.ProxyID || account.ProxyGroupID != req.ProxyGroupID
+
 	// 更新字段
 	account.Name = req.Name
 	account.PlatformType = req.PlatformType
 	account.RequestURL = req.RequestURL
+	account.UpstreamFormat = req.UpstreamFormat
 	if req.GroupID != nil {
 		account.GroupID = *req.GroupID
 	}
@@ -118,6 +141,13 @@ func (s *AccountService) UpdateAccount(id uint, req *model.UpdateAccountRequest,
 	account.TotalLimit = req.TotalLimit
 	account.EnableProxy = req.EnableProxy
 	account.ProxyURI = req.ProxyURI
+	account.ProxyID = req.ProxyID
+	account.ProxyGroupID = req.ProxyGroupID
+	account.MaxConcurrency = req.MaxConcurrency
+	account.ConnectTimeout = req.ConnectTimeout
+	account.FirstByteTimeout = req.FirstByteTimeout
+	account.StreamIdleTimeout = req.StreamIdleTimeout
+	account.MaxDuration = req.MaxDuration
 	account.ModelMapping = req.ModelMapping
 	account.ModelRestriction = req.ModelRestriction
 	account.ActiveStatus = req.ActiveStatus
@@ -140,10 +170,41 @@ func (s *AccountService) UpdateAccount(id uint, req *model.UpdateAccountRequest,
 		account.TodayUsageCount = req.TodayUsageCount
 	}
 
+	// 更新TLS配置，客户端私钥为空时保持原值，客户端证书为空时同时清除私钥
+	account.TLSCACert = req.TLSCACert
+	account.TLSClientCert = req.TLSClientCert
+	account.TLSServerName = req.TLSServerName
+	account.TLSInsecureSkipVerify = req.TLSInsecureSkipVerify
+	if req.TLSClientKey != "" {
+		account.TLSClientKey = req.TLSClientKey
+	}
+	if req.TLSClientCert == "" {
+		account.TLSClientKey = ""
+	}
+
+	if err := account.TLSOptions().Validate(); err != nil {
+		return nil, fmt.Errorf("%w: %v", common.ErrInvalidTLSConfig, err)
+	}
+
+	if err := NewProxyService().ValidateAccountProxy(account.ProxyID, account.ProxyGroupID, account.UserID); err != nil {
+		return nil, err
+	}
+
 	if err := model.UpdateAccount(account); err != nil {
 		return nil, errors.New("更新账号失败")
 	}
 
+	// token字段不随账号整体保存，手动填写了新token时单独更新
+	if req.AccessToken != "" || req.RefreshToken != "" {
+		if err := model.UpdateAccountToken(account.ID, account.AccessToken, account.RefreshToken, account.ExpiresAt); err != nil {
+			return nil, errors.New("更新账号失败")
+		}
+	}
+
+	if proxyChanged || previousTLS != *account.TLSOptions() {
+		common.InvalidateTransports(account.ID)
+	}
+
 	return account, nil
 }
 
@@ -158,6 +219,8 @@ func (s *AccountService) DeleteAccount(id uint, userID *uint) error {
 		return errors.New("删除账号失败")
 	}
 
+	common.InvalidateTransports(account.ID)
+
 	return nil
 }
 
@@ -178,19 +241,6 @@ func (s *AccountService) UpdateAccountActiveStatus(id uint, activeStatus int, us
 		return err
 	}
 
-	// 如果是启用账号（从禁用变为激活），设置今日请求次数
-	if account.ActiveStatus == 2 && activeStatus == 1 {
-		maxUsageCount, err := model.GetMaxTodayUsageCountFromAvailableAccounts(account.UserID, account.GroupID, account.Priority)
-		if err != nil {
-			return errors.New("获取最大今日请求次数失败")
-		}
-		todayUsageCount := maxUsageCount - 1
-		if todayUsageCount < 0 {
-			todayUsageCount = 0
-		}
-		account.TodayUsageCount = todayUsageCount
-	}
-
 	account.ActiveStatus = activeStatus
 
 	if err := model.UpdateAccount(account); err != nil {
@@ -217,6 +267,11 @@ func (s *AccountService) UpdateAccountCurrentStatus(id uint, currentStatus int,
 		return errors.New("更新账号当前状态失败")
 	}
 
+	// 手动恢复为正常状态时同时重置熔断器
+	if currentStatus == 1 {
+		NewCircuitBreakerService().Reset(account.ID)
+	}
+
 	return nil
 }
 
@@ -227,9 +282,10 @@ func (s *AccountService) UpdateAccountStatus(account *model.Account, statusCode
 	case statusCode == 429:
 		// 限流状态
 		account.CurrentStatus = 3
-	case statusCode > 400:
-		// 接口异常
-		account.CurrentStatus = 2
+	case IsUpstreamFailure(statusCode):
+		// 上游异常计入熔断器，由熔断器决定是否暂时移出轮询；客户端自身的4xx错误不影响账号状态
+		NewCircuitBreakerService().RecordFailure(account.ID)
+		return
 	case statusCode == 200 || statusCode == 201:
 		// 正常状态
 		account.CurrentStatus = 1
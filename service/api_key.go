@@ -43,6 +43,9 @@ func CreateApiKey(userID uint, req *model.CreateApiKeyRequest) (*model.ApiKey, e
 		ModelRestriction: req.ModelRestriction,
 		DailyLimit:       req.DailyLimit,
 		TotalLimit:       req.TotalLimit,
+		QueuePriority:    req.QueuePriority,
+		ResponseCacheTTL: req.ResponseCacheTTL,
+		BodyCaptureKB:    req.BodyCaptureKB,
 		UserID:           userID,
 	}
 
@@ -101,6 +104,9 @@ func AutoCreateApiKey(userID uint, req *model.AutoCreateApiKeyRequest) (*model.A
 		ModelRestriction: req.ModelRestriction,
 		DailyLimit:       req.DailyLimit,
 		TotalLimit:       req.TotalLimit,
+		QueuePriority:    req.QueuePriority,
+		ResponseCacheTTL: req.ResponseCacheTTL,
+		BodyCaptureKB:    req.BodyCaptureKB,
 	}
 
 	// 复用现有的CreateApiKey逻辑
@@ -158,6 +164,15 @@ func UpdateApiKey(id, userID uint, req *model.UpdateApiKeyRequest) (*model.ApiKe
 	if req.TotalLimit != nil {
 		apiKey.TotalLimit = *req.TotalLimit
 	}
+	if req.QueuePriority != nil {
+		apiKey.QueuePriority = *req.QueuePriority
+	}
+	if req.ResponseCacheTTL != nil {
+		apiKey.ResponseCacheTTL = *req.ResponseCacheTTL
+	}
+	if req.BodyCaptureKB != nil {
+		apiKey.BodyCaptureKB = *req.BodyCaptureKB
+	}
 
 	err = model.UpdateApiKey(apiKey)
 	if err != nil {
@@ -0,0 +1,254 @@
+package service
+
+import (
+	"claude-code-relay/common"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// 熔断器状态
+const (
+	CircuitStateClosed   = "closed"
+	CircuitStateOpen     = "open"
+	CircuitStateHalfOpen = "half_open"
+)
+
+const (
+	// 默认统计窗口内触发熔断的失败次数
+	defaultCircuitFailureThreshold = 5
+	// 默认失败统计窗口
+	defaultCircuitFailureWindow = time.Minute
+	// 默认首次熔断时长，之后每次连续熔断翻倍
+	defaultCircuitOpenDuration = 30 * time.Second
+	// 默认最长熔断时长
+	defaultCircuitMaxOpenDuration = 30 * time.Minute
+	// 半开探测请求的最长占用时间，防止探测请求异常退出后一直无法再次探测
+	circuitProbeTimeout = 5 * time.Minute
+	// 熔断状态的保留时间
+	circuitStateTTL = 24 * time.Hour
+)
+
+// CircuitBreakerService 账号熔断器服务
+// 状态保存在Redis中，多实例共享：
+//   - closed: 正常放行，统计窗口内上游失败次数达到阈值后熔断
+//   - open: 熔断中，跳过该账号，熔断时长按连续熔断次数指数增长
+//   - half_open: 熔断到期后只放行一个真实请求作为探测，成功则恢复，失败则再次熔断
+type CircuitBreakerService struct{}
+
+func NewCircuitBreakerService() *CircuitBreakerService {
+	return &CircuitBreakerService{}
+}
+
+// IsUpstreamFailure 判断状态码是否属于上游或账号自身的异常
+// 客户端请求本身的错误（如400参数错误、404、413、422）不计入熔断，429由限流逻辑单独处理
+func IsUpstreamFailure(statusCode int) bool {
+	switch statusCode {
+	case 401, 403, 408:
+		return true
+	}
+	return statusCode >= 500
+}
+
+// Allow 判断账号当前是否可以接收请求
+// 半开状态下只有获得探测权的请求会被放行，此时probing为true，请求结束后需调用ReleaseProbe
+func (s *CircuitBreakerService) Allow(accountID uint) (allowed bool, probing bool) {
+	if common.RDB == nil {
+		return true, false
+	}
+
+	ctx := context.Background()
+	state, err := common.RDB.HGetAll(ctx, circuitStateKey(accountID)).Result()
+	if err != nil || state["state"] != CircuitStateOpen {
+		return true, false
+	}
+
+	openUntil, _ := strconv.ParseInt(state["open_until"], 10, 64)
+	if time.Now().UnixMilli() < openUntil {
+		return false, false
+	}
+
+	acquired, err := common.RDB.SetNX(ctx, circuitProbeKey(accountID), "1", circuitProbeTimeout).Result()
+	if err != nil || !acquired {
+		return false, false
+	}
+
+	log.Printf("账号 %d 熔断到期，进入半开状态放行探测请求", accountID)
+	return true, true
+}
+
+// RecordSuccess 记录半开探测请求成功，恢复为关闭状态
+// 只能由获得探测权的请求调用，熔断前已发出的请求成功不代表账号已恢复
+func (s *CircuitBreakerService) RecordSuccess(accountID uint) {
+	if common.RDB == nil {
+		return
+	}
+
+	ctx := context.Background()
+	state, err := common.RDB.HGetAll(ctx, circuitStateKey(accountID)).Result()
+	if err != nil || state["state"] != CircuitStateOpen {
+		return
+	}
+
+	// 探测期间账号已被再次熔断（如探测权超时后其他请求探测失败）时不恢复
+	openUntil, _ := strconv.ParseInt(state["open_until"], 10, 64)
+	if time.Now().UnixMilli() < openUntil {
+		return
+	}
+
+	common.RDB.Del(ctx, circuitStateKey(accountID), circuitFailuresKey(accountID), circuitProbeKey(accountID))
+	log.Printf("账号 %d 探测请求成功，熔断器恢复", accountID)
+}
+
+// RecordFailure 记录一次上游失败
+func (s *CircuitBreakerService) RecordFailure(accountID uint) {
+	if common.RDB == nil {
+		return
+	}
+
+	ctx := context.Background()
+	state, err := common.RDB.HGetAll(ctx, circuitStateKey(accountID)).Result()
+	if err != nil {
+		return
+	}
+
+	if state["state"] == CircuitStateOpen {
+		// 只有半开探测请求的失败才会再次熔断；熔断前已发出的请求失败不延长熔断时间
+		deleted, err := common.RDB.Del(ctx, circuitProbeKey(accountID)).Result()
+		if err != nil || deleted == 0 {
+			return
+		}
+		trips, _ := strconv.Atoi(state["trips"])
+		s.trip(ctx, accountID, trips+1)
+		return
+	}
+
+	now := time.Now()
+	window := getCircuitFailureWindow()
+	failuresKey := circuitFailuresKey(accountID)
+
+	pipe := common.RDB.TxPipeline()
+	pipe.ZAdd(ctx, failuresKey, &redis.Z{Score: float64(now.UnixMilli()), Member: now.UnixNano()})
+	pipe.ZRemRangeByScore(ctx, failuresKey, "-inf", strconv.FormatInt(now.Add(-window).UnixMilli(), 10))
+	count := pipe.ZCard(ctx, failuresKey)
+	pipe.Expire(ctx, failuresKey, window)
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("记录账号 %d 失败次数失败: %v", accountID, err)
+		return
+	}
+
+	if count.Val() >= int64(getCircuitFailureThreshold()) {
+		s.trip(ctx, accountID, 1)
+	}
+}
+
+// ReleaseProbe 释放半开探测权（探测请求未成功时调用，如客户端错误或客户端断开）
+func (s *CircuitBreakerService) ReleaseProbe(accountID uint) {
+	if common.RDB == nil {
+		return
+	}
+	common.RDB.Del(context.Background(), circuitProbeKey(accountID))
+}
+
+// Reset 重置账号熔断状态（管理员手动恢复账号时调用）
+func (s *CircuitBreakerService) Reset(accountID uint) {
+	if common.RDB == nil {
+		return
+	}
+	common.RDB.Del(context.Background(), circuitStateKey(accountID), circuitFailuresKey(accountID), circuitProbeKey(accountID))
+}
+
+// GetState 获取账号当前熔断状态
+func (s *CircuitBreakerService) GetState(accountID uint) string {
+	if common.RDB == nil {
+		return CircuitStateClosed
+	}
+
+	state, err := common.RDB.HGetAll(context.Background(), circuitStateKey(accountID)).Result()
+	if err != nil || state["state"] != CircuitStateOpen {
+		return CircuitStateClosed
+	}
+
+	openUntil, _ := strconv.ParseInt(state["open_until"], 10, 64)
+	if time.Now().UnixMilli() < openUntil {
+		return CircuitStateOpen
+	}
+	return CircuitStateHalfOpen
+}
+
+// trip 熔断账号，trips为连续熔断次数，用于计算指数退避时长
+func (s *CircuitBreakerService) trip(ctx context.Context, accountID uint, trips int) {
+	openDuration := circuitOpenDuration(trips)
+	openUntil := time.Now().Add(openDuration)
+
+	pipe := common.RDB.TxPipeline()
+	pipe.HSet(ctx, circuitStateKey(accountID), map[string]interface{}{
+		"state":      CircuitStateOpen,
+		"open_until": openUntil.UnixMilli(),
+		"trips":      trips,
+	})
+	pipe.Expire(ctx, circuitStateKey(accountID), circuitStateTTL)
+	pipe.Del(ctx, circuitFailuresKey(accountID))
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("保存账号 %d 熔断状态失败: %v", accountID, err)
+		return
+	}
+
+	log.Printf("账号 %d 触发熔断（第%d次），熔断时长: %s", accountID, trips, openDuration)
+}
+
+// circuitOpenDuration 计算熔断时长：基础时长 * 2^(trips-1)，不超过最长熔断时长
+func circuitOpenDuration(trips int) time.Duration {
+	duration := getCircuitDurationEnv("CIRCUIT_BREAKER_OPEN_DURATION", defaultCircuitOpenDuration)
+	maxDuration := getCircuitDurationEnv("CIRCUIT_BREAKER_MAX_OPEN_DURATION", defaultCircuitMaxOpenDuration)
+
+	for i := 1; i < trips && duration < maxDuration; i++ {
+		duration *= 2
+	}
+	if duration > maxDuration {
+		duration = maxDuration
+	}
+	return duration
+}
+
+func circuitStateKey(accountID uint) string {
+	return fmt.Sprintf("circuit_breaker:%d", accountID)
+}
+
+func circuitFailuresKey(accountID uint) string {
+	return fmt.Sprintf("circuit_breaker:%d:failures", accountID)
+}
+
+func circuitProbeKey(accountID uint) string {
+	return fmt.Sprintf("circuit_breaker:%d:probe", accountID)
+}
+
+// getCircuitFailureThreshold 从环境变量获取触发熔断的失败次数
+func getCircuitFailureThreshold() int {
+	if thresholdStr := os.Getenv("CIRCUIT_BREAKER_FAILURE_THRESHOLD"); thresholdStr != "" {
+		if threshold, err := strconv.Atoi(thresholdStr); err == nil && threshold > 0 {
+			return threshold
+		}
+	}
+	return defaultCircuitFailureThreshold
+}
+
+// getCircuitFailureWindow 从环境变量获取失败统计窗口（秒）
+func getCircuitFailureWindow() time.Duration {
+	return getCircuitDurationEnv("CIRCUIT_BREAKER_WINDOW", defaultCircuitFailureWindow)
+}
+
+// getCircuitDurationEnv 从环境变量读取以秒为单位的时长
+func getCircuitDurationEnv(name string, defaultValue time.Duration) time.Duration {
+	if valueStr := os.Getenv(name); valueStr != "" {
+		if value, err := strconv.Atoi(valueStr); err == nil && value > 0 {
+			return time.Duration(value) * time.Second
+		}
+	}
+	return defaultValue
+}
@@ -0,0 +1,141 @@
+package service
+
+import (
+	"claude-code-relay/common"
+	"claude-code-relay/model"
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	// 并发槽位租约时长，持有期间定期续约；实例崩溃后租约到期自动释放
+	concurrencyLeaseTTL = 60 * time.Second
+	// 租约续约间隔
+	concurrencyRenewInterval = 20 * time.Second
+)
+
+// acquireSlotScript 清理过期租约后，在未达到上限时写入新租约
+// KEYS[1]: 并发集合键  ARGV[1]: 当前时间(毫秒) ARGV[2]: 租约到期时间(毫秒) ARGV[3]: 租约ID ARGV[4]: 最大并发数 ARGV[5]: 集合过期时间(毫秒)
+var acquireSlotScript = redis.NewScript(`
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', ARGV[1])
+if redis.call('ZCARD', KEYS[1]) >= tonumber(ARGV[4]) then
+	return 0
+end
+redis.call('ZADD', KEYS[1], ARGV[2], ARGV[3])
+redis.call('PEXPIRE', KEYS[1], ARGV[5])
+return 1
+`)
+
+// ConcurrencyService 账号并发控制服务
+// 使用Redis有序集合实现分布式信号量，成员为租约ID，分数为租约到期时间
+type ConcurrencyService struct{}
+
+func NewConcurrencyService() *ConcurrencyService {
+	return &ConcurrencyService{}
+}
+
+// ConcurrencySlot 已获取的并发槽位，请求结束（包括流式响应结束和客户端断开）时必须调用Release
+type ConcurrencySlot struct {
+	accountID uint
+	leaseID   string
+	stop      chan struct{}
+	once      sync.Once
+}
+
+// Acquire 为账号获取一个并发槽位，账号未限制并发时返回空槽位
+// 已达到并发上限时返回false
+func (s *ConcurrencyService) Acquire(account *model.Account) (*ConcurrencySlot, bool) {
+	if account.MaxConcurrency <= 0 || common.RDB == nil {
+		return &ConcurrencySlot{}, true
+	}
+
+	slot := &ConcurrencySlot{
+		accountID: account.ID,
+		leaseID:   common.GenerateUUID(),
+		stop:      make(chan struct{}),
+	}
+
+	now := time.Now()
+	acquired, err := acquireSlotScript.Run(context.Background(), common.RDB,
+		[]string{concurrencyKey(account.ID)},
+		now.UnixMilli(),
+		now.Add(concurrencyLeaseTTL).UnixMilli(),
+		slot.leaseID,
+		account.MaxConcurrency,
+		(2 * concurrencyLeaseTTL).Milliseconds(),
+	).Int()
+	if err != nil {
+		// Redis异常时不阻塞请求
+		log.Printf("获取账号 %d 并发槽位失败: %v", account.ID, err)
+		return &ConcurrencySlot{}, true
+	}
+	if acquired == 0 {
+		return nil, false
+	}
+
+	go slot.keepAlive()
+	return slot, true
+}
+
+// IsSaturated 判断账号当前并发是否已达到上限
+func (s *ConcurrencyService) IsSaturated(account *model.Account) bool {
+	if account.MaxConcurrency <= 0 {
+		return false
+	}
+	return s.CurrentConcurrency(account.ID) >= int64(account.MaxConcurrency)
+}
+
+// CurrentConcurrency 获取账号当前未过期的并发数
+func (s *ConcurrencyService) CurrentConcurrency(accountID uint) int64 {
+	if common.RDB == nil {
+		return 0
+	}
+
+	now := strconv.FormatInt(time.Now().UnixMilli(), 10)
+	count, err := common.RDB.ZCount(context.Background(), concurrencyKey(accountID), "("+now, "+inf").Result()
+	if err != nil {
+		return 0
+	}
+	return count
+}
+
+// Release 释放并发槽位，可重复调用
+func (slot *ConcurrencySlot) Release() {
+	if slot == nil || slot.leaseID == "" {
+		return
+	}
+
+	slot.once.Do(func() {
+		close(slot.stop)
+		common.RDB.ZRem(context.Background(), concurrencyKey(slot.accountID), slot.leaseID)
+	})
+}
+
+// keepAlive 定期续约，直到槽位被释放
+func (slot *ConcurrencySlot) keepAlive() {
+	ticker := time.NewTicker(concurrencyRenewInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-slot.stop:
+			return
+		case <-ticker.C:
+			expireAt := float64(time.Now().Add(concurrencyLeaseTTL).UnixMilli())
+			key := concurrencyKey(slot.accountID)
+			// XX: 只更新已存在的租约，租约已被清理时不再重新占用
+			common.RDB.ZAddXX(context.Background(), key, &redis.Z{Score: expireAt, Member: slot.leaseID})
+			common.RDB.PExpire(context.Background(), key, 2*concurrencyLeaseTTL)
+		}
+	}
+}
+
+func concurrencyKey(accountID uint) string {
+	return fmt.Sprintf("account_concurrency:%d", accountID)
+}
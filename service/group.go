@@ -22,11 +22,39 @@ func CreateGroup(req *model.CreateGroupRequest, userID uint) (*model.Group, erro
 		return nil, err
 	}
 
+	rewriteRules, err := normalizeRewriteRules(req.RewriteRules)
+	if err != nil {
+		return nil, err
+	}
+
 	group := &model.Group{
-		Name:   req.Name,
-		Remark: req.Remark,
-		Status: req.Status,
-		UserID: userID,
+		Name:             req.Name,
+		Remark:           req.Remark,
+		Status:           req.Status,
+		MaxAttempts:      req.MaxAttempts,
+		RewriteRules:     rewriteRules,
+		AutoCacheControl: req.AutoCacheControl,
+		BodyCaptureKB:    req.BodyCaptureKB,
+		UserID:           userID,
+	}
+
+	// 如果没有指定最多尝试账号数，使用默认值
+	if group.MaxAttempts < 1 {
+		group.MaxAttempts = model.DefaultGroupMaxAttempts
+	}
+
+	// 如果没有指定排队配置，使用默认值
+	group.QueueMaxWait = model.DefaultGroupQueueMaxWait
+	if req.QueueMaxWait != nil {
+		group.QueueMaxWait = *req.QueueMaxWait
+	}
+	group.QueueMaxDepth = req.QueueMaxDepth
+	if group.QueueMaxDepth < 1 {
+		group.QueueMaxDepth = model.DefaultGroupQueueMaxDepth
+	}
+	group.QueueMode = req.QueueMode
+	if group.QueueMode == "" {
+		group.QueueMode = model.GroupQueueModeFIFO
 	}
 
 	// 如果没有指定状态，默认为启用
@@ -85,6 +113,38 @@ func UpdateGroup(id string, req *model.UpdateGroupRequest, userID uint) (*model.
 		group.Status = *req.Status
 	}
 
+	if req.MaxAttempts != nil {
+		group.MaxAttempts = *req.MaxAttempts
+	}
+
+	if req.QueueMaxWait != nil {
+		group.QueueMaxWait = *req.QueueMaxWait
+	}
+
+	if req.QueueMaxDepth != nil {
+		group.QueueMaxDepth = *req.QueueMaxDepth
+	}
+
+	if req.QueueMode != "" {
+		group.QueueMode = req.QueueMode
+	}
+
+	if req.RewriteRules != nil {
+		rewriteRules, err := normalizeRewriteRules(*req.RewriteRules)
+		if err != nil {
+			return nil, err
+		}
+		group.RewriteRules = rewriteRules
+	}
+
+	if req.AutoCacheControl != nil {
+		group.AutoCacheControl = *req.AutoCacheControl
+	}
+
+	if req.BodyCaptureKB != nil {
+		group.BodyCaptureKB = *req.BodyCaptureKB
+	}
+
 	err = model.UpdateGroup(group)
 	if err != nil {
 		return nil, err
@@ -0,0 +1,313 @@
+package service
+
+import (
+	"claude-code-relay/constant"
+	"claude-code-relay/model"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// 启用规则的进程内缓存时长，本实例修改规则后立即失效，其他实例最多延迟该时长生效
+const headerRuleCacheTTL = time.Minute
+
+// 无论规则如何配置都不会转发到上游的请求头：连接相关请求头和客户端访问本服务的凭证
+var protectedRequestHeaders = []string{
+	"connection", "keep-alive", "proxy-authenticate", "proxy-authorization", "te", "trailer",
+	"transfer-encoding", "upgrade", "host", "content-length", "authorization", "x-api-key", "cookie",
+}
+
+// 默认不转发到上游的请求头（客户端来源和链路追踪信息），可通过allow规则放行
+var defaultDeniedRequestHeaders = []string{
+	"forwarded", "x-forwarded-*", "x-real-ip", "true-client-ip", "cf-*", "via",
+	"x-request-id", "traceparent", "tracestate", "baggage", "sentry-trace", "b3", "x-b3-*",
+	"x-amzn-trace-id", "x-cloud-trace-context",
+}
+
+// 无论规则如何配置都不会返回给客户端的响应头
+var protectedResponseHeaders = []string{
+	"connection", "keep-alive", "transfer-encoding", "content-length", "set-cookie",
+}
+
+// 默认不返回给客户端的响应头（上游组织和限流信息），可通过allow规则放行
+var defaultDeniedResponseHeaders = []string{
+	"anthropic-organization-id", "anthropic-ratelimit-*", "openai-organization", "openai-project",
+	"x-ratelimit-*",
+}
+
+// HeaderRuleService 请求头转发规则服务
+type HeaderRuleService struct{}
+
+func NewHeaderRuleService() *HeaderRuleService {
+	return &HeaderRuleService{}
+}
+
+var headerRuleCache struct {
+	sync.RWMutex
+	rules    []model.HeaderRule
+	loadedAt time.Time
+}
+
+// GetHeaderRuleList 获取请求头规则列表
+func (s *HeaderRuleService) GetHeaderRuleList(page, limit int, direction string) (*model.HeaderRuleListResult, error) {
+	if page < 1 {
+		page = 1
+	}
+	if limit < 1 || limit > 100 {
+		limit = 10
+	}
+
+	rules, total, err := model.GetHeaderRuleList(page, limit, direction)
+	if err != nil {
+		return nil, errors.New("获取请求头规则列表失败")
+	}
+
+	return &model.HeaderRuleListResult{
+		Rules: rules,
+		Total: total,
+		Page:  page,
+		Limit: limit,
+	}, nil
+}
+
+// GetHeaderRuleByID 获取请求头规则详情
+func (s *HeaderRuleService) GetHeaderRuleByID(id uint) (*model.HeaderRule, error) {
+	rule, err := model.GetHeaderRuleByID(id)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, errors.New("请求头规则不存在")
+		}
+		return nil, errors.New("获取请求头规则失败")
+	}
+	return rule, nil
+}
+
+// CreateHeaderRule 创建请求头规则
+func (s *HeaderRuleService) CreateHeaderRule(req *model.HeaderRuleRequest) (*model.HeaderRule, error) {
+	rule := &model.HeaderRule{}
+	if err := applyHeaderRuleRequest(rule, req); err != nil {
+		return nil, err
+	}
+
+	if err := model.CreateHeaderRule(rule); err != nil {
+		return nil, errors.New("创建请求头规则失败")
+	}
+	invalidateHeaderRuleCache()
+
+	return rule, nil
+}
+
+// UpdateHeaderRule 更新请求头规则
+func (s *HeaderRuleService) UpdateHeaderRule(id uint, req *model.HeaderRuleRequest) (*model.HeaderRule, error) {
+	rule, err := s.GetHeaderRuleByID(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := applyHeaderRuleRequest(rule, req); err != nil {
+		return nil, err
+	}
+
+	if err := model.UpdateHeaderRule(rule); err != nil {
+		return nil, errors.New("更新请求头规则失败")
+	}
+	invalidateHeaderRuleCache()
+
+	return rule, nil
+}
+
+// DeleteHeaderRule 删除请求头规则
+func (s *HeaderRuleService) DeleteHeaderRule(id uint) error {
+	if _, err := s.GetHeaderRuleByID(id); err != nil {
+		return err
+	}
+
+	if err := model.DeleteHeaderRule(id); err != nil {
+		return errors.New("删除请求头规则失败")
+	}
+	invalidateHeaderRuleCache()
+
+	return nil
+}
+
+// applyHeaderRuleRequest 校验并填充规则字段
+func applyHeaderRuleRequest(rule *model.HeaderRule, req *model.HeaderRuleRequest) error {
+	headerName := strings.ToLower(strings.TrimSpace(req.HeaderName))
+	if !isValidHeaderPattern(headerName) {
+		return errors.New("无效的请求头名称")
+	}
+	if req.Action == model.HeaderRuleActionSet {
+		if strings.HasSuffix(headerName, "*") {
+			return errors.New("注入请求头不支持通配符")
+		}
+		if strings.ContainsAny(req.HeaderValue, "\r\n") {
+			return errors.New("无效的请求头值")
+		}
+		if matchesAnyHeaderPattern(headerName, protectedHeaders(req.Direction)) {
+			return errors.New("不允许注入该请求头")
+		}
+	}
+
+	rule.Name = req.Name
+	rule.PlatformType = req.PlatformType
+	rule.GroupID = req.GroupID
+	rule.Direction = req.Direction
+	rule.Action = req.Action
+	rule.HeaderName = headerName
+	rule.HeaderValue = ""
+	if req.Action == model.HeaderRuleActionSet {
+		rule.HeaderValue = req.HeaderValue
+	}
+	rule.Remark = req.Remark
+	rule.Status = req.Status
+	if rule.Status == 0 {
+		rule.Status = 1
+	}
+
+	return nil
+}
+
+// isValidHeaderPattern 请求头名称只能包含token字符，允许以*结尾表示前缀匹配
+func isValidHeaderPattern(pattern string) bool {
+	name := strings.TrimSuffix(pattern, "*")
+	if name == "" {
+		return false
+	}
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || strings.ContainsRune("!#$%&'+-.^_`|~", r)) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchesAnyHeaderPattern 判断小写的请求头名称是否匹配任一规则（末尾*为前缀匹配）
+func matchesAnyHeaderPattern(name string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if prefix, wildcard := strings.CutSuffix(pattern, "*"); wildcard {
+			if strings.HasPrefix(name, prefix) {
+				return true
+			}
+		} else if name == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+func protectedHeaders(direction string) []string {
+	if direction == model.HeaderRuleDirectionResponse {
+		return protectedResponseHeaders
+	}
+	return protectedRequestHeaders
+}
+
+func invalidateHeaderRuleCache() {
+	headerRuleCache.Lock()
+	headerRuleCache.rules = nil
+	headerRuleCache.loadedAt = time.Time{}
+	headerRuleCache.Unlock()
+}
+
+// enabledHeaderRules 获取启用的规则（带进程内缓存），查询失败时沿用上次的规则
+func enabledHeaderRules() []model.HeaderRule {
+	headerRuleCache.RLock()
+	if !headerRuleCache.loadedAt.IsZero() && time.Since(headerRuleCache.loadedAt) < headerRuleCacheTTL {
+		rules := headerRuleCache.rules
+		headerRuleCache.RUnlock()
+		return rules
+	}
+	headerRuleCache.RUnlock()
+
+	headerRuleCache.Lock()
+	defer headerRuleCache.Unlock()
+
+	rules, err := model.GetEnabledHeaderRules()
+	if err != nil {
+		log.Printf("加载请求头规则失败: %v", err)
+		return headerRuleCache.rules
+	}
+	headerRuleCache.rules = rules
+	headerRuleCache.loadedAt = time.Now()
+	return rules
+}
+
+// HeaderPolicy 某个平台和分组在一个方向上生效的请求头转发策略
+type HeaderPolicy struct {
+	protected     []string
+	defaultDenied []string
+	allow         []string
+	deny          []string
+	set           []model.HeaderRule
+	// 没有白名单规则时是否转发未命中任何规则的请求头
+	forwardUnlisted bool
+}
+
+// GetHeaderPolicy 获取平台和分组在指定方向上的转发策略，全局规则、平台规则和分组规则同时生效
+func (s *HeaderRuleService) GetHeaderPolicy(direction, platformType string, groupID int) *HeaderPolicy {
+	policy := &HeaderPolicy{
+		protected:       protectedRequestHeaders,
+		defaultDenied:   defaultDeniedRequestHeaders,
+		forwardUnlisted: true,
+	}
+	if direction == model.HeaderRuleDirectionResponse {
+		policy.protected = protectedResponseHeaders
+		policy.defaultDenied = defaultDeniedResponseHeaders
+	} else if platformType == constant.PlatformOpenAI || platformType == constant.PlatformGemini {
+		// OpenAI和Gemini的请求格式与客户端不同，默认不转发客户端请求头，只转发白名单中的请求头
+		policy.forwardUnlisted = false
+	}
+
+	for _, rule := range enabledHeaderRules() {
+		if rule.Direction != direction ||
+			(rule.PlatformType != "" && rule.PlatformType != platformType) ||
+			(rule.GroupID != 0 && rule.GroupID != groupID) {
+			continue
+		}
+		switch rule.Action {
+		case model.HeaderRuleActionAllow:
+			policy.allow = append(policy.allow, rule.HeaderName)
+		case model.HeaderRuleActionDeny:
+			policy.deny = append(policy.deny, rule.HeaderName)
+		case model.HeaderRuleActionSet:
+			policy.set = append(policy.set, rule)
+		}
+	}
+
+	return policy
+}
+
+// Allowed 判断请求头是否可以转发
+// 保护请求头和黑名单优先；存在白名单时只转发白名单中的请求头；否则转发默认黑名单以外的请求头
+func (p *HeaderPolicy) Allowed(name string) bool {
+	name = strings.ToLower(name)
+	if matchesAnyHeaderPattern(name, p.protected) || matchesAnyHeaderPattern(name, p.deny) {
+		return false
+	}
+	if len(p.allow) > 0 {
+		return matchesAnyHeaderPattern(name, p.allow)
+	}
+	return p.forwardUnlisted && !matchesAnyHeaderPattern(name, p.defaultDenied)
+}
+
+// Apply 将src中允许转发的请求头复制到dst，再注入固定值的请求头
+func (p *HeaderPolicy) Apply(src, dst http.Header) {
+	for name, values := range src {
+		if !p.Allowed(name) {
+			continue
+		}
+		dst.Del(name)
+		for _, value := range values {
+			dst.Add(name, value)
+		}
+	}
+
+	for _, rule := range p.set {
+		dst.Set(rule.HeaderName, rule.HeaderValue)
+	}
+}
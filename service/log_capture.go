@@ -0,0 +1,285 @@
+package service
+
+import (
+	"bytes"
+	"claude-code-relay/common"
+	"claude-code-relay/model"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// MaxBodyCaptureRecordSize 捕获时最多记录的响应字节数，超过后只保留已记录的部分
+const MaxBodyCaptureRecordSize = 16 << 20
+
+// 流式响应的SSE事件包装远大于实际内容，按捕获字节数的倍数记录，合并为消息对象后再截断
+const streamBodyCaptureRecordFactor = 8
+
+// 默认捕获内容保留天数
+const defaultLogCaptureRetentionDays = 7
+
+// 超过该长度且只包含base64字符的字符串视为二进制内容
+const minRedactedBase64Length = 512
+
+const redactedValue = "[REDACTED]"
+
+// 值需要整体脱敏的字段名（小写）
+var sensitiveFieldNames = map[string]bool{
+	"api_key":       true,
+	"apikey":        true,
+	"x-api-key":     true,
+	"authorization": true,
+	"password":      true,
+	"secret":        true,
+	"client_secret": true,
+	"token":         true,
+	"access_token":  true,
+	"refresh_token": true,
+	"session_key":   true,
+}
+
+var (
+	base64StringPattern  = regexp.MustCompile(`^[A-Za-z0-9+/_-]+={0,2}$`)
+	base64DataURIPattern = regexp.MustCompile(`data:[\w.+-]+/[\w.+-]+;base64,[A-Za-z0-9+/]+={0,2}`)
+	bearerTokenPattern   = regexp.MustCompile(`(?i)bearer\s+[A-Za-z0-9._~+/-]+=*`)
+	secretKeyPattern     = regexp.MustCompile(`sk-[A-Za-z0-9_-]{16,}`)
+)
+
+// LogCaptureService 请求体和响应体捕获服务
+// 按API Key或分组开启，脱敏、截断并压缩后单独保存，通过日志ID关联
+type LogCaptureService struct{}
+
+func NewLogCaptureService() *LogCaptureService {
+	return &LogCaptureService{}
+}
+
+// GetBodyCaptureLimit 获取API Key生效的捕获字节数，API Key未配置时使用分组配置
+// 返回0表示不捕获，-1表示完整捕获
+func GetBodyCaptureLimit(apiKey *model.ApiKey) int {
+	if apiKey == nil {
+		return 0
+	}
+
+	captureKB := apiKey.BodyCaptureKB
+	if captureKB == 0 {
+		captureKB = model.GetGroupBodyCaptureKB(apiKey.GroupID)
+	}
+	if captureKB < 0 {
+		return -1
+	}
+	return captureKB * 1024
+}
+
+// BodyCaptureRecordSize 根据捕获字节数确定需要记录的响应字节数，避免较小的捕获配置也按最大记录量占用内存
+// 非流式响应只需记录捕获字节数，流式响应记录其若干倍；完整捕获时按最大记录量记录
+func BodyCaptureRecordSize(limit int, stream bool) int {
+	if limit < 0 {
+		return MaxBodyCaptureRecordSize
+	}
+
+	size := limit
+	if stream {
+		size = limit * streamBodyCaptureRecordFactor
+	}
+	if size > MaxBodyCaptureRecordSize {
+		size = MaxBodyCaptureRecordSize
+	}
+	return size
+}
+
+// SaveLogCapture 保存与日志关联的请求体和响应体
+// 流式响应合并为完整的消息对象后保存，incomplete表示记录的响应超过上限只有部分内容
+func (s *LogCaptureService) SaveLogCapture(logID string, requestBody, responseBody []byte, limit int, incomplete bool) error {
+	if logID == "" || limit == 0 {
+		return nil
+	}
+
+	request := redactBody(requestBody)
+	response := redactBody(reassembleResponse(responseBody))
+
+	capture := &model.LogCapture{
+		LogID:        logID,
+		RequestSize:  len(request),
+		ResponseSize: len(response),
+		Truncated:    incomplete,
+	}
+
+	var truncated bool
+	request, truncated = truncateCapture(request, limit)
+	capture.Truncated = capture.Truncated || truncated
+	response, truncated = truncateCapture(response, limit)
+	capture.Truncated = capture.Truncated || truncated
+
+	var err error
+	if capture.RequestBody, err = compressCapture(request); err != nil {
+		return err
+	}
+	if capture.ResponseBody, err = compressCapture(response); err != nil {
+		return err
+	}
+	return model.CreateLogCapture(capture)
+}
+
+// GetLogCaptureDetail 获取日志关联的捕获内容，没有捕获时返回nil
+func (s *LogCaptureService) GetLogCaptureDetail(logID string) *model.LogCaptureDetail {
+	capture, err := model.GetLogCaptureByLogID(logID)
+	if err != nil {
+		return nil
+	}
+
+	requestBody, err := decompressCapture(capture.RequestBody)
+	if err != nil {
+		log.Printf("解压日志 %s 的请求体失败: %v", logID, err)
+		return nil
+	}
+	responseBody, err := decompressCapture(capture.ResponseBody)
+	if err != nil {
+		log.Printf("解压日志 %s 的响应体失败: %v", logID, err)
+		return nil
+	}
+
+	return &model.LogCaptureDetail{
+		RequestBody:  string(requestBody),
+		ResponseBody: string(responseBody),
+		RequestSize:  capture.RequestSize,
+		ResponseSize: capture.ResponseSize,
+		Truncated:    capture.Truncated,
+		CreatedAt:    capture.CreatedAt,
+	}
+}
+
+// DeleteExpiredLogCaptures 删除超过保留天数的捕获内容
+func (s *LogCaptureService) DeleteExpiredLogCaptures(days int) (int64, error) {
+	if days <= 0 {
+		days = defaultLogCaptureRetentionDays
+	}
+	return model.DeleteExpiredLogCaptures(days)
+}
+
+// GetLogCaptureRetentionDays 从环境变量获取捕获内容保留天数
+func GetLogCaptureRetentionDays() int {
+	if daysStr := os.Getenv("LOG_CAPTURE_RETENTION_DAYS"); daysStr != "" {
+		if days, err := strconv.Atoi(daysStr); err == nil && days > 0 {
+			return days
+		}
+	}
+	return defaultLogCaptureRetentionDays
+}
+
+// reassembleResponse 将SSE流式响应合并为完整的消息对象，流中的错误事件保存错误内容
+// 非流式响应或无法合并时保存原始内容
+func reassembleResponse(body []byte) []byte {
+	trimmed := bytes.TrimSpace(body)
+	if len(trimmed) == 0 || trimmed[0] == '{' {
+		return trimmed
+	}
+
+	messageJSON, streamErr, err := common.AggregateStreamResponse(trimmed)
+	if streamErr != nil {
+		return streamErr.Body
+	}
+	if err != nil {
+		return trimmed
+	}
+	return messageJSON
+}
+
+// redactBody 脱敏请求体或响应体：敏感字段和base64内容替换为占位符，文本中的密钥按格式替换
+func redactBody(body []byte) []byte {
+	if len(body) == 0 {
+		return body
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	var parsed interface{}
+	if err := decoder.Decode(&parsed); err == nil {
+		var buf bytes.Buffer
+		encoder := json.NewEncoder(&buf)
+		encoder.SetEscapeHTML(false)
+		if err := encoder.Encode(redactValue("", parsed)); err == nil {
+			body = bytes.TrimSuffix(buf.Bytes(), []byte("\n"))
+		}
+	}
+
+	body = base64DataURIPattern.ReplaceAllFunc(body, func(match []byte) []byte {
+		return []byte(fmt.Sprintf("[base64 %d bytes redacted]", len(match)))
+	})
+	body = bearerTokenPattern.ReplaceAll(body, []byte("Bearer "+redactedValue))
+	return secretKeyPattern.ReplaceAll(body, []byte(redactedValue))
+}
+
+func redactValue(key string, value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		// 图片、文档等内容块的base64数据
+		if v["type"] == "base64" {
+			if data, ok := v["data"].(string); ok {
+				v["data"] = fmt.Sprintf("[base64 %d bytes redacted]", len(data))
+			}
+		}
+		for k, item := range v {
+			v[k] = redactValue(k, item)
+		}
+		return v
+	case []interface{}:
+		for i, item := range v {
+			v[i] = redactValue(key, item)
+		}
+		return v
+	case string:
+		if sensitiveFieldNames[strings.ToLower(key)] {
+			return redactedValue
+		}
+		if len(v) >= minRedactedBase64Length && base64StringPattern.MatchString(v) {
+			return fmt.Sprintf("[base64 %d bytes redacted]", len(v))
+		}
+		return v
+	}
+	return value
+}
+
+// truncateCapture 截断为指定字节数，截断位置不拆分UTF-8字符；limit为-1时不截断
+func truncateCapture(body []byte, limit int) ([]byte, bool) {
+	if limit < 0 || len(body) <= limit {
+		return body, false
+	}
+
+	cut := limit
+	for cut > 0 && !utf8.RuneStart(body[cut]) {
+		cut--
+	}
+	return body[:cut], true
+}
+
+func compressCapture(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	if _, err := writer.Write(data); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decompressCapture(data []byte) ([]byte, error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return io.ReadAll(reader)
+}
@@ -4,6 +4,16 @@ import (
 	"claude-code-relay/common"
 	"claude-code-relay/model"
 	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 日志中记录的请求ID和User-Agent最大长度，与字段长度一致
+const (
+	maxLogRequestIDLength = 50
+	maxLogUserAgentLength = 500
 )
 
 type LogService struct{}
@@ -30,7 +40,7 @@ func (s *LogService) CreateLog(req *model.LogCreateRequest) (*model.Log, error)
 }
 
 // CreateLogFromTokenUsage 根据TokenUsage创建日志记录（推荐使用）
-func (s *LogService) CreateLogFromTokenUsage(usage *common.TokenUsage, userID, apiKeyID, accountID uint, duration int64, isStream bool) (*model.Log, error) {
+func (s *LogService) CreateLogFromTokenUsage(usage *common.TokenUsage, userID, apiKeyID, accountID uint, duration int64, isStream bool, info *model.RequestLogInfo) (*model.Log, error) {
 	if usage == nil {
 		return nil, errors.New("TokenUsage不能为空")
 	}
@@ -38,7 +48,7 @@ func (s *LogService) CreateLogFromTokenUsage(usage *common.TokenUsage, userID, a
 		return nil, errors.New("用户ID不能为空")
 	}
 
-	log, err := model.CreateLogFromTokenUsage(usage, userID, apiKeyID, accountID, duration, isStream)
+	log, err := model.CreateLogFromTokenUsage(usage, userID, apiKeyID, accountID, duration, isStream, info)
 	if err != nil {
 		return nil, errors.New("创建日志失败: " + err.Error())
 	}
@@ -46,8 +56,49 @@ func (s *LogService) CreateLogFromTokenUsage(usage *common.TokenUsage, userID, a
 	return log, nil
 }
 
-// GetLogById 根据ID获取日志
-func (s *LogService) GetLogById(id string) (*model.Log, error) {
+// CreateErrorLog 创建失败或被拒绝请求的日志记录
+// 从错误响应体中提取错误消息，未指定错误类型时根据上游错误类型和状态码归一化
+// 鉴权失败的请求没有对应的用户，用户ID可以为空
+func (s *LogService) CreateErrorLog(req *model.LogCreateRequest, responseBody []byte) (*model.Log, error) {
+	if req.StatusCode < http.StatusBadRequest {
+		return nil, errors.New("状态码不是错误状态码")
+	}
+
+	upstreamType, message := common.ParseErrorResponse(responseBody)
+	if req.ErrorType == "" {
+		req.ErrorType = common.NormalizeErrorType(req.StatusCode, upstreamType)
+	}
+	if req.ErrorMessage == "" {
+		req.ErrorMessage = message
+	}
+
+	log, err := model.CreateLog(req)
+	if err != nil {
+		return nil, errors.New("创建日志失败: " + err.Error())
+	}
+
+	return log, nil
+}
+
+// NewRequestLogInfo 从请求上下文中获取日志记录的请求来源信息
+// 请求ID和User-Agent来自客户端，超过字段长度的部分截断
+func NewRequestLogInfo(c *gin.Context) *model.RequestLogInfo {
+	return &model.RequestLogInfo{
+		RequestID: truncateLogField(c.GetString("request_id"), maxLogRequestIDLength),
+		ClientIP:  c.ClientIP(),
+		UserAgent: truncateLogField(c.Request.UserAgent(), maxLogUserAgentLength),
+	}
+}
+
+func truncateLogField(value string, maxLength int) string {
+	if len(value) > maxLength {
+		return strings.ToValidUTF8(value[:maxLength], "")
+	}
+	return value
+}
+
+// GetLogById 根据ID获取日志，userID不为nil时只能获取该用户的日志
+func (s *LogService) GetLogById(id string, userID *uint) (*model.Log, error) {
 	if id == "" {
 		return nil, errors.New("日志ID不能为空")
 	}
@@ -56,7 +107,11 @@ func (s *LogService) GetLogById(id string) (*model.Log, error) {
 	if err != nil {
 		return nil, errors.New("获取日志失败")
 	}
+	if userID != nil && log.UserID != *userID {
+		return nil, errors.New("日志不存在")
+	}
 
+	log.Capture = NewLogCaptureService().GetLogCaptureDetail(log.ID)
 	return log, nil
 }
 
@@ -0,0 +1,435 @@
+package service
+
+import (
+	"claude-code-relay/common"
+	"claude-code-relay/model"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	// 默认代理连通性检测地址，只要能收到HTTP响应即视为代理可用
+	defaultProxyCheckURL = "https://api.anthropic.com"
+	// 代理检测超时时间
+	proxyCheckTimeout = 10 * time.Second
+	// 代理批量检测的最大并发数
+	proxyCheckConcurrency = 10
+	// 代理的进程内缓存时长，本实例修改代理后立即失效，其他实例最多延迟该时长生效
+	proxyCacheTTL = time.Minute
+)
+
+// ProxyService 代理池服务
+type ProxyService struct{}
+
+func NewProxyService() *ProxyService {
+	return &ProxyService{}
+}
+
+// 解析账号代理使用的代理快照，避免每次请求和重试都查询代理表
+var proxyCache struct {
+	sync.RWMutex
+	proxies  map[uint]model.Proxy   // 按ID索引的所有代理
+	groups   map[uint][]model.Proxy // 按代理分组索引的启用代理，按ID升序
+	loadedAt time.Time
+}
+
+// GetProxyList 获取代理列表
+func (s *ProxyService) GetProxyList(page, limit int, userID *uint, proxyGroupID uint) (*model.ProxyListResult, error) {
+	if page < 1 {
+		page = 1
+	}
+	if limit < 1 || limit > 100 {
+		limit = 10
+	}
+
+	proxies, total, err := model.GetProxyList(page, limit, userID, proxyGroupID)
+	if err != nil {
+		return nil, errors.New("获取代理列表失败")
+	}
+
+	return &model.ProxyListResult{
+		Proxies: proxies,
+		Total:   total,
+		Page:    page,
+		Limit:   limit,
+	}, nil
+}
+
+// GetProxyByID 获取代理详情
+func (s *ProxyService) GetProxyByID(id uint, userID *uint) (*model.Proxy, error) {
+	proxy, err := model.GetProxyByID(id, userID)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, errors.New("代理不存在")
+		}
+		return nil, errors.New("获取代理失败")
+	}
+	return proxy, nil
+}
+
+// CreateProxy 创建代理
+func (s *ProxyService) CreateProxy(req *model.CreateProxyRequest, userID uint) (*model.Proxy, error) {
+	if req.ProxyGroupID > 0 {
+		if _, err := model.GetProxyGroupByID(req.ProxyGroupID, &userID); err != nil {
+			return nil, errors.New("代理分组不存在")
+		}
+	}
+
+	proxy := &model.Proxy{
+		Name:         req.Name,
+		Type:         req.Type,
+		Host:         strings.TrimSpace(req.Host),
+		Port:         req.Port,
+		Username:     req.Username,
+		Password:     req.Password,
+		ProxyGroupID: req.ProxyGroupID,
+		Remark:       req.Remark,
+		Status:       req.Status,
+		UserID:       userID,
+	}
+	if proxy.Status == 0 {
+		proxy.Status = 1
+	}
+	if proxy.Username == "" {
+		proxy.Password = ""
+	}
+
+	if err := model.CreateProxy(proxy); err != nil {
+		return nil, errors.New("创建代理失败")
+	}
+	invalidateProxyCache()
+	proxy.HasPassword = proxy.Password != ""
+
+	return proxy, nil
+}
+
+// UpdateProxy 更新代理，代理地址变更后所有引用该代理的账号自动生效
+func (s *ProxyService) UpdateProxy(id uint, req *model.UpdateProxyRequest, userID *uint) (*model.Proxy, error) {
+	proxy, err := s.GetProxyByID(id, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if req.ProxyGroupID > 0 && req.ProxyGroupID != proxy.ProxyGroupID {
+		ownerID := proxy.UserID
+		if _, err := model.GetProxyGroupByID(req.ProxyGroupID, &ownerID); err != nil {
+			return nil, errors.New("代理分组不存在")
+		}
+	}
+
+	previousURI := proxy.URI()
+
+	proxy.Name = req.Name
+	proxy.Type = req.Type
+	proxy.Host = strings.TrimSpace(req.Host)
+	proxy.Port = req.Port
+	proxy.Username = req.Username
+	proxy.ProxyGroupID = req.ProxyGroupID
+	proxy.Remark = req.Remark
+	proxy.Status = req.Status
+	if req.Password != "" {
+		proxy.Password = req.Password
+	}
+	if proxy.Username == "" {
+		proxy.Password = ""
+	}
+
+	// 代理地址变更后需要重新检测
+	if proxy.URI() != previousURI {
+		proxy.HealthStatus = model.ProxyHealthUnknown
+		proxy.LastError = ""
+	}
+
+	if err := model.UpdateProxy(proxy); err != nil {
+		return nil, errors.New("更新代理失败")
+	}
+	invalidateProxyCache()
+
+	if proxy.URI() != previousURI {
+		common.InvalidateTransportsByProxy(previousURI)
+	}
+	proxy.HasPassword = proxy.Password != ""
+
+	return proxy, nil
+}
+
+// DeleteProxy 删除代理，被账号引用时不允许删除
+func (s *ProxyService) DeleteProxy(id uint, userID *uint) error {
+	proxy, err := s.GetProxyByID(id, userID)
+	if err != nil {
+		return err
+	}
+
+	if model.CountAccountsByProxy(proxy.ID, 0) > 0 {
+		return errors.New("代理正在被账号使用，无法删除")
+	}
+
+	if err := model.DeleteProxy(proxy.ID); err != nil {
+		return errors.New("删除代理失败")
+	}
+	invalidateProxyCache()
+
+	common.InvalidateTransportsByProxy(proxy.URI())
+	return nil
+}
+
+// GetProxyGroups 获取代理分组列表
+func (s *ProxyService) GetProxyGroups(userID *uint) ([]model.ProxyGroup, error) {
+	groups, err := model.GetProxyGroups(userID)
+	if err != nil {
+		return nil, errors.New("获取代理分组列表失败")
+	}
+	return groups, nil
+}
+
+// CreateProxyGroup 创建代理分组
+func (s *ProxyService) CreateProxyGroup(req *model.ProxyGroupRequest, userID uint) (*model.ProxyGroup, error) {
+	group := &model.ProxyGroup{
+		Name:   req.Name,
+		Remark: req.Remark,
+		UserID: userID,
+	}
+	if err := model.CreateProxyGroup(group); err != nil {
+		return nil, errors.New("创建代理分组失败")
+	}
+	return group, nil
+}
+
+// UpdateProxyGroup 更新代理分组
+func (s *ProxyService) UpdateProxyGroup(id uint, req *model.ProxyGroupRequest, userID *uint) (*model.ProxyGroup, error) {
+	group, err := model.GetProxyGroupByID(id, userID)
+	if err != nil {
+		return nil, errors.New("代理分组不存在")
+	}
+
+	group.Name = req.Name
+	group.Remark = req.Remark
+	if err := model.UpdateProxyGroup(group); err != nil {
+		return nil, errors.New("更新代理分组失败")
+	}
+	invalidateProxyCache()
+	return group, nil
+}
+
+// DeleteProxyGroup 删除代理分组，分组内有代理或被账号引用时不允许删除
+func (s *ProxyService) DeleteProxyGroup(id uint, userID *uint) error {
+	group, err := model.GetProxyGroupByID(id, userID)
+	if err != nil {
+		return errors.New("代理分组不存在")
+	}
+
+	if model.CountAccountsByProxy(0, group.ID) > 0 {
+		return errors.New("代理分组正在被账号使用，无法删除")
+	}
+	if model.CountProxiesByGroupID(group.ID) > 0 {
+		return errors.New("代理分组中还有代理，无法删除")
+	}
+
+	if err := model.DeleteProxyGroup(group.ID); err != nil {
+		return errors.New("删除代理分组失败")
+	}
+	invalidateProxyCache()
+	return nil
+}
+
+// ValidateAccountProxy 校验账号引用的代理或代理分组是否存在且属于账号所有者
+func (s *ProxyService) ValidateAccountProxy(proxyID, proxyGroupID uint, userID uint) error {
+	if proxyID > 0 && proxyGroupID > 0 {
+		return errors.New("代理和代理分组只能选择一个")
+	}
+	if proxyID > 0 {
+		if _, err := model.GetProxyByID(proxyID, &userID); err != nil {
+			return errors.New("代理不存在")
+		}
+	}
+	if proxyGroupID > 0 {
+		if _, err := model.GetProxyGroupByID(proxyGroupID, &userID); err != nil {
+			return errors.New("代理分组不存在")
+		}
+	}
+	return nil
+}
+
+// ResolveAccountProxyURI 获取账号实际使用的代理地址
+// 优先使用账号关联的代理或代理分组；都未关联时返回账号上配置的代理URI
+// 代理分组内按账号ID固定选择一个健康的代理，保证同一账号的出口IP稳定
+// 代理数据使用进程内缓存，本实例修改代理或代理分组时立即失效
+func (s *ProxyService) ResolveAccountProxyURI(account *model.Account, legacyProxyURI string) (string, error) {
+	if account.ProxyID == 0 && account.ProxyGroupID == 0 {
+		return legacyProxyURI, nil
+	}
+
+	proxiesByID, proxiesByGroup := cachedProxies()
+
+	if account.ProxyID > 0 {
+		proxy, exists := proxiesByID[account.ProxyID]
+		if !exists {
+			return "", fmt.Errorf("账号关联的代理 %d 不存在", account.ProxyID)
+		}
+		if proxy.Status != 1 {
+			return "", fmt.Errorf("账号关联的代理 %s 已禁用", proxy.Name)
+		}
+		return proxy.URI(), nil
+	}
+
+	if account.ProxyGroupID > 0 {
+		proxies := proxiesByGroup[account.ProxyGroupID]
+		if len(proxies) == 0 {
+			return "", fmt.Errorf("账号关联的代理分组 %d 中没有可用代理", account.ProxyGroupID)
+		}
+
+		var healthy []model.Proxy
+		for _, proxy := range proxies {
+			if proxy.HealthStatus != model.ProxyHealthUnhealthy {
+				healthy = append(healthy, proxy)
+			}
+		}
+		// 全部异常时仍然在所有启用的代理中选择，避免直接中断服务
+		if len(healthy) == 0 {
+			healthy = proxies
+		}
+
+		return healthy[int(account.ID)%len(healthy)].URI(), nil
+	}
+
+	return legacyProxyURI, nil
+}
+
+func invalidateProxyCache() {
+	proxyCache.Lock()
+	proxyCache.proxies = nil
+	proxyCache.groups = nil
+	proxyCache.loadedAt = time.Time{}
+	proxyCache.Unlock()
+}
+
+// cachedProxies 获取按ID和代理分组索引的代理（带进程内缓存），查询失败时沿用上次的数据
+func cachedProxies() (map[uint]model.Proxy, map[uint][]model.Proxy) {
+	proxyCache.RLock()
+	if !proxyCache.loadedAt.IsZero() && time.Since(proxyCache.loadedAt) < proxyCacheTTL {
+		proxies, groups := proxyCache.proxies, proxyCache.groups
+		proxyCache.RUnlock()
+		return proxies, groups
+	}
+	proxyCache.RUnlock()
+
+	proxyCache.Lock()
+	defer proxyCache.Unlock()
+
+	proxies, err := model.GetAllProxies()
+	if err != nil {
+		log.Printf("加载代理失败: %v", err)
+		return proxyCache.proxies, proxyCache.groups
+	}
+
+	proxyCache.proxies = make(map[uint]model.Proxy, len(proxies))
+	proxyCache.groups = make(map[uint][]model.Proxy)
+	for _, proxy := range proxies {
+		proxyCache.proxies[proxy.ID] = proxy
+		if proxy.ProxyGroupID > 0 && proxy.Status == 1 {
+			proxyCache.groups[proxy.ProxyGroupID] = append(proxyCache.groups[proxy.ProxyGroupID], proxy)
+		}
+	}
+	proxyCache.loadedAt = time.Now()
+	return proxyCache.proxies, proxyCache.groups
+}
+
+// CheckProxy 检测单个代理的连通性并保存结果
+func (s *ProxyService) CheckProxy(proxy *model.Proxy) {
+	startTime := time.Now()
+	err := checkProxyConnectivity(proxy.URI())
+	latency := int(time.Since(startTime).Milliseconds())
+
+	healthStatus := model.ProxyHealthHealthy
+	lastError := ""
+	if err != nil {
+		healthStatus = model.ProxyHealthUnhealthy
+		lastError = err.Error()
+		log.Printf("代理 %s (%s) 检测失败: %v", proxy.Name, proxy.DisplayAddress(), err)
+	}
+
+	checkTime := model.Time(time.Now())
+	if updateErr := model.UpdateProxyHealth(proxy.ID, healthStatus, latency, lastError, checkTime); updateErr != nil {
+		log.Printf("保存代理 %s 检测结果失败: %v", proxy.Name, updateErr)
+	} else if healthStatus != proxy.HealthStatus {
+		// 健康状态影响代理分组内的代理选择
+		invalidateProxyCache()
+	}
+
+	proxy.HealthStatus = healthStatus
+	proxy.LastLatency = latency
+	proxy.LastError = lastError
+	proxy.LastCheckTime = &checkTime
+}
+
+// CheckAllProxies 并发检测所有启用的代理
+func (s *ProxyService) CheckAllProxies() (healthy int, unhealthy int, err error) {
+	proxies, err := model.GetEnabledProxies()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	semaphore := make(chan struct{}, proxyCheckConcurrency)
+
+	for i := range proxies {
+		wg.Add(1)
+		semaphore <- struct{}{}
+		go func(proxy *model.Proxy) {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+
+			s.CheckProxy(proxy)
+
+			mu.Lock()
+			if proxy.HealthStatus == model.ProxyHealthHealthy {
+				healthy++
+			} else {
+				unhealthy++
+			}
+			mu.Unlock()
+		}(&proxies[i])
+	}
+	wg.Wait()
+
+	return healthy, unhealthy, nil
+}
+
+// checkProxyConnectivity 通过代理请求检测地址，能收到任意HTTP响应即视为可用
+func checkProxyConnectivity(proxyURI string) error {
+	proxyURL, err := url.Parse(proxyURI)
+	if err != nil {
+		return fmt.Errorf("代理地址无效: %v", err)
+	}
+
+	checkURL := os.Getenv("PROXY_CHECK_URL")
+	if checkURL == "" {
+		checkURL = defaultProxyCheckURL
+	}
+
+	// 每次检测使用独立连接，避免复用的空闲连接掩盖代理故障
+	client := &http.Client{
+		Timeout: proxyCheckTimeout,
+		Transport: &http.Transport{
+			Proxy:             http.ProxyURL(proxyURL),
+			DisableKeepAlives: true,
+		},
+	}
+
+	resp, err := client.Get(checkURL)
+	if err != nil {
+		return err
+	}
+	common.CloseIO(resp.Body)
+	return nil
+}
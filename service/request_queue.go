@@ -0,0 +1,157 @@
+package service
+
+import (
+	"claude-code-relay/model"
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// 排队轮询间隔：队首请求在未收到唤醒通知时按此间隔重新检查账号可用性
+const requestQueuePollInterval = 500 * time.Millisecond
+
+var (
+	ErrQueueFull    = errors.New("排队请求数已达上限")
+	ErrQueueTimeout = errors.New("排队等待超时")
+)
+
+// RequestQueueService 分组请求排队服务
+// 分组内没有可用账号时请求进入队列等待，只有队首请求会检查账号是否可用，保证排队顺序
+type RequestQueueService struct {
+	mu     sync.Mutex
+	queues map[int]*groupQueue
+}
+
+type groupQueue struct {
+	waiters []*queueWaiter
+}
+
+type queueWaiter struct {
+	priority int
+	wake     chan struct{}
+}
+
+var requestQueueService = &RequestQueueService{queues: make(map[int]*groupQueue)}
+
+func NewRequestQueueService() *RequestQueueService {
+	return requestQueueService
+}
+
+// Wait 在分组队列中等待，直到available返回true、等待超时或客户端断开
+// 队列为空且available直接返回true时不会进入队列
+func (s *RequestQueueService) Wait(ctx context.Context, groupID int, priority int, config model.GroupQueueConfig, available func() bool) error {
+	if config.MaxWait <= 0 {
+		return ErrQueueTimeout
+	}
+	if s.Depth(groupID) == 0 && available() {
+		return nil
+	}
+	if config.Mode != model.GroupQueueModePriority {
+		priority = 0
+	}
+
+	waiter, err := s.enqueue(groupID, priority, config.MaxDepth)
+	if err != nil {
+		return err
+	}
+	defer s.remove(groupID, waiter)
+
+	timer := time.NewTimer(time.Duration(config.MaxWait) * time.Second)
+	defer timer.Stop()
+	ticker := time.NewTicker(requestQueuePollInterval)
+	defer ticker.Stop()
+
+	for {
+		if s.isHead(groupID, waiter) && available() {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+			return ErrQueueTimeout
+		case <-waiter.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// Depth 获取分组当前排队请求数
+func (s *RequestQueueService) Depth(groupID int) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if queue, ok := s.queues[groupID]; ok {
+		return len(queue.waiters)
+	}
+	return 0
+}
+
+// enqueue 加入队列，按优先级从高到低、同优先级按到达顺序排列
+func (s *RequestQueueService) enqueue(groupID int, priority int, maxDepth int) (*queueWaiter, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	queue, ok := s.queues[groupID]
+	if !ok {
+		queue = &groupQueue{}
+		s.queues[groupID] = queue
+	}
+	if maxDepth > 0 && len(queue.waiters) >= maxDepth {
+		return nil, ErrQueueFull
+	}
+
+	waiter := &queueWaiter{priority: priority, wake: make(chan struct{}, 1)}
+
+	position := len(queue.waiters)
+	for i, existing := range queue.waiters {
+		if priority > existing.priority {
+			position = i
+			break
+		}
+	}
+	queue.waiters = append(queue.waiters, nil)
+	copy(queue.waiters[position+1:], queue.waiters[position:])
+	queue.waiters[position] = waiter
+
+	return waiter, nil
+}
+
+// remove 移出队列，并唤醒新的队首立即检查账号可用性
+func (s *RequestQueueService) remove(groupID int, waiter *queueWaiter) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	queue, ok := s.queues[groupID]
+	if !ok {
+		return
+	}
+
+	for i, existing := range queue.waiters {
+		if existing == waiter {
+			queue.waiters = append(queue.waiters[:i], queue.waiters[i+1:]...)
+			break
+		}
+	}
+
+	if len(queue.waiters) == 0 {
+		delete(s.queues, groupID)
+		return
+	}
+
+	select {
+	case queue.waiters[0].wake <- struct{}{}:
+	default:
+	}
+}
+
+// isHead 判断是否位于队首
+func (s *RequestQueueService) isHead(groupID int, waiter *queueWaiter) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	queue, ok := s.queues[groupID]
+	return ok && len(queue.waiters) > 0 && queue.waiters[0] == waiter
+}
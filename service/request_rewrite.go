@@ -0,0 +1,303 @@
+package service
+
+import (
+	"claude-code-relay/constant"
+	"claude-code-relay/model"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// 请求改写规则操作类型
+const (
+	RewriteOpSet           = "set"            // 设置path的值
+	RewriteOpDelete        = "delete"         // 删除path字段
+	RewriteOpClamp         = "clamp"          // 将path的数值限制在min和max之间
+	RewriteOpPrependSystem = "prepend_system" // 在系统提示词之前插入文本
+	RewriteOpAppendSystem  = "append_system"  // 在系统提示词之后追加文本
+	RewriteOpRemoveTools   = "remove_tools"   // 按名称移除工具定义
+)
+
+// 单个分组最多配置的改写规则数
+const maxRewriteRules = 50
+
+// ErrInvalidRewriteRule 改写规则校验失败，具体原因包装在错误信息中
+var ErrInvalidRewriteRule = errors.New("改写规则无效")
+
+// RewriteRule 请求改写规则，按配置顺序作用于Claude格式的请求体
+type RewriteRule struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path,omitempty"`  // set/delete/clamp的字段路径，使用gjson/sjson路径语法
+	Value json.RawMessage `json:"value,omitempty"` // set的JSON值；prepend_system/append_system的文本
+	Min   *float64        `json:"min,omitempty"`
+	Max   *float64        `json:"max,omitempty"`
+	Names []string        `json:"names,omitempty"` // remove_tools要移除的工具名称
+}
+
+// ParseRewriteRules 解析并校验改写规则，空字符串表示没有规则
+func ParseRewriteRules(raw string) ([]RewriteRule, error) {
+	if strings.TrimSpace(raw) == "" {
+		return nil, nil
+	}
+
+	var rules []RewriteRule
+	if err := json.Unmarshal([]byte(raw), &rules); err != nil {
+		return nil, fmt.Errorf("%w: 格式错误", ErrInvalidRewriteRule)
+	}
+	if len(rules) > maxRewriteRules {
+		return nil, fmt.Errorf("%w: 规则数量超出限制(%d)", ErrInvalidRewriteRule, maxRewriteRules)
+	}
+
+	for i, rule := range rules {
+		if err := validateRewriteRule(rule); err != nil {
+			return nil, fmt.Errorf("%w: 第%d条规则%v", ErrInvalidRewriteRule, i+1, err)
+		}
+	}
+	return rules, nil
+}
+
+// normalizeRewriteRules 校验改写规则并返回用于保存的规范化JSON
+func normalizeRewriteRules(raw string) (string, error) {
+	rules, err := ParseRewriteRules(raw)
+	if err != nil || len(rules) == 0 {
+		return "", err
+	}
+
+	normalized, err := json.Marshal(rules)
+	if err != nil {
+		return "", fmt.Errorf("%w: 格式错误", ErrInvalidRewriteRule)
+	}
+	return string(normalized), nil
+}
+
+// validateRewriteRule 校验单条改写规则，错误由ParseRewriteRules统一包装为ErrInvalidRewriteRule
+func validateRewriteRule(rule RewriteRule) error {
+	switch rule.Op {
+	case RewriteOpSet, RewriteOpDelete, RewriteOpClamp:
+		if !isValidRewritePath(rule.Path) {
+			return errors.New("无效的改写路径")
+		}
+	case RewriteOpPrependSystem, RewriteOpAppendSystem, RewriteOpRemoveTools:
+	default:
+		return errors.New("不支持的改写操作")
+	}
+
+	switch rule.Op {
+	case RewriteOpSet:
+		if len(rule.Value) == 0 || !json.Valid(rule.Value) {
+			return errors.New("无效的改写值")
+		}
+	case RewriteOpClamp:
+		if rule.Min == nil && rule.Max == nil || rule.Min != nil && rule.Max != nil && *rule.Min > *rule.Max {
+			return errors.New("无效的取值范围")
+		}
+	case RewriteOpPrependSystem, RewriteOpAppendSystem:
+		var text string
+		if err := json.Unmarshal(rule.Value, &text); err != nil || strings.TrimSpace(text) == "" {
+			return errors.New("系统提示词不能为空")
+		}
+	case RewriteOpRemoveTools:
+		if len(rule.Names) == 0 {
+			return errors.New("未指定要移除的工具")
+		}
+	}
+	return nil
+}
+
+// isValidRewritePath 只允许sjson可写的简单路径，不允许通配符、查询和修饰符
+func isValidRewritePath(path string) bool {
+	if path == "" || strings.HasPrefix(path, ".") || strings.HasSuffix(path, ".") || strings.Contains(path, "..") {
+		return false
+	}
+	return !strings.ContainsAny(path, "*?#@|{}[]!=<>,")
+}
+
+// ApplyRewriteRules 按顺序将改写规则应用到请求体
+func ApplyRewriteRules(body []byte, rules []RewriteRule) ([]byte, error) {
+	if len(rules) == 0 {
+		return body, nil
+	}
+	if !gjson.ValidBytes(body) {
+		return nil, errors.New("请求体不是有效的JSON")
+	}
+
+	var err error
+	for _, rule := range rules {
+		switch rule.Op {
+		case RewriteOpSet:
+			body, err = sjson.SetRawBytes(body, rule.Path, rule.Value)
+		case RewriteOpDelete:
+			body, err = sjson.DeleteBytes(body, rule.Path)
+		case RewriteOpClamp:
+			body, err = clampNumber(body, rule.Path, rule.Min, rule.Max)
+		case RewriteOpPrependSystem, RewriteOpAppendSystem:
+			var text string
+			_ = json.Unmarshal(rule.Value, &text)
+			body, err = insertSystemPrompt(body, text, rule.Op == RewriteOpPrependSystem)
+		case RewriteOpRemoveTools:
+			body, err = removeTools(body, rule.Names)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return body, nil
+}
+
+// ApplyGroupRewriteRules 应用分组配置的改写规则，规则无效或改写失败时返回原请求体
+func ApplyGroupRewriteRules(groupID int, body []byte) []byte {
+	rawRules := model.GetGroupRewriteRules(groupID)
+	if rawRules == "" {
+		return body
+	}
+
+	rules, err := ParseRewriteRules(rawRules)
+	if err != nil {
+		log.Printf("分组 %d 的请求改写规则无效: %v", groupID, err)
+		return body
+	}
+
+	rewritten, err := ApplyRewriteRules(body, rules)
+	if err != nil {
+		log.Printf("分组 %d 请求改写失败: %v", groupID, err)
+		return body
+	}
+	return rewritten
+}
+
+// PreviewRewriteRules 预览改写结果，不发送请求
+func PreviewRewriteRules(req *model.RewritePreviewRequest, userID uint) (json.RawMessage, error) {
+	var rawRules string
+	if req.RewriteRules != nil {
+		rawRules = *req.RewriteRules
+	} else {
+		group, err := GetGroup(strconv.Itoa(req.GroupID), userID)
+		if err != nil {
+			return nil, err
+		}
+		rawRules = group.RewriteRules
+	}
+
+	rules, err := ParseRewriteRules(rawRules)
+	if err != nil {
+		return nil, err
+	}
+	if !gjson.ValidBytes(req.Body) {
+		return nil, errors.New("请求体不是有效的JSON")
+	}
+
+	rewritten, err := ApplyRewriteRules(req.Body, rules)
+	if err != nil {
+		return nil, err
+	}
+	return rewritten, nil
+}
+
+// clampNumber 将数值字段限制在范围内，字段不存在或不是数值时不处理
+func clampNumber(body []byte, path string, min, max *float64) ([]byte, error) {
+	value := gjson.GetBytes(body, path)
+	if value.Type != gjson.Number {
+		return body, nil
+	}
+
+	clamped := value.Num
+	if min != nil && clamped < *min {
+		clamped = *min
+	}
+	if max != nil && clamped > *max {
+		clamped = *max
+	}
+	if clamped == value.Num {
+		return body, nil
+	}
+	return sjson.SetBytes(body, path, clamped)
+}
+
+// insertSystemPrompt 在系统提示词前后插入文本
+// 数组形式的系统提示词以独立文本块插入，保留原有块的cache_control；Claude Code身份提示词保持在第一位
+func insertSystemPrompt(body []byte, text string, prepend bool) ([]byte, error) {
+	system := gjson.GetBytes(body, "system")
+	if !system.Exists() || system.Type == gjson.Null || system.Type == gjson.String && system.Str == "" {
+		return sjson.SetBytes(body, "system", text)
+	}
+
+	var blocks []string
+	switch {
+	case system.Type == gjson.String:
+		if !prepend || !strings.HasPrefix(system.Str, constant.ClaudeCodeSystemPrompt) {
+			if prepend {
+				return sjson.SetBytes(body, "system", text+"\n\n"+system.Str)
+			}
+			return sjson.SetBytes(body, "system", system.Str+"\n\n"+text)
+		}
+		// 身份提示词为字符串时拆分为文本块，便于在其后插入
+		identityBlock, _ := json.Marshal(map[string]string{"type": "text", "text": system.Str})
+		blocks = []string{string(identityBlock)}
+	case system.IsArray():
+		for _, block := range system.Array() {
+			blocks = append(blocks, block.Raw)
+		}
+	default:
+		return body, nil
+	}
+
+	insertAt := len(blocks)
+	if prepend {
+		insertAt = 0
+		if len(blocks) > 0 && strings.HasPrefix(gjson.Get(blocks[0], "text").String(), constant.ClaudeCodeSystemPrompt) {
+			insertAt = 1
+		}
+	}
+
+	newBlock, _ := json.Marshal(map[string]string{"type": "text", "text": text})
+	blocks = append(blocks[:insertAt], append([]string{string(newBlock)}, blocks[insertAt:]...)...)
+	return sjson.SetRawBytes(body, "system", []byte("["+strings.Join(blocks, ",")+"]"))
+}
+
+// removeTools 按名称移除工具定义，工具全部移除时一并删除tool_choice
+func removeTools(body []byte, names []string) ([]byte, error) {
+	tools := gjson.GetBytes(body, "tools")
+	if !tools.IsArray() {
+		return body, nil
+	}
+
+	removed := make(map[string]bool)
+	for _, name := range names {
+		removed[name] = true
+	}
+
+	var kept []string
+	for _, tool := range tools.Array() {
+		if removed[tool.Get("name").String()] {
+			continue
+		}
+		kept = append(kept, tool.Raw)
+	}
+	if len(kept) == len(tools.Array()) {
+		return body, nil
+	}
+
+	var err error
+	if len(kept) == 0 {
+		if body, err = sjson.DeleteBytes(body, "tools"); err != nil {
+			return nil, err
+		}
+		return sjson.DeleteBytes(body, "tool_choice")
+	}
+
+	if body, err = sjson.SetRawBytes(body, "tools", []byte("["+strings.Join(kept, ",")+"]")); err != nil {
+		return nil, err
+	}
+	// 强制调用的工具被移除时改为由模型自动选择
+	toolChoice := gjson.GetBytes(body, "tool_choice")
+	if toolChoice.Get("type").String() == "tool" && removed[toolChoice.Get("name").String()] {
+		return sjson.SetRawBytes(body, "tool_choice", []byte(`{"type":"auto"}`))
+	}
+	return body, nil
+}
@@ -0,0 +1,228 @@
+package service
+
+import (
+	"bytes"
+	"claude-code-relay/common"
+	"claude-code-relay/model"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+// 默认单条响应缓存的最大字节数
+const defaultResponseCacheMaxEntrySize = 1 << 20
+
+// 参与缓存键计算的请求字段，metadata等与生成结果无关的字段不参与
+var responseCacheKeyFields = []string{
+	"model", "system", "messages", "tools", "tool_choice", "thinking",
+	"max_tokens", "temperature", "top_p", "top_k", "stop_sequences", "stream",
+}
+
+// CachedResponse 缓存的完整响应
+// 流式响应按SSE事件保存，回放时逐个事件输出；非流式响应保存完整的JSON
+type CachedResponse struct {
+	Stream                   bool     `json:"stream"`
+	Events                   []string `json:"events,omitempty"`
+	Body                     string   `json:"body,omitempty"`
+	Model                    string   `json:"model"`
+	InputTokens              int      `json:"input_tokens"`
+	OutputTokens             int      `json:"output_tokens"`
+	CacheReadInputTokens     int      `json:"cache_read_input_tokens"`
+	CacheCreationInputTokens int      `json:"cache_creation_input_tokens"`
+	CreatedAt                int64    `json:"created_at"`
+}
+
+// ResponseCacheService 精确匹配的响应缓存服务
+// 按API Key开启，相同的模型、消息、系统提示词、工具和采样参数直接返回缓存的响应，不请求上游
+type ResponseCacheService struct{}
+
+func NewResponseCacheService() *ResponseCacheService {
+	return &ResponseCacheService{}
+}
+
+// CacheKey 计算请求的缓存键，API Key未开启响应缓存、请求体无效或请求不是确定性采样时返回空字符串
+func (s *ResponseCacheService) CacheKey(apiKey *model.ApiKey, body []byte) string {
+	if common.RDB == nil || apiKey == nil || apiKey.ResponseCacheTTL <= 0 || !gjson.ValidBytes(body) {
+		return ""
+	}
+
+	// 只缓存temperature显式为0的请求，未指定时上游默认为1.0，每次生成的结果不同
+	if temperature := gjson.GetBytes(body, "temperature"); temperature.Type != gjson.Number || temperature.Float() != 0 {
+		return ""
+	}
+
+	// 解析后重新序列化，使字段顺序和空白不影响缓存键
+	canonical := make(map[string]interface{}, len(responseCacheKeyFields))
+	for _, field := range responseCacheKeyFields {
+		value := gjson.GetBytes(body, field)
+		if !value.Exists() {
+			continue
+		}
+		decoder := json.NewDecoder(strings.NewReader(value.Raw))
+		decoder.UseNumber()
+		var parsed interface{}
+		if err := decoder.Decode(&parsed); err != nil {
+			return ""
+		}
+		canonical[field] = parsed
+	}
+
+	data, err := json.Marshal(canonical)
+	if err != nil {
+		return ""
+	}
+	hash := sha256.Sum256(data)
+	return fmt.Sprintf("response_cache:%d:%s", apiKey.ID, hex.EncodeToString(hash[:]))
+}
+
+// Get 获取缓存的响应，未命中返回nil
+func (s *ResponseCacheService) Get(cacheKey string) *CachedResponse {
+	if common.RDB == nil || cacheKey == "" {
+		return nil
+	}
+
+	data, err := common.RDB.Get(context.Background(), cacheKey).Bytes()
+	if err != nil {
+		return nil
+	}
+
+	var cached CachedResponse
+	if err := json.Unmarshal(data, &cached); err != nil {
+		return nil
+	}
+	return &cached
+}
+
+// Store 保存完整的成功响应，不完整、出错或超过大小上限的响应不缓存
+// modelName为请求的模型，响应中没有模型名称时使用
+func (s *ResponseCacheService) Store(cacheKey string, ttl int, modelName string, body []byte) {
+	if common.RDB == nil || cacheKey == "" || ttl <= 0 || len(body) > GetResponseCacheMaxEntrySize() {
+		return
+	}
+
+	cached := parseCacheableResponse(body)
+	if cached == nil {
+		return
+	}
+	if cached.Model == "" {
+		cached.Model = modelName
+	}
+	cached.CreatedAt = time.Now().Unix()
+
+	data, err := json.Marshal(cached)
+	if err != nil {
+		return
+	}
+	if err := common.RDB.Set(context.Background(), cacheKey, data, time.Duration(ttl)*time.Second).Err(); err != nil {
+		log.Printf("保存响应缓存失败: %v", err)
+	}
+}
+
+// LogCacheHit 记录缓存命中的请求日志，未请求上游因此费用为0
+func (s *ResponseCacheService) LogCacheHit(apiKey *model.ApiKey, cached *CachedResponse, duration int64, info *model.RequestLogInfo) {
+	logReq := &model.LogCreateRequest{
+		ModelName:                cached.Model,
+		UserID:                   apiKey.UserID,
+		ApiKeyID:                 apiKey.ID,
+		InputTokens:              cached.InputTokens,
+		OutputTokens:             cached.OutputTokens,
+		CacheReadInputTokens:     cached.CacheReadInputTokens,
+		CacheCreationInputTokens: cached.CacheCreationInputTokens,
+		IsStream:                 cached.Stream,
+		CacheHit:                 true,
+		Duration:                 duration,
+	}
+	logReq.SetRequestInfo(info)
+
+	_, err := NewLogService().CreateLog(logReq)
+	if err != nil {
+		log.Printf("保存缓存命中日志失败: %v", err)
+	}
+}
+
+// parseCacheableResponse 解析Claude格式的响应，只有正常结束的响应才可以缓存
+func parseCacheableResponse(body []byte) *CachedResponse {
+	trimmed := bytes.TrimSpace(body)
+	if len(trimmed) == 0 {
+		return nil
+	}
+
+	// 非流式响应
+	if trimmed[0] == '{' {
+		if !gjson.ValidBytes(trimmed) || gjson.GetBytes(trimmed, "type").String() != "message" ||
+			gjson.GetBytes(trimmed, "stop_reason").String() == "" {
+			return nil
+		}
+		cached := &CachedResponse{Body: string(trimmed)}
+		cached.applyUsage(gjson.GetBytes(trimmed, "model").String(), gjson.GetBytes(trimmed, "usage"))
+		return cached
+	}
+
+	// 流式响应按空行切分为事件
+	cached := &CachedResponse{Stream: true}
+	completed := false
+	normalized := strings.ReplaceAll(string(trimmed), "\r\n", "\n")
+	for _, event := range strings.Split(normalized, "\n\n") {
+		event = strings.Trim(event, "\n")
+		if event == "" {
+			continue
+		}
+		cached.Events = append(cached.Events, event)
+
+		for _, line := range strings.Split(event, "\n") {
+			data, ok := strings.CutPrefix(line, "data:")
+			if !ok {
+				continue
+			}
+			payload := gjson.Parse(strings.TrimSpace(data))
+			switch payload.Get("type").String() {
+			case "message_start":
+				cached.applyUsage(payload.Get("message.model").String(), payload.Get("message.usage"))
+			case "message_delta":
+				if outputTokens := payload.Get("usage.output_tokens"); outputTokens.Exists() {
+					cached.OutputTokens = int(outputTokens.Int())
+				}
+			case "message_stop":
+				completed = true
+			case "error":
+				return nil
+			}
+		}
+	}
+
+	if !completed {
+		return nil
+	}
+	return cached
+}
+
+func (r *CachedResponse) applyUsage(modelName string, usage gjson.Result) {
+	if modelName != "" {
+		r.Model = modelName
+	}
+	r.InputTokens = int(usage.Get("input_tokens").Int())
+	r.CacheReadInputTokens = int(usage.Get("cache_read_input_tokens").Int())
+	r.CacheCreationInputTokens = int(usage.Get("cache_creation_input_tokens").Int())
+	if outputTokens := usage.Get("output_tokens"); outputTokens.Exists() {
+		r.OutputTokens = int(outputTokens.Int())
+	}
+}
+
+// GetResponseCacheMaxEntrySize 从环境变量获取单条响应缓存的最大字节数
+func GetResponseCacheMaxEntrySize() int {
+	if sizeStr := os.Getenv("RESPONSE_CACHE_MAX_ENTRY_SIZE"); sizeStr != "" {
+		if size, err := strconv.Atoi(sizeStr); err == nil && size > 0 {
+			return size
+		}
+	}
+	return defaultResponseCacheMaxEntrySize
+}
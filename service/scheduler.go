@@ -0,0 +1,82 @@
+package service
+
+import (
+	"claude-code-relay/model"
+	"math/rand"
+	"sort"
+)
+
+// 账号未配置权重时使用的默认权重
+const defaultAccountWeight = 100
+
+// AccountScheduler 账号调度器：按优先级分层，层内按权重随机
+type AccountScheduler struct{}
+
+func NewAccountScheduler() *AccountScheduler {
+	return &AccountScheduler{}
+}
+
+// OrderAccounts 返回调度后的账号顺序
+// 优先级高的层排在前面；同一层内按权重做不放回的加权随机排列，
+// 因此第一个账号即为本次选中的账号，后续账号可作为备选
+func (s *AccountScheduler) OrderAccounts(accounts []model.Account) []model.Account {
+	if len(accounts) == 0 {
+		return nil
+	}
+
+	// 按优先级分组
+	tiers := make(map[int][]model.Account)
+	var priorities []int
+	for _, account := range accounts {
+		if _, exists := tiers[account.Priority]; !exists {
+			priorities = append(priorities, account.Priority)
+		}
+		tiers[account.Priority] = append(tiers[account.Priority], account)
+	}
+	sort.Ints(priorities)
+
+	result := make([]model.Account, 0, len(accounts))
+	for _, priority := range priorities {
+		result = append(result, weightedShuffle(tiers[priority])...)
+	}
+
+	return result
+}
+
+// weightedShuffle 按权重进行不放回的加权随机排列
+func weightedShuffle(accounts []model.Account) []model.Account {
+	remaining := make([]model.Account, len(accounts))
+	copy(remaining, accounts)
+
+	result := make([]model.Account, 0, len(accounts))
+	for len(remaining) > 0 {
+		totalWeight := 0
+		for _, account := range remaining {
+			totalWeight += accountWeight(account)
+		}
+
+		// 在[0, totalWeight)中取随机数，落在哪个账号的权重区间就选中哪个账号
+		target := rand.Intn(totalWeight)
+		selected := 0
+		for i, account := range remaining {
+			target -= accountWeight(account)
+			if target < 0 {
+				selected = i
+				break
+			}
+		}
+
+		result = append(result, remaining[selected])
+		remaining = append(remaining[:selected], remaining[selected+1:]...)
+	}
+
+	return result
+}
+
+// accountWeight 获取账号的有效权重
+func accountWeight(account model.Account) int {
+	if account.Weight <= 0 {
+		return defaultAccountWeight
+	}
+	return account.Weight
+}
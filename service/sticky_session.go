@@ -0,0 +1,133 @@
+package service
+
+import (
+	"claude-code-relay/common"
+	"claude-code-relay/model"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+// 默认会话粘性有效期
+const defaultStickySessionTTL = time.Hour
+
+// StickySessionService 会话粘性服务
+// 将同一会话固定到同一账号，保证Prompt Cache命中
+type StickySessionService struct{}
+
+func NewStickySessionService() *StickySessionService {
+	return &StickySessionService{}
+}
+
+// ExtractSessionKey 从请求体中提取会话标识
+// 优先使用metadata.user_id中的session段，否则使用system和首条消息的哈希
+func ExtractSessionKey(body []byte) string {
+	userID := gjson.GetBytes(body, "metadata.user_id").String()
+	if idx := strings.LastIndex(userID, "session_"); idx >= 0 {
+		if sessionID := userID[idx+len("session_"):]; sessionID != "" {
+			return "session:" + sessionID
+		}
+	}
+
+	system := gjson.GetBytes(body, "system").Raw
+	firstMessage := gjson.GetBytes(body, "messages.0").Raw
+	if system == "" && firstMessage == "" {
+		return ""
+	}
+
+	hash := sha256.Sum256([]byte(system + "\n" + firstMessage))
+	return "hash:" + hex.EncodeToString(hash[:16])
+}
+
+// ApplyAffinity 将会话已绑定的账号移动到候选列表首位
+// 如果绑定的账号已不可用（限流、禁用、超出限额等不在候选列表中），则解除绑定并保持原有调度顺序
+func (s *StickySessionService) ApplyAffinity(accounts []model.Account, groupID int, sessionKey string) []model.Account {
+	if sessionKey == "" || len(accounts) == 0 {
+		return accounts
+	}
+
+	accountID := s.GetBoundAccountID(groupID, sessionKey)
+	if accountID == 0 {
+		return accounts
+	}
+
+	for i, account := range accounts {
+		if account.ID != accountID {
+			continue
+		}
+		if i == 0 {
+			return accounts
+		}
+
+		result := make([]model.Account, 0, len(accounts))
+		result = append(result, account)
+		result = append(result, accounts[:i]...)
+		result = append(result, accounts[i+1:]...)
+		return result
+	}
+
+	log.Printf("会话绑定的账号 %d 当前不可用，解除绑定", accountID)
+	s.Unbind(groupID, sessionKey)
+	return accounts
+}
+
+// GetBoundAccountID 获取会话绑定的账号ID，未绑定返回0
+func (s *StickySessionService) GetBoundAccountID(groupID int, sessionKey string) uint {
+	if common.RDB == nil || sessionKey == "" {
+		return 0
+	}
+
+	value, err := common.RDB.Get(context.Background(), stickySessionCacheKey(groupID, sessionKey)).Result()
+	if err != nil {
+		return 0
+	}
+
+	accountID, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return 0
+	}
+	return uint(accountID)
+}
+
+// Bind 绑定会话到账号（重复绑定会刷新有效期）
+func (s *StickySessionService) Bind(groupID int, sessionKey string, accountID uint) {
+	if common.RDB == nil || sessionKey == "" || accountID == 0 {
+		return
+	}
+
+	err := common.RDB.Set(context.Background(), stickySessionCacheKey(groupID, sessionKey), strconv.FormatUint(uint64(accountID), 10), getStickySessionTTL()).Err()
+	if err != nil {
+		log.Printf("保存会话绑定失败: %v", err)
+	}
+}
+
+// Unbind 解除会话绑定
+func (s *StickySessionService) Unbind(groupID int, sessionKey string) {
+	if common.RDB == nil || sessionKey == "" {
+		return
+	}
+	common.RDB.Del(context.Background(), stickySessionCacheKey(groupID, sessionKey))
+}
+
+// stickySessionCacheKey 会话绑定缓存键
+func stickySessionCacheKey(groupID int, sessionKey string) string {
+	return fmt.Sprintf("sticky_session:%d:%s", groupID, sessionKey)
+}
+
+// getStickySessionTTL 从环境变量获取会话粘性有效期（秒）
+func getStickySessionTTL() time.Duration {
+	if ttlStr := os.Getenv("STICKY_SESSION_TTL"); ttlStr != "" {
+		if ttl, err := strconv.Atoi(ttlStr); err == nil && ttl > 0 {
+			return time.Duration(ttl) * time.Second
+		}
+	}
+	return defaultStickySessionTTL
+}
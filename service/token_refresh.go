@@ -0,0 +1,112 @@
+package service
+
+import (
+	"claude-code-relay/common"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	// TokenRefreshRequestTimeout 调用OAuth刷新接口的超时时间
+	TokenRefreshRequestTimeout = 30 * time.Second
+	// 刷新锁的持有时长，到期自动释放，防止实例崩溃后账号无法再刷新
+	// 需明显长于刷新接口超时，避免慢刷新尚未结束锁就过期，其他实例用同一个refresh token重复刷新
+	tokenRefreshLockTTL = 2*TokenRefreshRequestTimeout + 15*time.Second
+	// 等待其他实例完成刷新的最长时间，超时后调用方继续使用当前token，避免长时间阻塞转发请求
+	tokenRefreshWaitTimeout = 10 * time.Second
+	// 等待其他实例完成刷新时的轮询间隔
+	tokenRefreshWaitInterval = 200 * time.Millisecond
+)
+
+var ErrTokenRefreshTimeout = errors.New("等待其他实例刷新token超时")
+
+// releaseTokenRefreshLockScript 只释放自己持有的刷新锁
+var releaseTokenRefreshLockScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+// TokenRefreshService OAuth token刷新协调服务
+// 同一实例内对同一账号的并发刷新只执行一次，多实例之间通过Redis锁保证同一时间只有一个实例刷新，
+// 避免多个实例各自用同一个refresh token刷新，导致先保存的token被后刷新的实例作废
+type TokenRefreshService struct {
+	mu    sync.Mutex
+	calls map[uint]*tokenRefreshCall
+}
+
+type tokenRefreshCall struct {
+	done chan struct{}
+	err  error
+}
+
+var tokenRefreshService = &TokenRefreshService{calls: make(map[uint]*tokenRefreshCall)}
+
+func NewTokenRefreshService() *TokenRefreshService {
+	return tokenRefreshService
+}
+
+// Refresh 执行账号token刷新
+// refresh需要先从数据库读取最新token，已被其他请求或实例刷新时直接返回，调用方在Refresh返回后从数据库同步最新token
+func (s *TokenRefreshService) Refresh(accountID uint, refresh func() error) error {
+	s.mu.Lock()
+	if call, ok := s.calls[accountID]; ok {
+		s.mu.Unlock()
+		<-call.done
+		return call.err
+	}
+	call := &tokenRefreshCall{done: make(chan struct{})}
+	s.calls[accountID] = call
+	s.mu.Unlock()
+
+	call.err = s.refreshWithLock(accountID, refresh)
+
+	s.mu.Lock()
+	delete(s.calls, accountID)
+	s.mu.Unlock()
+	close(call.done)
+
+	return call.err
+}
+
+// refreshWithLock 获取Redis刷新锁后执行刷新，锁被其他实例持有时等待其释放
+func (s *TokenRefreshService) refreshWithLock(accountID uint, refresh func() error) error {
+	if common.RDB == nil {
+		return refresh()
+	}
+
+	ctx := context.Background()
+	key := tokenRefreshLockKey(accountID)
+	lockID := common.GenerateUUID()
+	deadline := time.Now().Add(tokenRefreshWaitTimeout)
+
+	for {
+		acquired, err := common.RDB.SetNX(ctx, key, lockID, tokenRefreshLockTTL).Result()
+		if err != nil {
+			// Redis异常时退化为仅实例内去重
+			log.Printf("获取账号 %d token刷新锁失败: %v", accountID, err)
+			return refresh()
+		}
+		if acquired {
+			break
+		}
+		if time.Now().After(deadline) {
+			return ErrTokenRefreshTimeout
+		}
+		time.Sleep(tokenRefreshWaitInterval)
+	}
+	defer releaseTokenRefreshLockScript.Run(ctx, common.RDB, []string{key}, lockID)
+
+	return refresh()
+}
+
+func tokenRefreshLockKey(accountID uint) string {
+	return fmt.Sprintf("token_refresh_lock:%d", accountID)
+}